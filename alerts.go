@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ALERT_OVERTEMP     = "overtemp"
+	ALERT_FAILSAFE     = "failsafe"
+	ALERT_CONTROL_LOST = "control_lost"
+	ALERT_RAPID_RISE   = "rapid_rise"
+	// Events below are informational, which are delivered only to hooks
+	ALERT_CURVE_CHANGED = "curve_changed"
+	ALERT_SHUTDOWN      = "shutdown"
+
+	// Overtemp alert is sent again only after temperature drops this number of Celsius below alert temperature
+	ALERT_HYSTERESIS = 3
+	// Number of alerts waiting for delivery, further alerts are dropped when notifiers are too slow
+	ALERT_QUEUE_SIZE = 32
+)
+
+// alertEvent describes a cooling problem or a change of control of a GPU, which is delivered to notifiers
+type alertEvent struct {
+	Event       string    `json:"event"`
+	Time        time.Time `json:"time"`
+	Host        string    `json:"host"`
+	GPUIndex    int       `json:"gpu_index"`
+	GPUUUID     string    `json:"gpu_uuid"`
+	GPUName     string    `json:"gpu_name"`
+	Temperature uint32    `json:"temperature,omitempty"`
+	Message     string    `json:"message"`
+}
+
+// critical reports whether the event is a cooling problem, which is delivered to all notifiers rather than only hooks
+func (e alertEvent) critical() bool {
+	return e.Event != ALERT_CURVE_CHANGED && e.Event != ALERT_SHUTDOWN
+}
+
+// summary returns one line description of the alert, which is used as email subject and chat message title
+func (e alertEvent) summary() string {
+	return fmt.Sprintf("[nvml-fan] %s on %s GPU %d (%s)", e.Event, e.Host, e.GPUIndex, e.GPUName)
+}
+
+// alertNotifier delivers alerts to a destination e.g. webhook
+type alertNotifier interface {
+	name() string
+	notify(event alertEvent) error
+}
+
+// alertDispatcher delivers alerts to notifiers in background, so that slow destinations never delay the control loop
+type alertDispatcher struct {
+	notifiers []alertNotifier
+	// Hooks receive informational events in addition to critical ones
+	hooks []alertNotifier
+	host  string
+	queue chan alertEvent
+	done  chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newAlertDispatcher(notifiers, hooks []alertNotifier) *alertDispatcher {
+	host, err := os.Hostname()
+	if err != nil {
+		slog.Warn("Unable to get hostname for alerts", "err", err)
+	}
+	d := &alertDispatcher{
+		notifiers: notifiers,
+		hooks:     hooks,
+		host:      host,
+		queue:     make(chan alertEvent, ALERT_QUEUE_SIZE),
+		done:      make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+func (d *alertDispatcher) run() {
+	defer close(d.done)
+	for event := range d.queue {
+		for _, notifier := range d.notifiers {
+			if !event.critical() {
+				break
+			}
+			if err := notifier.notify(event); err != nil {
+				slog.Error("Unable to send alert", "notifier", notifier.name(), "event", event.Event, "err", err)
+			}
+		}
+		for _, hook := range d.hooks {
+			if err := hook.notify(event); err != nil {
+				slog.Error("Unable to run event hook", "hook", hook.name(), "event", event.Event, "err", err)
+			}
+		}
+	}
+}
+
+// send queues alert of the device for delivery
+func (d *alertDispatcher) send(event string, labels deviceLabels, temperature uint32, message string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	select {
+	case d.queue <- alertEvent{
+		Event:       event,
+		Time:        time.Now(),
+		Host:        d.host,
+		GPUIndex:    labels.index,
+		GPUUUID:     labels.uuid,
+		GPUName:     labels.name,
+		Temperature: temperature,
+		Message:     message,
+	}:
+	default:
+		slog.Warn("Alert queue is full, drop alert", "event", event, LABEL_GPU_INDEX, labels.index)
+	}
+}
+
+// close stops accepting alerts, and waits until queued alerts are delivered
+func (d *alertDispatcher) close() {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+	}
+	d.mu.Unlock()
+	<-d.done
+}
+
+// webhookNotifier posts alert as JSON to a URL
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookNotifier(url string) *webhookNotifier {
+	return &webhookNotifier{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (n *webhookNotifier) name() string {
+	return "webhook"
+}
+
+func (n *webhookNotifier) notify(event alertEvent) error {
+	return postAlertJSON(n.client, n.url, event)
+}
+
+// postAlertJSON posts payload as JSON, and treats error status as failure
+func postAlertJSON(client *http.Client, endpoint string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("unable to encode alert: %w", err)
+	}
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to send alert: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("alert destination responded with status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// smtpNotifier sends alert by email, through SMTP server which supports STARTTLS when credentials are given
+type smtpNotifier struct {
+	addr string
+	auth smtp.Auth
+	from string
+	to   []string
+}
+
+func newSMTPNotifier(addr, username, password, from string, to []string) (*smtpNotifier, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("SMTP address must be host:port, e.g. smtp.example.com:587: %w", err)
+	}
+	if from == "" || len(to) == 0 {
+		return nil, fmt.Errorf("SMTP sender and recipients must not be empty")
+	}
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &smtpNotifier{addr: addr, auth: auth, from: from, to: to}, nil
+}
+
+func (n *smtpNotifier) name() string {
+	return "smtp"
+}
+
+func (n *smtpNotifier) notify(event alertEvent) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", event.summary())
+	fmt.Fprintf(&msg, "Date: %s\r\n", event.Time.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\n", event.Message)
+	fmt.Fprintf(&msg, "Event: %s\r\nTime: %s\r\nHost: %s\r\nGPU: %d %s (%s)\r\n", event.Event, event.Time.Format(time.RFC3339), event.Host, event.GPUIndex, event.GPUName, event.GPUUUID)
+	if event.Temperature > 0 {
+		fmt.Fprintf(&msg, "Temperature: %d°C\r\n", event.Temperature)
+	}
+	if err := smtp.SendMail(n.addr, n.auth, n.from, n.to, msg.Bytes()); err != nil {
+		return fmt.Errorf("unable to send alert email: %w", err)
+	}
+	return nil
+}
+
+// discordNotifier posts alert as a message to Discord webhook
+type discordNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func newDiscordNotifier(url string) *discordNotifier {
+	return &discordNotifier{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (n *discordNotifier) name() string {
+	return "discord"
+}
+
+func (n *discordNotifier) notify(event alertEvent) error {
+	return postAlertJSON(n.client, n.url, map[string]string{
+		"content": fmt.Sprintf("**%s**\n%s", event.summary(), event.Message),
+	})
+}
+
+// telegramNotifier sends alert as a message to a chat by Telegram bot
+type telegramNotifier struct {
+	url    string
+	chatID string
+	client *http.Client
+}
+
+func newTelegramNotifier(token, chatID string) (*telegramNotifier, error) {
+	if chatID == "" {
+		return nil, fmt.Errorf("Telegram chat ID must not be empty")
+	}
+	return &telegramNotifier{
+		url:    fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", token),
+		chatID: chatID,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (n *telegramNotifier) name() string {
+	return "telegram"
+}
+
+func (n *telegramNotifier) notify(event alertEvent) error {
+	err := postAlertJSON(n.client, n.url, map[string]string{
+		"chat_id": n.chatID,
+		"text":    fmt.Sprintf("%s\n%s", event.summary(), event.Message),
+	})
+	if err != nil {
+		// URL contains bot token, which must not be logged
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return fmt.Errorf("unable to send alert to Telegram: %w", urlErr.Err)
+		}
+	}
+	return err
+}
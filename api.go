@@ -0,0 +1,585 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"time"
+)
+
+const (
+	MAX_OVERRIDE_DURATION = 24 * time.Hour
+	// Fans run at full speed for this duration by boost, unless requested otherwise
+	DEFAULT_BOOST_DURATION = 60 * time.Second
+	// Polling interval set at runtime must not be shorter than this, so that control loop never spins on NVML
+	MIN_POLLING_DURATION = 100 * time.Millisecond
+
+	// Health check fails if fan speed has not been applied within this number of polling intervals
+	HEALTH_MAX_MISSED_POLLS = 3
+)
+
+type overrideRequest struct {
+	Speed    uint8  `json:"speed"`
+	Duration string `json:"duration"`
+	// Fans are indices of fans to be forced, empty means all controlled fans
+	Fans []int `json:"fans,omitempty"`
+}
+
+type boostRequest struct {
+	// Duration is DEFAULT_BOOST_DURATION if empty
+	Duration string `json:"duration,omitempty"`
+}
+
+type overrideResponse struct {
+	Speed uint8     `json:"speed"`
+	Until time.Time `json:"until"`
+	Fans  []int     `json:"fans,omitempty"`
+}
+
+type curveRequest struct {
+	Curve string `json:"curve"`
+	// Persist writes the curve to config file, so that it is kept after restart
+	Persist bool `json:"persist"`
+}
+
+type curveResponse struct {
+	Curve     string `json:"curve"`
+	Persisted bool   `json:"persisted,omitempty"`
+}
+
+type pollingRequest struct {
+	Interval string `json:"interval"`
+	// Persist writes the interval to config file, so that it is kept after restart
+	Persist bool `json:"persist"`
+}
+
+type pollingResponse struct {
+	// Interval is empty if each device uses its configured interval
+	Interval  string `json:"interval,omitempty"`
+	Persisted bool   `json:"persisted,omitempty"`
+}
+
+type healthResponse struct {
+	Healthy       bool      `json:"healthy"`
+	LastPolledAt  time.Time `json:"lastPolledAt"`
+	LastAppliedAt time.Time `json:"lastAppliedAt"`
+	Paused        bool      `json:"paused"`
+}
+
+type fanStatusResponse struct {
+	Index int `json:"index"`
+	// Target is fan speed in percent last applied by the daemon
+	Target uint8 `json:"target"`
+	// Actual is fan speed in percent reported by the device, nil if it cannot be read
+	Actual *uint32 `json:"actual,omitempty"`
+	// Wear is cumulative usage of the fan, nil if wear is not tracked
+	Wear *fanWear `json:"wear,omitempty"`
+}
+
+type deviceStatusResponse struct {
+	GPUIndex          int        `json:"gpu_index"`
+	GPUUUID           string     `json:"gpu_uuid"`
+	GPUName           string     `json:"gpu_name"`
+	StartedAt         time.Time  `json:"startedAt"`
+	LastPolledAt      time.Time  `json:"lastPolledAt"`
+	Temperature       uint32     `json:"temperature"`
+	MemoryTemperature uint32     `json:"memoryTemperature,omitempty"`
+	Mode              string     `json:"mode"`
+	Curve             string     `json:"curve"`
+	OverrideUntil     *time.Time `json:"overrideUntil,omitempty"`
+	// OverrideFans are fans forced by override, empty means all controlled fans
+	OverrideFans []int               `json:"overrideFans,omitempty"`
+	Fans         []fanStatusResponse `json:"fans"`
+}
+
+type statusResponse struct {
+	Devices []deviceStatusResponse `json:"devices"`
+}
+
+type deviceHistoryResponse struct {
+	GPUIndex int             `json:"gpu_index"`
+	GPUUUID  string          `json:"gpu_uuid"`
+	GPUName  string          `json:"gpu_name"`
+	Samples  []historySample `json:"samples"`
+}
+
+type historyResponse struct {
+	Devices []deviceHistoryResponse `json:"devices"`
+}
+
+// controlServer serves control API, which is used to change behavior of running control loops of all controlled devices
+type controlServer struct {
+	devices         []*controlledDevice
+	pollingDuration time.Duration
+	// Path to config file, where curve changed by curve editor is persisted
+	configFile string
+	// Curve changes are sent to event hooks by this dispatcher, nil means disabled
+	alerts *alertDispatcher
+	// Wear of fans reported by status, nil means disabled
+	wear *wearTracker
+}
+
+func newControlServer(devices []*controlledDevice, pollingDuration time.Duration, configFile string) *controlServer {
+	return &controlServer{
+		devices:         devices,
+		pollingDuration: pollingDuration,
+		configFile:      configFile,
+	}
+}
+
+func (c *controlServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", c.handleHealth)
+	mux.HandleFunc("GET /status", c.handleStatus)
+	mux.HandleFunc("POST /override", c.handleSetOverride)
+	mux.HandleFunc("DELETE /override", c.handleDeleteOverride)
+	mux.HandleFunc("POST /boost", c.handleBoost)
+	mux.HandleFunc("GET /curve", c.handleGetCurve)
+	mux.HandleFunc("PUT /curve", c.handleSetCurve)
+	mux.HandleFunc("GET /polling", c.handleGetPolling)
+	mux.HandleFunc("PUT /polling", c.handleSetPolling)
+	mux.HandleFunc("GET /history", c.handleHistory)
+	mux.HandleFunc("GET /events", c.handleEvents)
+	mux.HandleFunc("GET /ws", c.handleWebSocket)
+	mux.HandleFunc("GET /{$}", c.handleDashboard)
+	return mux
+}
+
+// remoteHandler serves control API protected by token. Dashboard page is served without token,
+// as it contains no data, and asks for the token to call the API.
+func (c *controlServer) remoteHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", c.handleDashboard)
+	mux.Handle("/", requireToken(token, c.handler()))
+	return mux
+}
+
+// publicHandler serves only read-only endpoints, which are safe to be exposed on TCP address
+func (c *controlServer) publicHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", c.handleHealth)
+	mux.HandleFunc("GET /status", c.handleStatus)
+	mux.HandleFunc("GET /history", c.handleHistory)
+	mux.HandleFunc("GET /events", c.handleEvents)
+	return mux
+}
+
+// handleHealth responds 200 only if control loops of all devices have applied fan speed recently.
+// While paused, fans are controlled by driver, so polling temperature recently is enough.
+// Timestamps in response are the oldest ones among devices.
+func (c *controlServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	var resp healthResponse
+	for i, d := range c.devices {
+		maxAge := max(c.pollingDuration, d.state.pollingDuration()) * HEALTH_MAX_MISSED_POLLS
+		deviceResp := d.state.health(now, maxAge)
+		if i == 0 {
+			resp = deviceResp
+			continue
+		}
+		resp.Healthy = resp.Healthy && deviceResp.Healthy
+		resp.Paused = resp.Paused || deviceResp.Paused
+		if deviceResp.LastPolledAt.Before(resp.LastPolledAt) {
+			resp.LastPolledAt = deviceResp.LastPolledAt
+		}
+		if deviceResp.LastAppliedAt.Before(resp.LastAppliedAt) {
+			resp.LastAppliedAt = deviceResp.LastAppliedAt
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !resp.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		moduleLogger(LOG_MODULE_API).Error("unable to write response", "err", err)
+	}
+}
+
+// handleStatus responds current temperature, mode and fan speeds of all devices. Actual fan speeds are read
+// from devices, so that a fan which does not follow the applied speed can be spotted.
+func (c *controlServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.status()); err != nil {
+		moduleLogger(LOG_MODULE_API).Error("unable to write response", "err", err)
+	}
+}
+
+func (c *controlServer) status() statusResponse {
+	now := time.Now()
+	var resp statusResponse
+	for _, d := range c.devices {
+		deviceResp := d.state.status(now)
+		deviceResp.GPUIndex = d.labels.index
+		deviceResp.GPUUUID = d.labels.uuid
+		deviceResp.GPUName = d.labels.name
+		device := d.handle.get()
+		for i, fan := range deviceResp.Fans {
+			if actual, err := device.FanSpeed(fan.Index); err == nil {
+				deviceResp.Fans[i].Actual = &actual
+			}
+			if c.wear != nil {
+				if wear, ok := c.wear.fan(d.labels.uuid, fan.Index); ok {
+					deviceResp.Fans[i].Wear = &wear
+				}
+			}
+		}
+		resp.Devices = append(resp.Devices, deviceResp)
+	}
+	return resp
+}
+
+// requestApply asks control loops to apply fan speed immediately instead of waiting for next polling tick
+func (c *controlServer) requestApply() {
+	for _, d := range c.devices {
+		select {
+		case d.applyNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (c *controlServer) handleSetOverride(w http.ResponseWriter, r *http.Request) {
+	var req overrideRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("unable to decode request body: %s", err), http.StatusBadRequest)
+		return
+	}
+	resp, err := c.setOverride(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		moduleLogger(LOG_MODULE_API).Error("unable to write response", "err", err)
+	}
+}
+
+// setOverride forces fan speed of all devices, or of the requested fans of all devices, until the requested duration elapses
+func (c *controlServer) setOverride(req overrideRequest) (overrideResponse, error) {
+	if req.Speed > MAX_FAN_SPEED_PERCENT {
+		return overrideResponse{}, fmt.Errorf("speed must not be greater than %d", MAX_FAN_SPEED_PERCENT)
+	}
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil {
+		return overrideResponse{}, fmt.Errorf("unable to parse duration: %w", err)
+	}
+	if duration <= 0 || duration > MAX_OVERRIDE_DURATION {
+		return overrideResponse{}, fmt.Errorf("duration must be greater than 0 and not greater than %s", MAX_OVERRIDE_DURATION)
+	}
+
+	var fans []int
+	if len(req.Fans) > 0 {
+		seen := make(map[int]bool, len(req.Fans))
+		for _, fanIdx := range req.Fans {
+			if fanIdx < 0 {
+				return overrideResponse{}, fmt.Errorf("fan index %d must not be negative", fanIdx)
+			}
+			if seen[fanIdx] {
+				return overrideResponse{}, fmt.Errorf("fan index %d is duplicated", fanIdx)
+			}
+			seen[fanIdx] = true
+			fans = append(fans, fanIdx)
+			for _, d := range c.devices {
+				if numFans, err := d.handle.get().NumFans(); err == nil && fanIdx >= numFans {
+					return overrideResponse{}, fmt.Errorf("fan index %d does not exist on GPU %d, which has %d fans", fanIdx, d.index, numFans)
+				}
+			}
+		}
+		sort.Ints(fans)
+	}
+
+	until := time.Now().Add(duration)
+	for _, d := range c.devices {
+		d.state.setOverride(req.Speed, until, fans)
+	}
+	moduleLogger(LOG_MODULE_API).Info("Fan speed override is set", "speed", req.Speed, "until", until, "fans", fans)
+	c.requestApply()
+	return overrideResponse{Speed: req.Speed, Until: until, Fans: fans}, nil
+}
+
+// handleBoost runs all controlled fans at full speed for a while, e.g. to cool the GPU quickly after a job finishes.
+// It is a shorthand of override at 100%, and is cancelled the same way.
+func (c *controlServer) handleBoost(w http.ResponseWriter, r *http.Request) {
+	var req boostRequest
+	// Body is optional
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, fmt.Sprintf("unable to decode request body: %s", err), http.StatusBadRequest)
+		return
+	}
+	resp, err := c.boost(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		moduleLogger(LOG_MODULE_API).Error("unable to write response", "err", err)
+	}
+}
+
+func (c *controlServer) boost(req boostRequest) (overrideResponse, error) {
+	if req.Duration == "" {
+		req.Duration = DEFAULT_BOOST_DURATION.String()
+	}
+	return c.setOverride(overrideRequest{Speed: MAX_FAN_SPEED_PERCENT, Duration: req.Duration})
+}
+
+func (c *controlServer) handleDeleteOverride(w http.ResponseWriter, r *http.Request) {
+	c.clearOverride()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *controlServer) clearOverride() {
+	for _, d := range c.devices {
+		d.state.clearOverride()
+	}
+	moduleLogger(LOG_MODULE_API).Info("Fan speed override is cancelled")
+	c.requestApply()
+}
+
+// requireToken rejects requests without the bearer token, which protects control API listening on TCP address.
+// WebSocket handshake may carry the token by access_token parameter instead, as browsers cannot set its headers.
+func requireToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		if queryToken := r.URL.Query().Get("access_token"); authorization == "" && queryToken != "" && headerContainsToken(r.Header, "Upgrade", "websocket") {
+			authorization = "Bearer " + queryToken
+		}
+		if subtle.ConstantTimeCompare([]byte(authorization), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *controlServer) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
+
+func (c *controlServer) handleGetCurve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(curveResponse{Curve: formatSpeedConfig(c.devices[0].state.curveConfig())}); err != nil {
+		moduleLogger(LOG_MODULE_API).Error("unable to write response", "err", err)
+	}
+}
+
+// handleSetCurve replaces the curve of all devices at runtime, and optionally persists it to config file
+func (c *controlServer) handleSetCurve(w http.ResponseWriter, r *http.Request) {
+	var req curveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("unable to decode request body: %s", err), http.StatusBadRequest)
+		return
+	}
+	resp, status, err := c.setCurve(req)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		moduleLogger(LOG_MODULE_API).Error("unable to write response", "err", err)
+	}
+}
+
+// setCurve replaces the curve of all devices, and returns HTTP status code describing the error if it fails
+func (c *controlServer) setCurve(req curveRequest) (curveResponse, int, error) {
+	curve, err := parseSpeedConfigFlag(req.Curve)
+	if err != nil {
+		return curveResponse{}, http.StatusBadRequest, fmt.Errorf("invalid curve: %w", err)
+	}
+
+	if req.Persist {
+		if c.configFile == "" {
+			return curveResponse{}, http.StatusBadRequest, fmt.Errorf("config file is not set")
+		}
+		if err := updateConfigFile(c.configFile, "speeds", formatSpeedConfig(curve)); err != nil {
+			moduleLogger(LOG_MODULE_API).Error("Unable to persist fan curve to config file", "path", c.configFile, "err", err)
+			return curveResponse{}, http.StatusInternalServerError, fmt.Errorf("unable to persist curve: %w", err)
+		}
+	}
+	speedMap := generateTempNFanSpeedMap(curve)
+	for _, d := range c.devices {
+		d.state.setCurve(curve, speedMap)
+		if c.alerts != nil {
+			c.alerts.send(ALERT_CURVE_CHANGED, d.labels, 0, fmt.Sprintf("Fan curve is changed to %s", formatSpeedConfig(curve)))
+		}
+	}
+	moduleLogger(LOG_MODULE_API).Info("Fan curve is changed", "curve", formatSpeedConfig(curve), "persisted", req.Persist)
+	c.requestApply()
+	return curveResponse{Curve: formatSpeedConfig(curve), Persisted: req.Persist}, http.StatusOK, nil
+}
+
+func (c *controlServer) handleGetPolling(w http.ResponseWriter, r *http.Request) {
+	var resp pollingResponse
+	if interval := c.devices[0].state.pollingDuration(); interval > 0 {
+		resp.Interval = interval.String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		moduleLogger(LOG_MODULE_API).Error("unable to write response", "err", err)
+	}
+}
+
+// handleSetPolling replaces the polling interval of all devices at runtime, and optionally persists it to config file
+func (c *controlServer) handleSetPolling(w http.ResponseWriter, r *http.Request) {
+	var req pollingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("unable to decode request body: %s", err), http.StatusBadRequest)
+		return
+	}
+	resp, status, err := c.setPolling(req)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		moduleLogger(LOG_MODULE_API).Error("unable to write response", "err", err)
+	}
+}
+
+// setPolling replaces the polling interval of all devices, and returns HTTP status code describing the error if it fails
+func (c *controlServer) setPolling(req pollingRequest) (pollingResponse, int, error) {
+	interval, err := time.ParseDuration(req.Interval)
+	if err != nil {
+		return pollingResponse{}, http.StatusBadRequest, fmt.Errorf("invalid interval: %w", err)
+	}
+	if interval < MIN_POLLING_DURATION {
+		return pollingResponse{}, http.StatusBadRequest, fmt.Errorf("interval must not be shorter than %s", MIN_POLLING_DURATION)
+	}
+
+	if req.Persist {
+		if c.configFile == "" {
+			return pollingResponse{}, http.StatusBadRequest, fmt.Errorf("config file is not set")
+		}
+		if err := updateConfigFile(c.configFile, "polling-duration", interval.String()); err != nil {
+			moduleLogger(LOG_MODULE_API).Error("Unable to persist polling interval to config file", "path", c.configFile, "err", err)
+			return pollingResponse{}, http.StatusInternalServerError, fmt.Errorf("unable to persist polling interval: %w", err)
+		}
+	}
+	for _, d := range c.devices {
+		d.state.setPollingDuration(interval)
+	}
+	moduleLogger(LOG_MODULE_API).Info("Polling interval is changed", "interval", interval, "persisted", req.Persist)
+	c.requestApply()
+	return pollingResponse{Interval: interval.String(), Persisted: req.Persist}, http.StatusOK, nil
+}
+
+// parseHistorySince parses since parameter of history request, which is either RFC 3339 timestamp,
+// or duration before now e.g. 15m. Empty string means all samples.
+func parseHistorySince(sinceStr string, now time.Time) (time.Time, error) {
+	if sinceStr == "" {
+		return time.Time{}, nil
+	}
+	if since, err := time.Parse(time.RFC3339, sinceStr); err == nil {
+		return since, nil
+	}
+	duration, err := time.ParseDuration(sinceStr)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("since must be RFC 3339 timestamp or duration: %s", sinceStr)
+	}
+	return now.Add(-duration), nil
+}
+
+// handleHistory responds samples of all devices recorded after since parameter
+func (c *controlServer) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if c.devices[0].history == nil {
+		http.Error(w, "history is disabled", http.StatusNotFound)
+		return
+	}
+	since, err := parseHistorySince(r.URL.Query().Get("since"), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var resp historyResponse
+	for _, d := range c.devices {
+		resp.Devices = append(resp.Devices, deviceHistoryResponse{
+			GPUIndex: d.labels.index,
+			GPUUUID:  d.labels.uuid,
+			GPUName:  d.labels.name,
+			Samples:  d.history.since(since),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		moduleLogger(LOG_MODULE_API).Error("unable to write response", "err", err)
+	}
+}
+
+// serveHTTP starts HTTP server on a TCP address, which serves HTTPS if tlsConfig is not nil
+func serveHTTP(addr string, handler http.Handler, tlsConfig *tls.Config) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on HTTP address: %w", err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			moduleLogger(LOG_MODULE_API).Error("HTTP server stopped unexpectedly", "err", err)
+		}
+	}()
+
+	return server, nil
+}
+
+// listenControlSocket creates a unix socket, which is only accessible by root. It is created before privilege is
+// dropped by -privsep-user, as its directory e.g. /run may not be writable by the user.
+func listenControlSocket(socketPath string) (net.Listener, error) {
+	// Socket of a running instance is kept, so that a second instance failing to start does not take it away
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("control socket is in use by another process")
+	}
+	// Remove stale socket left by previous process
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("unable to remove existing control socket: %w", err)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on control socket: %w", err)
+	}
+	// Windows has no file mode, socket access is controlled by directory ACL instead
+	if runtime.GOOS != "windows" {
+		if err := os.Chmod(socketPath, 0600); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("unable to set permission of control socket: %w", err)
+		}
+	}
+	return listener, nil
+}
+
+// serveControlSocket starts HTTP server on the listener of control socket
+func serveControlSocket(listener net.Listener, handler http.Handler) *http.Server {
+	server := &http.Server{Handler: handler}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			moduleLogger(LOG_MODULE_API).Error("control server stopped unexpectedly", "err", err)
+		}
+	}()
+	return server
+}
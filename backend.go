@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Failure modes matched by backend errors with errors.Is, so that callers can branch on them regardless of backend.
+// NVML return code wrapped by the error is available by nvmlReturnCode.
+var (
+	// ErrUnsupportedDevice means the device or driver does not support the operation
+	ErrUnsupportedDevice = errors.New("operation is not supported by the device")
+	// ErrPolicyRejected means the device refused to set fan speed or fan control policy, e.g. without root privilege
+	ErrPolicyRejected = errors.New("fan control is rejected by the device")
+	// ErrDeviceLost means the device has fallen off the bus or requires reset, so that its handle is no longer usable
+	ErrDeviceLost = errors.New("device is lost")
+	// ErrLibraryNotFound means NVML library cannot be loaded, e.g. when it is not mounted into a container
+	ErrLibraryNotFound = errors.New("NVML library is not found")
+	// ErrMissingPrivilege means the process lacks privilege to set fan speed, which NVML also reports when it is set
+	ErrMissingPrivilege = errors.New("missing privilege to set fan speed")
+)
+
+// failureMode returns short name of failure mode of backend error for logs, or empty string if it is not known
+func failureMode(err error) string {
+	switch {
+	case errors.Is(err, ErrDeviceLost):
+		return "device_lost"
+	case errors.Is(err, ErrPolicyRejected):
+		return "policy_rejected"
+	case errors.Is(err, ErrUnsupportedDevice):
+		return "unsupported_device"
+	case errors.Is(err, ErrLibraryNotFound):
+		return "library_not_found"
+	}
+	return ""
+}
+
+// nvmlReturnCoder is implemented by backend errors, which wrap NVML return code
+type nvmlReturnCoder interface {
+	returnCode() int
+}
+
+// nvmlReturnCode returns NVML return code wrapped by the error, if any
+func nvmlReturnCode(err error) (int, bool) {
+	var coder nvmlReturnCoder
+	if errors.As(err, &coder) {
+		return coder.returnCode(), true
+	}
+	return 0, false
+}
+
+// fanControlPolicy is fan control policy of a fan, as defined by NVML
+type fanControlPolicy uint32
+
+const (
+	FAN_POLICY_TEMPERATURE_CONTINOUS_SW = fanControlPolicy(0)
+	FAN_POLICY_MANUAL                   = fanControlPolicy(1)
+)
+
+func (p fanControlPolicy) String() string {
+	switch p {
+	case FAN_POLICY_MANUAL:
+		return "MANUAL"
+	case FAN_POLICY_TEMPERATURE_CONTINOUS_SW:
+		return "TEMPERATURE-BASED automatic"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// thermalTarget is the part of the board, whose temperature is measured by a thermal sensor, as defined by NVML
+type thermalTarget int32
+
+const (
+	THERMAL_TARGET_GPU          = thermalTarget(1)
+	THERMAL_TARGET_MEMORY       = thermalTarget(2)
+	THERMAL_TARGET_POWER_SUPPLY = thermalTarget(4)
+	THERMAL_TARGET_BOARD        = thermalTarget(8)
+	THERMAL_TARGET_VCD_BOARD    = thermalTarget(9)
+	THERMAL_TARGET_VCD_INLET    = thermalTarget(10)
+	THERMAL_TARGET_VCD_OUTLET   = thermalTarget(11)
+	// Sensor index which queries sensors of all targets at once
+	THERMAL_TARGET_ALL = thermalTarget(15)
+)
+
+func (t thermalTarget) String() string {
+	switch t {
+	case THERMAL_TARGET_GPU:
+		return "gpu"
+	case THERMAL_TARGET_MEMORY:
+		return "memory"
+	case THERMAL_TARGET_POWER_SUPPLY:
+		return "power_supply"
+	case THERMAL_TARGET_BOARD:
+		return "board"
+	case THERMAL_TARGET_VCD_BOARD:
+		return "vcd_board"
+	case THERMAL_TARGET_VCD_INLET:
+		return "vcd_inlet"
+	case THERMAL_TARGET_VCD_OUTLET:
+		return "vcd_outlet"
+	default:
+		return "unknown"
+	}
+}
+
+// Names of backends selected by -backend
+const (
+	GPU_BACKEND_AUTO       = "auto"
+	GPU_BACKEND_NVML       = "nvml"
+	GPU_BACKEND_JETSON     = "jetson"
+	GPU_BACKEND_NVIDIA_SMI = "nvidia-smi"
+)
+
+var GPU_BACKENDS = []string{GPU_BACKEND_AUTO, GPU_BACKEND_NVML, GPU_BACKEND_JETSON, GPU_BACKEND_NVIDIA_SMI}
+
+// gpuBackend is the driver API used to access GPU devices, which differs between platforms.
+// newGPUBackend returns the implementation for current platform.
+type gpuBackend interface {
+	Init() error
+	Shutdown() error
+	DeviceCount() (int, error)
+	Device(index int) (gpuDevice, error)
+	// DriverVersion returns version of NVIDIA driver e.g. 555.58.02
+	DriverVersion() (string, error)
+	// NVMLVersion returns version of NVML library e.g. 12.555.58.02
+	NVMLVersion() (string, error)
+}
+
+// gpuDevice reads sensors and sets fan speed of a GPU device
+type gpuDevice interface {
+	Name() (string, error)
+	UUID() (string, error)
+	NumFans() (int, error)
+	// Temperature returns GPU core temperature in Celsius
+	Temperature() (uint32, error)
+	// MemoryTemperature returns memory temperature in Celsius, which is not supported by all GPUs
+	MemoryTemperature() (uint32, error)
+	// ThermalSensors returns temperature in Celsius of each thermal sensor of the board by its target,
+	// e.g. power supply, which are only exposed by some GPUs
+	ThermalSensors() (map[thermalTarget]uint32, error)
+	// PowerUsage returns power draw of the device in milliwatts
+	PowerUsage() (uint32, error)
+	// PerformanceState returns current performance state, from 0 for maximum performance to 15 for minimum performance
+	PerformanceState() (uint32, error)
+	// Utilization returns GPU utilization in percent over the last sample period of the driver
+	Utilization() (uint32, error)
+	// AcousticTemperatureThreshold returns current acoustic temperature threshold in Celsius
+	AcousticTemperatureThreshold() (uint32, error)
+	FanSpeed(fanIdx int) (uint32, error)
+	// FanSpeedRPM returns RPM of the first fan
+	FanSpeedRPM() (uint32, error)
+	// MinMaxFanSpeed returns range of fan speed in percent, which can be set to the device
+	MinMaxFanSpeed() (uint32, uint32, error)
+	FanControlPolicy(fanIdx int) (fanControlPolicy, error)
+	SetFanSpeed(fanIdx int, speed uint8) error
+	// SetDefaultFanSpeed returns the fan to driver default fan control policy
+	SetDefaultFanSpeed(fanIdx int) error
+	// PowerLimit returns power management limit of the device in milliwatts
+	PowerLimit() (uint32, error)
+	// PowerLimitConstraints returns range of power management limit in milliwatts, which can be set to the device
+	PowerLimitConstraints() (uint32, uint32, error)
+	SetPowerLimit(limit uint32) error
+	// SetLockedClocks locks GPU clock within the range in MHz
+	SetLockedClocks(minMHz, maxMHz uint32) error
+	// ResetLockedClocks returns GPU clock to driver default range
+	ResetLockedClocks() error
+	// PersistenceMode returns whether driver is kept loaded while no client uses the device, which is only supported on Linux
+	PersistenceMode() (bool, error)
+	SetPersistenceMode(enabled bool) error
+}
+
+// Value types of NVML field value, as defined by NVML
+const (
+	FIELD_VALUE_TYPE_DOUBLE             = 0
+	FIELD_VALUE_TYPE_UNSIGNED_INT       = 1
+	FIELD_VALUE_TYPE_UNSIGNED_LONG      = 2
+	FIELD_VALUE_TYPE_UNSIGNED_LONG_LONG = 3
+	FIELD_VALUE_TYPE_SIGNED_LONG_LONG   = 4
+	FIELD_VALUE_TYPE_SIGNED_INT         = 5
+	FIELD_VALUE_TYPE_UNSIGNED_SHORT     = 6
+)
+
+// decodeFieldValue decodes value of NVML field value, based on its value type
+func decodeFieldValue(valueType uint32, value [8]byte) (float64, error) {
+	switch valueType {
+	case FIELD_VALUE_TYPE_DOUBLE:
+		return math.Float64frombits(binary.LittleEndian.Uint64(value[:])), nil
+	case FIELD_VALUE_TYPE_UNSIGNED_INT:
+		return float64(binary.LittleEndian.Uint32(value[:])), nil
+	case FIELD_VALUE_TYPE_UNSIGNED_LONG, FIELD_VALUE_TYPE_UNSIGNED_LONG_LONG:
+		return float64(binary.LittleEndian.Uint64(value[:])), nil
+	case FIELD_VALUE_TYPE_SIGNED_LONG_LONG:
+		return float64(int64(binary.LittleEndian.Uint64(value[:]))), nil
+	case FIELD_VALUE_TYPE_SIGNED_INT:
+		return float64(int32(binary.LittleEndian.Uint32(value[:]))), nil
+	case FIELD_VALUE_TYPE_UNSIGNED_SHORT:
+		return float64(binary.LittleEndian.Uint16(value[:])), nil
+	default:
+		return 0, fmt.Errorf("unknown field value type: %d", valueType)
+	}
+}
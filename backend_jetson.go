@@ -0,0 +1,412 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Release file of Linux for Tegra, which tells that the program runs on a Jetson board
+	JETSON_RELEASE_FILE = "/etc/nv_tegra_release"
+	JETSON_MODEL_FILE   = "/proc/device-tree/model"
+	JETSON_SERIAL_FILE  = "/proc/device-tree/serial-number"
+	// Fan interface of pwm-fan driver of L4T R32 and earlier, used by Jetson Nano, TX2 and Xavier
+	JETSON_LEGACY_FAN_DIR = "/sys/devices/pwm-fan"
+	// Value of temp_control of legacy fan interface, by which kernel controls fan speed by temperature
+	JETSON_TEMP_CONTROL_AUTO   = "1"
+	JETSON_TEMP_CONTROL_MANUAL = "0"
+	JETSON_PWM_MAX             = 255
+)
+
+// Names of hwmon devices of pwm-fan driver of L4T R34 and later, used by Jetson Orin
+var JETSON_HWMON_FAN_NAMES = []string{"pwmfan", "pwm-fan"}
+
+// GPU load in per mille, whose location differs between Jetson modules
+var JETSON_GPU_LOAD_FILES = []string{"/sys/devices/gpu.0/load", "/sys/devices/platform/gpu.0/load", "/sys/devices/platform/bus@0/17000000.gpu/load"}
+
+// e.g. "# R35 (release), REVISION: 4.1, GCID: ..." in release file
+var jetsonReleasePattern = regexp.MustCompile(`R(\d+) \(release\), REVISION: ([0-9.]+)`)
+
+// isJetson tells whether the program runs on a Jetson board, whose integrated GPU is not exposed by NVML
+func isJetson() bool {
+	_, err := os.Stat(JETSON_RELEASE_FILE)
+	return err == nil
+}
+
+// jetsonBackend exposes integrated GPU of a Jetson board as a single device, whose temperature is read from thermal zone
+// and whose fan is driven through PWM fan interface in sysfs
+type jetsonBackend struct {
+	device *jetsonDevice
+}
+
+// Init finds thermal zone and fans once. Later calls e.g. after resume keep the device, as sysfs needs no
+// re-initialization, and duty before this process took control must be kept to be restored.
+func (b *jetsonBackend) Init() error {
+	if b.device != nil {
+		return nil
+	}
+	device, err := openJetsonDevice()
+	if err != nil {
+		return err
+	}
+	b.device = device
+	return nil
+}
+
+func (b *jetsonBackend) Shutdown() error {
+	return nil
+}
+
+func (b *jetsonBackend) DeviceCount() (int, error) {
+	return 1, nil
+}
+
+func (b *jetsonBackend) Device(index int) (gpuDevice, error) {
+	if index != 0 {
+		return nil, fmt.Errorf("Jetson has only one GPU at index 0: %w", ErrUnsupportedDevice)
+	}
+	if b.device == nil {
+		return nil, errors.New("Jetson backend is not initialized")
+	}
+	return b.device, nil
+}
+
+// DriverVersion returns release of Linux for Tegra e.g. R35.4.1
+func (b *jetsonBackend) DriverVersion() (string, error) {
+	data, err := os.ReadFile(JETSON_RELEASE_FILE)
+	if err != nil {
+		return "", fmt.Errorf("unable to read L4T release: %w", err)
+	}
+	match := jetsonReleasePattern.FindStringSubmatch(string(data))
+	if match == nil {
+		return "", fmt.Errorf("unknown L4T release format %q", strings.TrimSpace(string(data)))
+	}
+	return fmt.Sprintf("R%s.%s", match[1], match[2]), nil
+}
+
+func (b *jetsonBackend) NVMLVersion() (string, error) {
+	return "", jetsonUnsupported("NVML")
+}
+
+func jetsonUnsupported(operation string) error {
+	return fmt.Errorf("%s is not available on Jetson: %w", operation, ErrUnsupportedDevice)
+}
+
+// jetsonFan is a PWM fan of Jetson board
+type jetsonFan struct {
+	// Duty from 0 to 255 to be written, which is target_pwm of legacy interface or pwm1 of hwmon
+	pwmPath string
+	// Current duty, which follows target_pwm gradually on legacy interface
+	curPWMPath string
+	// temp_control of legacy interface, empty on hwmon, which has no automatic mode in kernel
+	tempControlPath string
+	// Tachometer, empty if the fan has none
+	rpmPath string
+	// Duty before this process took control, which is restored as default policy without automatic mode in kernel
+	previousPWM string
+	manual      bool
+}
+
+// jetsonDevice is integrated GPU of a Jetson board
+type jetsonDevice struct {
+	name     string
+	uuid     string
+	tempPath string
+	loadPath string
+	fans     []*jetsonFan
+}
+
+func openJetsonDevice() (*jetsonDevice, error) {
+	d := &jetsonDevice{name: "NVIDIA Jetson", uuid: "JETSON-0"}
+	if model, err := readSysfs(JETSON_MODEL_FILE); err == nil && model != "" {
+		d.name = model
+	}
+	if serial, err := readSysfs(JETSON_SERIAL_FILE); err == nil && serial != "" {
+		d.uuid = "JETSON-" + serial
+	}
+	tempPath, err := findGPUThermalZone()
+	if err != nil {
+		return nil, err
+	}
+	d.tempPath = tempPath
+	for _, path := range JETSON_GPU_LOAD_FILES {
+		if _, err := os.Stat(path); err == nil {
+			d.loadPath = path
+			break
+		}
+	}
+	if d.fans, err = findJetsonFans(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// findGPUThermalZone returns temperature file of thermal zone of GPU, e.g. GPU-therm on Xavier or gpu-thermal on Orin
+func findGPUThermalZone() (string, error) {
+	typePaths, err := filepath.Glob("/sys/class/thermal/thermal_zone*/type")
+	if err != nil {
+		return "", fmt.Errorf("unable to list thermal zones: %w", err)
+	}
+	for _, typePath := range typePaths {
+		zoneType, err := readSysfs(typePath)
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(strings.ToLower(zoneType), "gpu") {
+			return filepath.Join(filepath.Dir(typePath), "temp"), nil
+		}
+	}
+	return "", fmt.Errorf("no thermal zone of GPU in /sys/class/thermal")
+}
+
+// findJetsonFans finds fan of legacy interface, or hwmon devices of pwm-fan driver. No fan is found on boards
+// without fan header, which are monitored only.
+func findJetsonFans() ([]*jetsonFan, error) {
+	legacyPWM := filepath.Join(JETSON_LEGACY_FAN_DIR, "target_pwm")
+	if _, err := os.Stat(legacyPWM); err == nil {
+		fan := &jetsonFan{
+			pwmPath:         legacyPWM,
+			curPWMPath:      filepath.Join(JETSON_LEGACY_FAN_DIR, "cur_pwm"),
+			tempControlPath: filepath.Join(JETSON_LEGACY_FAN_DIR, "temp_control"),
+			rpmPath:         filepath.Join(JETSON_LEGACY_FAN_DIR, "rpm_measured"),
+		}
+		if _, err := os.Stat(fan.rpmPath); err != nil {
+			fan.rpmPath = ""
+		}
+		if fan.previousPWM, err = readSysfs(legacyPWM); err != nil {
+			return nil, err
+		}
+		return []*jetsonFan{fan}, nil
+	}
+
+	namePaths, err := filepath.Glob("/sys/class/hwmon/hwmon*/name")
+	if err != nil {
+		return nil, fmt.Errorf("unable to list hwmon devices: %w", err)
+	}
+	var fans []*jetsonFan
+	for _, namePath := range namePaths {
+		name, err := readSysfs(namePath)
+		if err != nil || !slices.Contains(JETSON_HWMON_FAN_NAMES, name) {
+			continue
+		}
+		dir := filepath.Dir(namePath)
+		fan := &jetsonFan{pwmPath: filepath.Join(dir, "pwm1"), curPWMPath: filepath.Join(dir, "pwm1")}
+		if fan.previousPWM, err = readSysfs(fan.pwmPath); err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(filepath.Join(dir, "fan1_input")); err == nil {
+			fan.rpmPath = filepath.Join(dir, "fan1_input")
+		}
+		fans = append(fans, fan)
+	}
+	return fans, nil
+}
+
+func readSysfs(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read %s: %w", path, err)
+	}
+	return strings.TrimSpace(strings.TrimRight(string(data), "\x00")), nil
+}
+
+func readSysfsUint(path string) (uint32, error) {
+	value, err := readSysfs(path)
+	if err != nil {
+		return 0, err
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+	return uint32(max(parsed, 0)), nil
+}
+
+// writeSysfs writes the value, where lack of permission is reported as rejected fan control
+func writeSysfs(path, value string) error {
+	err := os.WriteFile(path, []byte(value), 0644)
+	if errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("unable to write %s: %w: %w", path, ErrPolicyRejected, err)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write %s: %w", path, err)
+	}
+	return nil
+}
+
+func (d *jetsonDevice) fan(fanIdx int) (*jetsonFan, error) {
+	if fanIdx < 0 || fanIdx >= len(d.fans) {
+		return nil, fmt.Errorf("fan index %d is out of range, device has %d fans", fanIdx, len(d.fans))
+	}
+	return d.fans[fanIdx], nil
+}
+
+func (d *jetsonDevice) Name() (string, error) {
+	return d.name, nil
+}
+
+func (d *jetsonDevice) UUID() (string, error) {
+	return d.uuid, nil
+}
+
+func (d *jetsonDevice) NumFans() (int, error) {
+	return len(d.fans), nil
+}
+
+func (d *jetsonDevice) Temperature() (uint32, error) {
+	milliCelsius, err := readSysfsUint(d.tempPath)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(math.Round(float64(milliCelsius) / 1000)), nil
+}
+
+func (d *jetsonDevice) MemoryTemperature() (uint32, error) {
+	return 0, jetsonUnsupported("memory temperature")
+}
+
+func (d *jetsonDevice) ThermalSensors() (map[thermalTarget]uint32, error) {
+	return nil, jetsonUnsupported("thermal sensors of board")
+}
+
+func (d *jetsonDevice) PowerUsage() (uint32, error) {
+	return 0, jetsonUnsupported("power usage")
+}
+
+func (d *jetsonDevice) PerformanceState() (uint32, error) {
+	return 0, jetsonUnsupported("performance state")
+}
+
+func (d *jetsonDevice) Utilization() (uint32, error) {
+	if d.loadPath == "" {
+		return 0, jetsonUnsupported("GPU load")
+	}
+	load, err := readSysfsUint(d.loadPath)
+	if err != nil {
+		return 0, err
+	}
+	return min(load/10, 100), nil
+}
+
+func (d *jetsonDevice) AcousticTemperatureThreshold() (uint32, error) {
+	return 0, jetsonUnsupported("acoustic temperature threshold")
+}
+
+func (d *jetsonDevice) FanSpeed(fanIdx int) (uint32, error) {
+	fan, err := d.fan(fanIdx)
+	if err != nil {
+		return 0, err
+	}
+	pwm, err := readSysfsUint(fan.curPWMPath)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(math.Round(float64(min(pwm, JETSON_PWM_MAX)) * float64(MAX_FAN_SPEED_PERCENT) / JETSON_PWM_MAX)), nil
+}
+
+func (d *jetsonDevice) FanSpeedRPM() (uint32, error) {
+	if len(d.fans) == 0 || d.fans[0].rpmPath == "" {
+		return 0, jetsonUnsupported("fan tachometer")
+	}
+	return readSysfsUint(d.fans[0].rpmPath)
+}
+
+func (d *jetsonDevice) MinMaxFanSpeed() (uint32, uint32, error) {
+	return 0, uint32(MAX_FAN_SPEED_PERCENT), nil
+}
+
+func (d *jetsonDevice) FanControlPolicy(fanIdx int) (fanControlPolicy, error) {
+	fan, err := d.fan(fanIdx)
+	if err != nil {
+		return 0, err
+	}
+	if fan.tempControlPath != "" {
+		tempControl, err := readSysfs(fan.tempControlPath)
+		if err != nil {
+			return 0, err
+		}
+		if tempControl == JETSON_TEMP_CONTROL_AUTO {
+			return FAN_POLICY_TEMPERATURE_CONTINOUS_SW, nil
+		}
+		return FAN_POLICY_MANUAL, nil
+	}
+	if fan.manual {
+		return FAN_POLICY_MANUAL, nil
+	}
+	return FAN_POLICY_TEMPERATURE_CONTINOUS_SW, nil
+}
+
+func (d *jetsonDevice) SetFanSpeed(fanIdx int, speed uint8) error {
+	fan, err := d.fan(fanIdx)
+	if err != nil {
+		return err
+	}
+	if fan.tempControlPath != "" && !fan.manual {
+		if err := writeSysfs(fan.tempControlPath, JETSON_TEMP_CONTROL_MANUAL); err != nil {
+			return err
+		}
+	}
+	value := int(math.Round(float64(min(speed, MAX_FAN_SPEED_PERCENT)) * JETSON_PWM_MAX / float64(MAX_FAN_SPEED_PERCENT)))
+	if err := writeSysfs(fan.pwmPath, strconv.Itoa(value)); err != nil {
+		return err
+	}
+	fan.manual = true
+	return nil
+}
+
+// SetDefaultFanSpeed hands the fan back to kernel on legacy interface. On hwmon, which is controlled by nvfancontrol
+// service in user space, duty before this process took control is restored instead.
+func (d *jetsonDevice) SetDefaultFanSpeed(fanIdx int) error {
+	fan, err := d.fan(fanIdx)
+	if err != nil {
+		return err
+	}
+	if fan.tempControlPath != "" {
+		if err := writeSysfs(fan.tempControlPath, JETSON_TEMP_CONTROL_AUTO); err != nil {
+			return err
+		}
+	} else if fan.manual {
+		if err := writeSysfs(fan.pwmPath, fan.previousPWM); err != nil {
+			return err
+		}
+	}
+	fan.manual = false
+	return nil
+}
+
+func (d *jetsonDevice) PowerLimit() (uint32, error) {
+	return 0, jetsonUnsupported("power limit")
+}
+
+func (d *jetsonDevice) PowerLimitConstraints() (uint32, uint32, error) {
+	return 0, 0, jetsonUnsupported("power limit")
+}
+
+func (d *jetsonDevice) SetPowerLimit(limit uint32) error {
+	return jetsonUnsupported("power limit")
+}
+
+func (d *jetsonDevice) SetLockedClocks(minMHz, maxMHz uint32) error {
+	return jetsonUnsupported("locked clocks")
+}
+
+func (d *jetsonDevice) ResetLockedClocks() error {
+	return jetsonUnsupported("locked clocks")
+}
+
+func (d *jetsonDevice) PersistenceMode() (bool, error) {
+	return false, jetsonUnsupported("persistence mode")
+}
+
+func (d *jetsonDevice) SetPersistenceMode(enabled bool) error {
+	return jetsonUnsupported("persistence mode")
+}
@@ -0,0 +1,121 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+const NVIDIA_SETTINGS_BIN = "nvidia-settings"
+
+// nvidiaSettingsFallbackDevice sets fan speed through NVML, and falls back to nvidia-settings CLI
+// once NVML returns NOT_SUPPORTED, which happens on many pre-Turing GPUs.
+// nvidia-settings requires a running X server with Coolbits option enabled.
+type nvidiaSettingsFallbackDevice struct {
+	gpuDevice
+
+	deviceIndex int
+	// Index of the first fan of this device, as nvidia-settings numbers fans across all GPUs
+	fanOffset int
+	display   string
+
+	mu          sync.Mutex
+	useFallback bool
+}
+
+// withNvidiaSettingsFallback wraps device, so that fan speed is set by nvidia-settings when NVML does not support it.
+// If forced, nvidia-settings is used from the start, e.g. when the driver is too old to set fan speed through NVML.
+func withNvidiaSettingsFallback(backend gpuBackend, device gpuDevice, deviceIndex int, display string, forced bool) gpuDevice {
+	fanOffset := 0
+	for i := 0; i < deviceIndex; i++ {
+		d, err := backend.Device(i)
+		if err != nil {
+			moduleLogger(LOG_MODULE_NVML).Warn("Unable to get device for nvidia-settings fan index, fan index may be wrong", LABEL_GPU_INDEX, i, "err", err)
+			continue
+		}
+		numFans, err := d.NumFans()
+		if err != nil {
+			moduleLogger(LOG_MODULE_NVML).Warn("Unable to get number of fans for nvidia-settings fan index, fan index may be wrong", LABEL_GPU_INDEX, i, "err", err)
+			continue
+		}
+		fanOffset += numFans
+	}
+
+	return &nvidiaSettingsFallbackDevice{
+		gpuDevice:   device,
+		deviceIndex: deviceIndex,
+		fanOffset:   fanOffset,
+		display:     display,
+		useFallback: forced,
+	}
+}
+
+func (d *nvidiaSettingsFallbackDevice) runNvidiaSettings(assignments ...string) error {
+	args := []string{"-c", d.display}
+	for _, assignment := range assignments {
+		args = append(args, "-a", assignment)
+	}
+	cmd := exec.Command(NVIDIA_SETTINGS_BIN, args...)
+	cmd.Env = append(os.Environ(), "DISPLAY="+d.display)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("nvidia-settings failed, make sure X server is running on display %s, XAUTHORITY is set, and Coolbits option includes value 4; err: %w, output: %s", d.display, err, bytes.TrimSpace(output.Bytes()))
+	}
+	// nvidia-settings exits with 0 even when the assignment is rejected
+	if bytes.Contains(output.Bytes(), []byte("ERROR")) {
+		return fmt.Errorf("nvidia-settings rejected the assignment, make sure Coolbits option includes value 4; output: %s", bytes.TrimSpace(output.Bytes()))
+	}
+	return nil
+}
+
+func (d *nvidiaSettingsFallbackDevice) fallbackEnabled(err error) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.useFallback && errors.Is(err, ErrUnsupportedDevice) {
+		moduleLogger(LOG_MODULE_NVML).Warn("NVML does not support setting fan speed on this device, fall back to nvidia-settings", LABEL_GPU_INDEX, d.deviceIndex, "display", d.display)
+		d.useFallback = true
+	}
+	return d.useFallback
+}
+
+func (d *nvidiaSettingsFallbackDevice) SetFanSpeed(fanIdx int, speed uint8) error {
+	if !d.fallbackEnabled(nil) {
+		err := d.gpuDevice.SetFanSpeed(fanIdx, speed)
+		if err == nil || !d.fallbackEnabled(err) {
+			return err
+		}
+	}
+
+	return d.runNvidiaSettings(
+		fmt.Sprintf("[gpu:%d]/GPUFanControlState=1", d.deviceIndex),
+		fmt.Sprintf("[fan:%d]/GPUTargetFanSpeed=%d", d.fanOffset+fanIdx, speed),
+	)
+}
+
+func (d *nvidiaSettingsFallbackDevice) SetDefaultFanSpeed(fanIdx int) error {
+	if !d.fallbackEnabled(nil) {
+		err := d.gpuDevice.SetDefaultFanSpeed(fanIdx)
+		if err == nil || !d.fallbackEnabled(err) {
+			return err
+		}
+	}
+
+	// Fan control state is per GPU, so all fans of the device return to driver control
+	return d.runNvidiaSettings(fmt.Sprintf("[gpu:%d]/GPUFanControlState=0", d.deviceIndex))
+}
+
+// WatchEvents forwards to the wrapped device, as the fallback only affects setting fan speed
+func (d *nvidiaSettingsFallbackDevice) WatchEvents(notify func(), stop <-chan struct{}) error {
+	source, ok := d.gpuDevice.(gpuEventSource)
+	if !ok {
+		return ErrUnsupportedDevice
+	}
+	return source.WatchEvents(notify, stop)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	NVIDIA_SMI_BIN = "nvidia-smi"
+	// Sensors of a device are queried at once, and reused within this duration, as each query starts a process
+	NVIDIA_SMI_CACHE_DURATION = 500 * time.Millisecond
+)
+
+// Fields queried from nvidia-smi at once for each device
+var NVIDIA_SMI_QUERY_FIELDS = []string{"uuid", "name", "temperature.gpu", "temperature.memory", "power.draw", "pstate", "utilization.gpu", "fan.speed", "power.limit", "power.min_limit", "power.max_limit", "persistence_mode"}
+
+// nvidiaSMIBackend reads sensors by running nvidia-smi, e.g. when NVML library cannot be loaded in a container while
+// nvidia-smi is mounted. It cannot set fan speed, so that its devices are monitored only.
+type nvidiaSMIBackend struct{}
+
+func (b *nvidiaSMIBackend) Init() error {
+	if _, err := exec.LookPath(NVIDIA_SMI_BIN); err != nil {
+		return fmt.Errorf("unable to find %s: %w", NVIDIA_SMI_BIN, err)
+	}
+	_, err := b.DeviceCount()
+	return err
+}
+
+func (b *nvidiaSMIBackend) Shutdown() error {
+	return nil
+}
+
+func (b *nvidiaSMIBackend) DeviceCount() (int, error) {
+	rows, err := runNvidiaSMIQuery([]string{"index"}, -1)
+	if err != nil {
+		return 0, err
+	}
+	return len(rows), nil
+}
+
+func (b *nvidiaSMIBackend) Device(index int) (gpuDevice, error) {
+	count, err := b.DeviceCount()
+	if err != nil {
+		return nil, err
+	}
+	if index < 0 || index >= count {
+		return nil, fmt.Errorf("device index %d is out of range, %s reports %d devices", index, NVIDIA_SMI_BIN, count)
+	}
+	return &nvidiaSMIDevice{index: index}, nil
+}
+
+func (b *nvidiaSMIBackend) DriverVersion() (string, error) {
+	rows, err := runNvidiaSMIQuery([]string{"driver_version"}, 0)
+	if err != nil {
+		return "", err
+	}
+	return rows[0][0], nil
+}
+
+func (b *nvidiaSMIBackend) NVMLVersion() (string, error) {
+	return "", fmt.Errorf("NVML version is not reported by %s: %w", NVIDIA_SMI_BIN, ErrUnsupportedDevice)
+}
+
+// runNvidiaSMIQuery queries the fields of the device, or of all devices if index is negative
+func runNvidiaSMIQuery(fields []string, index int) ([][]string, error) {
+	args := []string{"--query-gpu=" + strings.Join(fields, ","), "--format=csv,noheader,nounits"}
+	if index >= 0 {
+		args = append(args, "-i", strconv.Itoa(index))
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(NVIDIA_SMI_BIN, args...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to run %s: %w, stderr: %s", NVIDIA_SMI_BIN, err, strings.TrimSpace(stderr.String()))
+	}
+	reader := csv.NewReader(bytes.NewReader(output))
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse output of %s: %w", NVIDIA_SMI_BIN, err)
+	}
+	for _, row := range rows {
+		if len(row) != len(fields) {
+			return nil, fmt.Errorf("%s returned %d fields instead of %d", NVIDIA_SMI_BIN, len(row), len(fields))
+		}
+	}
+	if index >= 0 && len(rows) == 0 {
+		return nil, fmt.Errorf("%s returned no device at index %d", NVIDIA_SMI_BIN, index)
+	}
+	return rows, nil
+}
+
+// nvidiaSMIDevice reads sensors of a device by nvidia-smi, where all setters fail as unsupported
+type nvidiaSMIDevice struct {
+	index int
+
+	mu        sync.Mutex
+	values    map[string]string
+	queriedAt time.Time
+}
+
+// field returns value of the field from the latest query, which is refreshed once it is older than cache duration
+func (d *nvidiaSMIDevice) field(name string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.values == nil || time.Since(d.queriedAt) > NVIDIA_SMI_CACHE_DURATION {
+		rows, err := runNvidiaSMIQuery(NVIDIA_SMI_QUERY_FIELDS, d.index)
+		if err != nil {
+			return "", err
+		}
+		d.values = make(map[string]string, len(NVIDIA_SMI_QUERY_FIELDS))
+		for i, field := range NVIDIA_SMI_QUERY_FIELDS {
+			d.values[field] = rows[0][i]
+		}
+		d.queriedAt = time.Now()
+	}
+	value := d.values[name]
+	// e.g. [N/A] or [Not Supported]
+	if strings.HasPrefix(value, "[") {
+		return "", fmt.Errorf("%s is %s: %w", name, value, ErrUnsupportedDevice)
+	}
+	return value, nil
+}
+
+// number returns value of numeric field, which is a decimal in unit of nvidia-smi e.g. watts
+func (d *nvidiaSMIDevice) number(name string) (float64, error) {
+	value, err := d.field(name)
+	if err != nil {
+		return 0, err
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse %s %q: %w", name, value, err)
+	}
+	return number, nil
+}
+
+func (d *nvidiaSMIDevice) uint32Field(name string, scale float64) (uint32, error) {
+	number, err := d.number(name)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(math.Round(max(number, 0) * scale)), nil
+}
+
+func nvidiaSMIUnsupported(operation string) error {
+	return fmt.Errorf("%s is not available through %s: %w", operation, NVIDIA_SMI_BIN, ErrUnsupportedDevice)
+}
+
+func (d *nvidiaSMIDevice) Name() (string, error) {
+	return d.field("name")
+}
+
+func (d *nvidiaSMIDevice) UUID() (string, error) {
+	return d.field("uuid")
+}
+
+// NumFans fails as unsupported, so that the device is monitored only, as fan speed cannot be set through nvidia-smi
+func (d *nvidiaSMIDevice) NumFans() (int, error) {
+	return 0, nvidiaSMIUnsupported("fan control")
+}
+
+func (d *nvidiaSMIDevice) Temperature() (uint32, error) {
+	return d.uint32Field("temperature.gpu", 1)
+}
+
+func (d *nvidiaSMIDevice) MemoryTemperature() (uint32, error) {
+	return d.uint32Field("temperature.memory", 1)
+}
+
+func (d *nvidiaSMIDevice) ThermalSensors() (map[thermalTarget]uint32, error) {
+	return nil, nvidiaSMIUnsupported("thermal sensors of board")
+}
+
+func (d *nvidiaSMIDevice) PowerUsage() (uint32, error) {
+	return d.uint32Field("power.draw", 1000)
+}
+
+func (d *nvidiaSMIDevice) PerformanceState() (uint32, error) {
+	value, err := d.field("pstate")
+	if err != nil {
+		return 0, err
+	}
+	pstate, err := strconv.ParseUint(strings.TrimPrefix(value, "P"), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse pstate %q: %w", value, err)
+	}
+	return uint32(pstate), nil
+}
+
+func (d *nvidiaSMIDevice) Utilization() (uint32, error) {
+	return d.uint32Field("utilization.gpu", 1)
+}
+
+func (d *nvidiaSMIDevice) AcousticTemperatureThreshold() (uint32, error) {
+	return 0, nvidiaSMIUnsupported("acoustic temperature threshold")
+}
+
+// FanSpeed returns speed reported for the device, as nvidia-smi does not report fans separately
+func (d *nvidiaSMIDevice) FanSpeed(fanIdx int) (uint32, error) {
+	return d.uint32Field("fan.speed", 1)
+}
+
+func (d *nvidiaSMIDevice) FanSpeedRPM() (uint32, error) {
+	return 0, nvidiaSMIUnsupported("fan RPM")
+}
+
+func (d *nvidiaSMIDevice) MinMaxFanSpeed() (uint32, uint32, error) {
+	return 0, 0, nvidiaSMIUnsupported("fan speed range")
+}
+
+func (d *nvidiaSMIDevice) FanControlPolicy(fanIdx int) (fanControlPolicy, error) {
+	return 0, nvidiaSMIUnsupported("fan control policy")
+}
+
+func (d *nvidiaSMIDevice) SetFanSpeed(fanIdx int, speed uint8) error {
+	return nvidiaSMIUnsupported("fan control")
+}
+
+func (d *nvidiaSMIDevice) SetDefaultFanSpeed(fanIdx int) error {
+	return nvidiaSMIUnsupported("fan control")
+}
+
+func (d *nvidiaSMIDevice) PowerLimit() (uint32, error) {
+	return d.uint32Field("power.limit", 1000)
+}
+
+func (d *nvidiaSMIDevice) PowerLimitConstraints() (uint32, uint32, error) {
+	minLimit, err := d.uint32Field("power.min_limit", 1000)
+	if err != nil {
+		return 0, 0, err
+	}
+	maxLimit, err := d.uint32Field("power.max_limit", 1000)
+	if err != nil {
+		return 0, 0, err
+	}
+	return minLimit, maxLimit, nil
+}
+
+func (d *nvidiaSMIDevice) SetPowerLimit(limit uint32) error {
+	return nvidiaSMIUnsupported("setting power limit")
+}
+
+func (d *nvidiaSMIDevice) SetLockedClocks(minMHz, maxMHz uint32) error {
+	return nvidiaSMIUnsupported("locked clocks")
+}
+
+func (d *nvidiaSMIDevice) ResetLockedClocks() error {
+	return nvidiaSMIUnsupported("locked clocks")
+}
+
+func (d *nvidiaSMIDevice) PersistenceMode() (bool, error) {
+	value, err := d.field("persistence_mode")
+	if err != nil {
+		return false, err
+	}
+	return value == "Enabled", nil
+}
+
+func (d *nvidiaSMIDevice) SetPersistenceMode(enabled bool) error {
+	return nvidiaSMIUnsupported("setting persistence mode")
+}
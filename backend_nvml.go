@@ -0,0 +1,408 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// nvmlError wraps NVML return code as an error
+type nvmlError struct {
+	ret nvml.Return
+	// Error is returned by setting fan speed or fan control policy, so that rejection can be told apart
+	fanControl bool
+}
+
+func (e nvmlError) Error() string {
+	return nvml.ErrorString(e.ret)
+}
+
+func (e nvmlError) Is(target error) bool {
+	switch target {
+	case ErrUnsupportedDevice:
+		return e.ret == nvml.ERROR_NOT_SUPPORTED || e.ret == nvml.ERROR_FUNCTION_NOT_FOUND
+	case ErrPolicyRejected:
+		return e.fanControl && (e.ret == nvml.ERROR_NO_PERMISSION || e.ret == nvml.ERROR_INVALID_ARGUMENT)
+	case ErrDeviceLost:
+		return e.ret == nvml.ERROR_GPU_IS_LOST || e.ret == nvml.ERROR_RESET_REQUIRED
+	case ErrLibraryNotFound:
+		return e.ret == nvml.ERROR_LIBRARY_NOT_FOUND
+	}
+	return false
+}
+
+func (e nvmlError) returnCode() int {
+	return int(e.ret)
+}
+
+// Fan functions, which are missing in older drivers. Calling a function missing in the loaded library crashes
+// the process instead of returning FUNCTION_NOT_FOUND, so that they are looked up before use.
+var NVML_OPTIONAL_FAN_FUNCTIONS = []string{
+	"nvmlDeviceGetNumFans",
+	"nvmlDeviceGetFanSpeed_v2",
+	"nvmlDeviceGetFanControlPolicy_v2",
+	"nvmlDeviceSetFanSpeed_v2",
+	"nvmlDeviceSetDefaultFanSpeed_v2",
+	"nvmlDeviceGetMinMaxFanSpeed",
+	"nvmlDeviceGetFanSpeedRPM",
+}
+
+func newGPUBackend() gpuBackend {
+	return &nvmlBackend{}
+}
+
+// resolveGPUBackend returns backend selected by name, where auto selects Jetson backend on Jetson boards and NVML otherwise
+func resolveGPUBackend(name string) (string, error) {
+	switch name {
+	case GPU_BACKEND_AUTO:
+		if isJetson() {
+			return GPU_BACKEND_JETSON, nil
+		}
+		return GPU_BACKEND_NVML, nil
+	case GPU_BACKEND_NVML, GPU_BACKEND_JETSON, GPU_BACKEND_NVIDIA_SMI:
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown backend %q, must be one of %s", name, strings.Join(GPU_BACKENDS, ", "))
+}
+
+// newGPUBackendByName returns backend resolved by resolveGPUBackend
+func newGPUBackendByName(name string) gpuBackend {
+	switch name {
+	case GPU_BACKEND_JETSON:
+		return &jetsonBackend{}
+	case GPU_BACKEND_NVIDIA_SMI:
+		return &nvidiaSMIBackend{}
+	}
+	return newGPUBackend()
+}
+
+// nvmlBackend accesses GPU devices through NVML library, which is loaded by go-nvml
+type nvmlBackend struct{}
+
+func (b *nvmlBackend) Init() error {
+	if ret := nvml.Init(); ret != nvml.SUCCESS {
+		return nvmlError{ret: ret}
+	}
+	return nil
+}
+
+func (b *nvmlBackend) Shutdown() error {
+	if ret := nvml.Shutdown(); ret != nvml.SUCCESS {
+		return nvmlError{ret: ret}
+	}
+	return nil
+}
+
+func (b *nvmlBackend) DeviceCount() (int, error) {
+	count, ret := nvml.DeviceGetCount()
+	if ret != nvml.SUCCESS {
+		return 0, nvmlError{ret: ret}
+	}
+	return count, nil
+}
+
+func (b *nvmlBackend) DriverVersion() (string, error) {
+	version, ret := nvml.SystemGetDriverVersion()
+	if ret != nvml.SUCCESS {
+		return "", nvmlError{ret: ret}
+	}
+	return version, nil
+}
+
+func (b *nvmlBackend) NVMLVersion() (string, error) {
+	version, ret := nvml.SystemGetNVMLVersion()
+	if ret != nvml.SUCCESS {
+		return "", nvmlError{ret: ret}
+	}
+	return version, nil
+}
+
+func (b *nvmlBackend) Device(index int) (gpuDevice, error) {
+	device, ret := nvml.DeviceGetHandleByIndex(index)
+	if ret != nvml.SUCCESS {
+		return nil, nvmlError{ret: ret}
+	}
+	missing := make(map[string]bool)
+	for _, name := range NVML_OPTIONAL_FAN_FUNCTIONS {
+		if err := nvml.Extensions().LookupSymbol(name); err != nil {
+			missing[name] = true
+		}
+	}
+	return &nvmlDevice{device: device, missing: missing}, nil
+}
+
+type nvmlDevice struct {
+	device nvml.Device
+	// Optional functions missing in the loaded library, which are replaced by legacy v1 functions where possible
+	missing map[string]bool
+}
+
+func (d *nvmlDevice) Name() (string, error) {
+	name, ret := d.device.GetName()
+	if ret != nvml.SUCCESS {
+		return "", nvmlError{ret: ret}
+	}
+	return name, nil
+}
+
+func (d *nvmlDevice) UUID() (string, error) {
+	uuid, ret := d.device.GetUUID()
+	if ret != nvml.SUCCESS {
+		return "", nvmlError{ret: ret}
+	}
+	return uuid, nil
+}
+
+// NumFans reports a single fan on drivers without nvmlDeviceGetNumFans, as legacy fan speed API only exposes the first fan
+func (d *nvmlDevice) NumFans() (int, error) {
+	if d.missing["nvmlDeviceGetNumFans"] {
+		if _, ret := nvml.DeviceGetFanSpeed(d.device); ret != nvml.SUCCESS {
+			return 0, nvmlError{ret: ret}
+		}
+		return 1, nil
+	}
+	numFans, ret := nvml.DeviceGetNumFans(d.device)
+	if ret != nvml.SUCCESS {
+		return 0, nvmlError{ret: ret}
+	}
+	return numFans, nil
+}
+
+func (d *nvmlDevice) Temperature() (uint32, error) {
+	temperature, ret := nvml.DeviceGetTemperature(d.device, nvml.TEMPERATURE_GPU)
+	if ret != nvml.SUCCESS {
+		return 0, nvmlError{ret: ret}
+	}
+	return temperature, nil
+}
+
+// MemoryTemperature reads memory temperature through NVML field value API,
+// which is only supported by some GPUs e.g. ones with GDDR6X or HBM memory.
+func (d *nvmlDevice) MemoryTemperature() (uint32, error) {
+	values := []nvml.FieldValue{{FieldId: nvml.FI_DEV_MEMORY_TEMP}}
+	if ret := nvml.DeviceGetFieldValues(d.device, values); ret != nvml.SUCCESS {
+		return 0, nvmlError{ret: ret}
+	}
+	if ret := nvml.Return(values[0].NvmlReturn); ret != nvml.SUCCESS {
+		return 0, nvmlError{ret: ret}
+	}
+	temperature, err := decodeFieldValue(values[0].ValueType, values[0].Value)
+	if err != nil {
+		return 0, fmt.Errorf("unable to decode memory temperature: %w", err)
+	}
+	return uint32(max(temperature, 0)), nil
+}
+
+func (d *nvmlDevice) ThermalSensors() (map[thermalTarget]uint32, error) {
+	settings, ret := d.device.GetThermalSettings(uint32(THERMAL_TARGET_ALL))
+	if ret != nvml.SUCCESS {
+		return nil, nvmlError{ret: ret}
+	}
+	sensors := make(map[thermalTarget]uint32, settings.Count)
+	for _, sensor := range settings.Sensor[:min(int(settings.Count), len(settings.Sensor))] {
+		sensors[thermalTarget(sensor.Target)] = uint32(max(sensor.CurrentTemp, 0))
+	}
+	return sensors, nil
+}
+
+func (d *nvmlDevice) PowerUsage() (uint32, error) {
+	power, ret := d.device.GetPowerUsage()
+	if ret != nvml.SUCCESS {
+		return 0, nvmlError{ret: ret}
+	}
+	return power, nil
+}
+
+func (d *nvmlDevice) PerformanceState() (uint32, error) {
+	pstate, ret := d.device.GetPerformanceState()
+	if ret != nvml.SUCCESS {
+		return 0, nvmlError{ret: ret}
+	}
+	return uint32(pstate), nil
+}
+
+func (d *nvmlDevice) Utilization() (uint32, error) {
+	utilization, ret := d.device.GetUtilizationRates()
+	if ret != nvml.SUCCESS {
+		return 0, nvmlError{ret: ret}
+	}
+	return utilization.Gpu, nil
+}
+
+func (d *nvmlDevice) AcousticTemperatureThreshold() (uint32, error) {
+	threshold, ret := nvml.DeviceGetTemperatureThreshold(d.device, nvml.TEMPERATURE_THRESHOLD_ACOUSTIC_CURR)
+	if ret != nvml.SUCCESS {
+		return 0, nvmlError{ret: ret}
+	}
+	return threshold, nil
+}
+
+// FanSpeed falls back to legacy nvmlDeviceGetFanSpeed on drivers without v2 function, which only reads the first fan
+func (d *nvmlDevice) FanSpeed(fanIdx int) (uint32, error) {
+	if d.missing["nvmlDeviceGetFanSpeed_v2"] {
+		if fanIdx != 0 {
+			return 0, nvmlError{ret: nvml.ERROR_FUNCTION_NOT_FOUND}
+		}
+		speed, ret := nvml.DeviceGetFanSpeed(d.device)
+		if ret != nvml.SUCCESS {
+			return 0, nvmlError{ret: ret}
+		}
+		return speed, nil
+	}
+	speed, ret := nvml.DeviceGetFanSpeed_v2(d.device, fanIdx)
+	if ret != nvml.SUCCESS {
+		return 0, nvmlError{ret: ret}
+	}
+	return speed, nil
+}
+
+func (d *nvmlDevice) FanSpeedRPM() (uint32, error) {
+	if d.missing["nvmlDeviceGetFanSpeedRPM"] {
+		return 0, nvmlError{ret: nvml.ERROR_FUNCTION_NOT_FOUND}
+	}
+	info, ret := nvml.DeviceGetFanSpeedRPM(d.device)
+	if ret != nvml.SUCCESS {
+		return 0, nvmlError{ret: ret}
+	}
+	return info.Speed, nil
+}
+
+func (d *nvmlDevice) MinMaxFanSpeed() (uint32, uint32, error) {
+	if d.missing["nvmlDeviceGetMinMaxFanSpeed"] {
+		return 0, 0, nvmlError{ret: nvml.ERROR_FUNCTION_NOT_FOUND}
+	}
+	minSpeed, maxSpeed, ret := d.device.GetMinMaxFanSpeed()
+	if ret != nvml.SUCCESS {
+		return 0, 0, nvmlError{ret: ret}
+	}
+	return uint32(minSpeed), uint32(maxSpeed), nil
+}
+
+func (d *nvmlDevice) FanControlPolicy(fanIdx int) (fanControlPolicy, error) {
+	if d.missing["nvmlDeviceGetFanControlPolicy_v2"] {
+		return 0, nvmlError{ret: nvml.ERROR_FUNCTION_NOT_FOUND}
+	}
+	policy, ret := nvml.DeviceGetFanControlPolicy_v2(d.device, fanIdx)
+	if ret != nvml.SUCCESS {
+		return 0, nvmlError{ret: ret}
+	}
+	return fanControlPolicy(policy), nil
+}
+
+// SetFanSpeed returns FUNCTION_NOT_FOUND on drivers without v2 function, as NVML has no legacy function to set fan speed.
+// Such devices are controlled by nvidia-settings fallback instead, if it is enabled.
+func (d *nvmlDevice) SetFanSpeed(fanIdx int, speed uint8) error {
+	if d.missing["nvmlDeviceSetFanSpeed_v2"] {
+		return nvmlError{ret: nvml.ERROR_FUNCTION_NOT_FOUND, fanControl: true}
+	}
+	if ret := nvml.DeviceSetFanSpeed_v2(d.device, fanIdx, int(speed)); ret != nvml.SUCCESS {
+		return nvmlError{ret: ret, fanControl: true}
+	}
+	return nil
+}
+
+func (d *nvmlDevice) SetDefaultFanSpeed(fanIdx int) error {
+	if d.missing["nvmlDeviceSetDefaultFanSpeed_v2"] {
+		return nvmlError{ret: nvml.ERROR_FUNCTION_NOT_FOUND, fanControl: true}
+	}
+	if ret := nvml.DeviceSetDefaultFanSpeed_v2(d.device, fanIdx); ret != nvml.SUCCESS {
+		return nvmlError{ret: ret, fanControl: true}
+	}
+	return nil
+}
+
+func (d *nvmlDevice) PowerLimit() (uint32, error) {
+	limit, ret := d.device.GetPowerManagementLimit()
+	if ret != nvml.SUCCESS {
+		return 0, nvmlError{ret: ret}
+	}
+	return limit, nil
+}
+
+func (d *nvmlDevice) PowerLimitConstraints() (uint32, uint32, error) {
+	minLimit, maxLimit, ret := d.device.GetPowerManagementLimitConstraints()
+	if ret != nvml.SUCCESS {
+		return 0, 0, nvmlError{ret: ret}
+	}
+	return minLimit, maxLimit, nil
+}
+
+func (d *nvmlDevice) SetPowerLimit(limit uint32) error {
+	if ret := d.device.SetPowerManagementLimit(limit); ret != nvml.SUCCESS {
+		return nvmlError{ret: ret}
+	}
+	return nil
+}
+
+func (d *nvmlDevice) SetLockedClocks(minMHz, maxMHz uint32) error {
+	if ret := d.device.SetGpuLockedClocks(minMHz, maxMHz); ret != nvml.SUCCESS {
+		return nvmlError{ret: ret}
+	}
+	return nil
+}
+
+func (d *nvmlDevice) ResetLockedClocks() error {
+	if ret := d.device.ResetGpuLockedClocks(); ret != nvml.SUCCESS {
+		return nvmlError{ret: ret}
+	}
+	return nil
+}
+
+func (d *nvmlDevice) PersistenceMode() (bool, error) {
+	mode, ret := d.device.GetPersistenceMode()
+	if ret != nvml.SUCCESS {
+		return false, nvmlError{ret: ret}
+	}
+	return mode == nvml.FEATURE_ENABLED, nil
+}
+
+func (d *nvmlDevice) SetPersistenceMode(enabled bool) error {
+	mode := nvml.FEATURE_DISABLED
+	if enabled {
+		mode = nvml.FEATURE_ENABLED
+	}
+	if ret := d.device.SetPersistenceMode(mode); ret != nvml.SUCCESS {
+		return nvmlError{ret: ret}
+	}
+	return nil
+}
+
+// WatchEvents waits for P-state and clock change events, which indicate load changes, as NVML has no temperature event
+func (d *nvmlDevice) WatchEvents(notify func(), stop <-chan struct{}) error {
+	supported, ret := d.device.GetSupportedEventTypes()
+	if ret != nvml.SUCCESS {
+		return nvmlError{ret: ret}
+	}
+	eventTypes := supported & (nvml.EventTypePState | nvml.EventTypeClock)
+	if eventTypes == 0 {
+		return nvmlError{ret: nvml.ERROR_NOT_SUPPORTED}
+	}
+
+	set, ret := nvml.EventSetCreate()
+	if ret != nvml.SUCCESS {
+		return nvmlError{ret: ret}
+	}
+	defer set.Free()
+	if ret := d.device.RegisterEvents(eventTypes, set); ret != nvml.SUCCESS {
+		return nvmlError{ret: ret}
+	}
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		_, ret := set.Wait(uint32(NVML_EVENT_WAIT_TIMEOUT.Milliseconds()))
+		switch ret {
+		case nvml.SUCCESS:
+			notify()
+		case nvml.ERROR_TIMEOUT:
+		default:
+			return nvmlError{ret: ret}
+		}
+	}
+}
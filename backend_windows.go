@@ -0,0 +1,442 @@
+//go:build windows
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	NVML_DLL_NAME = "nvml.dll"
+
+	NVML_ERROR_INVALID_ARGUMENT   = 2
+	NVML_ERROR_NOT_SUPPORTED      = 3
+	NVML_ERROR_NO_PERMISSION      = 4
+	NVML_ERROR_FUNCTION_NOT_FOUND = 13
+	NVML_ERROR_GPU_IS_LOST        = 15
+	NVML_ERROR_RESET_REQUIRED     = 16
+
+	NVML_DEVICE_NAME_BUFFER_SIZE = 96
+	NVML_DEVICE_UUID_BUFFER_SIZE = 80
+	NVML_VERSION_BUFFER_SIZE     = 80
+
+	NVML_TEMPERATURE_GPU                     = 0
+	NVML_TEMPERATURE_THRESHOLD_ACOUSTIC_CURR = 5
+	NVML_FI_DEV_MEMORY_TEMP                  = 82
+	NVML_FEATURE_DISABLED                    = 0
+	NVML_FEATURE_ENABLED                     = 1
+)
+
+// Known NVML return codes, as defined in nvml.h
+var nvmlDLLErrorStrings = map[uintptr]string{
+	1:   "Uninitialized",
+	2:   "Invalid Argument",
+	3:   "Not Supported",
+	4:   "Insufficient Permissions",
+	5:   "Already Initialized",
+	6:   "Not Found",
+	7:   "Insufficient Size",
+	8:   "Insufficient External Power",
+	9:   "Driver Not Loaded",
+	10:  "Timeout",
+	12:  "NVML Shared Library Not Found",
+	13:  "Function Not Found",
+	15:  "GPU is lost",
+	16:  "GPU requires restart",
+	999: "Unknown Error",
+}
+
+// nvmlDLLError wraps NVML return code as an error
+type nvmlDLLError struct {
+	ret uintptr
+	// Error is returned by setting fan speed or fan control policy, so that rejection can be told apart
+	fanControl bool
+}
+
+func (e nvmlDLLError) Error() string {
+	if msg, ok := nvmlDLLErrorStrings[e.ret]; ok {
+		return msg
+	}
+	return fmt.Sprintf("NVML error code %d", e.ret)
+}
+
+func (e nvmlDLLError) Is(target error) bool {
+	switch target {
+	case ErrUnsupportedDevice:
+		return e.ret == NVML_ERROR_NOT_SUPPORTED || e.ret == NVML_ERROR_FUNCTION_NOT_FOUND
+	case ErrPolicyRejected:
+		return e.fanControl && (e.ret == NVML_ERROR_NO_PERMISSION || e.ret == NVML_ERROR_INVALID_ARGUMENT)
+	case ErrDeviceLost:
+		return e.ret == NVML_ERROR_GPU_IS_LOST || e.ret == NVML_ERROR_RESET_REQUIRED
+	}
+	return false
+}
+
+func (e nvmlDLLError) returnCode() int {
+	return int(e.ret)
+}
+
+// fanControlError marks NVML error of setting fan speed or fan control policy
+func fanControlError(err error) error {
+	var dllErr nvmlDLLError
+	if errors.As(err, &dllErr) {
+		dllErr.fanControl = true
+		return dllErr
+	}
+	return err
+}
+
+// nvmlFieldValue has the same memory layout as nvmlFieldValue_t
+type nvmlFieldValue struct {
+	FieldId     uint32
+	ScopeId     uint32
+	Timestamp   int64
+	LatencyUsec int64
+	ValueType   uint32
+	NvmlReturn  uint32
+	Value       [8]byte
+}
+
+// nvmlGpuThermalSettings has the same memory layout as nvmlGpuThermalSettings_t
+type nvmlGpuThermalSettings struct {
+	Count  uint32
+	Sensor [3]struct {
+		Controller     int32
+		DefaultMinTemp int32
+		DefaultMaxTemp int32
+		CurrentTemp    int32
+		Target         int32
+	}
+}
+
+// nvmlFanSpeedInfo has the same memory layout as nvmlFanSpeedInfo_t
+type nvmlFanSpeedInfo struct {
+	Version uint32
+	Fan     uint32
+	Speed   uint32
+}
+
+// nvmlUtilization has the same memory layout as nvmlUtilization_t
+type nvmlUtilization struct {
+	Gpu    uint32
+	Memory uint32
+}
+
+func newGPUBackend() gpuBackend {
+	return &nvmlDLLBackend{}
+}
+
+// resolveGPUBackend returns backend selected by name, which is always NVML on Windows
+func resolveGPUBackend(name string) (string, error) {
+	switch name {
+	case GPU_BACKEND_AUTO, GPU_BACKEND_NVML:
+		return GPU_BACKEND_NVML, nil
+	case GPU_BACKEND_NVIDIA_SMI:
+		return name, nil
+	case GPU_BACKEND_JETSON:
+		return "", fmt.Errorf("backend %q is only supported on Linux", name)
+	}
+	return "", fmt.Errorf("unknown backend %q, must be one of %s", name, strings.Join(GPU_BACKENDS, ", "))
+}
+
+// newGPUBackendByName returns backend resolved by resolveGPUBackend
+func newGPUBackendByName(name string) gpuBackend {
+	if name == GPU_BACKEND_NVIDIA_SMI {
+		return &nvidiaSMIBackend{}
+	}
+	return newGPUBackend()
+}
+
+// nvmlDLLBackend accesses GPU devices by calling NVML functions exported by nvml.dll,
+// which is installed together with NVIDIA driver on Windows.
+type nvmlDLLBackend struct {
+	dll *syscall.DLL
+}
+
+// nvmlDLLPaths returns paths to look for nvml.dll, newer drivers install it to System32,
+// while older ones install it to NVSMI directory.
+func nvmlDLLPaths() []string {
+	return []string{
+		filepath.Join(os.Getenv("SystemRoot"), "System32", NVML_DLL_NAME),
+		filepath.Join(os.Getenv("ProgramFiles"), "NVIDIA Corporation", "NVSMI", NVML_DLL_NAME),
+	}
+}
+
+// call calls NVML function by name, and converts its return code to an error
+func (b *nvmlDLLBackend) call(name string, args ...uintptr) error {
+	proc, err := b.dll.FindProc(name)
+	if err != nil {
+		// Reported as FUNCTION_NOT_FOUND, so that functions missing in older drivers are treated as unsupported
+		return fmt.Errorf("unable to find NVML function %s: %v: %w", name, err, nvmlDLLError{ret: NVML_ERROR_FUNCTION_NOT_FOUND})
+	}
+	ret, _, _ := proc.Call(args...)
+	if ret != 0 {
+		return nvmlDLLError{ret: ret}
+	}
+	return nil
+}
+
+func (b *nvmlDLLBackend) Init() error {
+	var errs []error
+	for _, path := range nvmlDLLPaths() {
+		dll, err := syscall.LoadDLL(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		b.dll = dll
+		break
+	}
+	if b.dll == nil {
+		return fmt.Errorf("unable to load %s: %v: %w", NVML_DLL_NAME, errs, ErrLibraryNotFound)
+	}
+
+	return b.call("nvmlInit_v2")
+}
+
+func (b *nvmlDLLBackend) Shutdown() error {
+	if err := b.call("nvmlShutdown"); err != nil {
+		return err
+	}
+	return b.dll.Release()
+}
+
+func (b *nvmlDLLBackend) getString(name string) (string, error) {
+	buf := make([]byte, NVML_VERSION_BUFFER_SIZE)
+	if err := b.call(name, uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf))); err != nil {
+		return "", err
+	}
+	if i := bytes.IndexByte(buf, 0); i >= 0 {
+		buf = buf[:i]
+	}
+	return string(buf), nil
+}
+
+func (b *nvmlDLLBackend) DriverVersion() (string, error) {
+	return b.getString("nvmlSystemGetDriverVersion")
+}
+
+func (b *nvmlDLLBackend) NVMLVersion() (string, error) {
+	return b.getString("nvmlSystemGetNVMLVersion")
+}
+
+func (b *nvmlDLLBackend) DeviceCount() (int, error) {
+	var count uint32
+	if err := b.call("nvmlDeviceGetCount_v2", uintptr(unsafe.Pointer(&count))); err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+func (b *nvmlDLLBackend) Device(index int) (gpuDevice, error) {
+	var handle uintptr
+	if err := b.call("nvmlDeviceGetHandleByIndex_v2", uintptr(index), uintptr(unsafe.Pointer(&handle))); err != nil {
+		return nil, err
+	}
+	return &nvmlDLLDevice{backend: b, handle: handle}, nil
+}
+
+type nvmlDLLDevice struct {
+	backend *nvmlDLLBackend
+	handle  uintptr
+}
+
+func (d *nvmlDLLDevice) getString(name string, size int) (string, error) {
+	buf := make([]byte, size)
+	if err := d.backend.call(name, d.handle, uintptr(unsafe.Pointer(&buf[0])), uintptr(size)); err != nil {
+		return "", err
+	}
+	if i := bytes.IndexByte(buf, 0); i >= 0 {
+		buf = buf[:i]
+	}
+	return string(buf), nil
+}
+
+func (d *nvmlDLLDevice) Name() (string, error) {
+	return d.getString("nvmlDeviceGetName", NVML_DEVICE_NAME_BUFFER_SIZE)
+}
+
+func (d *nvmlDLLDevice) UUID() (string, error) {
+	return d.getString("nvmlDeviceGetUUID", NVML_DEVICE_UUID_BUFFER_SIZE)
+}
+
+// NumFans reports a single fan on drivers without nvmlDeviceGetNumFans, as legacy fan speed API only exposes the first fan
+func (d *nvmlDLLDevice) NumFans() (int, error) {
+	var numFans uint32
+	if err := d.backend.call("nvmlDeviceGetNumFans", d.handle, uintptr(unsafe.Pointer(&numFans))); err != nil {
+		if nvmlReturn, _ := nvmlReturnCode(err); nvmlReturn == NVML_ERROR_FUNCTION_NOT_FOUND {
+			var speed uint32
+			if err := d.backend.call("nvmlDeviceGetFanSpeed", d.handle, uintptr(unsafe.Pointer(&speed))); err == nil {
+				return 1, nil
+			}
+		}
+		return 0, err
+	}
+	return int(numFans), nil
+}
+
+func (d *nvmlDLLDevice) Temperature() (uint32, error) {
+	var temperature uint32
+	if err := d.backend.call("nvmlDeviceGetTemperature", d.handle, NVML_TEMPERATURE_GPU, uintptr(unsafe.Pointer(&temperature))); err != nil {
+		return 0, err
+	}
+	return temperature, nil
+}
+
+func (d *nvmlDLLDevice) MemoryTemperature() (uint32, error) {
+	values := []nvmlFieldValue{{FieldId: NVML_FI_DEV_MEMORY_TEMP}}
+	if err := d.backend.call("nvmlDeviceGetFieldValues", d.handle, uintptr(len(values)), uintptr(unsafe.Pointer(&values[0]))); err != nil {
+		return 0, err
+	}
+	if values[0].NvmlReturn != 0 {
+		return 0, nvmlDLLError{ret: uintptr(values[0].NvmlReturn)}
+	}
+	temperature, err := decodeFieldValue(values[0].ValueType, values[0].Value)
+	if err != nil {
+		return 0, fmt.Errorf("unable to decode memory temperature: %w", err)
+	}
+	return uint32(max(temperature, 0)), nil
+}
+
+func (d *nvmlDLLDevice) ThermalSensors() (map[thermalTarget]uint32, error) {
+	var settings nvmlGpuThermalSettings
+	if err := d.backend.call("nvmlDeviceGetThermalSettings", d.handle, uintptr(THERMAL_TARGET_ALL), uintptr(unsafe.Pointer(&settings))); err != nil {
+		return nil, err
+	}
+	sensors := make(map[thermalTarget]uint32, settings.Count)
+	for _, sensor := range settings.Sensor[:min(int(settings.Count), len(settings.Sensor))] {
+		sensors[thermalTarget(sensor.Target)] = uint32(max(sensor.CurrentTemp, 0))
+	}
+	return sensors, nil
+}
+
+func (d *nvmlDLLDevice) PowerUsage() (uint32, error) {
+	var power uint32
+	if err := d.backend.call("nvmlDeviceGetPowerUsage", d.handle, uintptr(unsafe.Pointer(&power))); err != nil {
+		return 0, err
+	}
+	return power, nil
+}
+
+func (d *nvmlDLLDevice) PerformanceState() (uint32, error) {
+	var pstate uint32
+	if err := d.backend.call("nvmlDeviceGetPerformanceState", d.handle, uintptr(unsafe.Pointer(&pstate))); err != nil {
+		return 0, err
+	}
+	return pstate, nil
+}
+
+func (d *nvmlDLLDevice) Utilization() (uint32, error) {
+	utilization := nvmlUtilization{}
+	if err := d.backend.call("nvmlDeviceGetUtilizationRates", d.handle, uintptr(unsafe.Pointer(&utilization))); err != nil {
+		return 0, err
+	}
+	return utilization.Gpu, nil
+}
+
+func (d *nvmlDLLDevice) AcousticTemperatureThreshold() (uint32, error) {
+	var threshold uint32
+	if err := d.backend.call("nvmlDeviceGetTemperatureThreshold", d.handle, NVML_TEMPERATURE_THRESHOLD_ACOUSTIC_CURR, uintptr(unsafe.Pointer(&threshold))); err != nil {
+		return 0, err
+	}
+	return threshold, nil
+}
+
+// FanSpeed falls back to legacy nvmlDeviceGetFanSpeed on drivers without v2 function, which only reads the first fan
+func (d *nvmlDLLDevice) FanSpeed(fanIdx int) (uint32, error) {
+	var speed uint32
+	if err := d.backend.call("nvmlDeviceGetFanSpeed_v2", d.handle, uintptr(fanIdx), uintptr(unsafe.Pointer(&speed))); err != nil {
+		if nvmlReturn, _ := nvmlReturnCode(err); nvmlReturn != NVML_ERROR_FUNCTION_NOT_FOUND || fanIdx != 0 {
+			return 0, err
+		}
+		if err := d.backend.call("nvmlDeviceGetFanSpeed", d.handle, uintptr(unsafe.Pointer(&speed))); err != nil {
+			return 0, err
+		}
+	}
+	return speed, nil
+}
+
+func (d *nvmlDLLDevice) FanSpeedRPM() (uint32, error) {
+	info := nvmlFanSpeedInfo{}
+	// Struct version is encoded as struct size | (version << 24)
+	info.Version = uint32(unsafe.Sizeof(info)) | 1<<24
+	if err := d.backend.call("nvmlDeviceGetFanSpeedRPM", d.handle, uintptr(unsafe.Pointer(&info))); err != nil {
+		return 0, err
+	}
+	return info.Speed, nil
+}
+
+func (d *nvmlDLLDevice) MinMaxFanSpeed() (uint32, uint32, error) {
+	var minSpeed, maxSpeed uint32
+	if err := d.backend.call("nvmlDeviceGetMinMaxFanSpeed", d.handle, uintptr(unsafe.Pointer(&minSpeed)), uintptr(unsafe.Pointer(&maxSpeed))); err != nil {
+		return 0, 0, err
+	}
+	return minSpeed, maxSpeed, nil
+}
+
+func (d *nvmlDLLDevice) FanControlPolicy(fanIdx int) (fanControlPolicy, error) {
+	var policy uint32
+	if err := d.backend.call("nvmlDeviceGetFanControlPolicy_v2", d.handle, uintptr(fanIdx), uintptr(unsafe.Pointer(&policy))); err != nil {
+		return 0, err
+	}
+	return fanControlPolicy(policy), nil
+}
+
+func (d *nvmlDLLDevice) SetFanSpeed(fanIdx int, speed uint8) error {
+	return fanControlError(d.backend.call("nvmlDeviceSetFanSpeed_v2", d.handle, uintptr(fanIdx), uintptr(speed)))
+}
+
+func (d *nvmlDLLDevice) SetDefaultFanSpeed(fanIdx int) error {
+	return fanControlError(d.backend.call("nvmlDeviceSetDefaultFanSpeed_v2", d.handle, uintptr(fanIdx)))
+}
+
+func (d *nvmlDLLDevice) PowerLimit() (uint32, error) {
+	var limit uint32
+	if err := d.backend.call("nvmlDeviceGetPowerManagementLimit", d.handle, uintptr(unsafe.Pointer(&limit))); err != nil {
+		return 0, err
+	}
+	return limit, nil
+}
+
+func (d *nvmlDLLDevice) PowerLimitConstraints() (uint32, uint32, error) {
+	var minLimit, maxLimit uint32
+	if err := d.backend.call("nvmlDeviceGetPowerManagementLimitConstraints", d.handle, uintptr(unsafe.Pointer(&minLimit)), uintptr(unsafe.Pointer(&maxLimit))); err != nil {
+		return 0, 0, err
+	}
+	return minLimit, maxLimit, nil
+}
+
+func (d *nvmlDLLDevice) SetPowerLimit(limit uint32) error {
+	return d.backend.call("nvmlDeviceSetPowerManagementLimit", d.handle, uintptr(limit))
+}
+
+func (d *nvmlDLLDevice) SetLockedClocks(minMHz, maxMHz uint32) error {
+	return d.backend.call("nvmlDeviceSetGpuLockedClocks", d.handle, uintptr(minMHz), uintptr(maxMHz))
+}
+
+func (d *nvmlDLLDevice) ResetLockedClocks() error {
+	return d.backend.call("nvmlDeviceResetGpuLockedClocks", d.handle)
+}
+
+func (d *nvmlDLLDevice) PersistenceMode() (bool, error) {
+	var mode uint32
+	if err := d.backend.call("nvmlDeviceGetPersistenceMode", d.handle, uintptr(unsafe.Pointer(&mode))); err != nil {
+		return false, err
+	}
+	return mode == NVML_FEATURE_ENABLED, nil
+}
+
+func (d *nvmlDLLDevice) SetPersistenceMode(enabled bool) error {
+	mode := NVML_FEATURE_DISABLED
+	if enabled {
+		mode = NVML_FEATURE_ENABLED
+	}
+	return d.backend.call("nvmlDeviceSetPersistenceMode", d.handle, uintptr(mode))
+}
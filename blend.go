@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Sensors, which can be blended into the temperature of curve lookup
+const (
+	BLEND_SENSOR_CORE   = "core"
+	BLEND_SENSOR_MEMORY = "memory"
+	BLEND_SENSOR_BOARD  = "board"
+	BLEND_SENSOR_PSU    = "psu"
+	// Temperature read from -temp-source
+	BLEND_SENSOR_SOURCE = "source"
+)
+
+var BLEND_SENSORS = []string{BLEND_SENSOR_CORE, BLEND_SENSOR_MEMORY, BLEND_SENSOR_BOARD, BLEND_SENSOR_PSU, BLEND_SENSOR_SOURCE}
+
+type blendTerm struct {
+	sensor string
+	weight float64
+}
+
+// temperatureBlend is a weighted average of sensor temperatures e.g. 0.7*core + 0.3*memory, by which the curve is
+// looked up instead of core temperature
+type temperatureBlend []blendTerm
+
+// parseTemperatureBlend parses comma-separated sensor:weight pairs e.g. "core:0.7,memory:0.3".
+// Weights are relative to their sum, so that "core:7,memory:3" is the same blend.
+func parseTemperatureBlend(blendStr string) (temperatureBlend, error) {
+	var blend temperatureBlend
+	for _, pair := range strings.Split(blendStr, ",") {
+		sensor, weightStr, found := strings.Cut(strings.TrimSpace(pair), ":")
+		if !found {
+			return nil, fmt.Errorf("blend term %q must be sensor:weight", pair)
+		}
+		sensor = strings.ToLower(strings.TrimSpace(sensor))
+		if !slices.Contains(BLEND_SENSORS, sensor) {
+			return nil, fmt.Errorf("unknown blend sensor %q, must be one of %s", sensor, strings.Join(BLEND_SENSORS, ", "))
+		}
+		if blend.uses(sensor) {
+			return nil, fmt.Errorf("blend sensor %q is given more than once", sensor)
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(weightStr), 64)
+		if err != nil || weight <= 0 || math.IsInf(weight, 0) {
+			return nil, fmt.Errorf("weight of blend sensor %q must be a positive number: %q", sensor, weightStr)
+		}
+		blend = append(blend, blendTerm{sensor: sensor, weight: weight})
+	}
+	return blend, nil
+}
+
+func (b temperatureBlend) uses(sensor string) bool {
+	for _, term := range b {
+		if term.sensor == sensor {
+			return true
+		}
+	}
+	return false
+}
+
+func (b temperatureBlend) String() string {
+	terms := make([]string, 0, len(b))
+	for _, term := range b {
+		terms = append(terms, term.sensor+":"+strconv.FormatFloat(term.weight, 'f', -1, 64))
+	}
+	return strings.Join(terms, ",")
+}
+
+// blend returns weighted average of temperatures of the sensors read by read. Sensors which cannot be read are left
+// out, and weights of the others are scaled up, so that the blend keeps working when a sensor is briefly unavailable.
+// Error of the last unreadable sensor is returned together with the temperature, and false if no sensor can be read.
+func (b temperatureBlend) blend(read func(sensor string) (uint32, error)) (uint32, bool, error) {
+	var sum, weights float64
+	var lastErr error
+	for _, term := range b {
+		temperature, err := read(term.sensor)
+		if err != nil {
+			lastErr = fmt.Errorf("unable to read %s temperature: %w", term.sensor, err)
+			continue
+		}
+		sum += float64(temperature) * term.weight
+		weights += term.weight
+	}
+	if weights == 0 {
+		return 0, false, lastErr
+	}
+	return uint32(math.Round(sum / weights)), true, lastErr
+}
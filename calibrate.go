@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Temperature must stay within this delta (Celsius) during settle window to be considered steady
+	CALIBRATION_STEADY_DELTA = uint32(1)
+	// Abort stepping down when temperature exceeds target temperature by this margin (Celsius)
+	CALIBRATION_SAFETY_MARGIN = uint32(10)
+	// Maximum number of settle windows to wait for a steady temperature in each step
+	CALIBRATION_MAX_SETTLE_WINDOWS = 10
+)
+
+var errCalibrationCancelled = errors.New("calibration cancelled")
+
+type calibrationResult struct {
+	speed       uint8
+	temperature uint32
+	fanSpeeds   []uint32
+	rpm         uint32
+	settled     bool
+}
+
+func parseCalibrationSteps(stepsStr string) ([]uint8, error) {
+	var steps []uint8
+	for i, stepStr := range strings.Split(stepsStr, ",") {
+		speed, err := strconv.ParseUint(strings.TrimSpace(stepStr), 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse calibration step at index %d: %w", i, err)
+		}
+		if uint8(speed) > MAX_FAN_SPEED_PERCENT {
+			return nil, fmt.Errorf("calibration step at index %d is greater than %d%%: %d", i, MAX_FAN_SPEED_PERCENT, speed)
+		}
+		steps = append(steps, uint8(speed))
+	}
+
+	// Always start from the highest speed, so the GPU never runs hot before it has to
+	sort.Slice(steps, func(i, j int) bool { return steps[i] > steps[j] })
+
+	return steps, nil
+}
+
+func setAllFanSpeeds(device gpuDevice, fans []int, speed uint8) error {
+	for _, i := range fans {
+		if err := device.SetFanSpeed(i, speed); err != nil {
+			return fmt.Errorf("unable to set fan speed; fanIdx: %d, speed: %d, err: %w", i, speed, err)
+		}
+	}
+	return nil
+}
+
+// waitForSteadyTemperature polls temperature until it stays within CALIBRATION_STEADY_DELTA for the whole settle window.
+// It returns false as the second value if the temperature did not settle in time.
+func waitForSteadyTemperature(ctx context.Context, device gpuDevice, settleDuration, pollingDuration time.Duration, abortAbove uint32) (uint32, bool, error) {
+	ticker := time.NewTicker(pollingDuration)
+	defer ticker.Stop()
+
+	type sample struct {
+		at          time.Time
+		temperature uint32
+	}
+	var samples []sample
+	start := time.Now()
+	deadline := start.Add(settleDuration * CALIBRATION_MAX_SETTLE_WINDOWS)
+
+	for {
+		select {
+		case <-ticker.C:
+			temperature, err := device.Temperature()
+			if err != nil {
+				return 0, false, fmt.Errorf("unable to get device temperature; err: %w", err)
+			}
+			now := time.Now()
+			slog.Debug("calibration sample", "temperature", temperature, "elapsed", now.Sub(start))
+			if temperature > abortAbove {
+				return temperature, false, nil
+			}
+
+			samples = append(samples, sample{at: now, temperature: temperature})
+			for len(samples) > 0 && now.Sub(samples[0].at) > settleDuration {
+				samples = samples[1:]
+			}
+
+			if now.Sub(start) >= settleDuration {
+				minTemp, maxTemp := samples[0].temperature, samples[0].temperature
+				for _, s := range samples {
+					minTemp = min(minTemp, s.temperature)
+					maxTemp = max(maxTemp, s.temperature)
+				}
+				if maxTemp-minTemp <= CALIBRATION_STEADY_DELTA {
+					return temperature, true, nil
+				}
+			}
+			if now.After(deadline) {
+				return temperature, false, nil
+			}
+		case <-ctx.Done():
+			return 0, false, errCalibrationCancelled
+		}
+	}
+}
+
+func runCalibration(ctx context.Context, device gpuDevice, selectedFans fanSelection, steps []uint8, targetTemp uint8, settleDuration, pollingDuration time.Duration) ([]calibrationResult, error) {
+	deviceName, err := device.Name()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get device name; err: %w", err)
+	}
+	fans, _, err := controlledFans(device, selectedFans)
+	if err != nil {
+		return nil, fmt.Errorf("%w, device: %s", err, deviceName)
+	}
+
+	slog.Info("Starting calibration, please start a sustained full GPU load (e.g. a game benchmark or stress test) now and keep it running until calibration finishes",
+		LABEL_GPU_NAME, deviceName, "steps", steps, "targetTemp", targetTemp, "settle", settleDuration)
+
+	abortAbove := uint32(targetTemp) + CALIBRATION_SAFETY_MARGIN
+	var results []calibrationResult
+	for _, speed := range steps {
+		slog.Info("Calibration step", LABEL_GPU_NAME, deviceName, "speed", speed)
+		if err := setAllFanSpeeds(device, fans, speed); err != nil {
+			return results, fmt.Errorf("%w, device: %s", err, deviceName)
+		}
+
+		temperature, settled, err := waitForSteadyTemperature(ctx, device, settleDuration, pollingDuration, abortAbove)
+		if err != nil {
+			return results, err
+		}
+
+		result := calibrationResult{speed: speed, temperature: temperature, settled: settled}
+		for _, i := range fans {
+			fanSpeed, err := device.FanSpeed(i)
+			if err != nil {
+				slog.Warn("Unable to read back fan speed", LABEL_GPU_NAME, deviceName, LABEL_FAN_INDEX, i, "err", err)
+			}
+			result.fanSpeeds = append(result.fanSpeeds, fanSpeed)
+		}
+		// NVML only reports RPM of the first fan
+		if rpm, err := device.FanSpeedRPM(); err == nil {
+			result.rpm = rpm
+		} else {
+			slog.Debug("Unable to read fan RPM", LABEL_GPU_NAME, deviceName, "err", err)
+		}
+		results = append(results, result)
+		slog.Info("Calibration step finished", LABEL_GPU_NAME, deviceName, "speed", speed, "temperature", temperature, "settled", settled, "fanSpeeds", result.fanSpeeds, "rpm", result.rpm)
+
+		if temperature > abortAbove {
+			slog.Warn("Temperature exceeded target by safety margin, skip remaining lower speed steps", LABEL_GPU_NAME, deviceName, "temperature", temperature, "limit", abortAbove)
+			break
+		}
+	}
+
+	return results, nil
+}
+
+// proposeCalibratedCurve builds a fan curve around the lowest tested speed that holds the target temperature under load.
+func proposeCalibratedCurve(results []calibrationResult, targetTemp uint8) ([][2]uint8, error) {
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no calibration results")
+	}
+
+	holdSpeed := MAX_FAN_SPEED_PERCENT + 1
+	lowestSpeed := MAX_FAN_SPEED_PERCENT
+	for _, r := range results {
+		lowestSpeed = min(lowestSpeed, r.speed)
+		if r.temperature <= uint32(targetTemp) && r.speed < holdSpeed {
+			holdSpeed = r.speed
+		}
+	}
+	if holdSpeed > MAX_FAN_SPEED_PERCENT {
+		return nil, fmt.Errorf("no tested fan speed holds target temperature %d under load", targetTemp)
+	}
+
+	return [][2]uint8{
+		{targetTemp - 20, min(lowestSpeed, holdSpeed)},
+		{targetTemp - 5, holdSpeed},
+		{targetTemp, min(holdSpeed+10, MAX_FAN_SPEED_PERCENT)},
+		{targetTemp + 5, MAX_FAN_SPEED_PERCENT},
+	}, nil
+}
+
+func printCalibrationReport(results []calibrationResult, curve [][2]uint8) {
+	fmt.Println("Speed(%)  Temp(C)  Settled  RPM(fan#0)  Fan speeds(%)")
+	for _, r := range results {
+		fmt.Printf("%8d  %7d  %7t  %10d  %v\n", r.speed, r.temperature, r.settled, r.rpm, r.fanSpeeds)
+	}
+	if curve != nil {
+		fmt.Printf("\nProposed curve: -speeds %s\n", formatSpeedConfig(curve))
+	}
+}
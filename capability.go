@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// probeFanControl tells whether fans of the device can be controlled at all, without changing fan speed.
+// Error wrapping ErrUnsupportedDevice is returned for devices which can only be monitored, e.g. laptop GPUs whose fans
+// are controlled by embedded controller, or passively cooled datacenter GPUs.
+func probeFanControl(device gpuDevice, selection fanSelection) error {
+	numFans, err := device.NumFans()
+	if errors.Is(err, ErrUnsupportedDevice) {
+		return fmt.Errorf("device does not report its fans: %w", err)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to get number of fans from device; err: %w", err)
+	}
+	if numFans == 0 {
+		return fmt.Errorf("device has no fans: %w", ErrUnsupportedDevice)
+	}
+	fans, _, err := controlledFans(device, selection)
+	if err != nil {
+		return err
+	}
+	for _, i := range fans {
+		if _, err := device.FanSpeed(i); errors.Is(err, ErrUnsupportedDevice) {
+			return fmt.Errorf("device does not report speed of fan %d: %w", i, err)
+		}
+	}
+	return nil
+}
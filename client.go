@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// controlClient talks to control API of a running daemon
+type controlClient struct {
+	httpClient *http.Client
+	baseURL    string
+	// Token sent as bearer token, which is required by control API on TCP address
+	token string
+}
+
+func newControlClient(socketPath string) *controlClient {
+	return &controlClient{
+		// Host is ignored, as connection is always made to control socket
+		baseURL: "http://nvml-fan",
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// newRemoteControlClient returns client of control API listening on TCP address of a remote daemon.
+// HTTPS is used if tlsConfig is not nil.
+func newRemoteControlClient(addr, token string, tlsConfig *tls.Config) *controlClient {
+	scheme := "http"
+	transport := http.DefaultTransport
+	if tlsConfig != nil {
+		scheme = "https"
+		transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	return &controlClient{
+		baseURL:    scheme + "://" + addr,
+		token:      token,
+		httpClient: &http.Client{Timeout: 10 * time.Second, Transport: transport},
+	}
+}
+
+func (c *controlClient) do(method, path string, body any, result any) error {
+	var reqBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("unable to encode request: %w", err)
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, reqBody)
+	if err != nil {
+		return fmt.Errorf("unable to create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to connect to daemon: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("daemon responded with status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	if result != nil {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return fmt.Errorf("unable to decode response: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// controlClientFlags are flags of subcommands, which select the daemon to talk to
+type controlClientFlags struct {
+	socketPath   string
+	controlAddr  string
+	controlToken string
+	controlTLS   bool
+	tlsCA        string
+	tlsCert      string
+	tlsKey       string
+}
+
+func (f *controlClientFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.socketPath, "control-socket", DEFAULT_CONTROL_SOCKET, "Path to control socket of running daemon")
+	flags.StringVar(&f.controlAddr, "control-addr", "", "TCP address of control API of a remote daemon e.g. 192.168.1.10:9101, which is used instead of control socket if set")
+	flags.StringVar(&f.controlToken, "control-token", "", "Token of control API on TCP address")
+	flags.BoolVar(&f.controlTLS, "control-tls", false, "Connect to -control-addr by HTTPS. Implied by -tls-ca and -tls-cert")
+	flags.StringVar(&f.tlsCA, "tls-ca", "", "Path to PEM encoded CA certificates, which verify certificate of remote daemon instead of system roots")
+	flags.StringVar(&f.tlsCert, "tls-cert", "", "Path to PEM encoded TLS client certificate, which is presented to remote daemon")
+	flags.StringVar(&f.tlsKey, "tls-key", "", "Path to PEM encoded private key of -tls-cert")
+}
+
+// client returns client of control socket, or of control API on TCP address if -control-addr is set
+func (f *controlClientFlags) client() (*controlClient, error) {
+	if f.controlAddr == "" {
+		return newControlClient(f.socketPath), nil
+	}
+	var tlsConfig *tls.Config
+	if f.controlTLS || f.tlsCA != "" || f.tlsCert != "" {
+		var err error
+		if tlsConfig, err = newClientTLSConfig(f.tlsCA, f.tlsCert, f.tlsKey); err != nil {
+			return nil, fmt.Errorf("unable to load TLS config: %w", err)
+		}
+	}
+	return newRemoteControlClient(f.controlAddr, f.controlToken, tlsConfig), nil
+}
+
+// runOverrideCommand implements `override` subcommand, which forces a fixed fan speed on running daemon for a period of time
+func runOverrideCommand(args []string) int {
+	var clientFlags controlClientFlags
+	var speed uint
+	var duration time.Duration
+	var cancelOverride bool
+	var fansStr string
+
+	flags := flag.NewFlagSet("override", flag.ExitOnError)
+	clientFlags.register(flags)
+	flags.UintVar(&speed, "speed", 100, "Fan speed in percent to be forced")
+	flags.DurationVar(&duration, "duration", 10*time.Minute, "Time duration of the override, after which the daemon returns to configured fan curve")
+	flags.StringVar(&fansStr, "fans", "", "Comma-separated list of fan indices to be forced e.g. 0,1, while other fans keep following the fan curve. All controlled fans are forced if empty")
+	flags.BoolVar(&cancelOverride, "cancel", false, "Cancel active override and return to configured fan curve immediately")
+	flags.Parse(args)
+
+	client, err := clientFlags.client()
+	if err != nil {
+		slog.Error("unable to configure control client", "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+	if cancelOverride {
+		if err := client.do(http.MethodDelete, "/override", nil, nil); err != nil {
+			slog.Error("unable to cancel override", "err", err)
+			return EXIT_RUNTIME_FAILURE
+		}
+		fmt.Println("Override cancelled")
+		return EXIT_OK
+	}
+
+	if speed > uint(MAX_FAN_SPEED_PERCENT) {
+		slog.Error("speed must not be greater than 100", "speed", speed)
+		return EXIT_CONFIG_ERROR
+	}
+	fans, err := parseFanIndices(fansStr)
+	if err != nil {
+		slog.Error("unable to parse fans flag", "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+	var resp overrideResponse
+	if err := client.do(http.MethodPost, "/override", overrideRequest{Speed: uint8(speed), Duration: duration.String(), Fans: fans}, &resp); err != nil {
+		slog.Error("unable to set override", "err", err)
+		return EXIT_RUNTIME_FAILURE
+	}
+	if len(resp.Fans) > 0 {
+		fmt.Printf("Speed of fans %v is forced to %d%% until %s\n", resp.Fans, resp.Speed, resp.Until.Format(time.DateTime))
+		return EXIT_OK
+	}
+	fmt.Printf("Fan speed is forced to %d%% until %s\n", resp.Speed, resp.Until.Format(time.DateTime))
+
+	return EXIT_OK
+}
+
+// runBoostCommand implements `boost` subcommand, which runs fans of running daemon at full speed for a while
+func runBoostCommand(args []string) int {
+	var clientFlags controlClientFlags
+	var duration time.Duration
+
+	flags := flag.NewFlagSet("boost", flag.ExitOnError)
+	clientFlags.register(flags)
+	flags.DurationVar(&duration, "duration", DEFAULT_BOOST_DURATION, "Time duration at full speed, after which the daemon returns to configured fan curve")
+	flags.Parse(args)
+
+	client, err := clientFlags.client()
+	if err != nil {
+		slog.Error("unable to configure control client", "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+	var resp overrideResponse
+	if err := client.do(http.MethodPost, "/boost", boostRequest{Duration: duration.String()}, &resp); err != nil {
+		slog.Error("unable to boost fans", "err", err)
+		return EXIT_RUNTIME_FAILURE
+	}
+	fmt.Printf("Fans run at full speed until %s\n", resp.Until.Format(time.DateTime))
+	return EXIT_OK
+}
+
+// runPollingCommand implements `polling` subcommand, which prints or changes polling interval of running daemon
+func runPollingCommand(args []string) int {
+	var clientFlags controlClientFlags
+	var interval time.Duration
+	var persist bool
+
+	flags := flag.NewFlagSet("polling", flag.ExitOnError)
+	clientFlags.register(flags)
+	flags.DurationVar(&interval, "interval", 0, "Polling interval of all GPUs e.g. 1s for benchmarking or 10s when idle. Current interval is printed if not set")
+	flags.BoolVar(&persist, "persist", false, "Write the interval to config file of the daemon, so that it is kept after restart")
+	flags.Parse(args)
+
+	client, err := clientFlags.client()
+	if err != nil {
+		slog.Error("unable to configure control client", "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+	var resp pollingResponse
+	if interval == 0 {
+		if err := client.do(http.MethodGet, "/polling", nil, &resp); err != nil {
+			slog.Error("unable to get polling interval", "err", err)
+			return EXIT_RUNTIME_FAILURE
+		}
+		if resp.Interval == "" {
+			fmt.Println("Polling interval is not changed at runtime, each GPU uses its configured interval")
+			return EXIT_OK
+		}
+		fmt.Printf("Polling interval is %s\n", resp.Interval)
+		return EXIT_OK
+	}
+
+	if err := client.do(http.MethodPut, "/polling", pollingRequest{Interval: interval.String(), Persist: persist}, &resp); err != nil {
+		slog.Error("unable to change polling interval", "err", err)
+		return EXIT_RUNTIME_FAILURE
+	}
+	if resp.Persisted {
+		fmt.Printf("Polling interval is changed to %s, and saved to config file\n", resp.Interval)
+		return EXIT_OK
+	}
+	fmt.Printf("Polling interval is changed to %s\n", resp.Interval)
+	return EXIT_OK
+}
+
+// runStatusCommand implements `status` subcommand, which prints current state of running daemon.
+// It fails if no daemon is running, so that it can be used in scripts.
+func runStatusCommand(args []string) int {
+	var clientFlags controlClientFlags
+	var printJSON bool
+	var watch bool
+	var watchInterval time.Duration
+
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	clientFlags.register(flags)
+	flags.BoolVar(&printJSON, "json", false, "Print status as JSON, as responded by GET /status of control API")
+	flags.BoolVar(&watch, "watch", false, "Redraw a compact table of all GPUs in place every -watch-interval until Ctrl+C is pressed")
+	flags.DurationVar(&watchInterval, "watch-interval", 2*time.Second, "Time duration between each redraw of -watch")
+	flags.Parse(args)
+	if watch && (printJSON || watchInterval <= 0) {
+		slog.Error("-watch requires a positive -watch-interval, and cannot be combined with -json", "watchInterval", watchInterval)
+		return EXIT_CONFIG_ERROR
+	}
+
+	client, err := clientFlags.client()
+	if err != nil {
+		slog.Error("unable to configure control client", "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+	if watch {
+		return runStatusWatch(client, watchInterval)
+	}
+	var resp statusResponse
+	if err := client.do(http.MethodGet, "/status", nil, &resp); err != nil {
+		slog.Error("unable to get status, make sure the daemon is running", "err", err)
+		return EXIT_RUNTIME_FAILURE
+	}
+	if printJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(resp); err != nil {
+			slog.Error("unable to encode status", "err", err)
+			return EXIT_RUNTIME_FAILURE
+		}
+		return EXIT_OK
+	}
+
+	now := time.Now()
+	for _, d := range resp.Devices {
+		fmt.Printf("GPU %d: %s (%s)\n", d.GPUIndex, d.GPUName, d.GPUUUID)
+		fmt.Printf("  Uptime:      %s\n", now.Sub(d.StartedAt).Round(time.Second))
+		if d.MemoryTemperature > 0 {
+			fmt.Printf("  Temperature: %d°C, memory %d°C\n", d.Temperature, d.MemoryTemperature)
+		} else {
+			fmt.Printf("  Temperature: %d°C\n", d.Temperature)
+		}
+		if d.OverrideUntil != nil && len(d.OverrideFans) > 0 {
+			fmt.Printf("  Mode:        %s of fans %v until %s\n", d.Mode, d.OverrideFans, d.OverrideUntil.Local().Format(time.DateTime))
+		} else if d.OverrideUntil != nil {
+			fmt.Printf("  Mode:        %s until %s\n", d.Mode, d.OverrideUntil.Local().Format(time.DateTime))
+		} else {
+			fmt.Printf("  Mode:        %s\n", d.Mode)
+		}
+		fmt.Printf("  Curve:       %s\n", d.Curve)
+		for _, fan := range d.Fans {
+			actual := "unknown"
+			if fan.Actual != nil {
+				actual = fmt.Sprintf("%d%%", *fan.Actual)
+			}
+			fmt.Printf("  Fan %d:       target %d%%, actual %s\n", fan.Index, fan.Target, actual)
+			if fan.Wear != nil {
+				fmt.Printf("               wear %.0fh, %.0fh at full speed equivalent, %.0fh above 80%%\n", fan.Wear.Hours, fan.Wear.DutyHours, fan.Wear.HoursAbove[80])
+			}
+		}
+	}
+	return EXIT_OK
+}
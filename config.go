@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Config file is a JSON object, whose keys are flag names without leading dash, e.g.
+//
+//	{"speeds": "35:40,40:50,50:60,60:90,80:100", "max-speed": 80, "dry-run": true}
+//
+// so that every flag can be set in config file, while environment variables and flags given on command line take precedence.
+// Flags can also be put in "defaults" section, and settings of a device in "devices" section
+// keyed by device index or UUID override them, e.g.
+//
+//	{"defaults": {"max-speed": 80}, "devices": {"1": {"max-speed": 100}}}
+
+// Flags which can be overridden per device in "devices" section of config file
+var DEVICE_CONFIG_KEYS = map[string]bool{
+	"speeds":               true,
+	"preset":               true,
+	"polling-duration":     true,
+	"min-speed":            true,
+	"max-speed":            true,
+	"speed-step":           true,
+	"failsafe-temp":        true,
+	"temp-offset":          true,
+	"spike-threshold":      true,
+	"median-samples":       true,
+	"takeover-temp":        true,
+	"target-temp":          true,
+	"fallback-speed-above": true,
+	"fallback-speed-below": true,
+	"write-interval":       true,
+	"fans":                 true,
+	"auto-fans":            true,
+	"fan-offsets":          true,
+	"power-limit":          true,
+	"locked-clocks":        true,
+}
+
+// fileConfig is content of config file
+type fileConfig struct {
+	// Flag values, including ones in "defaults" section
+	values map[string]string
+	// Flag values of each device, keyed by device index or UUID
+	devices map[string]map[string]string
+}
+
+func decodeConfigValue(key string, value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		return "", fmt.Errorf("value of config %q must be a string, number or boolean", key)
+	}
+}
+
+func decodeConfigSection(section string, raw any) (map[string]any, error) {
+	values, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("config %q must be an object", section)
+	}
+	return values, nil
+}
+
+func loadConfigFile(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %w", err)
+	}
+	return parseConfigFile(data)
+}
+
+// parseConfigFile parses content of config file. Keys are not checked against flags, which is done when applied.
+func parseConfigFile(data []byte) (*fileConfig, error) {
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("unable to decode config file: %w", err)
+	}
+
+	config := &fileConfig{values: make(map[string]string, len(raw)), devices: make(map[string]map[string]string)}
+	var err error
+	for key, value := range raw {
+		switch key {
+		case "defaults":
+			defaults, err := decodeConfigSection(key, value)
+			if err != nil {
+				return nil, err
+			}
+			for defaultKey, defaultValue := range defaults {
+				// -devices flag can only be set in defaults, as "devices" at top level is the section of per device settings
+				if _, ok := raw[defaultKey]; ok && defaultKey != "devices" {
+					return nil, fmt.Errorf("config %q is set both in defaults and at top level", defaultKey)
+				}
+				if config.values[defaultKey], err = decodeConfigValue(defaultKey, defaultValue); err != nil {
+					return nil, err
+				}
+			}
+		case "devices":
+			devices, err := decodeConfigSection(key, value)
+			if err != nil {
+				return nil, err
+			}
+			for device, deviceRaw := range devices {
+				deviceValues, err := decodeConfigSection("devices."+device, deviceRaw)
+				if err != nil {
+					return nil, err
+				}
+				config.devices[device] = make(map[string]string, len(deviceValues))
+				for deviceKey, deviceValue := range deviceValues {
+					if !DEVICE_CONFIG_KEYS[deviceKey] {
+						return nil, fmt.Errorf("config %q cannot be set per device %s", deviceKey, device)
+					}
+					if config.devices[device][deviceKey], err = decodeConfigValue(deviceKey, deviceValue); err != nil {
+						return nil, err
+					}
+				}
+			}
+		default:
+			if config.values[key], err = decodeConfigValue(key, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if config.values["preset"] != "" && config.values["speeds"] != "" {
+		return nil, fmt.Errorf("config \"preset\" cannot be combined with \"speeds\"")
+	}
+	return config, nil
+}
+
+// applyConfigValues sets flags from config values, except ones which are already set on command line or by environment
+func applyConfigValues(flags *flag.FlagSet, values map[string]string) error {
+	setOnCommandLine := setFlags(flags)
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == "config" || flags.Lookup(key) == nil {
+			return fmt.Errorf("unknown config %q", key)
+		}
+		if setOnCommandLine[key] {
+			continue
+		}
+		if err := flags.Set(key, values[key]); err != nil {
+			return fmt.Errorf("invalid value of config %q: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// applyConfigFile loads config file into flags. Missing config file is ignored, unless it is explicitly given on command line.
+// Per device settings are returned, except ones which are set on command line or by environment, as both take precedence
+// over config file.
+func applyConfigFile(flags *flag.FlagSet, path string) (map[string]map[string]string, error) {
+	setOnCommandLine := setFlags(flags)
+
+	config, err := loadConfigFile(path)
+	if err != nil {
+		if !setOnCommandLine["config"] && errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err := applyConfigValues(flags, config.values); err != nil {
+		return nil, err
+	}
+
+	for _, values := range config.devices {
+		for key := range values {
+			if overriddenByFlags(key, setOnCommandLine) {
+				delete(values, key)
+			}
+		}
+	}
+	return config.devices, nil
+}
+
+// SETTING_GROUPS lists flags which set the same thing in different ways, so that setting any of them on command line
+// overrides all of them in per device sections, e.g. -preset overrides speeds of a device
+var SETTING_GROUPS = [][]string{
+	{"speeds", "preset", "speed-formula", "rpm-speeds"},
+}
+
+// overriddenByFlags tells whether per device setting of the key is overridden by flags set on command line or by
+// environment, which are either the same flag or another flag of its group
+func overriddenByFlags(key string, set map[string]bool) bool {
+	if set[key] {
+		return true
+	}
+	for _, group := range SETTING_GROUPS {
+		if !slices.Contains(group, key) {
+			continue
+		}
+		for _, name := range group {
+			if set[name] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Prefix of environment variables which set flags, e.g. NVFC_SPEEDS sets -speeds
+const ENV_PREFIX = "NVFC_"
+
+// envName returns name of environment variable of the flag, e.g. NVFC_DEVICE_INDEX for -device-index
+func envName(flagName string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnvironment sets flags from environment variables, except ones which are already set on command line.
+// It must be called before applyConfigFile, so that environment takes precedence over config file, see loadSettings.
+func applyEnvironment(flags *flag.FlagSet, lookupEnv func(string) (string, bool)) error {
+	setOnCommandLine := setFlags(flags)
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || setOnCommandLine[f.Name] {
+			return
+		}
+		name := envName(f.Name)
+		value, ok := lookupEnv(name)
+		if !ok {
+			return
+		}
+		if setErr := flags.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value of environment variable %s: %w", name, setErr)
+		}
+	})
+	return err
+}
+
+// Sources of flag values, from the lowest to the highest precedence
+const (
+	SETTING_SOURCE_DEFAULT      = "default"
+	SETTING_SOURCE_CONFIG_FILE  = "config file"
+	SETTING_SOURCE_ENVIRONMENT  = "environment"
+	SETTING_SOURCE_COMMAND_LINE = "command line"
+)
+
+// Flags whose values are credentials, which are never logged
+var SECRET_FLAGS = map[string]bool{
+	"control-token":         true,
+	"alert-webhook":         true,
+	"alert-discord-webhook": true,
+	"alert-telegram-token":  true,
+	"alert-smtp-password":   true,
+	"ipmi-args":             true,
+}
+
+// setFlags returns names of flags which have been set
+func setFlags(flags *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// loadSettings applies environment variables and config file to flags parsed from command line,
+// with precedence default < config file < environment < command line. Config file is given by -config flag,
+// which may itself be set by environment. Per device settings of config file and source of each flag are returned.
+func loadSettings(flags *flag.FlagSet, lookupEnv func(string) (string, bool)) (map[string]map[string]string, map[string]string, error) {
+	commandLine := setFlags(flags)
+	if err := applyEnvironment(flags, lookupEnv); err != nil {
+		return nil, nil, err
+	}
+	environment := setFlags(flags)
+	deviceConfigs, err := applyConfigFile(flags, flags.Lookup("config").Value.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	configFile := setFlags(flags)
+
+	sources := make(map[string]string)
+	flags.VisitAll(func(f *flag.Flag) {
+		switch {
+		case commandLine[f.Name]:
+			sources[f.Name] = SETTING_SOURCE_COMMAND_LINE
+		case environment[f.Name]:
+			sources[f.Name] = SETTING_SOURCE_ENVIRONMENT
+		case configFile[f.Name]:
+			sources[f.Name] = SETTING_SOURCE_CONFIG_FILE
+		default:
+			sources[f.Name] = SETTING_SOURCE_DEFAULT
+		}
+	})
+	return deviceConfigs, sources, nil
+}
+
+// logSettings logs value and source of each flag which is not left at default, so that it is clear
+// which of layered config file, environment and command line a setting comes from
+func logSettings(flags *flag.FlagSet, sources map[string]string) {
+	flags.VisitAll(func(f *flag.Flag) {
+		if sources[f.Name] == SETTING_SOURCE_DEFAULT {
+			return
+		}
+		value := f.Value.String()
+		if SECRET_FLAGS[f.Name] && value != "" {
+			value = "<redacted>"
+		}
+		slog.Debug("Setting", "name", f.Name, "value", value, "source", sources[f.Name])
+	})
+}
+
+// deviceConfigValues returns per device settings of the device, which are matched by either device index or UUID
+func deviceConfigValues(devices map[string]map[string]string, index int, uuid string) (map[string]string, error) {
+	byIndex, byUUID := devices[strconv.Itoa(index)], devices[uuid]
+	if byIndex != nil && byUUID != nil {
+		return nil, fmt.Errorf("device %d is configured both by index and by UUID %s", index, uuid)
+	}
+	if byIndex != nil {
+		return byIndex, nil
+	}
+	return byUUID, nil
+}
+
+// writeConfigFile writes config values into a JSON file, in the same format as loaded by loadConfigFile.
+// Values which loadConfigFile would reject are not written, so that the next startup does not fail.
+func writeConfigFile(path string, values map[string]any) error {
+	data, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode config: %w", err)
+	}
+	if _, err := parseConfigFile(data); err != nil {
+		return fmt.Errorf("config would not be loadable: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("unable to create config directory: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("unable to write config file: %w", err)
+	}
+	return nil
+}
+
+// updateConfigFile sets a value in config file, while keeping other values. Config file is created if it does not exist.
+// The value is set in "defaults" section if the key is already there, as a key must not be set in both, and "preset"
+// is removed when "speeds" is set, as a curve replaces the preset.
+func updateConfigFile(path string, key string, value any) error {
+	values := make(map[string]any)
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to read config file: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &values); err != nil {
+			return fmt.Errorf("unable to decode config file: %w", err)
+		}
+	}
+	defaults, _ := values["defaults"].(map[string]any)
+	if _, ok := defaults[key]; ok {
+		defaults[key] = value
+	} else {
+		values[key] = value
+	}
+	if key == "speeds" {
+		delete(values, "preset")
+		delete(defaults, "preset")
+	}
+	return writeConfigFile(path, values)
+}
+
+// Formats of exported settings
+const (
+	EXPORT_FORMAT_JSON = "json"
+	EXPORT_FORMAT_ENV  = "env"
+)
+
+// Flags whose values are fan curves of temperature:speed pairs, which are normalized on export
+var CURVE_FLAGS = map[string]bool{
+	"speeds":             true,
+	"memory-speeds":      true,
+	"temp-source-speeds": true,
+	"hwmon-speeds":       true,
+	"cooler-speeds":      true,
+	"ipmi-speeds":        true,
+}
+
+// configExportOptions are options of "config export" subcommand, which makes run print resolved settings instead of
+// controlling fans
+type configExportOptions struct {
+	format  string
+	secrets bool
+}
+
+// exportValue returns value of the flag as it is written to config file. Curves are normalized, so that the value
+// matches the curve in effect.
+func exportValue(f *flag.Flag) (any, error) {
+	if CURVE_FLAGS[f.Name] && f.Value.String() != "" {
+		curve, err := parseSpeedConfigFlag(f.Value.String())
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %w", f.Name, err)
+		}
+		return formatSpeedConfig(curve), nil
+	}
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return f.Value.String(), nil
+	}
+	switch value := getter.Get().(type) {
+	case bool, int, uint, float64, string:
+		return value, nil
+	default:
+		// Durations are written as e.g. 5s, which is parsed back by the flag
+		return f.Value.String(), nil
+	}
+}
+
+// exportSettings writes every flag except -config, together with per device settings, in the given format.
+// JSON is loadable as config file, and env is loadable as environment variables e.g. by systemd EnvironmentFile=,
+// which cannot express per device settings. Only the curve in effect is written: -preset if it is set, otherwise
+// -speeds if it is set, otherwise neither, so that the default curve is still chosen per GPU model when loaded.
+func exportSettings(w io.Writer, flags *flag.FlagSet, deviceConfigs map[string]map[string]string, options configExportOptions) error {
+	set := setFlags(flags)
+	values := make(map[string]any)
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		// Credentials are left out unless secrets are exported, so that the export does not load as if they were unset
+		if err != nil || f.Name == "config" || (SECRET_FLAGS[f.Name] && !options.secrets && f.Value.String() != "") {
+			return
+		}
+		values[f.Name], err = exportValue(f)
+	})
+	if err != nil {
+		return err
+	}
+	if values["preset"] != "" || !set["speeds"] {
+		delete(values, "speeds")
+	}
+	if values["preset"] == "" {
+		delete(values, "preset")
+	}
+
+	switch options.format {
+	case EXPORT_FORMAT_JSON:
+		// Flags are written in "defaults" section, as -devices flag would be mistaken for "devices" section at top level
+		exported := map[string]any{"defaults": values}
+		if len(deviceConfigs) > 0 {
+			devices := make(map[string]map[string]string, len(deviceConfigs))
+			for device, deviceValues := range deviceConfigs {
+				devices[device] = make(map[string]string, len(deviceValues))
+				for key, value := range deviceValues {
+					if CURVE_FLAGS[key] {
+						curve, err := parseSpeedConfigFlag(value)
+						if err != nil {
+							return fmt.Errorf("unable to parse %s of device %s: %w", key, device, err)
+						}
+						value = formatSpeedConfig(curve)
+					}
+					devices[device][key] = value
+				}
+			}
+			exported["devices"] = devices
+		}
+		var data bytes.Buffer
+		encoder := json.NewEncoder(&data)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(exported); err != nil {
+			return fmt.Errorf("unable to encode settings: %w", err)
+		}
+		// Exported settings are loaded back, so that a snapshot which cannot be used by -config is never printed
+		if _, err := parseConfigFile(data.Bytes()); err != nil {
+			return fmt.Errorf("exported settings cannot be loaded back: %w", err)
+		}
+		_, err = w.Write(data.Bytes())
+		return err
+	case EXPORT_FORMAT_ENV:
+		if len(deviceConfigs) > 0 {
+			slog.Warn("Per device settings cannot be exported as environment variables, and are omitted", "devices", len(deviceConfigs))
+		}
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if _, err := fmt.Fprintf(w, "%s=%s\n", envName(name), quoteEnvValue(fmt.Sprint(values[name]))); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown export format %q, it must be %s or %s", options.format, EXPORT_FORMAT_JSON, EXPORT_FORMAT_ENV)
+	}
+}
+
+// quoteEnvValue double quotes the value if it contains characters which are special to shell or systemd
+func quoteEnvValue(value string) string {
+	if !strings.ContainsAny(value, " \t\n\"'\\$`#;&|<>()*?") {
+		return value
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`", "\n", `\n`)
+	return `"` + replacer.Replace(value) + `"`
+}
+
+// runConfigCommand handles "config export", which runs the daemon up to settings validation, then prints
+// resolved settings. Flags of the daemon are given after --, e.g. config export -format env -- -speeds 40:30,80:100
+func runConfigCommand(args []string) int {
+	if len(args) == 0 || args[0] != "export" {
+		fmt.Fprintf(os.Stderr, "Usage: %s config export [-format json|env] [-secrets] [-- flags]\n", os.Args[0])
+		return EXIT_CONFIG_ERROR
+	}
+	options := configExportOptions{}
+	flags := flag.NewFlagSet("config export", flag.ExitOnError)
+	flags.StringVar(&options.format, "format", EXPORT_FORMAT_JSON, "Format of exported settings: json or env")
+	flags.BoolVar(&options.secrets, "secrets", false, "Export credentials e.g. -control-token, which are left out otherwise")
+	flags.Parse(args[1:])
+	if options.format != EXPORT_FORMAT_JSON && options.format != EXPORT_FORMAT_ENV {
+		slog.Error("unknown export format", "format", options.format)
+		return EXIT_CONFIG_ERROR
+	}
+
+	return run(context.Background(), runOptions{args: flags.Args(), export: &options})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// processInfo is a running process, as listed by listProcesses
+type processInfo struct {
+	pid int
+	// Names by which the process is known, e.g. its command name and base name of its executable
+	names []string
+	// Command line arguments, which are not available on all platforms
+	args []string
+}
+
+// conflictingProgram is other fan control program, which fights over fan control policy when running together
+type conflictingProgram struct {
+	name string
+	// Process names, which are compared case-insensitively
+	processes []string
+}
+
+var CONFLICTING_PROGRAMS = []conflictingProgram{
+	{name: "GreenWithEnvy", processes: []string{"gwe"}},
+	{name: "CoolerControl", processes: []string{"coolercontrold", "coolercontrol"}},
+	{name: "nvfancontrol", processes: []string{"nvfancontrol"}},
+	{name: "MSI Afterburner", processes: []string{"MSIAfterburner.exe"}},
+	{name: "EVGA Precision X1", processes: []string{"PrecisionX_x64.exe"}},
+	{name: "Fan Control", processes: []string{"FanControl.exe"}},
+}
+
+// Subcommands of this program, which run next to the daemon without controlling fans
+var CLIENT_SUBCOMMANDS = []string{"override", "boost", "status", "polling", "init", "import", "config", "simulate"}
+
+// detectConflicts returns descriptions of running processes which may fight over fan control, including other
+// instances of this program. Process of this program has selfPID, and its executable is named selfName.
+func detectConflicts(processes []processInfo, selfPID int, selfName string) []string {
+	var conflicts []string
+	for _, process := range processes {
+		if process.pid == selfPID {
+			continue
+		}
+		for _, program := range CONFLICTING_PROGRAMS {
+			if matchProcessName(process, program.processes...) {
+				conflicts = append(conflicts, fmt.Sprintf("%s (pid %d)", program.name, process.pid))
+				break
+			}
+		}
+		if selfName != "" && matchProcessName(process, selfName) {
+			if len(process.args) > 1 && slices.Contains(CLIENT_SUBCOMMANDS, process.args[1]) {
+				continue
+			}
+			conflicts = append(conflicts, fmt.Sprintf("another instance of %s (pid %d)", selfName, process.pid))
+		}
+	}
+	return conflicts
+}
+
+func matchProcessName(process processInfo, names ...string) bool {
+	for _, processName := range process.names {
+		for _, name := range names {
+			if strings.EqualFold(processName, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findConflictingPrograms lists running processes, and returns descriptions of ones which may fight over fan control
+func findConflictingPrograms() ([]string, error) {
+	processes, err := listProcesses()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list processes: %w", err)
+	}
+	selfName := ""
+	if executable, err := os.Executable(); err == nil {
+		selfName = filepath.Base(executable)
+	}
+	return detectConflicts(processes, os.Getpid(), selfName), nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// coolerOutput is a cooler outside GPU e.g. case fan, which follows GPU temperature
+type coolerOutput interface {
+	name() string
+	// setSpeed sets speed of the cooler in percent
+	setSpeed(speed uint8) error
+	// restore returns the cooler to the control it was under before this process started
+	restore() error
+}
+
+// externalCooler drives a cooler output by its own curve of GPU temperature
+type externalCooler struct {
+	output   coolerOutput
+	speedMap map[uint8]uint8
+}
+
+// runExternalCoolers sets speed of coolers from the hottest controlled GPU periodically until ctx is done.
+// Speed is computed by the curve of each cooler, then -min-speed, -max-speed and failsafe apply as for GPU fans.
+func runExternalCoolers(ctx context.Context, coolers []externalCooler, config controlConfig, devices []*controlledDevice) {
+	limiter := newLogLimiter(config.logRepeatInterval, nil)
+	ticker := time.NewTicker(config.pollingDuration)
+	defer ticker.Stop()
+	lastSpeeds := make(map[int]uint8, len(coolers))
+	for {
+		select {
+		case <-ticker.C:
+			temperature, polled := uint32(0), false
+			for _, d := range devices {
+				m := d.state.metrics()
+				if m.polledAt.IsZero() {
+					continue
+				}
+				temperature, polled = max(temperature, applyTempOffset(m.temperature, d.config.tempOffset)), true
+			}
+			if !polled {
+				continue
+			}
+			for i, cooler := range coolers {
+				speed, ok := lookupFanSpeed(cooler.speedMap, temperature, config)
+				speed, failsafe := limitFanSpeed(speed, temperature, config)
+				if !ok && !failsafe {
+					limiter.Warn("cannot find proper cooler speed for given temperature, ignore updating cooler speed at this time", "cooler", cooler.output.name(), "temperature", temperature)
+					continue
+				}
+				if last, ok := lastSpeeds[i]; ok && last == speed {
+					continue
+				}
+				if config.dryrun {
+					slog.Info("(Dryrun) set cooler speed", "cooler", cooler.output.name(), "speed", speed, "temperature", temperature)
+					lastSpeeds[i] = speed
+					continue
+				}
+				if err := cooler.output.setSpeed(speed); err != nil {
+					limiter.Warn("Unable to set cooler speed", "cooler", cooler.output.name(), "speed", speed, "err", err)
+					continue
+				}
+				lastSpeeds[i] = speed
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
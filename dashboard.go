@@ -0,0 +1,8 @@
+package main
+
+import _ "embed"
+
+// dashboardHTML is the dashboard page with curve editor, which calls control API from browser
+//
+//go:embed dashboard.html
+var dashboardHTML []byte
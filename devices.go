@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SUPERVISOR_MIN_BACKOFF = time.Second
+	SUPERVISOR_MAX_BACKOFF = time.Minute
+	// Backoff is reset once the control loop has run longer than this duration without failure
+	SUPERVISOR_STABLE_DURATION = 5 * time.Minute
+)
+
+// controlledDevice holds everything needed to control fans of one GPU device
+type controlledDevice struct {
+	index  int
+	labels deviceLabels
+	logger *slog.Logger
+	handle *deviceHandle
+	state  *controllerState
+	// Config of control loop, with per device settings of config file applied
+	config controlConfig
+	// Recent samples of the device, nil if history is disabled
+	history     *telemetryHistory
+	togglePause chan struct{}
+	applyNow    chan struct{}
+	// Sleep and resume announced by logind
+	prepareSleep chan sleepEvent
+}
+
+func newControlledDevice(index int, handle *deviceHandle, state *controllerState) *controlledDevice {
+	labels := newDeviceLabels(index, handle.get())
+	return &controlledDevice{
+		index:        index,
+		labels:       labels,
+		logger:       labels.logger(),
+		handle:       handle,
+		state:        state,
+		togglePause:  make(chan struct{}, 1),
+		applyNow:     make(chan struct{}, 1),
+		prepareSleep: make(chan sleepEvent, 1),
+	}
+}
+
+// enablePersistenceMode keeps driver loaded while no client uses the device. On headless machines, driver is otherwise
+// unloaded between polls, which makes NVML calls slow and resets fan policy. It returns a function which restores
+// persistence mode of the device as it was before.
+func enablePersistenceMode(logger *slog.Logger, handle *deviceHandle, dryrun bool) func() {
+	enabled, err := handle.get().PersistenceMode()
+	if err != nil {
+		logger.Warn("Unable to get persistence mode", "err", err)
+		return func() {}
+	}
+	if enabled {
+		logger.Info("Persistence mode is already enabled")
+		return func() {}
+	}
+	if dryrun {
+		logger.Info("(Dryrun) Enable persistence mode")
+		return func() {}
+	}
+	if err := handle.get().SetPersistenceMode(true); err != nil {
+		logger.Warn("Unable to enable persistence mode", "err", err)
+		return func() {}
+	}
+	logger.Info("Persistence mode enabled")
+	return func() {
+		// Device may have been reopened e.g. after resume
+		if err := handle.get().SetPersistenceMode(false); err != nil {
+			logger.Warn("Unable to restore persistence mode", "err", err)
+			return
+		}
+		logger.Info("Persistence mode restored to disabled")
+	}
+}
+
+// applyPowerLimit sets power limit of the device in watts, so that heat output is reduced together with fan speed.
+// It returns a function which restores power limit of the device as it was before.
+func applyPowerLimit(logger *slog.Logger, handle *deviceHandle, watts uint, dryrun bool) (func(), error) {
+	device := handle.get()
+	previous, err := device.PowerLimit()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get power limit: %w", err)
+	}
+	minLimit, maxLimit, err := device.PowerLimitConstraints()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get power limit range: %w", err)
+	}
+	// Watts are checked against the maximum before converting to milliwatts, so that a huge -power-limit cannot wrap
+	// around into the range
+	if watts > uint(maxLimit/1000) || uint32(watts*1000) < minLimit {
+		return nil, fmt.Errorf("power limit %dW is out of range of the device, which is %dW to %dW", watts, minLimit/1000, maxLimit/1000)
+	}
+	limit := uint32(watts * 1000)
+	if dryrun {
+		logger.Info("(Dryrun) Set power limit", "watts", watts, "previousWatts", previous/1000)
+		return func() {}, nil
+	}
+	if limit == previous {
+		return func() {}, nil
+	}
+	if err := device.SetPowerLimit(limit); err != nil {
+		return nil, fmt.Errorf("unable to set power limit: %w", err)
+	}
+	logger.Info("Power limit set", "watts", watts, "previousWatts", previous/1000)
+	return func() {
+		// Device may have been reopened e.g. after resume
+		if err := handle.get().SetPowerLimit(previous); err != nil {
+			logger.Warn("Unable to restore power limit", "watts", previous/1000, "err", err)
+			return
+		}
+		logger.Info("Power limit restored", "watts", previous/1000)
+	}, nil
+}
+
+// parseLockedClocks parses range of locked GPU clock in MHz e.g. 300:1800. Empty string means unlocked, which is returned as zeros.
+func parseLockedClocks(clocksStr string) (uint32, uint32, error) {
+	if clocksStr == "" {
+		return 0, 0, nil
+	}
+	minStr, maxStr, found := strings.Cut(clocksStr, ":")
+	if !found {
+		return 0, 0, fmt.Errorf("locked clocks %q must be in format minMHz:maxMHz", clocksStr)
+	}
+	minMHz, err := strconv.ParseUint(strings.TrimSpace(minStr), 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to parse min clock %q: %w", minStr, err)
+	}
+	maxMHz, err := strconv.ParseUint(strings.TrimSpace(maxStr), 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to parse max clock %q: %w", maxStr, err)
+	}
+	if minMHz == 0 || minMHz > maxMHz {
+		return 0, 0, fmt.Errorf("min clock must be positive and not greater than max clock")
+	}
+	return uint32(minMHz), uint32(maxMHz), nil
+}
+
+// applyLockedClocks locks GPU clock within the range in MHz, so that clocks and thermals are managed together.
+// It returns a function which resets GPU clock to driver default range.
+func applyLockedClocks(logger *slog.Logger, handle *deviceHandle, minMHz, maxMHz uint32, dryrun bool) (func(), error) {
+	if dryrun {
+		logger.Info("(Dryrun) Lock GPU clocks", "minMHz", minMHz, "maxMHz", maxMHz)
+		return func() {}, nil
+	}
+	if err := handle.get().SetLockedClocks(minMHz, maxMHz); err != nil {
+		return nil, fmt.Errorf("unable to lock GPU clocks: %w", err)
+	}
+	logger.Info("GPU clocks locked", "minMHz", minMHz, "maxMHz", maxMHz)
+	return func() {
+		// Device may have been reopened e.g. after resume
+		if err := handle.get().ResetLockedClocks(); err != nil {
+			logger.Warn("Unable to reset locked GPU clocks", "err", err)
+			return
+		}
+		logger.Info("GPU clocks reset to driver default")
+	}, nil
+}
+
+// controlValues are values of settings, which are set both by flags and per device, before they are narrowed into
+// controlConfig. They are validated the same way in both places, so that per device settings cannot bypass checks.
+type controlValues struct {
+	pollingDuration time.Duration
+	// Bounds of adaptive polling, which polling duration must be within. Zero means adaptive polling is disabled
+	pollingFastDuration time.Duration
+	pollingSlowDuration time.Duration
+	minSpeed            uint
+	maxSpeed            uint
+	speedStep           uint
+	fallbackSpeedAbove  uint
+	fallbackSpeedBelow  uint
+	failsafeTemp        uint
+	takeoverTemp        uint
+	targetTemp          uint
+	spikeThreshold      uint
+	tempOffset          int
+	medianSamples       uint
+	writeInterval       time.Duration
+	// Target temperature cannot be combined with these, which also compute fan speed
+	rpmCurve bool
+	formula  bool
+}
+
+func (v controlValues) validate() error {
+	switch {
+	case v.pollingDuration <= 0:
+		return errors.New("polling duration must be positive")
+	case v.pollingFastDuration > 0 && (v.pollingFastDuration > v.pollingDuration || v.pollingSlowDuration < v.pollingDuration):
+		return fmt.Errorf("adaptive polling durations must satisfy 0 < fast <= polling <= slow, got %s <= %s <= %s", v.pollingFastDuration, v.pollingDuration, v.pollingSlowDuration)
+	case v.maxSpeed > uint(MAX_FAN_SPEED_PERCENT) || v.speedStep > uint(MAX_FAN_SPEED_PERCENT) || v.fallbackSpeedAbove > uint(MAX_FAN_SPEED_PERCENT) || v.fallbackSpeedBelow > uint(MAX_FAN_SPEED_PERCENT):
+		return fmt.Errorf("fan speeds must not be greater than %d", MAX_FAN_SPEED_PERCENT)
+	case v.minSpeed > v.maxSpeed:
+		return fmt.Errorf("min speed %d must not be greater than max speed %d", v.minSpeed, v.maxSpeed)
+	case v.failsafeTemp > uint(MAX_TEMP) || v.takeoverTemp > uint(MAX_TEMP) || v.targetTemp > uint(MAX_TEMP) || v.spikeThreshold > uint(MAX_TEMP):
+		return fmt.Errorf("temperatures must not be greater than %d", MAX_TEMP)
+	case v.tempOffset < -MAX_TEMP_OFFSET || v.tempOffset > MAX_TEMP_OFFSET:
+		return fmt.Errorf("temperature offset must be between %d and %d", -MAX_TEMP_OFFSET, MAX_TEMP_OFFSET)
+	case v.medianSamples > MAX_MEDIAN_SAMPLES:
+		return fmt.Errorf("median samples must not be greater than %d", MAX_MEDIAN_SAMPLES)
+	case v.writeInterval < 0:
+		return errors.New("write interval must not be negative")
+	case v.targetTemp > 0 && (v.rpmCurve || v.formula):
+		return errors.New("target temperature cannot be used together with RPM-target mode or fan speed formula")
+	}
+	return nil
+}
+
+// applyDeviceOverrides applies per device settings of config file, which are flag values of DEVICE_CONFIG_KEYS,
+// to config and curve shared by all devices. Polling duration of the device must be within fast and slow durations
+// of adaptive polling, unless both are 0.
+func applyDeviceOverrides(config controlConfig, curve [][2]uint8, values map[string]string, pollingFastDuration, pollingSlowDuration time.Duration) (controlConfig, [][2]uint8, error) {
+	if len(values) == 0 {
+		return config, curve, nil
+	}
+	flags := flag.NewFlagSet("device", flag.ContinueOnError)
+	speeds := flags.String("speeds", "", "")
+	preset := flags.String("preset", "", "")
+	pollingDuration := flags.Duration("polling-duration", config.pollingDuration, "")
+	minSpeed := flags.Uint("min-speed", uint(config.minSpeed), "")
+	maxSpeed := flags.Uint("max-speed", uint(config.maxSpeed), "")
+	speedStep := flags.Uint("speed-step", uint(config.speedStep), "")
+	failsafeTemp := flags.Uint("failsafe-temp", uint(config.failsafeTemp), "")
+	tempOffset := flags.Int("temp-offset", config.tempOffset, "")
+	spikeThreshold := flags.Uint("spike-threshold", uint(config.spikeThreshold), "")
+	medianSamples := flags.Uint("median-samples", config.medianSamples, "")
+	takeoverTemp := flags.Uint("takeover-temp", uint(config.takeoverTemp), "")
+	targetTemp := flags.Uint("target-temp", uint(config.targetTemp), "")
+	fallbackSpeedAbove := flags.Uint("fallback-speed-above", uint(config.fallbackSpeedAbove), "")
+	fallbackSpeedBelow := flags.Uint("fallback-speed-below", uint(config.fallbackSpeedBelow), "")
+	writeInterval := flags.Duration("write-interval", config.writeInterval, "")
+	fansStr := flags.String("fans", "", "")
+	autoFansStr := flags.String("auto-fans", "", "")
+	fanOffsetsStr := flags.String("fan-offsets", "", "")
+	powerLimit := flags.Uint("power-limit", config.powerLimit, "")
+	lockedClocks := flags.String("locked-clocks", "", "")
+	for key, value := range values {
+		if err := flags.Set(key, value); err != nil {
+			return config, curve, fmt.Errorf("invalid value of config %q: %w", key, err)
+		}
+	}
+
+	deviceValues := controlValues{
+		pollingDuration:     *pollingDuration,
+		pollingFastDuration: pollingFastDuration,
+		pollingSlowDuration: pollingSlowDuration,
+		minSpeed:            *minSpeed,
+		maxSpeed:            *maxSpeed,
+		speedStep:           *speedStep,
+		fallbackSpeedAbove:  *fallbackSpeedAbove,
+		fallbackSpeedBelow:  *fallbackSpeedBelow,
+		failsafeTemp:        *failsafeTemp,
+		takeoverTemp:        *takeoverTemp,
+		targetTemp:          *targetTemp,
+		spikeThreshold:      *spikeThreshold,
+		tempOffset:          *tempOffset,
+		medianSamples:       *medianSamples,
+		writeInterval:       *writeInterval,
+		rpmCurve:            config.rpmCurve != nil,
+		formula:             config.formula != nil,
+	}
+	if err := deviceValues.validate(); err != nil {
+		return config, curve, err
+	}
+	if *preset != "" {
+		if *speeds != "" {
+			return config, curve, fmt.Errorf("preset cannot be combined with speeds")
+		}
+		var err error
+		if *speeds, err = presetCurve(*preset); err != nil {
+			return config, curve, err
+		}
+	}
+	if *speeds != "" {
+		var err error
+		if curve, err = parseSpeedConfigFlag(*speeds); err != nil {
+			return config, curve, fmt.Errorf("unable to parse fan speed: %w", err)
+		}
+		config.speedMap = generateTempNFanSpeedMap(curve)
+	}
+	if _, ok := values["fans"]; ok {
+		fans, err := parseFanIndices(*fansStr)
+		if err != nil {
+			return config, curve, err
+		}
+		config.fans.fans = fans
+	}
+	if _, ok := values["auto-fans"]; ok {
+		autoFans, err := parseFanIndices(*autoFansStr)
+		if err != nil {
+			return config, curve, err
+		}
+		config.fans.autoFans = autoFans
+	}
+	if _, ok := values["fan-offsets"]; ok {
+		offsets, err := parseFanOffsets(*fanOffsetsStr)
+		if err != nil {
+			return config, curve, err
+		}
+		config.fans.offsets = offsets
+	}
+	config.pollingDuration = *pollingDuration
+	config.minSpeed = uint8(*minSpeed)
+	config.maxSpeed = uint8(*maxSpeed)
+	config.speedStep = uint8(*speedStep)
+	config.failsafeTemp = uint8(*failsafeTemp)
+	config.tempOffset = *tempOffset
+	config.spikeThreshold = uint8(*spikeThreshold)
+	config.medianSamples = *medianSamples
+	config.takeoverTemp = uint8(*takeoverTemp)
+	config.targetTemp = uint8(*targetTemp)
+	config.fallbackSpeedAbove = uint8(*fallbackSpeedAbove)
+	config.fallbackSpeedBelow = uint8(*fallbackSpeedBelow)
+	config.writeInterval = *writeInterval
+	config.powerLimit = *powerLimit
+	if _, ok := values["locked-clocks"]; ok {
+		minMHz, maxMHz, err := parseLockedClocks(*lockedClocks)
+		if err != nil {
+			return config, curve, err
+		}
+		config.lockedClocks = [2]uint32{minMHz, maxMHz}
+	}
+	return config, curve, nil
+}
+
+// deviceSelection tells which devices are controlled, as given by -device-index, -devices, -exclude-devices and
+// -device-match
+type deviceSelection struct {
+	index   int
+	indices string
+	exclude string
+	match   *regexp.Regexp
+}
+
+// selectDevices returns indices of selected devices out of count devices. Failure is logged, and returned as exit code.
+func selectDevices(backend gpuBackend, count int, selection deviceSelection) ([]int, int) {
+	var err error
+	deviceIndices := []int{selection.index}
+	devicesStr := selection.indices
+	if devicesStr == "" && (selection.match != nil || selection.exclude != "") {
+		devicesStr = "all"
+	}
+	if devicesStr != "" {
+		if deviceIndices, err = parseDeviceIndices(devicesStr, count); err != nil {
+			slog.Error("unable to parse devices flag", "err", err)
+			return nil, EXIT_CONFIG_ERROR
+		}
+	}
+	if selection.exclude != "" {
+		if deviceIndices, err = excludeDevices(backend, deviceIndices, selection.exclude); err != nil {
+			slog.Error("Unable to exclude devices", "err", err)
+			return nil, EXIT_UNSUPPORTED_DEVICE
+		}
+		if len(deviceIndices) == 0 {
+			slog.Error("All devices are excluded", "excludeDevices", selection.exclude)
+			return nil, EXIT_UNSUPPORTED_DEVICE
+		}
+	}
+	if selection.match != nil {
+		if deviceIndices, err = filterDevicesByName(backend, deviceIndices, selection.match); err != nil {
+			slog.Error("Unable to match device names", "err", err)
+			return nil, EXIT_UNSUPPORTED_DEVICE
+		}
+		if len(deviceIndices) == 0 {
+			slog.Error("No device name matches the pattern", "pattern", selection.match)
+			return nil, EXIT_UNSUPPORTED_DEVICE
+		}
+	}
+	return deviceIndices, EXIT_OK
+}
+
+// parseDeviceIndices parses list of device indices e.g. 0,2, or "all" for every device
+func parseDeviceIndices(devicesStr string, count int) ([]int, error) {
+	if devicesStr == "all" {
+		indices := make([]int, 0, count)
+		for i := 0; i < count; i++ {
+			indices = append(indices, i)
+		}
+		return indices, nil
+	}
+
+	var indices []int
+	seen := make(map[int]bool)
+	for _, indexStr := range strings.Split(devicesStr, ",") {
+		index, err := strconv.Atoi(strings.TrimSpace(indexStr))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse device index %q: %w", indexStr, err)
+		}
+		if index < 0 || index >= count {
+			return nil, fmt.Errorf("device index %d is out of range, found %d devices", index, count)
+		}
+		if seen[index] {
+			return nil, fmt.Errorf("device index %d is duplicated", index)
+		}
+		seen[index] = true
+		indices = append(indices, index)
+	}
+	return indices, nil
+}
+
+// filterDevicesByName returns indices of devices whose name matches the pattern
+func filterDevicesByName(backend gpuBackend, indices []int, pattern *regexp.Regexp) ([]int, error) {
+	var matched []int
+	for _, index := range indices {
+		device, err := backend.Device(index)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get device at index %d: %w", index, err)
+		}
+		name, err := device.Name()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get name of device at index %d: %w", index, err)
+		}
+		if !pattern.MatchString(name) {
+			slog.Info("Device name does not match, leave it on driver default policy", LABEL_GPU_INDEX, index, LABEL_GPU_NAME, name, "pattern", pattern)
+			continue
+		}
+		matched = append(matched, index)
+	}
+	return matched, nil
+}
+
+// excludeDevices returns indices of devices which are not in exclusion list. Each entry of the list is either device index or UUID
+func excludeDevices(backend gpuBackend, indices []int, excludeStr string) ([]int, error) {
+	excluded := make(map[string]bool)
+	for _, entry := range strings.Split(excludeStr, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			excluded[entry] = true
+		}
+	}
+
+	var remaining []int
+	for _, index := range indices {
+		if excluded[strconv.Itoa(index)] {
+			slog.Info("Device is excluded, leave it on driver default policy", LABEL_GPU_INDEX, index)
+			continue
+		}
+		device, err := backend.Device(index)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get device at index %d: %w", index, err)
+		}
+		uuid, err := device.UUID()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get uuid of device at index %d: %w", index, err)
+		}
+		if excluded[uuid] {
+			slog.Info("Device is excluded, leave it on driver default policy", LABEL_GPU_INDEX, index, LABEL_GPU_UUID, uuid)
+			continue
+		}
+		remaining = append(remaining, index)
+	}
+	return remaining, nil
+}
+
+// superviseControlLoop runs control loop of a device, and restarts it with exponential backoff when it fails,
+// so that failure of one device neither stops nor leaves uncontrolled other devices.
+func superviseControlLoop(ctx context.Context, d *controlledDevice, config controlConfig) {
+	backoff := SUPERVISOR_MIN_BACKOFF
+	for {
+		startedAt := time.Now()
+		err := runCustomGPUFanCurve(ctx, d.handle, config, d.state, d.togglePause, d.applyNow, d.prepareSleep)
+		if err == nil {
+			return
+		}
+		if time.Since(startedAt) > SUPERVISOR_STABLE_DURATION {
+			backoff = SUPERVISOR_MIN_BACKOFF
+		}
+		attrs := []any{"backoff", backoff, "err", err}
+		if mode := failureMode(err); mode != "" {
+			attrs = append(attrs, "failureMode", mode)
+		}
+		if code, ok := nvmlReturnCode(err); ok {
+			attrs = append(attrs, "nvmlReturn", code)
+		}
+		d.logger.Error("Control loop of device failed, restart it after backoff", attrs...)
+		if config.alerts != nil {
+			config.alerts.send(ALERT_CONTROL_LOST, d.labels, 0, fmt.Sprintf("Fan control is lost, fans are returned to driver default policy until the control loop restarts: %s", err))
+		}
+
+		// Leave fans to driver while the control loop is down
+		device := d.handle.get()
+		if fans, _, err := controlledFans(device, config.fans); err == nil && !config.observeOnly {
+			restoreDefaultFanSpeeds(d.logger, device, fans, config.dryrun)
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, SUPERVISOR_MAX_BACKOFF)
+
+		// Device handle may be stale, failure here is reported again by the next run. NVML is not re-initialized, as
+		// it would invalidate devices of other control loops, which are still working.
+		if _, err := d.handle.refresh(ctx); err != nil {
+			d.logger.Warn("Unable to reopen device before restarting control loop", "err", err)
+		}
+	}
+}
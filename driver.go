@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Driver branches, which introduced NVML functions used for fan control
+const (
+	// nvmlDeviceGetNumFans, nvmlDeviceSetFanSpeed_v2 and nvmlDeviceSetDefaultFanSpeed_v2
+	MIN_DRIVER_FAN_CONTROL = 470
+	// nvmlDeviceGetFanControlPolicy_v2 and nvmlDeviceGetMinMaxFanSpeed
+	MIN_DRIVER_FAN_POLICY = 510
+)
+
+// Backoff between attempts to initialize NVML while waiting for driver
+const (
+	DRIVER_WAIT_MIN_BACKOFF = time.Second
+	DRIVER_WAIT_MAX_BACKOFF = 15 * time.Second
+)
+
+// waitForDriver calls init until it succeeds or timeout has passed, with exponential backoff between attempts, as
+// NVIDIA driver may not be loaded yet when the service starts at boot. Error of the last attempt is returned on timeout
+// or when ctx is done. Init is attempted only once if timeout is 0.
+func waitForDriver(ctx context.Context, timeout time.Duration, init func() error) error {
+	logger := moduleLogger(LOG_MODULE_NVML)
+	deadline := time.Now().Add(timeout)
+	backoff := DRIVER_WAIT_MIN_BACKOFF
+	for attempt := 1; ; attempt++ {
+		err := init()
+		if err == nil {
+			if attempt > 1 {
+				logger.Info("NVIDIA driver is ready", "attempts", attempt)
+			}
+			return nil
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return err
+		}
+		wait := min(backoff, remaining)
+		logger.Warn("NVIDIA driver is not ready, retry after backoff", "backoff", wait, "remaining", remaining.Round(time.Second), "err", err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		backoff = min(backoff*2, DRIVER_WAIT_MAX_BACKOFF)
+	}
+}
+
+// parseDriverMajor returns branch of driver version e.g. 555 of 555.58.02
+func parseDriverMajor(version string) (int, error) {
+	major, _, _ := strings.Cut(strings.TrimSpace(version), ".")
+	branch, err := strconv.Atoi(major)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse driver version %q: %w", version, err)
+	}
+	return branch, nil
+}
+
+// checkDriverCompatibility logs versions of driver and NVML, and warns about fan functions which the driver lacks,
+// so that users are not left with FUNCTION_NOT_FOUND errors at runtime.
+// It returns true if fan speed must be set by nvidia-settings from the start, as NVML of the driver cannot set it.
+func checkDriverCompatibility(backend gpuBackend, nvidiaSettingsFallback bool) bool {
+	logger := moduleLogger(LOG_MODULE_NVML)
+	driverVersion, err := backend.DriverVersion()
+	if err != nil {
+		logger.Warn("Unable to get driver version, skip driver compatibility check", "err", err)
+		return false
+	}
+	nvmlVersion, err := backend.NVMLVersion()
+	if err != nil {
+		logger.Debug("Unable to get NVML version", "err", err)
+	}
+	logger.Info("NVIDIA driver", "driverVersion", driverVersion, "nvmlVersion", nvmlVersion)
+
+	branch, err := parseDriverMajor(driverVersion)
+	if err != nil {
+		logger.Warn("Unknown driver version format, skip driver compatibility check", "err", err)
+		return false
+	}
+	if branch < MIN_DRIVER_FAN_CONTROL {
+		if nvidiaSettingsFallback {
+			logger.Warn("Driver is older than the first one which can set fan speed through NVML, set fan speed by nvidia-settings instead", "driverVersion", driverVersion, "minVersion", MIN_DRIVER_FAN_CONTROL)
+			return true
+		}
+		logger.Warn("Driver is older than the first one which can set fan speed through NVML, and nvidia-settings fallback is disabled, so that fans cannot be controlled. Upgrade the driver or enable -nvidia-settings-fallback", "driverVersion", driverVersion, "minVersion", MIN_DRIVER_FAN_CONTROL)
+		return false
+	}
+	if branch < MIN_DRIVER_FAN_POLICY {
+		logger.Warn("Driver does not report fan control policy and fan speed range, so that self-test only checks fan speed and RPM-target mode is not supported", "driverVersion", driverVersion, "minVersion", MIN_DRIVER_FAN_POLICY)
+	}
+	return false
+}
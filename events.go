@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum time to block waiting for an event, so that stop request is noticed
+	NVML_EVENT_WAIT_TIMEOUT = time.Second
+	// Events arriving within this interval after the previous one do not trigger another update
+	NVML_EVENT_MIN_INTERVAL = time.Second
+)
+
+// gpuEventSource is implemented by devices, which can notify events related to GPU load e.g. P-state and clock changes
+type gpuEventSource interface {
+	// WatchEvents calls notify on every event until stop is closed
+	WatchEvents(notify func(), stop <-chan struct{}) error
+}
+
+// watchDeviceEvents asks control loop to apply fan speed immediately on device events, in addition to fixed polling.
+// It returns a function which stops watching and waits until the watcher exits.
+func watchDeviceEvents(device gpuDevice, logger *slog.Logger, applyNow chan struct{}) func() {
+	source, ok := device.(gpuEventSource)
+	if !ok {
+		logger.Warn("NVML events are not supported on this platform, use only polling")
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var lastNotifiedAt time.Time
+		err := source.WatchEvents(func() {
+			now := time.Now()
+			if now.Sub(lastNotifiedAt) < NVML_EVENT_MIN_INTERVAL {
+				return
+			}
+			lastNotifiedAt = now
+			select {
+			case applyNow <- struct{}{}:
+			default:
+			}
+		}, stop)
+		if errors.Is(err, ErrUnsupportedDevice) {
+			logger.Warn("NVML events are not supported by the device, use only polling")
+		} else if err != nil {
+			logger.Warn("Unable to watch NVML events, use only polling", "err", err)
+		}
+	}()
+
+	return func() {
+		close(stop)
+		wg.Wait()
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fanSelection tells which fans of a device are controlled, while other fans are kept on driver automatic policy,
+// e.g. a fan header which drives a pump
+type fanSelection struct {
+	// Only these fans are controlled, nil means every fan
+	fans []int
+	// These fans are kept on driver automatic policy, even if they are in fans
+	autoFans []int
+	// Percentage added to fan speed of each fan, e.g. fan 1 runs 10% faster than others with {1: 10}
+	offsets map[int]int
+}
+
+// parseFanIndices parses list of fan indices e.g. 0,2. Empty string means no list, which is returned as nil.
+func parseFanIndices(fansStr string) ([]int, error) {
+	if fansStr == "" {
+		return nil, nil
+	}
+
+	var indices []int
+	seen := make(map[int]bool)
+	for _, indexStr := range strings.Split(fansStr, ",") {
+		index, err := strconv.Atoi(strings.TrimSpace(indexStr))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse fan index %q: %w", indexStr, err)
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("fan index %d must not be negative", index)
+		}
+		if seen[index] {
+			return nil, fmt.Errorf("fan index %d is duplicated", index)
+		}
+		seen[index] = true
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+	return indices, nil
+}
+
+// parseFanOffsets parses per fan speed offsets in percent e.g. 1:10,2:-5, where fan 1 runs 10% faster and fan 2 runs 5% slower
+func parseFanOffsets(offsetsStr string) (map[int]int, error) {
+	if offsetsStr == "" {
+		return nil, nil
+	}
+
+	offsets := make(map[int]int)
+	for _, pairStr := range strings.Split(offsetsStr, ",") {
+		indexStr, offsetStr, found := strings.Cut(strings.TrimSpace(pairStr), ":")
+		if !found {
+			return nil, fmt.Errorf("fan offset %q must be in format fanIndex:offset", pairStr)
+		}
+		index, err := strconv.Atoi(indexStr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse fan index %q: %w", indexStr, err)
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("fan index %d must not be negative", index)
+		}
+		offset, err := strconv.Atoi(offsetStr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse fan offset %q: %w", offsetStr, err)
+		}
+		if offset < -int(MAX_FAN_SPEED_PERCENT) || offset > int(MAX_FAN_SPEED_PERCENT) {
+			return nil, fmt.Errorf("fan offset %d must be between %d and %d", offset, -int(MAX_FAN_SPEED_PERCENT), MAX_FAN_SPEED_PERCENT)
+		}
+		if _, ok := offsets[index]; ok {
+			return nil, fmt.Errorf("fan index %d is duplicated", index)
+		}
+		offsets[index] = offset
+	}
+	return offsets, nil
+}
+
+// fanSpeedWithOffset adds offset of the fan to fan speed, which stays within min and max speed
+func fanSpeedWithOffset(speed uint8, offset int, config controlConfig) uint8 {
+	if offset == 0 {
+		return speed
+	}
+	return uint8(min(max(int(speed)+offset, int(config.minSpeed)), int(config.maxSpeed)))
+}
+
+// controlledFans returns indices of fans of the device which are controlled, and ones which are kept on driver automatic policy
+func controlledFans(device gpuDevice, selection fanSelection) ([]int, []int, error) {
+	numFans, err := device.NumFans()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get number of fans from device; err: %w", err)
+	}
+	selected := make(map[int]bool, numFans)
+	for _, fanIdx := range selection.fans {
+		if fanIdx >= numFans {
+			return nil, nil, fmt.Errorf("fan index %d is out of range, device has %d fans", fanIdx, numFans)
+		}
+		selected[fanIdx] = true
+	}
+	auto := make(map[int]bool, numFans)
+	for _, fanIdx := range selection.autoFans {
+		if fanIdx >= numFans {
+			return nil, nil, fmt.Errorf("fan index %d is out of range, device has %d fans", fanIdx, numFans)
+		}
+		auto[fanIdx] = true
+	}
+
+	var controlled, automatic []int
+	isControlled := make(map[int]bool, numFans)
+	for i := 0; i < numFans; i++ {
+		if (selection.fans == nil || selected[i]) && !auto[i] {
+			controlled = append(controlled, i)
+			isControlled[i] = true
+		} else {
+			automatic = append(automatic, i)
+		}
+	}
+	for fanIdx := range selection.offsets {
+		if !isControlled[fanIdx] {
+			return nil, nil, fmt.Errorf("fan offset is set for fan %d, which is not controlled", fanIdx)
+		}
+	}
+	return controlled, automatic, nil
+}
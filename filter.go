@@ -0,0 +1,65 @@
+package main
+
+import "slices"
+
+// Median filter covers at most this number of readings, as it delays a real change by half of them
+const MAX_MEDIAN_SAMPLES = 15
+
+// spikeFilter ignores a single temperature reading, which deviates from the previous accepted reading by more than
+// threshold, e.g. a sensor glitch of some cards, so that fans are not slammed to full speed for one polling.
+// A deviation confirmed by the next reading is accepted, so that a real jump is only delayed by one polling.
+type spikeFilter struct {
+	threshold uint32
+	last      uint32
+	hasLast   bool
+	// Reading held back as a possible spike, which is accepted if the next reading is close to it
+	held    uint32
+	holding bool
+}
+
+func newSpikeFilter(threshold uint32) *spikeFilter {
+	return &spikeFilter{threshold: threshold}
+}
+
+func absDiff(a, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// filter returns temperature to be used instead of the reading, and whether the reading is ignored as a spike
+func (f *spikeFilter) filter(temperature uint32) (uint32, bool) {
+	confirmed := f.holding && absDiff(temperature, f.held) <= f.threshold
+	if !f.hasLast || absDiff(temperature, f.last) <= f.threshold || confirmed {
+		f.last, f.hasLast, f.holding = temperature, true, false
+		return temperature, false
+	}
+	f.held, f.holding = temperature, true
+	return f.last, true
+}
+
+// medianFilter returns median of the last readings, which rejects outliers with less lag than averaging.
+// With an even number of readings, the higher of the two middle readings is used, so that fans err on the faster side.
+type medianFilter struct {
+	size     int
+	readings []uint32
+}
+
+func newMedianFilter(size int) *medianFilter {
+	return &medianFilter{
+		size:     size,
+		readings: make([]uint32, 0, size),
+	}
+}
+
+// filter adds the reading, and returns median of the last readings
+func (f *medianFilter) filter(temperature uint32) uint32 {
+	if len(f.readings) == f.size {
+		f.readings = append(f.readings[:0], f.readings[1:]...)
+	}
+	f.readings = append(f.readings, temperature)
+	sorted := slices.Clone(f.readings)
+	slices.Sort(sorted)
+	return sorted[len(sorted)/2]
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"unicode"
+)
+
+// Variables available in fan speed formula
+const (
+	FORMULA_VAR_GPU_TEMP    = "gpu_temp"
+	FORMULA_VAR_MEM_TEMP    = "mem_temp"
+	FORMULA_VAR_SOURCE_TEMP = "source_temp"
+	FORMULA_VAR_PSU_TEMP    = "psu_temp"
+	FORMULA_VAR_BOARD_TEMP  = "board_temp"
+	FORMULA_VAR_POWER       = "power"
+	FORMULA_VAR_UTIL        = "util"
+	FORMULA_VAR_RISING      = "rising"
+)
+
+// Curves available in fan speed formula, which look up fan speed of -speeds and -memory-speeds curves
+const (
+	FORMULA_FUNC_CURVE  = "curve"
+	FORMULA_FUNC_CURVE2 = "curve2"
+)
+
+var formulaVars = map[string]bool{
+	FORMULA_VAR_GPU_TEMP:    true,
+	FORMULA_VAR_MEM_TEMP:    true,
+	FORMULA_VAR_SOURCE_TEMP: true,
+	FORMULA_VAR_PSU_TEMP:    true,
+	FORMULA_VAR_BOARD_TEMP:  true,
+	FORMULA_VAR_POWER:       true,
+	FORMULA_VAR_UTIL:        true,
+	FORMULA_VAR_RISING:      true,
+}
+
+// Number of arguments of functions, -1 means 1 or more
+var formulaFuncs = map[string]int{
+	"min":               -1,
+	"max":               -1,
+	"abs":               1,
+	"clamp":             3,
+	FORMULA_FUNC_CURVE:  1,
+	FORMULA_FUNC_CURVE2: 1,
+}
+
+// formulaEnv holds values of variables and curves, by which formula is evaluated
+type formulaEnv struct {
+	vars   map[string]float64
+	curves map[string]func(temperature float64) float64
+}
+
+type formulaNode interface {
+	eval(env formulaEnv) (float64, error)
+}
+
+type formulaNumber float64
+
+func (n formulaNumber) eval(env formulaEnv) (float64, error) {
+	return float64(n), nil
+}
+
+type formulaVar string
+
+func (v formulaVar) eval(env formulaEnv) (float64, error) {
+	return env.vars[string(v)], nil
+}
+
+type formulaUnary struct {
+	operand formulaNode
+}
+
+func (u formulaUnary) eval(env formulaEnv) (float64, error) {
+	value, err := u.operand.eval(env)
+	return -value, err
+}
+
+type formulaBinary struct {
+	op          byte
+	left, right formulaNode
+}
+
+func (b formulaBinary) eval(env formulaEnv) (float64, error) {
+	left, err := b.left.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	right, err := b.right.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	switch b.op {
+	case '+':
+		return left + right, nil
+	case '-':
+		return left - right, nil
+	case '*':
+		return left * right, nil
+	default:
+		if right == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return left / right, nil
+	}
+}
+
+type formulaCall struct {
+	name string
+	args []formulaNode
+}
+
+func (c formulaCall) eval(env formulaEnv) (float64, error) {
+	args := make([]float64, 0, len(c.args))
+	for _, arg := range c.args {
+		value, err := arg.eval(env)
+		if err != nil {
+			return 0, err
+		}
+		args = append(args, value)
+	}
+	switch c.name {
+	case "min":
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Min(result, arg)
+		}
+		return result, nil
+	case "max":
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Max(result, arg)
+		}
+		return result, nil
+	case "abs":
+		return math.Abs(args[0]), nil
+	case "clamp":
+		return math.Max(math.Min(args[0], args[2]), args[1]), nil
+	default:
+		curve, ok := env.curves[c.name]
+		if !ok {
+			return 0, fmt.Errorf("curve of %s() is not configured", c.name)
+		}
+		return curve(args[0]), nil
+	}
+}
+
+// speedFormula is a compiled fan speed formula e.g. max(curve(gpu_temp), curve2(mem_temp)) + 5*rising
+type speedFormula struct {
+	source string
+	root   formulaNode
+	// Variables and functions referenced by the formula, so that only needed sensors are read
+	refs map[string]bool
+}
+
+func (f *speedFormula) uses(name string) bool {
+	return f.refs[name]
+}
+
+// eval evaluates the formula, and returns fan speed in percent, which is rounded and clamped to 0-100
+func (f *speedFormula) eval(env formulaEnv) (uint8, error) {
+	value, err := f.root.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(value) {
+		return 0, fmt.Errorf("formula evaluated to NaN")
+	}
+	return uint8(math.Max(math.Min(math.Round(value), float64(MAX_FAN_SPEED_PERCENT)), 0)), nil
+}
+
+// parseSpeedFormula compiles formula with operators + - * /, parentheses, numbers, variables and functions
+func parseSpeedFormula(source string) (*speedFormula, error) {
+	p := &formulaParser{source: source, refs: make(map[string]bool)}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.source) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.source[p.pos], p.pos)
+	}
+	return &speedFormula{source: source, root: root, refs: p.refs}, nil
+}
+
+// formulaParser is a recursive descent parser of the grammar
+//
+//	expr    = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/") unary }
+//	unary   = "-" unary | primary
+//	primary = number | ident | ident "(" expr { "," expr } ")" | "(" expr ")"
+type formulaParser struct {
+	source string
+	pos    int
+	refs   map[string]bool
+}
+
+func (p *formulaParser) skipSpaces() {
+	for p.pos < len(p.source) && (p.source[p.pos] == ' ' || p.source[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// peek returns next non-space character, or 0 at the end of formula
+func (p *formulaParser) peek() byte {
+	p.skipSpaces()
+	if p.pos >= len(p.source) {
+		return 0
+	}
+	return p.source[p.pos]
+}
+
+func (p *formulaParser) parseExpr() (formulaNode, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = formulaBinary{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *formulaParser) parseTerm() (formulaNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = formulaBinary{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *formulaParser) parseUnary() (formulaNode, error) {
+	if p.peek() == '-' {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return formulaUnary{operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *formulaParser) parsePrimary() (formulaNode, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of formula")
+	case c == '(':
+		p.pos++
+		node, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) at position %d", p.pos)
+		}
+		p.pos++
+		return node, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.source) && (p.source[p.pos] == '.' || (p.source[p.pos] >= '0' && p.source[p.pos] <= '9')) {
+			p.pos++
+		}
+		value, err := strconv.ParseFloat(p.source[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", p.source[start:p.pos], start)
+		}
+		return formulaNumber(value), nil
+	case c == '_' || unicode.IsLetter(rune(c)):
+		start := p.pos
+		for p.pos < len(p.source) && (p.source[p.pos] == '_' || unicode.IsLetter(rune(p.source[p.pos])) || unicode.IsDigit(rune(p.source[p.pos]))) {
+			p.pos++
+		}
+		name := p.source[start:p.pos]
+		if p.peek() != '(' {
+			if !formulaVars[name] {
+				return nil, fmt.Errorf("unknown variable %q at position %d", name, start)
+			}
+			p.refs[name] = true
+			return formulaVar(name), nil
+		}
+		arity, ok := formulaFuncs[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown function %q at position %d", name, start)
+		}
+		p.pos++
+		var args []formulaNode
+		if p.peek() != ')' {
+			for {
+				arg, err := p.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, arg)
+				if p.peek() != ',' {
+					break
+				}
+				p.pos++
+			}
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) of %s() at position %d", name, p.pos)
+		}
+		p.pos++
+		if (arity < 0 && len(args) == 0) || (arity >= 0 && len(args) != arity) {
+			return nil, fmt.Errorf("wrong number of arguments to %s(): %d", name, len(args))
+		}
+		p.refs[name] = true
+		return formulaCall{name: name, args: args}, nil
+	default:
+		return nil, fmt.Errorf("unexpected %q at position %d", c, p.pos)
+	}
+}
+
+// readFormulaVars returns values of variables referenced by the formula. Variables whose sensor cannot be read are 0,
+// and the last error is returned together with other values.
+func readFormulaVars(device gpuDevice, formula *speedFormula, temperature, memoryTemperature, sourceTemperature uint32, rising bool) (map[string]float64, error) {
+	vars := map[string]float64{
+		FORMULA_VAR_GPU_TEMP:    float64(temperature),
+		FORMULA_VAR_MEM_TEMP:    float64(memoryTemperature),
+		FORMULA_VAR_SOURCE_TEMP: float64(sourceTemperature),
+		FORMULA_VAR_RISING:      0,
+	}
+	if rising {
+		vars[FORMULA_VAR_RISING] = 1
+	}
+	var err error
+	if formula.uses(FORMULA_VAR_POWER) {
+		power, powerErr := device.PowerUsage()
+		if powerErr != nil {
+			err = fmt.Errorf("unable to get power usage: %w", powerErr)
+		}
+		vars[FORMULA_VAR_POWER] = float64(power) / 1000
+	}
+	for name, target := range map[string]thermalTarget{FORMULA_VAR_PSU_TEMP: THERMAL_TARGET_POWER_SUPPLY, FORMULA_VAR_BOARD_TEMP: THERMAL_TARGET_BOARD} {
+		if !formula.uses(name) {
+			continue
+		}
+		temperature, sensorErr := readThermalSensor(device, target)
+		if sensorErr != nil {
+			err = sensorErr
+		}
+		vars[name] = float64(temperature)
+	}
+	if formula.uses(FORMULA_VAR_UTIL) {
+		utilization, utilErr := device.Utilization()
+		if utilErr != nil {
+			err = fmt.Errorf("unable to get utilization: %w", utilErr)
+		}
+		vars[FORMULA_VAR_UTIL] = float64(utilization)
+	}
+	return vars, err
+}
+
+// formulaCurves returns curves of formula, which look up fan speed from -speeds and -memory-speeds curves
+func formulaCurves(speedMap map[uint8]uint8, config controlConfig) map[string]func(float64) float64 {
+	lookup := func(speedMap map[uint8]uint8) func(float64) float64 {
+		return func(temperature float64) float64 {
+			speed, _ := lookupFanSpeed(speedMap, uint32(math.Max(math.Min(math.Round(temperature), float64(MAX_TEMP)+1), 0)), config)
+			return float64(speed)
+		}
+	}
+	curves := map[string]func(float64) float64{FORMULA_FUNC_CURVE: lookup(speedMap)}
+	if config.memorySpeedMap != nil {
+		curves[FORMULA_FUNC_CURVE2] = lookup(config.memorySpeedMap)
+	}
+	return curves
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseSpeedFormula(t *testing.T) {
+	env := formulaEnv{
+		vars: map[string]float64{FORMULA_VAR_GPU_TEMP: 60, FORMULA_VAR_MEM_TEMP: 80, FORMULA_VAR_RISING: 1},
+		curves: map[string]func(float64) float64{
+			FORMULA_FUNC_CURVE: func(temperature float64) float64 { return temperature - 10 },
+		},
+	}
+	tests := []struct {
+		formula  string
+		want     uint8
+		wantRefs []string
+	}{
+		{formula: "42", want: 42},
+		{formula: "1 + 2 * 3", want: 7},
+		{formula: "(1 + 2) * 3", want: 9},
+		{formula: "10 - 4 - 3", want: 3},
+		{formula: "-5 + 20", want: 15},
+		{formula: "7 / 2", want: 4},
+		{formula: "gpu_temp", want: 60, wantRefs: []string{FORMULA_VAR_GPU_TEMP}},
+		{formula: "max(gpu_temp, mem_temp) + 5*rising", want: 85, wantRefs: []string{FORMULA_VAR_GPU_TEMP, FORMULA_VAR_MEM_TEMP, FORMULA_VAR_RISING}},
+		{formula: "min(gpu_temp, 30, 40)", want: 30},
+		{formula: "clamp(gpu_temp, 70, 90)", want: 70},
+		{formula: "abs(-12.4)", want: 12},
+		{formula: "curve(gpu_temp)", want: 50, wantRefs: []string{FORMULA_FUNC_CURVE}},
+		{formula: "gpu_temp * 3", want: MAX_FAN_SPEED_PERCENT},
+		{formula: "0 - gpu_temp", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.formula, func(t *testing.T) {
+			formula, err := parseSpeedFormula(tt.formula)
+			if err != nil {
+				t.Fatalf("parseSpeedFormula(%q): %v", tt.formula, err)
+			}
+			got, err := formula.eval(env)
+			if err != nil {
+				t.Fatalf("eval(%q): %v", tt.formula, err)
+			}
+			if got != tt.want {
+				t.Errorf("eval(%q) = %d, want %d", tt.formula, got, tt.want)
+			}
+			for _, ref := range tt.wantRefs {
+				if !formula.uses(ref) {
+					t.Errorf("formula %q does not use %s", tt.formula, ref)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSpeedFormulaErrors(t *testing.T) {
+	for _, formula := range []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"1.2.3",
+		"gpu",
+		"unknown(1)",
+		"max(1, 2",
+		"clamp(1, 2)",
+		"abs()",
+		"1 2",
+		"1 $ 2",
+	} {
+		t.Run(formula, func(t *testing.T) {
+			if _, err := parseSpeedFormula(formula); err == nil {
+				t.Errorf("parseSpeedFormula(%q) succeeded, want error", formula)
+			}
+		})
+	}
+}
+
+func TestSpeedFormulaEvalErrors(t *testing.T) {
+	for _, formula := range []string{"1 / 0", "curve2(gpu_temp)"} {
+		t.Run(formula, func(t *testing.T) {
+			parsed, err := parseSpeedFormula(formula)
+			if err != nil {
+				t.Fatalf("parseSpeedFormula(%q): %v", formula, err)
+			}
+			if _, err := parsed.eval(formulaEnv{vars: map[string]float64{FORMULA_VAR_GPU_TEMP: 60}}); err == nil {
+				t.Errorf("eval(%q) succeeded, want error", formula)
+			}
+		})
+	}
+}
@@ -2,4 +2,4 @@ module github.com/ntchjb/nvidia-fan-controller
 
 go 1.22
 
-require github.com/NVIDIA/go-nvml v0.12.4-0
+require github.com/NVIDIA/go-nvml v0.12.9-0
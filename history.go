@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// historySample is a snapshot of telemetry of a device at the time it was polled
+type historySample struct {
+	Time              time.Time     `json:"time"`
+	Temperature       uint32        `json:"temperature"`
+	MemoryTemperature uint32        `json:"memoryTemperature,omitempty"`
+	FanSpeeds         map[int]uint8 `json:"fanSpeeds"`
+}
+
+// telemetryHistory keeps recent samples of a device in a fixed size ring buffer,
+// so that recent trends can be queried without an external time-series database.
+type telemetryHistory struct {
+	mu      sync.Mutex
+	samples []historySample
+	// Index of the oldest sample
+	start int
+	count int
+}
+
+func newTelemetryHistory(capacity int) *telemetryHistory {
+	return &telemetryHistory{samples: make([]historySample, max(capacity, 1))}
+}
+
+// add appends the sample, overwriting the oldest one when the buffer is full.
+// Sample taken at the same time as the latest one is ignored, as the device has not been polled since.
+func (h *telemetryHistory) add(sample historySample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count > 0 && !sample.Time.After(h.samples[(h.start+h.count-1)%len(h.samples)].Time) {
+		return
+	}
+	if h.count < len(h.samples) {
+		h.samples[(h.start+h.count)%len(h.samples)] = sample
+		h.count++
+		return
+	}
+	h.samples[h.start] = sample
+	h.start = (h.start + 1) % len(h.samples)
+}
+
+// since returns samples taken after the given time, from oldest to newest
+func (h *telemetryHistory) since(t time.Time) []historySample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	samples := make([]historySample, 0, h.count)
+	for i := 0; i < h.count; i++ {
+		sample := h.samples[(h.start+i)%len(h.samples)]
+		if sample.Time.After(t) {
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+// runHistoryRecorder records metrics of all devices to their history periodically until ctx is done.
+// If aligned, recording is aligned to polling of the devices, so that they wake up the CPU together.
+func runHistoryRecorder(ctx context.Context, interval time.Duration, aligned bool, devices []*controlledDevice) {
+	ticker := newPollTicker(interval, aligned)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, d := range devices {
+				m := d.state.metrics()
+				if m.polledAt.IsZero() {
+					continue
+				}
+				d.history.add(historySample{
+					Time:              m.polledAt,
+					Temperature:       m.temperature,
+					MemoryTemperature: m.memoryTemperature,
+					FanSpeeds:         m.fanSpeeds,
+				})
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
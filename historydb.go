@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+const SQLITE3_BIN = "sqlite3"
+
+const HISTORY_DB_SCHEMA = `
+CREATE TABLE IF NOT EXISTS samples (
+	time INTEGER NOT NULL,
+	gpu_index INTEGER NOT NULL,
+	gpu_uuid TEXT NOT NULL,
+	gpu_name TEXT NOT NULL,
+	temperature INTEGER NOT NULL,
+	memory_temperature INTEGER
+);
+CREATE INDEX IF NOT EXISTS samples_time ON samples (time);
+CREATE TABLE IF NOT EXISTS fan_speeds (
+	time INTEGER NOT NULL,
+	gpu_uuid TEXT NOT NULL,
+	fan_index INTEGER NOT NULL,
+	speed INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS fan_speeds_time ON fan_speeds (time);
+`
+
+// historyDB stores samples to a local SQLite file by sqlite3 CLI, so that thermal behavior can be analyzed
+// over months without external infrastructure, and without linking SQLite into this program.
+// Time is stored as unix seconds.
+type historyDB struct {
+	path string
+	// Samples older than retention are deleted on each write, 0 keeps samples forever
+	retention time.Duration
+	// Poll time of the last sample written for each device index, so that a sample is not written twice
+	lastWritten map[int]time.Time
+}
+
+// openHistoryDB creates tables in the SQLite file if they do not exist
+func openHistoryDB(path string, retention time.Duration) (*historyDB, error) {
+	db := &historyDB{path: path, retention: retention, lastWritten: make(map[int]time.Time)}
+	if err := db.exec(HISTORY_DB_SCHEMA); err != nil {
+		return nil, fmt.Errorf("unable to create history tables: %w", err)
+	}
+	return db, nil
+}
+
+func (db *historyDB) exec(sql string) error {
+	cmd := exec.Command(SQLITE3_BIN, "-bail", db.path)
+	cmd.Stdin = strings.NewReader(sql)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("sqlite3 failed, make sure sqlite3 is installed and %s is writable; err: %w, output: %s", db.path, err, bytes.TrimSpace(output.Bytes()))
+	}
+	return nil
+}
+
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// write inserts a sample of each device in one transaction, and deletes samples older than retention
+func (db *historyDB) write(devices []*controlledDevice, now time.Time) error {
+	var sql strings.Builder
+	sql.WriteString("BEGIN;\n")
+	written := make(map[int]time.Time)
+	for _, d := range devices {
+		m := d.state.metrics()
+		if m.polledAt.IsZero() || !m.polledAt.After(db.lastWritten[d.index]) {
+			continue
+		}
+		t := m.polledAt.Unix()
+		memoryTemperature := "NULL"
+		if m.memoryTemperature > 0 {
+			memoryTemperature = fmt.Sprint(m.memoryTemperature)
+		}
+		fmt.Fprintf(&sql, "INSERT INTO samples VALUES (%d, %d, %s, %s, %d, %s);\n",
+			t, d.labels.index, sqlString(d.labels.uuid), sqlString(d.labels.name), m.temperature, memoryTemperature)
+
+		fanIndices := make([]int, 0, len(m.fanSpeeds))
+		for fanIdx := range m.fanSpeeds {
+			fanIndices = append(fanIndices, fanIdx)
+		}
+		sort.Ints(fanIndices)
+		for _, fanIdx := range fanIndices {
+			fmt.Fprintf(&sql, "INSERT INTO fan_speeds VALUES (%d, %s, %d, %d);\n", t, sqlString(d.labels.uuid), fanIdx, m.fanSpeeds[fanIdx])
+		}
+		written[d.index] = m.polledAt
+	}
+	if len(written) == 0 {
+		return nil
+	}
+	if db.retention > 0 {
+		cutoff := now.Add(-db.retention).Unix()
+		fmt.Fprintf(&sql, "DELETE FROM samples WHERE time < %d;\nDELETE FROM fan_speeds WHERE time < %d;\n", cutoff, cutoff)
+	}
+	sql.WriteString("COMMIT;\n")
+	if err := db.exec(sql.String()); err != nil {
+		return err
+	}
+	for index, polledAt := range written {
+		db.lastWritten[index] = polledAt
+	}
+	return nil
+}
+
+// runHistoryDBWriter writes samples of all devices to the SQLite file periodically until ctx is done
+func runHistoryDBWriter(ctx context.Context, db *historyDB, interval time.Duration, devices []*controlledDevice, logRepeatInterval time.Duration) {
+	limiter := newLogLimiter(logRepeatInterval, moduleLogger(LOG_MODULE_METRICS))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := db.write(devices, time.Now()); err != nil {
+				limiter.Warn("Unable to write history to SQLite file", "path", db.path, "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
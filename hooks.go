@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hook command is killed if it does not finish within this duration, so that it never blocks other events
+const HOOK_TIMEOUT = 30 * time.Second
+
+// hookNotifier runs a shell command on events, with details of the event passed by environment variables
+type hookNotifier struct {
+	command string
+	// Events on which the command runs, empty means all events
+	events map[string]bool
+}
+
+func newHookNotifier(command string, eventsStr string) (*hookNotifier, error) {
+	events := make(map[string]bool)
+	for _, event := range strings.Split(eventsStr, ",") {
+		event = strings.TrimSpace(event)
+		switch event {
+		case "":
+			continue
+		case ALERT_OVERTEMP, ALERT_FAILSAFE, ALERT_CONTROL_LOST, ALERT_RAPID_RISE, ALERT_CURVE_CHANGED, ALERT_SHUTDOWN:
+			events[event] = true
+		default:
+			return nil, fmt.Errorf("unknown hook event %q", event)
+		}
+	}
+	return &hookNotifier{command: command, events: events}, nil
+}
+
+func (n *hookNotifier) name() string {
+	return "command"
+}
+
+func (n *hookNotifier) notify(event alertEvent) error {
+	if len(n.events) > 0 && !n.events[event.Event] {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), HOOK_TIMEOUT)
+	defer cancel()
+	cmd := shellCommand(ctx, n.command)
+	cmd.Env = append(os.Environ(),
+		"NVML_FAN_EVENT="+event.Event,
+		"NVML_FAN_TIME="+event.Time.Format(time.RFC3339),
+		"NVML_FAN_HOST="+event.Host,
+		"NVML_FAN_GPU_INDEX="+strconv.Itoa(event.GPUIndex),
+		"NVML_FAN_GPU_UUID="+event.GPUUUID,
+		"NVML_FAN_GPU_NAME="+event.GPUName,
+		"NVML_FAN_TEMPERATURE="+strconv.FormatUint(uint64(event.Temperature), 10),
+		"NVML_FAN_MESSAGE="+event.Message,
+	)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("hook command failed; err: %w, output: %s", err, bytes.TrimSpace(output.Bytes()))
+	}
+	return nil
+}
+
+// shellCommand runs command line by shell of the platform
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "/bin/sh", "-c", command)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	HWMON_PWM_MAX = 255
+	// Value of pwmN_enable, by which PWM channel is controlled manually through pwmN
+	HWMON_PWM_ENABLE_MANUAL = "1"
+)
+
+// hwmonPWM drives a PWM channel of motherboard e.g. /sys/class/hwmon/hwmon2/pwm1, which a case fan is connected to
+type hwmonPWM struct {
+	path string
+	// Values of pwmN and pwmN_enable before this process took control, which are restored on exit
+	previousPWM    string
+	previousEnable string
+	enabled        bool
+}
+
+// newHWMonPWM switches the PWM channel to manual control. In dry run, the channel is only checked to be readable.
+func newHWMonPWM(path string, dryrun bool) (*hwmonPWM, error) {
+	previousPWM, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read PWM channel: %w", err)
+	}
+	previousEnable, err := os.ReadFile(path + "_enable")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read PWM channel mode: %w", err)
+	}
+	p := &hwmonPWM{
+		path:           path,
+		previousPWM:    strings.TrimSpace(string(previousPWM)),
+		previousEnable: strings.TrimSpace(string(previousEnable)),
+	}
+	if dryrun {
+		return p, nil
+	}
+	if err := os.WriteFile(path+"_enable", []byte(HWMON_PWM_ENABLE_MANUAL), 0644); err != nil {
+		return nil, fmt.Errorf("unable to switch PWM channel to manual control: %w", err)
+	}
+	p.enabled = true
+	return p, nil
+}
+
+func (p *hwmonPWM) name() string {
+	return p.path
+}
+
+func (p *hwmonPWM) setSpeed(speed uint8) error {
+	value := int(math.Round(float64(speed) * HWMON_PWM_MAX / float64(MAX_FAN_SPEED_PERCENT)))
+	if err := os.WriteFile(p.path, []byte(strconv.Itoa(value)), 0644); err != nil {
+		return fmt.Errorf("unable to write PWM channel: %w", err)
+	}
+	return nil
+}
+
+func (p *hwmonPWM) restore() error {
+	if !p.enabled {
+		return nil
+	}
+	// Duty is restored first, as it is kept when the channel was already under manual control
+	if err := os.WriteFile(p.path, []byte(p.previousPWM), 0644); err != nil {
+		return fmt.Errorf("unable to restore PWM channel: %w", err)
+	}
+	if err := os.WriteFile(p.path+"_enable", []byte(p.previousEnable), 0644); err != nil {
+		return fmt.Errorf("unable to restore PWM channel mode: %w", err)
+	}
+	return nil
+}
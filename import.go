@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Formats of fan curves, which can be imported from other fan control programs
+const (
+	IMPORT_FORMAT_AFTERBURNER = "afterburner"
+	IMPORT_FORMAT_GWE         = "gwe"
+)
+
+const (
+	// Key of fan curve in MSI Afterburner profile, which is found in [Startup] and [Profile1] to [Profile5] sections
+	AFTERBURNER_CURVE_KEY = "SwAutoFanControlCurve"
+	// Curve blob starts with format version and number of points, each of which is little-endian uint32
+	AFTERBURNER_CURVE_HEADER_SIZE = 8
+)
+
+// curveImporter reads fan curve of other fan control program from the file at path. Profile selects one of curves
+// stored in the file, or the default one if empty.
+type curveImporter func(path string, profile string) ([][2]float64, error)
+
+var curveImporters = map[string]curveImporter{
+	IMPORT_FORMAT_AFTERBURNER: importAfterburnerCurve,
+	IMPORT_FORMAT_GWE:         importGWECurve,
+}
+
+// importAfterburnerCurve reads fan curve from MSI Afterburner profile e.g. Profiles/VEN_10DE&DEV_2684&....cfg.
+// Profile is a section name e.g. Profile1, which defaults to Startup, i.e. the curve applied when Afterburner starts.
+func importAfterburnerCurve(path string, profile string) ([][2]float64, error) {
+	if profile == "" {
+		profile = "Startup"
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open Afterburner profile: %w", err)
+	}
+	defer file.Close()
+	var section, encoded string
+	found := false
+	scanner := bufio.NewScanner(file)
+	// Curve blob is about 2KB of hex, which may exceed default line limit
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if ok && strings.EqualFold(section, profile) && strings.TrimSpace(key) == AFTERBURNER_CURVE_KEY {
+			encoded, found = strings.TrimSpace(value), true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read Afterburner profile: %w", err)
+	}
+	if !found || encoded == "" {
+		return nil, fmt.Errorf("%s is not found in [%s] section of Afterburner profile", AFTERBURNER_CURVE_KEY, profile)
+	}
+
+	data, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode %s: %w", AFTERBURNER_CURVE_KEY, err)
+	}
+	if len(data) < AFTERBURNER_CURVE_HEADER_SIZE {
+		return nil, fmt.Errorf("%s is too short", AFTERBURNER_CURVE_KEY)
+	}
+	count := binary.LittleEndian.Uint32(data[4:8])
+	// Each point is a pair of little-endian float32 of temperature and fan speed in percent
+	if count == 0 || uint64(len(data)-AFTERBURNER_CURVE_HEADER_SIZE) < uint64(count)*8 {
+		return nil, fmt.Errorf("%s has %d points, which do not fit in %d bytes", AFTERBURNER_CURVE_KEY, count, len(data))
+	}
+	reader := bytes.NewReader(data[AFTERBURNER_CURVE_HEADER_SIZE:])
+	points := make([][2]float64, 0, count)
+	for i := uint32(0); i < count; i++ {
+		var point [2]float32
+		if err := binary.Read(reader, binary.LittleEndian, &point); err != nil {
+			return nil, fmt.Errorf("unable to read point %d of %s: %w", i, AFTERBURNER_CURVE_KEY, err)
+		}
+		points = append(points, [2]float64{float64(point[0]), float64(point[1])})
+	}
+	return points, nil
+}
+
+// importGWECurve reads fan profile from GreenWithEnvy database e.g. ~/.config/gwe/gwe.db by sqlite3 CLI.
+// Profile is a name of fan profile, which defaults to the profile currently selected in GreenWithEnvy.
+func importGWECurve(path string, profile string) ([][2]float64, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("unable to open GreenWithEnvy database: %w", err)
+	}
+	profileID := "(SELECT profile_id FROM currentspeedprofile LIMIT 1)"
+	if profile != "" {
+		profileID = fmt.Sprintf("(SELECT id FROM speedprofile WHERE name = %s LIMIT 1)", sqlString(profile))
+	}
+	query := fmt.Sprintf("SELECT temperature, duty FROM speedstep WHERE profile_id = %s ORDER BY temperature;", profileID)
+	cmd := exec.Command(SQLITE3_BIN, "-readonly", "-bail", "-separator", ":", path, query)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("sqlite3 failed, make sure sqlite3 is installed and %s is a GreenWithEnvy database; err: %w, stderr: %s", path, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	var points [][2]float64
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if line == "" {
+			continue
+		}
+		temperature, duty, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("unexpected fan profile step %q", line)
+		}
+		var point [2]float64
+		for i, value := range []string{temperature, duty} {
+			if point[i], err = strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil {
+				return nil, fmt.Errorf("unable to parse fan profile step %q: %w", line, err)
+			}
+		}
+		points = append(points, point)
+	}
+	if len(points) == 0 {
+		if profile == "" {
+			return nil, fmt.Errorf("GreenWithEnvy has no fan profile selected, use -profile to choose one by name")
+		}
+		return nil, fmt.Errorf("fan profile %q is not found or has no steps", profile)
+	}
+	return points, nil
+}
+
+// convertImportedCurve rounds points of imported curve into fan speed config. Temperature and fan speed are clamped
+// into supported range, and points whose rounded temperature is not above the previous one are dropped.
+func convertImportedCurve(points [][2]float64) ([][2]uint8, error) {
+	var curve [][2]uint8
+	for i, point := range points {
+		if math.IsNaN(point[0]) || math.IsNaN(point[1]) {
+			return nil, fmt.Errorf("point %d of imported curve is not a number", i)
+		}
+		temperature := uint8(math.Max(math.Min(math.Round(point[0]), float64(MAX_TEMP)), 0))
+		speed := uint8(math.Max(math.Min(math.Round(point[1]), float64(MAX_FAN_SPEED_PERCENT)), 0))
+		if len(curve) > 0 && temperature <= curve[len(curve)-1][0] {
+			slog.Warn("Drop point of imported curve, as its temperature is not above the previous point", "temperature", point[0], "speed", point[1])
+			continue
+		}
+		curve = append(curve, [2]uint8{temperature, speed})
+	}
+	if len(curve) == 0 {
+		return nil, fmt.Errorf("imported curve has no points")
+	}
+	return curve, validateSpeedConfig(curve)
+}
+
+// runImportCommand converts fan curve of other fan control program, then prints it or writes it to config file
+func runImportCommand(args []string) int {
+	var format string
+	var profile string
+	var configFile string
+
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.StringVar(&format, "format", IMPORT_FORMAT_AFTERBURNER, "Format of the imported file. Supported values are afterburner and gwe")
+	flags.StringVar(&profile, "profile", "", "Profile to be imported from the file, e.g. Profile1 of Afterburner or a fan profile name of GreenWithEnvy. Empty value imports the curve currently in use")
+	flags.StringVar(&configFile, "config", "", "Path to config file, whose fan curve is replaced by the imported curve. The curve is printed if empty")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s import [flags] <file>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return EXIT_CONFIG_ERROR
+	}
+	importer, ok := curveImporters[format]
+	if !ok {
+		slog.Error("unknown import format", "format", format)
+		return EXIT_CONFIG_ERROR
+	}
+
+	path := flags.Arg(0)
+	points, err := importer(path, profile)
+	if err != nil {
+		slog.Error("Unable to import fan curve", "path", path, "format", format, "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+	curve, err := convertImportedCurve(points)
+	if err != nil {
+		slog.Error("Imported fan curve is invalid", "path", path, "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+
+	if configFile == "" {
+		fmt.Println(formatSpeedConfig(curve))
+		return EXIT_OK
+	}
+	if err := updateConfigFile(configFile, "speeds", formatSpeedConfig(curve)); err != nil {
+		slog.Error("Unable to write config file", "path", configFile, "err", err)
+		return EXIT_RUNTIME_FAILURE
+	}
+	fmt.Printf("Fan curve %s is written to %s\n", formatSpeedConfig(curve), configFile)
+	fmt.Printf("Try it with: %s -config %s -dry-run\n", os.Args[0], configFile)
+	return EXIT_OK
+}
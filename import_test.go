@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestConvertImportedCurve(t *testing.T) {
+	tests := []struct {
+		name   string
+		points [][2]float64
+		want   string
+	}{
+		{name: "rounded", points: [][2]float64{{30.4, 20.5}, {60.6, 79.4}}, want: "30:21,61:79"},
+		{name: "clamped", points: [][2]float64{{-5, -10}, {200, 150}}, want: "0:0,150:100"},
+		{name: "points not above previous are dropped", points: [][2]float64{{40, 30}, {40.2, 50}, {35, 60}, {70, 80}}, want: "40:30,70:80"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			curve, err := convertImportedCurve(tt.points)
+			if err != nil {
+				t.Fatalf("convertImportedCurve: %v", err)
+			}
+			if got := formatSpeedConfig(curve); got != tt.want {
+				t.Errorf("convertImportedCurve = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertImportedCurveErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		points [][2]float64
+	}{
+		{name: "empty", points: nil},
+		{name: "not a number", points: [][2]float64{{40, 30}, {math.NaN(), 50}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if curve, err := convertImportedCurve(tt.points); err == nil {
+				t.Errorf("convertImportedCurve = %v, want error", curve)
+			}
+		})
+	}
+}
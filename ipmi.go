@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const IPMITOOL_BIN = "ipmitool"
+
+// Vendors of BMC, whose chassis fans can be controlled by IPMI raw commands
+const (
+	IPMI_VENDOR_SUPERMICRO = "supermicro"
+	IPMI_VENDOR_DELL       = "dell"
+)
+
+// Supermicro fan zones, which are CPU zone and peripheral zone where GPUs are
+var IPMI_SUPERMICRO_ZONES = []byte{0x00, 0x01}
+
+// ipmiCooler raises chassis fan duty of servers by IPMI raw commands through ipmitool, as datacenter GPUs are passively
+// cooled and depend entirely on chassis airflow. BMC is switched to manual fan control, and returned to its previous
+// automatic mode on exit.
+type ipmiCooler struct {
+	vendor string
+	// Arguments given to ipmitool before raw command, e.g. -I lanplus -H <host> -U <user> -E for remote BMC
+	args []string
+	// Fan mode of Supermicro BMC before this process took control
+	previousMode string
+	enabled      bool
+}
+
+func newIPMICooler(vendor string, argsStr string, dryrun bool) (*ipmiCooler, error) {
+	c := &ipmiCooler{vendor: vendor, args: strings.Fields(argsStr)}
+	switch vendor {
+	case IPMI_VENDOR_SUPERMICRO:
+		output, err := c.raw("0x30", "0x45", "0x00")
+		if err != nil {
+			return nil, fmt.Errorf("unable to get fan mode of BMC: %w", err)
+		}
+		c.previousMode = "0x" + strings.TrimSpace(output)
+		if dryrun {
+			return c, nil
+		}
+		// Full mode keeps BMC from overriding duty set by raw command
+		if _, err := c.raw("0x30", "0x45", "0x01", "0x01"); err != nil {
+			return nil, fmt.Errorf("unable to switch BMC to full fan mode: %w", err)
+		}
+	case IPMI_VENDOR_DELL:
+		if dryrun {
+			return c, nil
+		}
+		if _, err := c.raw("0x30", "0x30", "0x01", "0x00"); err != nil {
+			return nil, fmt.Errorf("unable to switch BMC to manual fan control: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("IPMI vendor must be %s or %s: %s", IPMI_VENDOR_SUPERMICRO, IPMI_VENDOR_DELL, vendor)
+	}
+	c.enabled = true
+	return c, nil
+}
+
+// raw runs IPMI raw command, and returns its output
+func (c *ipmiCooler) raw(bytesHex ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), COOLER_COMMAND_TIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, IPMITOOL_BIN, append(append(append([]string{}, c.args...), "raw"), bytesHex...)...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("ipmitool failed; err: %w, output: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return stdout.String(), nil
+}
+
+func (c *ipmiCooler) name() string {
+	return "ipmi " + c.vendor
+}
+
+func (c *ipmiCooler) setSpeed(speed uint8) error {
+	duty := fmt.Sprintf("0x%02x", speed)
+	switch c.vendor {
+	case IPMI_VENDOR_SUPERMICRO:
+		for _, zone := range IPMI_SUPERMICRO_ZONES {
+			if _, err := c.raw("0x30", "0x70", "0x66", "0x01", fmt.Sprintf("0x%02x", zone), duty); err != nil {
+				return fmt.Errorf("unable to set duty of fan zone %d: %w", zone, err)
+			}
+		}
+		return nil
+	default:
+		_, err := c.raw("0x30", "0x30", "0x02", "0xff", duty)
+		return err
+	}
+}
+
+func (c *ipmiCooler) restore() error {
+	if !c.enabled {
+		return nil
+	}
+	switch c.vendor {
+	case IPMI_VENDOR_SUPERMICRO:
+		_, err := c.raw("0x30", "0x45", "0x01", c.previousMode)
+		return err
+	default:
+		_, err := c.raw("0x30", "0x30", "0x01", "0x01")
+		return err
+	}
+}
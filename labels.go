@@ -0,0 +1,36 @@
+package main
+
+import "log/slog"
+
+// Label keys attached to metrics and logs of a GPU device and its fans, so that multi-GPU dashboards can be assembled without relabeling
+const (
+	LABEL_GPU_INDEX = "gpu_index"
+	LABEL_GPU_UUID  = "gpu_uuid"
+	LABEL_GPU_NAME  = "gpu_name"
+	LABEL_FAN_INDEX = "fan_index"
+)
+
+// deviceLabels identifies a GPU device in metrics and logs
+type deviceLabels struct {
+	index int
+	uuid  string
+	name  string
+}
+
+// newDeviceLabels queries labels of the device. Labels which cannot be queried are left empty, as they are informational only.
+func newDeviceLabels(index int, device gpuDevice) deviceLabels {
+	labels := deviceLabels{index: index}
+	var err error
+	if labels.uuid, err = device.UUID(); err != nil {
+		slog.Warn("Unable to get device UUID for labels", LABEL_GPU_INDEX, index, "err", err)
+	}
+	if labels.name, err = device.Name(); err != nil {
+		slog.Warn("Unable to get device name for labels", LABEL_GPU_INDEX, index, "err", err)
+	}
+	return labels
+}
+
+// logger returns logger, which attaches device labels to every record
+func (l deviceLabels) logger() *slog.Logger {
+	return moduleLogger(LOG_MODULE_CONTROLLER).With(LABEL_GPU_INDEX, l.index, LABEL_GPU_UUID, l.uuid, LABEL_GPU_NAME, l.name)
+}
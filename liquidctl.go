@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	LIQUIDCTL_BIN = "liquidctl"
+	// Cooler command is killed if it does not finish within this duration, so that it never stalls other coolers
+	COOLER_COMMAND_TIMEOUT = 10 * time.Second
+)
+
+// runCoolerCommand runs command with timeout, and returns its output in error if it fails
+func runCoolerCommand(cmd *exec.Cmd) error {
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("cooler command failed; err: %w, output: %s", err, bytes.TrimSpace(output.Bytes()))
+	}
+	return nil
+}
+
+// liquidctlChannel drives a channel of a device supported by liquidctl e.g. pump of AIO liquid cooler
+type liquidctlChannel struct {
+	match   string
+	channel string
+}
+
+// parseLiquidctlChannels parses list of liquidctl device match and channel pairs e.g. kraken:pump,kraken:fan
+func parseLiquidctlChannels(channelsStr string) ([]*liquidctlChannel, error) {
+	var channels []*liquidctlChannel
+	for _, pairStr := range strings.Split(channelsStr, ",") {
+		match, channel, found := strings.Cut(strings.TrimSpace(pairStr), ":")
+		if !found || match == "" || channel == "" {
+			return nil, fmt.Errorf("liquidctl channel %q must be in format match:channel", pairStr)
+		}
+		channels = append(channels, &liquidctlChannel{match: match, channel: channel})
+	}
+	return channels, nil
+}
+
+func (c *liquidctlChannel) name() string {
+	return "liquidctl " + c.match + ":" + c.channel
+}
+
+func (c *liquidctlChannel) setSpeed(speed uint8) error {
+	ctx, cancel := context.WithTimeout(context.Background(), COOLER_COMMAND_TIMEOUT)
+	defer cancel()
+	return runCoolerCommand(exec.CommandContext(ctx, LIQUIDCTL_BIN, "--match", c.match, "set", c.channel, "speed", strconv.Itoa(int(speed))))
+}
+
+// restore leaves the channel at full speed, as liquidctl has no automatic mode to return to
+func (c *liquidctlChannel) restore() error {
+	return c.setSpeed(MAX_FAN_SPEED_PERCENT)
+}
+
+// commandCooler runs a shell command to set speed of a cooler, which is a stable interface for coolers
+// not supported otherwise. Speed in percent is passed by NVML_FAN_COOLER_SPEED environment variable,
+// and NVML_FAN_COOLER_RESTORE is set to 1 when the cooler should return to its own control on exit.
+type commandCooler struct {
+	command string
+}
+
+func (c *commandCooler) name() string {
+	return "command"
+}
+
+func (c *commandCooler) run(env ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), COOLER_COMMAND_TIMEOUT)
+	defer cancel()
+	cmd := shellCommand(ctx, c.command)
+	cmd.Env = append(os.Environ(), env...)
+	return runCoolerCommand(cmd)
+}
+
+func (c *commandCooler) setSpeed(speed uint8) error {
+	return c.run("NVML_FAN_COOLER_SPEED="+strconv.Itoa(int(speed)), "NVML_FAN_COOLER_RESTORE=0")
+}
+
+func (c *commandCooler) restore() error {
+	return c.run("NVML_FAN_COOLER_SPEED=", "NVML_FAN_COOLER_RESTORE=1")
+}
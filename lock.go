@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errInstanceLocked means the lock is held by another process
+var errInstanceLocked = errors.New("lock is held by another process")
+
+// deviceLockFile returns path of lock file of the device, which is keyed by UUID so that it does not depend on
+// device index, which may change between boots or differ between processes with different CUDA_VISIBLE_DEVICES
+func deviceLockFile(dir, uuid string) string {
+	return filepath.Join(dir, strings.ReplaceAll(uuid, string(filepath.Separator), "_")+".lock")
+}
+
+// lockDevice takes exclusive lock of the device, so that two processes cannot silently fight over its fan speed.
+// The lock is released by the returned function, or by the OS when the process exits.
+func lockDevice(dir, uuid string) (func(), error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create lock directory: %w", err)
+	}
+	path := deviceLockFile(dir, uuid)
+	release, err := lockFile(path)
+	if errors.Is(err, errInstanceLocked) {
+		holder := ""
+		if pid, err := os.ReadFile(path); err == nil {
+			holder = strings.TrimSpace(string(pid))
+		}
+		if holder != "" {
+			return nil, fmt.Errorf("%w, device %s is controlled by pid %s; lock: %s", err, uuid, holder, path)
+		}
+		return nil, fmt.Errorf("%w, device %s is controlled by another instance; lock: %s", err, uuid, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to lock %s: %w", path, err)
+	}
+	return release, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rotatingFile is a log file writer, which rotates the file when it grows over max size or gets older than max age.
+// Rotated files are renamed with timestamp suffix, and only the newest max backups files are kept.
+type rotatingFile struct {
+	mu sync.Mutex
+
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("unable to create log directory: %w", err)
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("unable to stat log file: %w", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	// Existing file is rotated by age based on its modification time, as creation time is not portable
+	f.openedAt = time.Now()
+	if f.size > 0 {
+		f.openedAt = info.ModTime()
+	}
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("unable to close log file: %w", err)
+	}
+	rotatedPath := fmt.Sprintf("%s.%s", f.path, time.Now().Format("20060102-150405"))
+	renameErr := os.Rename(f.path, rotatedPath)
+	// Reopen log file even if rename fails, so that logging can continue
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return fmt.Errorf("unable to rename log file: %w", renameErr)
+	}
+
+	rotatedPaths, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return fmt.Errorf("unable to list rotated log files: %w", err)
+	}
+	// Timestamp suffix sorts in chronological order
+	sort.Strings(rotatedPaths)
+	for len(rotatedPaths) > f.maxBackups {
+		if err := os.Remove(rotatedPaths[0]); err != nil {
+			return fmt.Errorf("unable to remove old log file: %w", err)
+		}
+		rotatedPaths = rotatedPaths[1:]
+	}
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.size > 0 && (f.size+int64(len(p)) > f.maxSize || time.Since(f.openedAt) > f.maxAge) {
+		if err := f.rotate(); err != nil {
+			// Logger cannot be used here, as it writes to this file
+			fmt.Fprintf(os.Stderr, "unable to rotate log file: %s\n", err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
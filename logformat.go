@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// Formats of log records, which can be chosen by -log-format
+const (
+	LOG_FORMAT_TEXT   = "text"
+	LOG_FORMAT_JSON   = "json"
+	LOG_FORMAT_LOGFMT = "logfmt"
+)
+
+// logHandlerFactory creates handler, which writes records to w in its format
+type logHandlerFactory func(w io.Writer, opts *slog.HandlerOptions) slog.Handler
+
+// logFormats maps each format to its handler factory, so that a format is added by adding its factory here
+var logFormats = map[string]logHandlerFactory{
+	LOG_FORMAT_TEXT: func(w io.Writer, opts *slog.HandlerOptions) slog.Handler {
+		return slog.NewTextHandler(w, opts)
+	},
+	LOG_FORMAT_JSON: func(w io.Writer, opts *slog.HandlerOptions) slog.Handler {
+		return slog.NewJSONHandler(w, opts)
+	},
+	LOG_FORMAT_LOGFMT: newLogfmtHandler,
+}
+
+// logFormatNames returns names of supported log formats in alphabetical order
+func logFormatNames() []string {
+	names := make([]string, 0, len(logFormats))
+	for name := range logFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newLogHandler returns handler, which writes records to w in the format
+func newLogHandler(format string, w io.Writer, opts *slog.HandlerOptions) (slog.Handler, error) {
+	factory, ok := logFormats[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown log format %q, it must be one of %s", format, strings.Join(logFormatNames(), ", "))
+	}
+	return factory(w, opts), nil
+}
+
+// newLogfmtHandler returns handler, which writes records as logfmt lines e.g. ts=... level=info msg="..." key=value.
+// Text handler already writes space-separated key=value pairs with quoted values where needed, so that only the keys
+// and values of built-in attributes are changed to the ones logfmt parsers expect.
+func newLogfmtHandler(w io.Writer, opts *slog.HandlerOptions) slog.Handler {
+	logfmtOpts := *opts
+	replaceAttr := opts.ReplaceAttr
+	logfmtOpts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) == 0 {
+			switch a.Key {
+			case slog.TimeKey:
+				a.Key = "ts"
+			case slog.LevelKey:
+				a.Value = slog.StringValue(strings.ToLower(a.Value.String()))
+			}
+		}
+		if replaceAttr != nil {
+			return replaceAttr(groups, a)
+		}
+		return a
+	}
+	return slog.NewTextHandler(w, &logfmtOpts)
+}
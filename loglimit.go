@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type logLimiterEntry struct {
+	lastLoggedAt time.Time
+	suppressed   int
+}
+
+// logLimiter suppresses repeated log messages, which would be logged on every polling tick otherwise.
+// A message is logged at most once per interval, with the number of suppressed repetitions since it was last logged.
+type logLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	entries  map[string]*logLimiterEntry
+	logger   *slog.Logger
+}
+
+// newLogLimiter returns limiter, which logs by the logger, or by default logger if logger is nil
+func newLogLimiter(interval time.Duration, logger *slog.Logger) *logLimiter {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &logLimiter{
+		interval: interval,
+		entries:  make(map[string]*logLimiterEntry),
+		logger:   logger,
+	}
+}
+
+func (l *logLimiter) log(level slog.Level, msg string, args ...any) {
+	now := time.Now()
+
+	l.mu.Lock()
+	entry, ok := l.entries[msg]
+	if ok && now.Sub(entry.lastLoggedAt) < l.interval {
+		entry.suppressed++
+		l.mu.Unlock()
+		return
+	}
+	if ok && entry.suppressed > 0 {
+		args = append(args, "suppressed", entry.suppressed, "since", entry.lastLoggedAt)
+	}
+	l.entries[msg] = &logLimiterEntry{lastLoggedAt: now}
+	l.mu.Unlock()
+
+	l.logger.Log(context.Background(), level, msg, args...)
+}
+
+func (l *logLimiter) Warn(msg string, args ...any) {
+	l.log(slog.LevelWarn, msg, args...)
+}
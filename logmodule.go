@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Key of log attribute, which tells subsystem emitting the record, so that log level can be set per subsystem
+const LOG_MODULE_KEY = "module"
+
+// Subsystems, whose log level can be set by -log-levels
+const (
+	LOG_MODULE_CONTROLLER = "controller"
+	LOG_MODULE_NVML       = "nvml"
+	LOG_MODULE_API        = "api"
+	LOG_MODULE_METRICS    = "metrics"
+)
+
+var logModules = map[string]bool{
+	LOG_MODULE_CONTROLLER: true,
+	LOG_MODULE_NVML:       true,
+	LOG_MODULE_API:        true,
+	LOG_MODULE_METRICS:    true,
+}
+
+// moduleLogger returns default logger, which attaches the subsystem to every record
+func moduleLogger(module string) *slog.Logger {
+	return slog.With(LOG_MODULE_KEY, module)
+}
+
+// parseLogLevels parses comma-separated list of module=level pairs e.g. controller=DEBUG,api=WARN
+func parseLogLevels(levelsStr string) (map[string]slog.Level, error) {
+	levels := make(map[string]slog.Level)
+	if levelsStr == "" {
+		return levels, nil
+	}
+	for _, pair := range strings.Split(levelsStr, ",") {
+		module, levelStr, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("log level %q must be module=level", pair)
+		}
+		if !logModules[module] {
+			return nil, fmt.Errorf("unknown log module %q, it must be one of %s, %s, %s or %s", module, LOG_MODULE_CONTROLLER, LOG_MODULE_NVML, LOG_MODULE_API, LOG_MODULE_METRICS)
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(levelStr)); err != nil {
+			return nil, fmt.Errorf("unable to parse log level of %s: %w", module, err)
+		}
+		levels[module] = level
+	}
+	return levels, nil
+}
+
+// moduleLevelHandler filters records by log level of their module, or by default level if the module has no level.
+// Wrapped handler must accept records at the lowest of the levels.
+type moduleLevelHandler struct {
+	next         slog.Handler
+	levels       map[string]slog.Level
+	defaultLevel slog.Level
+	// Module attached by logger.With, empty if not attached yet
+	module string
+}
+
+func newModuleLevelHandler(next slog.Handler, levels map[string]slog.Level, defaultLevel slog.Level) *moduleLevelHandler {
+	return &moduleLevelHandler{next: next, levels: levels, defaultLevel: defaultLevel}
+}
+
+func (h *moduleLevelHandler) level(module string) slog.Level {
+	if level, ok := h.levels[module]; ok {
+		return level
+	}
+	return h.defaultLevel
+}
+
+func (h *moduleLevelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if h.module == "" {
+		// Module may still be given as an attribute of the record, which is checked by Handle
+		minLevel := h.defaultLevel
+		for _, moduleLevel := range h.levels {
+			minLevel = min(minLevel, moduleLevel)
+		}
+		return level >= minLevel && h.next.Enabled(ctx, level)
+	}
+	return level >= h.level(h.module) && h.next.Enabled(ctx, level)
+}
+
+func (h *moduleLevelHandler) Handle(ctx context.Context, record slog.Record) error {
+	module := h.module
+	record.Attrs(func(attr slog.Attr) bool {
+		if attr.Key == LOG_MODULE_KEY {
+			module = attr.Value.String()
+			return false
+		}
+		return true
+	})
+	if record.Level < h.level(module) {
+		return nil
+	}
+	return h.next.Handle(ctx, record)
+}
+
+func (h *moduleLevelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handler := *h
+	handler.next = h.next.WithAttrs(attrs)
+	for _, attr := range attrs {
+		if attr.Key == LOG_MODULE_KEY {
+			handler.module = attr.Value.String()
+		}
+	}
+	return &handler
+}
+
+func (h *moduleLevelHandler) WithGroup(name string) slog.Handler {
+	handler := *h
+	handler.next = h.next.WithGroup(name)
+	return &handler
+}
@@ -1,18 +1,25 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
+	"math"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
-
-	"github.com/NVIDIA/go-nvml/pkg/nvml"
 )
 
 const (
@@ -20,6 +27,27 @@ const (
 	MAX_TEMP = uint8(150)
 
 	MAX_FAN_SPEED_PERCENT = uint8(100)
+
+	MAX_TEMP_OFFSET = 50
+	// Deepest performance state, while greater values mean unknown
+	MAX_PSTATE = 15
+	// Fans return to stock fan curve when temperature drops this number of degrees below takeover temperature
+	TAKEOVER_HYSTERESIS = 3
+	// Dry-run table covers temperatures up to this value, or up to the last point of the curves if higher
+	DRY_RUN_TABLE_MAX_TEMP = 100
+	// Unchanged fan speed is written again after this duration, in case the driver or another program has changed it
+	FAN_SPEED_REASSERT_INTERVAL = time.Minute
+)
+
+// Process exit codes, so that systemd (Restart=on-failure) and scripts can react to the failure
+const (
+	EXIT_OK                 = 0
+	EXIT_CONFIG_ERROR       = 2
+	EXIT_NVML_INIT_FAILURE  = 3
+	EXIT_UNSUPPORTED_DEVICE = 4
+	EXIT_RUNTIME_FAILURE    = 5
+	EXIT_PERMISSION_DENIED  = 6
+	EXIT_CONFLICT           = 7
 )
 
 func generateTempNFanSpeedMap(ranges [][2]uint8) map[uint8]uint8 {
@@ -51,7 +79,7 @@ func generateTempNFanSpeedMap(ranges [][2]uint8) map[uint8]uint8 {
 		// m = (y_2-y_1)/(x_2-x_1)
 		linearSlope := float32(0)
 		if endRangeTemp-r[0] != 0 {
-			linearSlope = float32(endRangeFanSpeed-r[1]) / float32(endRangeTemp-r[0])
+			linearSlope = (float32(endRangeFanSpeed) - float32(r[1])) / float32(endRangeTemp-r[0])
 		}
 		for temp := r[0]; temp < endRangeTemp; temp++ {
 			// y = m(x-x_0)+y_0
@@ -62,106 +90,808 @@ func generateTempNFanSpeedMap(ranges [][2]uint8) map[uint8]uint8 {
 	return bucket
 }
 
-func runCustomGPUFanCurve(device nvml.Device, speedMap map[uint8]uint8, pollingDuration time.Duration, dryrun bool, cancel chan bool) error {
-	ticker := time.NewTicker(pollingDuration)
+// controlConfig contains settings of the control loop
+type controlConfig struct {
+	speedMap map[uint8]uint8
+	// Fan speed map based on memory temperature, nil means disabled.
+	// If enabled, applied fan speed is the maximum of core and memory temperature curves.
+	memorySpeedMap map[uint8]uint8
+	// Temperature read from external source e.g. coolant sensor, nil means disabled.
+	// If enabled, applied fan speed is also at least the speed of sourceSpeedMap at source temperature.
+	tempSource      temperatureSource
+	sourceSpeedMap  map[uint8]uint8
+	pollingDuration time.Duration
+	dryrun          bool
+	// Fan speed computed by the curve is clamped to this value, except when failsafe is engaged
+	maxSpeed uint8
+	// Fan speed computed by the curve never drops below this value, even when the curve says 0
+	minSpeed uint8
+	// Fan speed computed by the curve is rounded up to a multiple of this value, 0 or 1 means disabled
+	speedStep uint8
+	// Fans run at full speed when temperature reaches this value, 0 means disabled
+	failsafeTemp uint8
+	// Curve outputs in RPM, which are converted to duty by feedback from measured RPM. nil means speedMap is used instead
+	rpmCurve []rpmPoint
+	// Fan speed is adjusted by feedback to hold temperature at this value instead of the curve lookup, 0 means disabled
+	targetTemp uint8
+	// Curve is looked up by temperature predicted this duration ahead from recent trend, 0 means disabled
+	predictAhead time.Duration
+	// Fans are left to stock fan curve of the device below this temperature, 0 means disabled
+	takeoverTemp uint8
+	// Fans are left to stock fan curve of the device while it is in this P-state or deeper e.g. P8, 0 means disabled
+	idlePState uint8
+	// Fan speeds applied when temperature is above or below the map
+	fallbackSpeedAbove uint8
+	fallbackSpeedBelow uint8
+	// Offset in Celsius added to reported temperature before the curve lookup
+	tempOffset int
+	// A single reading deviating from the previous one by more than this number of Celsius is ignored, 0 means disabled
+	spikeThreshold uint8
+	// Temperature is the median of this number of recent readings, 0 or 1 means disabled
+	medianSamples uint
+	// Path to file, where applied fan speeds are saved. Empty means disabled
+	stateFile string
+	// Repeated warnings are logged at most once per this interval
+	logRepeatInterval time.Duration
+	// Logger with labels of the device, nil means default logger
+	logger *slog.Logger
+	// Labels of the device attached to alerts
+	labels deviceLabels
+	// Alerts of cooling problems are sent by this dispatcher, nil means disabled
+	alerts *alertDispatcher
+	// Overtemp alert is sent when temperature stays at or above this value for alertTempDuration, 0 means disabled
+	alertTemp         uint8
+	alertTempDuration time.Duration
+	// Rapid rise alarm is raised when temperature rises faster than this rate in Celsius per second, 0 means disabled
+	riseRate float64
+	// Fans run at full speed for this duration on rapid rise, the same way as boost. 0 means alarm only
+	riseBoostDuration time.Duration
+	// Curve is looked up by weighted average of sensor temperatures instead of core temperature, nil means disabled
+	blend temperatureBlend
+	// Fan speed is computed by this formula instead of the curve lookup, nil means disabled
+	formula *speedFormula
+	// Polling interval is chosen by temperature trend between fast and slow intervals, nil means fixed interval
+	poller *adaptivePoller
+	// Apply fan speed immediately on NVML events, in addition to polling
+	nvmlEvents bool
+	// Fan speed is written at most once per this interval, while temperature is still sampled at every polling. 0 means every polling
+	writeInterval time.Duration
+	// Fans controlled by this loop, while other fans are kept on driver automatic policy
+	fans fanSelection
+	// Power limit of the device in watts, which is set on startup and restored on exit. 0 means unchanged
+	powerLimit uint
+	// Min and max GPU clock in MHz, which are locked on startup and reset on exit. Zeros mean unlocked
+	lockedClocks [2]uint32
+	// Device does not support fan control, so that its temperature is monitored without touching fans
+	observeOnly bool
+	// Polling is lengthened on battery or while the GPU idles, and aligned to wall clock, so that wakeups are coalesced
+	lowWakeup bool
+}
+
+// applyTempOffset adds offset to reported temperature, without going below 0
+func applyTempOffset(temperature uint32, offset int) uint32 {
+	return uint32(max(int(temperature)+offset, 0))
+}
+
+// limitFanSpeed rounds the speed computed by the curve up to speed step, applies fan speed floor and cap to it,
+// and returns whether failsafe is engaged. When failsafe is engaged, fans always run at full speed regardless of the cap.
+func limitFanSpeed(speed uint8, temperature uint32, config controlConfig) (uint8, bool) {
+	if config.failsafeTemp > 0 && temperature >= uint32(config.failsafeTemp) {
+		return MAX_FAN_SPEED_PERCENT, true
+	}
+	if step := uint(config.speedStep); step > 1 && uint(speed)%step != 0 {
+		speed = uint8(min((uint(speed)/step+1)*step, uint(MAX_FAN_SPEED_PERCENT)))
+	}
+	return max(min(speed, config.maxSpeed), config.minSpeed), false
+}
+
+// lookupFanSpeed returns fan speed of the temperature from the map. When temperature is outside the map,
+// fallback speed above or below the map is returned instead. It returns false only if the map is empty.
+func lookupFanSpeed(speedMap map[uint8]uint8, temperature uint32, config controlConfig) (uint8, bool) {
+	if temperature <= uint32(MAX_TEMP) {
+		if speed, ok := speedMap[uint8(temperature)]; ok {
+			return speed, true
+		}
+	}
+	if len(speedMap) == 0 {
+		return 0, false
+	}
+	lowest, highest := MAX_TEMP, MIN_TEMP
+	for temp := range speedMap {
+		lowest, highest = min(lowest, temp), max(highest, temp)
+	}
+	if temperature > uint32(highest) {
+		return config.fallbackSpeedAbove, true
+	}
+	if temperature < uint32(lowest) {
+		return config.fallbackSpeedBelow, true
+	}
+	return 0, false
+}
+
+// runCustomGPUFanCurve controls fans of the device by the fan curve until ctx is done, then returns nil.
+// Error is returned if the device cannot be controlled anymore.
+func runCustomGPUFanCurve(ctx context.Context, handle *deviceHandle, config controlConfig, state *controllerState, togglePause chan struct{}, applyNow chan struct{}, prepareSleep chan sleepEvent) error {
+	speedMap := config.speedMap
+	dryrun := config.dryrun
+	pollingDuration := config.pollingDuration
+	// Interval of the ticker, which is longer than polling interval while low-wakeup mode slows polling down
+	tickerInterval := pollingDuration
+	ticker := newPollTicker(tickerInterval, config.lowWakeup)
 	defer ticker.Stop()
 
-	deviceName, ret := device.GetName()
-	if ret != nvml.SUCCESS {
-		return fmt.Errorf("unable to get device name; err: %s", nvml.ErrorString(ret))
+	device := handle.get()
+	logger := config.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	var lowWakeup *lowWakeupPolicy
+	if config.lowWakeup {
+		lowWakeup = newLowWakeupPolicy(logger)
+	}
+
+	deviceName, err := device.Name()
+	if err != nil {
+		return fmt.Errorf("unable to get device name; err: %w", err)
+	}
+	fans, autoFans, err := controlledFans(device, config.fans)
+	if config.observeOnly {
+		// Fans are never touched, while temperature is still polled for status, history and metrics
+		fans, autoFans, err = nil, nil, nil
+		logger.Info("Observe-only mode, fan speed is controlled by the device")
+	}
+	if err != nil {
+		return fmt.Errorf("%w, device: %s", err, deviceName)
+	}
+	if len(fans) == 0 && !config.observeOnly {
+		return fmt.Errorf("device has no fan to control; device: %s", deviceName)
+	}
+	// Fans may have been left on manual policy by previous process, e.g. when it crashed
+	if len(autoFans) > 0 {
+		logger.Info("Keep fans on driver automatic policy", "fans", autoFans, "controlledFans", fans)
+		restoreDefaultFanSpeeds(logger, device, autoFans, dryrun)
+	}
+
+	var uuid string
+	if config.stateFile != "" {
+		if uuid, err = device.UUID(); err != nil {
+			return fmt.Errorf("unable to get device uuid; err: %w, device: %s", err, deviceName)
+		}
+	}
+	savedSpeeds := make(map[int]uint8)
+
+	var rpmCtl *rpmController
+	if config.rpmCurve != nil && !config.observeOnly {
+		minDuty, maxDuty, err := device.MinMaxFanSpeed()
+		if err != nil {
+			return fmt.Errorf("unable to get min/max fan speed, which is required by RPM-target mode; device: %s, err: %w", deviceName, err)
+		}
+		if _, err := device.FanSpeedRPM(); err != nil {
+			return fmt.Errorf("unable to get fan RPM, which is required by RPM-target mode; device: %s, err: %w", deviceName, err)
+		}
+		initialDuty, err := device.FanSpeed(fans[0])
+		if err != nil {
+			initialDuty = minDuty
+		}
+		rpmCtl = newRPMController(uint8(minDuty), uint8(min(maxDuty, uint32(MAX_FAN_SPEED_PERCENT))), uint8(initialDuty))
+		logger.Info("RPM-target mode enabled", "minDuty", minDuty, "maxDuty", maxDuty)
+	}
+	var targetCtl *targetTempController
+	if config.targetTemp > 0 && !config.observeOnly {
+		initialSpeed, err := device.FanSpeed(fans[0])
+		if err != nil {
+			initialSpeed = uint32(config.minSpeed)
+		}
+		targetCtl = newTargetTempController(config.targetTemp, config.minSpeed, config.maxSpeed, uint8(min(initialSpeed, uint32(MAX_FAN_SPEED_PERCENT))))
+		logger.Info("Target temperature mode enabled", "targetTemp", config.targetTemp, "initialSpeed", initialSpeed)
+	}
+
+	var predictor *temperaturePredictor
+	if config.predictAhead > 0 {
+		predictor = newTemperaturePredictor(config.predictAhead)
+	}
+	var rise *riseDetector
+	if config.riseRate > 0 {
+		rise = newRiseDetector(config.riseRate)
+	}
+	var spikes *spikeFilter
+	if config.spikeThreshold > 0 {
+		spikes = newSpikeFilter(uint32(config.spikeThreshold))
+	}
+	var median *medianFilter
+	if config.medianSamples > 1 {
+		median = newMedianFilter(int(config.medianSamples))
+	}
+	limiter := newLogLimiter(config.logRepeatInterval, logger)
+	paused := false
+	failsafe := false
+	overtemp := false
+	// Temperature of previous update, which tells whether temperature is rising for fan speed formula
+	var lastTemperature uint32
+	hasLastTemperature := false
+	var overtempSince time.Time
+	detector := newSuspendDetector(time.Now())
+	reopenPending := false
+	// Set between sleep and resume announced by logind, while fans are left to driver default policy
+	asleep := false
+	// Takeover and pending speed between fan speed writes, which are carried from one decision to the next
+	decisionState := newFanDecisionState()
+	// Speeds last written to fans, so that unchanged speeds are not written at every polling. It is cleared whenever
+	// fans may have left the speed, e.g. when they are returned to driver or the device is reopened.
+	writtenSpeeds := make(map[int]uint8)
+	var reassertedAt time.Time
+	// update reads temperature and applies fan speed. Unless forced, fan speed is written at most once per write interval
+	update := func(force bool) error {
+		startedAt := time.Now()
+		defer func() {
+			state.setLoopLatency(time.Since(startedAt))
+			state.publishSample()
+		}()
+		if liveSpeedMap := state.speedMap(); liveSpeedMap != nil {
+			speedMap = liveSpeedMap
+		}
+		livePollingDuration := state.pollingDuration()
+		if livePollingDuration > 0 && livePollingDuration != pollingDuration {
+			logger.Info("Polling interval is changed", "from", pollingDuration, "to", livePollingDuration)
+			pollingDuration = livePollingDuration
+		}
+		// Get current temperature
+		temperature, err := device.Temperature()
+		if err != nil {
+			state.incTemperatureErrors()
+			return fmt.Errorf("unable to get device temperature; device: %s, err: %w", deviceName, err)
+		}
+		reportedTemperature := temperature
+		if spikes != nil {
+			if filtered, ignored := spikes.filter(reportedTemperature); ignored {
+				limiter.Warn("ignore temperature spike, which is used only if the next reading confirms it", "temperature", reportedTemperature, "previousTemperature", filtered, "spikeThreshold", config.spikeThreshold)
+				temperature = filtered
+			}
+		}
+		if median != nil {
+			temperature = median.filter(temperature)
+		}
+		temperature = applyTempOffset(temperature, config.tempOffset)
+		previousTemperature, hasPrevious := lastTemperature, hasLastTemperature
+		lastTemperature, hasLastTemperature = temperature, true
+		if !hasPrevious {
+			previousTemperature = temperature
+		}
+		logger.Debug("current temperature", "temperature", temperature, "reportedTemperature", reportedTemperature)
+		state.setTemperature(reportedTemperature, temperature)
+		if config.alerts != nil && config.alertTemp > 0 {
+			if temperature >= uint32(config.alertTemp) {
+				if overtempSince.IsZero() {
+					overtempSince = time.Now()
+				}
+				if !overtemp && time.Since(overtempSince) >= config.alertTempDuration {
+					overtemp = true
+					config.alerts.send(ALERT_OVERTEMP, config.labels, temperature, fmt.Sprintf("GPU temperature %d°C has stayed at or above alert temperature %d°C for %s", temperature, config.alertTemp, time.Since(overtempSince).Round(time.Second)))
+				}
+			} else {
+				overtempSince = time.Time{}
+				if overtemp && temperature+ALERT_HYSTERESIS < uint32(config.alertTemp) {
+					overtemp = false
+				}
+			}
+		}
+		if rise != nil {
+			if rate, started := rise.observe(time.Now(), temperature); started {
+				rate = math.Round(rate*100) / 100
+				logger.Warn("Temperature rises rapidly, which may indicate fan failure or blocked airflow", "temperature", temperature, "rate", rate, "riseRate", config.riseRate)
+				if config.alerts != nil {
+					config.alerts.send(ALERT_RAPID_RISE, config.labels, temperature, fmt.Sprintf("GPU temperature is rising at %g°C/s, faster than alert rate %g°C/s", rate, config.riseRate))
+				}
+				// Override set by user is kept, while failsafe still protects the GPU
+				if config.riseBoostDuration > 0 && !paused && !config.observeOnly {
+					if _, _, active, _ := state.activeOverride(time.Now()); active {
+						logger.Info("Fan speed override is active, skip boost on rapid rise")
+					} else {
+						until := time.Now().Add(config.riseBoostDuration)
+						state.setOverride(MAX_FAN_SPEED_PERCENT, until, nil)
+						logger.Info("Boost fans on rapid rise", "until", until)
+					}
+				}
+			}
+		}
+
+		// Polling interval changed at runtime replaces adaptive polling
+		if config.poller != nil && livePollingDuration == 0 {
+			if interval := config.poller.next(temperature); interval != pollingDuration {
+				logger.Debug("change polling interval", "from", pollingDuration, "to", interval, "temperature", temperature)
+				pollingDuration = interval
+			}
+		}
+		interval := pollingDuration
+		if lowWakeup != nil {
+			interval = lowWakeup.interval(time.Now(), pollingDuration, device)
+		}
+		if interval != tickerInterval {
+			tickerInterval = interval
+			ticker.Reset(tickerInterval)
+		}
+
+		memoryTemperature, memoryOk := uint32(0), false
+		if config.memorySpeedMap != nil || (config.formula != nil && config.formula.uses(FORMULA_VAR_MEM_TEMP)) || config.blend.uses(BLEND_SENSOR_MEMORY) {
+			memoryTemperature, err = readMemoryTemperature(device)
+			if err != nil {
+				state.incTemperatureErrors()
+				limiter.Warn("unable to get memory temperature, use only core temperature curve at this time", "err", err)
+			} else {
+				memoryOk = true
+				logger.Debug("current memory temperature", "temperature", memoryTemperature)
+				state.setMemoryTemperature(memoryTemperature)
+			}
+		}
+
+		sourceTemperature, sourceOk := uint32(0), false
+		if config.tempSource != nil {
+			sourceTemperature, err = config.tempSource.Temperature()
+			if err != nil {
+				state.incTemperatureErrors()
+				limiter.Warn("unable to get temperature from external source, ignore its curve at this time", "err", err)
+			} else {
+				sourceOk = true
+				logger.Debug("current external source temperature", "temperature", sourceTemperature)
+				state.setSourceTemperature(sourceTemperature)
+			}
+		}
+
+		// Curve is looked up by blended and predicted temperature, while failsafe and takeover still use core temperature
+		curveTemperature := temperature
+		if config.blend != nil {
+			blended, blendOk, err := config.blend.blend(func(sensor string) (uint32, error) {
+				switch sensor {
+				case BLEND_SENSOR_CORE:
+					return temperature, nil
+				case BLEND_SENSOR_MEMORY:
+					if !memoryOk {
+						return 0, fmt.Errorf("memory temperature is not available")
+					}
+					return memoryTemperature, nil
+				case BLEND_SENSOR_SOURCE:
+					if !sourceOk {
+						return 0, fmt.Errorf("external source temperature is not available")
+					}
+					return sourceTemperature, nil
+				case BLEND_SENSOR_BOARD:
+					return readThermalSensor(device, THERMAL_TARGET_BOARD)
+				default:
+					return readThermalSensor(device, THERMAL_TARGET_POWER_SUPPLY)
+				}
+			})
+			if err != nil {
+				limiter.Warn("unable to read a sensor of temperature blend, blend other sensors at this time", "err", err)
+			}
+			if blendOk {
+				curveTemperature = blended
+				logger.Debug("blended temperature", "temperature", temperature, "blendedTemperature", blended)
+			}
+		}
+		if predictor != nil {
+			predicted := predictor.predict(time.Now(), curveTemperature)
+			if predicted != curveTemperature {
+				logger.Debug("predicted temperature", "temperature", curveTemperature, "predictedTemperature", predicted)
+			}
+			curveTemperature = predicted
+		}
+
+		// Fans are under driver control while paused, and always in observe-only mode
+		if paused || config.observeOnly {
+			return nil
+		}
+
+		// Speed is computed by a controller instead of the curve lookup in RPM-target, target temperature and formula modes
+		sample := fanSample{
+			now:               time.Now(),
+			temperature:       temperature,
+			curveTemperature:  curveTemperature,
+			memoryTemperature: memoryTemperature,
+			memoryOk:          memoryOk,
+			sourceTemperature: sourceTemperature,
+			sourceOk:          sourceOk,
+			force:             force,
+		}
+		if rpmCtl != nil {
+			sample.computed = true
+			target := targetRPM(config.rpmCurve, curveTemperature)
+			measured, err := device.FanSpeedRPM()
+			if err != nil {
+				limiter.Warn("unable to get fan RPM, keep current duty at this time", "err", err)
+				sample.computedSpeed, sample.computedOk = rpmCtl.duty, true
+			} else {
+				sample.computedSpeed, sample.computedOk = rpmCtl.next(target, measured), true
+				logger.Debug("RPM-target control", "targetRPM", target, "measuredRPM", measured, "duty", sample.computedSpeed)
+			}
+		} else if targetCtl != nil {
+			sample.computed = true
+			sample.computedSpeed, sample.computedOk = targetCtl.next(sample.now, curveTemperature), true
+			logger.Debug("target temperature control", "temperature", curveTemperature, "targetTemp", config.targetTemp, "speed", sample.computedSpeed)
+		} else if config.formula != nil {
+			sample.computed = true
+			vars, err := readFormulaVars(device, config.formula, curveTemperature, memoryTemperature, sourceTemperature, temperature > previousTemperature)
+			if err != nil {
+				limiter.Warn("unable to read sensor of fan speed formula, use 0 at this time", "err", err)
+			}
+			sample.computedSpeed, err = config.formula.eval(formulaEnv{vars: vars, curves: formulaCurves(speedMap, config)})
+			if err != nil {
+				limiter.Warn("unable to evaluate fan speed formula, ignore updating fan speed at this time", "formula", config.formula.source, "err", err)
+			} else {
+				sample.computedOk = true
+				logger.Debug("fan speed formula", "vars", vars, "speed", sample.computedSpeed)
+			}
+		}
+		var expired bool
+		sample.overrideSpeed, sample.overrideFans, sample.overridden, expired = state.activeOverride(sample.now)
+		if expired {
+			logger.Info("Fan speed override expired, return to configured fan curve")
+		}
+		if config.idlePState > 0 {
+			if sample.pstate, err = device.PerformanceState(); err != nil {
+				limiter.Warn("unable to get performance state, treat the GPU as busy at this time", "err", err)
+			} else {
+				sample.pstateOk = true
+			}
+		}
+
+		decision, nextDecisionState := decideFanSpeed(config, speedMap, decisionState, sample)
+		decisionState = nextDecisionState
+		if decision.failsafe != failsafe {
+			failsafe = decision.failsafe
+			state.setFailsafe(failsafe)
+			if failsafe {
+				logger.Warn("Failsafe engaged, run fans at full speed", "temperature", temperature, "failsafeTemp", config.failsafeTemp)
+				if config.alerts != nil {
+					config.alerts.send(ALERT_FAILSAFE, config.labels, temperature, fmt.Sprintf("Failsafe engaged at %d°C, fans run at full speed", temperature))
+				}
+			} else {
+				logger.Info("Failsafe disengaged, return to configured fan curve", "temperature", temperature)
+			}
+		}
+		if decision.takeOver {
+			state.setStock(false)
+			logger.Info("Take over fan control from stock fan curve", "temperature", temperature, "takeoverTemp", config.takeoverTemp, "pstate", sample.pstate)
+		}
+		if decision.release {
+			state.setStock(true)
+			logger.Info("Return fans to stock fan curve", "temperature", temperature, "takeoverTemp", config.takeoverTemp, "pstate", sample.pstate)
+			restoreDefaultFanSpeeds(logger, device, fans, dryrun)
+			clear(writtenSpeeds)
+		}
+		switch decision.action {
+		case FAN_ACTION_STOCK, FAN_ACTION_HOLD:
+			return nil
+		case FAN_ACTION_SKIP:
+			state.incMissingSpeedBucket()
+			limiter.Warn("cannot find proper fan speed for given temperature, ignore updating fan speed at this time", "temperature", temperature, "buckets", speedMap)
+			return nil
+		}
+
+		if time.Since(reassertedAt) >= FAN_SPEED_REASSERT_INTERVAL {
+			clear(writtenSpeeds)
+			reassertedAt = time.Now()
+		}
+		// Apply target fan speed to NVIDIA GPU
+		appliedSpeeds := make(map[int]uint8, len(fans))
+		for _, i := range fans {
+			fanSpeed := decision.fanSpeed(i, config)
+			if written, ok := writtenSpeeds[i]; ok && written == fanSpeed {
+				logger.Debug("fan speed is unchanged, skip writing", LABEL_FAN_INDEX, i, "speed", int(fanSpeed))
+			} else if !dryrun {
+				logger.Debug("set fan speed", LABEL_FAN_INDEX, i, "speed", int(fanSpeed))
+				if err := device.SetFanSpeed(i, fanSpeed); err != nil {
+					state.incSetSpeedErrors()
+					if errors.Is(err, ErrPolicyRejected) {
+						return fmt.Errorf("device rejected fan speed, which requires root privilege and speed within the range of the device; device: %s, fanIdx: %d, speed: %d, err: %w", deviceName, i, fanSpeed, err)
+					}
+					return fmt.Errorf("unable to set fan speed; device: %s, fanIdx: %d, speed: %d, err: %w", deviceName, i, fanSpeed, err)
+				}
+				writtenSpeeds[i] = fanSpeed
+			} else {
+				logger.Info("(Dryrun) set fan speed", LABEL_FAN_INDEX, i, "speed", fanSpeed)
+				writtenSpeeds[i] = fanSpeed
+			}
+			state.setFanSpeed(i, fanSpeed)
+			appliedSpeeds[i] = fanSpeed
+		}
+
+		if config.stateFile != "" && !dryrun && !maps.Equal(savedSpeeds, appliedSpeeds) {
+			if err := savePersistedState(config.stateFile, persistedState{
+				DeviceUUID: uuid,
+				Curve:      state.curveString(),
+				FanSpeeds:  appliedSpeeds,
+				SavedAt:    time.Now(),
+			}); err != nil {
+				logger.Warn("Unable to save state", "path", config.stateFile, "err", err)
+			}
+			// Do not retry saving failed state on every tick
+			savedSpeeds = appliedSpeeds
+		}
+		return nil
 	}
-	numFans, ret := nvml.DeviceGetNumFans(device)
-	if ret != nvml.SUCCESS {
-		return fmt.Errorf("nable to get number of fans from device; err: %s, device: %s", nvml.ErrorString(ret), deviceName)
+
+	stopEvents := func() {}
+	if config.nvmlEvents {
+		stopEvents = watchDeviceEvents(device, logger, applyNow)
+	}
+	defer func() { stopEvents() }()
+	// reopen re-initializes NVML after resume, or only fetches the device again if NVML has already been
+	// re-initialized by another device. On failure, it is retried at next tick, as driver may not be ready
+	// right after resume.
+	reopen := func() bool {
+		// Event set belongs to the NVML session, which is about to be shut down
+		stopEvents()
+		stopEvents = func() {}
+		reopened, err := handle.reopen(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				limiter.Warn("Unable to re-initialize NVML after resume, retry at next polling", "err", err)
+			}
+			reopenPending = true
+			return false
+		}
+		device = reopened
+		reopenPending = false
+		clear(writtenSpeeds)
+		if config.nvmlEvents {
+			stopEvents = watchDeviceEvents(device, logger, applyNow)
+		}
+		logger.Info("NVML re-initialized after resume")
+		return true
 	}
+
 	for {
 		select {
-		case <-ticker.C:
-			// Get current temperature
-			temperature, ret := nvml.DeviceGetTemperature(device, nvml.TEMPERATURE_GPU)
-			if ret != nvml.SUCCESS {
-				return fmt.Errorf("unable to get device temperature; device: %s, err: %s", deviceName, nvml.ErrorString(ret))
-			}
-			slog.Debug("current temperature", "temperature", temperature)
-
-			// Get target fan speed based on temperature
-			speed, ok := speedMap[uint8(temperature)]
-			if !ok {
-				slog.Warn("cannot find proper fan speed for given temperature, ignore updating fan speed at this time", "device", deviceName, "temperature", temperature, "buckets", speedMap)
+		case now := <-ticker.C:
+			resumed := false
+			suspended, detected := detector.check(now)
+			if asleep && !detected {
 				continue
 			}
-
-			// Apply target fan speed to NVIDIA GPU
-			for i := 0; i < numFans; i++ {
-				if !dryrun {
-					slog.Debug("set fan speed", "device", deviceName, "fanIdx", i, "speed", int(speed))
-					if ret := nvml.DeviceSetFanSpeed_v2(device, i, int(speed)); ret != nvml.SUCCESS {
-						return fmt.Errorf("unable to set fan speed; device: %s, fanIdx: %d, speed: %d, err: %s", deviceName, i, speed, nvml.ErrorString(ret))
+			// Resume signal of logind may be missed, so detected resume also ends sleep
+			asleep = false
+			// NVML handles and fan policies frequently reset after system suspend,
+			// so NVML is re-initialized, and fan speed is reapplied to reassert manual policy
+			// Device is also fetched again, when another device has re-initialized NVML without this loop noticing resume
+			if detected || reopenPending || handle.stale() {
+				if detected {
+					logger.Info("System resume detected, re-initialize NVML", "suspended", suspended.Round(time.Second))
+				}
+				if !reopen() {
+					if ctx.Err() != nil {
+						return nil
 					}
-				} else {
-					slog.Info("(Dryrun) set fan speed", "device", deviceName, "fanIdx", i, "speed", speed)
+					continue
+				}
+				resumed = true
+			}
+			// Fan speed must be reasserted right after resume, regardless of write interval
+			if err := update(resumed); err != nil {
+				return err
+			}
+		case <-togglePause:
+			paused = !paused
+			state.setPaused(paused)
+			if config.observeOnly {
+				continue
+			}
+			if paused {
+				logger.Info("Fan control paused, fan speed is controlled by driver default policy")
+				restoreDefaultFanSpeeds(logger, device, fans, dryrun)
+				clear(writtenSpeeds)
+				continue
+			}
+			logger.Info("Fan control resumed")
+			if err := update(true); err != nil {
+				return err
+			}
+		case <-applyNow:
+			if asleep {
+				continue
+			}
+			if err := update(true); err != nil {
+				return err
+			}
+		case event := <-prepareSleep:
+			if event.sleeping {
+				// Fans are returned to driver before sleep, so that they are not stuck at the last speed after resume
+				// if manual policy does not survive it, or survives it without anything reasserting it
+				asleep = true
+				decisionState.pendingSpeed = 0
+				if !paused && !config.observeOnly {
+					restoreDefaultFanSpeeds(logger, device, fans, dryrun)
+				}
+				clear(writtenSpeeds)
+				event.done()
+				continue
+			}
+			event.done()
+			asleep = false
+			// Resume is already handled here, so that it is not detected again at next tick
+			detector = newSuspendDetector(time.Now())
+			if !reopen() {
+				if ctx.Err() != nil {
+					return nil
 				}
+				continue
 			}
-		case <-cancel:
+			if err := update(true); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// restoreDefaultFanSpeeds sets the fans of the device back to driver default fan control policy
+func restoreDefaultFanSpeeds(logger *slog.Logger, device gpuDevice, fans []int, dryrun bool) {
+	if dryrun {
+		logger.Info("(Dryrun) Set NVIDIA GPU fan speed to default setting")
+		return
+	}
+
+	logger.Info("Setting device fan speed policy to default")
+	for _, i := range fans {
+		if err := device.SetDefaultFanSpeed(i); err != nil {
+			logger.Error("Unable to set fan speed to default state", LABEL_FAN_INDEX, i, "err", err)
+		}
+	}
+}
+
+// speedMapRow is fan speed computed for a temperature, where nil speed means the temperature is out of the curve
+type speedMapRow struct {
+	Temperature uint32 `json:"temperature"`
+	Curve       *uint8 `json:"curve"`
+	Applied     *uint8 `json:"applied"`
+	Failsafe    bool   `json:"failsafe,omitempty"`
+	Memory      *uint8 `json:"memory,omitempty"`
+	TargetRPM   uint32 `json:"targetRPM,omitempty"`
+}
+
+// speedMapRows computes fan speed for every temperature in the table range, so that the whole generated map can be audited.
+// Temperature is the one reported by the device, before temperature offset is applied.
+func speedMapRows(config controlConfig, fanSpeedConfig [][2]uint8, memoryFanSpeedConfig [][2]uint8) []speedMapRow {
+	maxTemp := uint32(DRY_RUN_TABLE_MAX_TEMP)
+	for _, curve := range [][][2]uint8{fanSpeedConfig, memoryFanSpeedConfig} {
+		if len(curve) > 0 {
+			maxTemp = max(maxTemp, uint32(curve[len(curve)-1][0]))
+		}
+	}
+	speedOrNil := func(speed uint8, ok bool) *uint8 {
+		if !ok {
 			return nil
 		}
+		return &speed
+	}
+
+	var rows []speedMapRow
+	for temperature := uint32(MIN_TEMP); temperature <= maxTemp; temperature++ {
+		effectiveTemperature := applyTempOffset(temperature, config.tempOffset)
+		curveSpeed, ok := lookupFanSpeed(config.speedMap, effectiveTemperature, config)
+		// Failsafe is engaged even when temperature is out of the curve
+		speed, failsafe := limitFanSpeed(curveSpeed, effectiveTemperature, config)
+		row := speedMapRow{
+			Temperature: temperature,
+			Curve:       speedOrNil(curveSpeed, ok),
+			Applied:     speedOrNil(speed, ok || failsafe),
+			Failsafe:    failsafe,
+		}
+		if config.memorySpeedMap != nil {
+			// Memory temperature is not affected by temperature offset
+			row.Memory = speedOrNil(lookupFanSpeed(config.memorySpeedMap, temperature, config))
+		}
+		if config.rpmCurve != nil {
+			row.TargetRPM = targetRPM(config.rpmCurve, effectiveTemperature)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// printSpeedMapTable prints rows of speedMapRows as a table
+func printSpeedMapTable(config controlConfig, fanSpeedConfig [][2]uint8, memoryFanSpeedConfig [][2]uint8) {
+	format := func(speed *uint8) string {
+		if speed == nil {
+			return "-"
+		}
+		return strconv.Itoa(int(*speed))
+	}
+
+	header := "Temp(C)  Curve(%)  Applied(%)    "
+	if config.memorySpeedMap != nil {
+		header += "  Memory curve(%)"
+	}
+	if config.rpmCurve != nil {
+		header += "  Target(RPM)"
+	}
+	fmt.Println(header)
+	for _, row := range speedMapRows(config, fanSpeedConfig, memoryFanSpeedConfig) {
+		applied := format(row.Applied)
+		if row.Failsafe {
+			applied += " (failsafe)"
+		}
+		line := fmt.Sprintf("%7d  %8s  %-14s", row.Temperature, format(row.Curve), applied)
+		if config.memorySpeedMap != nil {
+			line += fmt.Sprintf("  %16s", format(row.Memory))
+		}
+		if config.rpmCurve != nil {
+			line += fmt.Sprintf("  %11d", row.TargetRPM)
+		}
+		fmt.Println(strings.TrimRight(line, " "))
 	}
 }
 
-func printDeviceInfo(device nvml.Device) {
-	uuid, ret := device.GetUUID()
-	if ret != nvml.SUCCESS {
-		slog.Error("Unable to get uuid of device at index 0", "err", nvml.ErrorString(ret))
+func printDeviceInfo(device gpuDevice) {
+	uuid, err := device.UUID()
+	if err != nil {
+		slog.Error("Unable to get uuid of device", "err", err)
 		return
 	}
 	slog.Info("Device UUID", "uuid", uuid)
 
-	deviceName, ret := device.GetName()
-	if ret != nvml.SUCCESS {
-		slog.Error("Unable to get device name", "err", nvml.ErrorString(ret))
+	deviceName, err := device.Name()
+	if err != nil {
+		slog.Error("Unable to get device name", "err", err)
 		return
 	}
-	slog.Info("Device Name", "name", deviceName)
+	slog.Info("Device Name", LABEL_GPU_NAME, deviceName)
 
-	numFans, ret := nvml.DeviceGetNumFans(device)
-	if ret != nvml.SUCCESS {
-		slog.Error("Unable to get number of fans from device", "err", nvml.ErrorString(ret), "device", uuid)
+	numFans, err := device.NumFans()
+	if err != nil {
+		slog.Error("Unable to get number of fans from device", "err", err, "device", uuid)
 		return
 	}
 	slog.Info("Number of fans", "count", numFans)
 
-	temp, ret := nvml.DeviceGetTemperature(device, nvml.TEMPERATURE_GPU)
-	if ret != nvml.SUCCESS {
-		slog.Error("Unable to get device temperature", "err", nvml.ErrorString(ret))
+	temp, err := device.Temperature()
+	if err != nil {
+		slog.Error("Unable to get device temperature", "err", err)
 		return
 	}
-	slog.Info("Current temperature", "name", deviceName, "temp", temp)
+	slog.Info("Current temperature", LABEL_GPU_NAME, deviceName, "temp", temp)
 
-	tempThreshold, ret := nvml.DeviceGetTemperatureThreshold(device, nvml.TEMPERATURE_THRESHOLD_ACOUSTIC_CURR)
-	if ret != nvml.SUCCESS {
-		slog.Error("Unable to get temperature threshold", "err", nvml.ErrorString(ret))
+	tempThreshold, err := device.AcousticTemperatureThreshold()
+	if err != nil {
+		slog.Error("Unable to get temperature threshold", "err", err)
 		return
 	}
-	slog.Info("Temperature threshold", "name", deviceName, "temperature", tempThreshold)
+	slog.Info("Temperature threshold", LABEL_GPU_NAME, deviceName, "temperature", tempThreshold)
+
+	// Sensors other than core temperature are only exposed by some GPUs
+	if sensors, err := device.ThermalSensors(); err != nil {
+		slog.Debug("Unable to get thermal sensors", "err", err)
+	} else {
+		for target, temperature := range sensors {
+			slog.Info("Thermal sensor", LABEL_GPU_NAME, deviceName, "target", target, "temperature", temperature)
+		}
+	}
+
+	// Range of fan speed allowed by VBIOS, which stock fan curve operates within
+	if minSpeed, maxSpeed, err := device.MinMaxFanSpeed(); err != nil {
+		slog.Warn("Unable to get min/max fan speed", "err", err)
+	} else {
+		slog.Info("Fan speed range", LABEL_GPU_NAME, deviceName, "min", minSpeed, "max", maxSpeed)
+	}
 
 	for j := 0; j < numFans; j++ {
-		fanSpeed, ret := nvml.DeviceGetFanSpeed_v2(device, j)
-		if ret != nvml.SUCCESS {
-			slog.Error("Unable to get device fan speed", "err", nvml.ErrorString(ret))
+		fanSpeed, err := device.FanSpeed(j)
+		if err != nil {
+			slog.Error("Unable to get device fan speed", "err", err)
 			break
 		}
-		slog.Info("Fan control speed", "name", deviceName, "fan#", j, "speed", fanSpeed)
+		slog.Info("Fan control speed", LABEL_GPU_NAME, deviceName, "fan#", j, "speed", fanSpeed)
 
-		policy, ret := nvml.DeviceGetFanControlPolicy_v2(device, j)
-		if ret != nvml.SUCCESS {
-			slog.Error("Unable to get fan control policy", "ret", nvml.ErrorString(ret))
+		policy, err := device.FanControlPolicy(j)
+		if err != nil {
+			slog.Error("Unable to get fan control policy", "err", err)
 			break
 		}
 
 		switch policy {
-		case nvml.FAN_POLICY_MANUAL:
+		case FAN_POLICY_MANUAL:
 			slog.Info("Current fan control policy is MANUAL")
-		case nvml.FAN_POLICY_TEMPERATURE_CONTINOUS_SW:
+		case FAN_POLICY_TEMPERATURE_CONTINOUS_SW:
 			slog.Info("Current fan control policy is TEMPERATURE-BASED automatic")
 		default:
 			slog.Warn("Unknown fan control policy", "policyID", policy)
@@ -174,121 +904,1372 @@ func parseSpeedConfigFlag(fanSpeedStrConfig string) ([][2]uint8, error) {
 	var fanSpeedConfig [][2]uint8
 
 	for i, speedPoint := range speedPoints {
-		speedPointArr := strings.Split(speedPoint, ":")
+		speedPointArr := strings.Split(strings.TrimSpace(speedPoint), ":")
 		if len(speedPointArr) != 2 {
 			return nil, fmt.Errorf("fan speed pair at index %d is not a pair: %s", i, speedPoint)
 		}
-		temperature, err := strconv.ParseInt(speedPointArr[0], 10, 8)
+		// Parse as wider integers, so that out of range values are reported instead of overflowing
+		temperature, err := strconv.ParseUint(speedPointArr[0], 10, 16)
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse temperature at pair %d: %w", i, err)
+			return nil, fmt.Errorf("unable to parse temperature at pair %d (%s): %w", i, speedPoint, err)
 		}
-		speed, err := strconv.ParseInt(speedPointArr[1], 10, 8)
+		speed, err := strconv.ParseUint(speedPointArr[1], 10, 16)
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse fan speed at pair %d: %w", i, err)
+			return nil, fmt.Errorf("unable to parse fan speed at pair %d (%s): %w", i, speedPoint, err)
+		}
+		if temperature > uint64(MAX_TEMP) {
+			return nil, fmt.Errorf("temperature at pair %d (%s) is not plausible, it must be between %d and %d", i, speedPoint, MIN_TEMP, MAX_TEMP)
+		}
+		if speed > uint64(MAX_FAN_SPEED_PERCENT) {
+			return nil, fmt.Errorf("fan speed at pair %d (%s) must be between 0 and %d", i, speedPoint, MAX_FAN_SPEED_PERCENT)
 		}
 		fanSpeedConfig = append(fanSpeedConfig, [2]uint8{uint8(temperature), uint8(speed)})
 	}
 
+	if err := validateSpeedConfig(fanSpeedConfig); err != nil {
+		return nil, err
+	}
+
 	return fanSpeedConfig, nil
 }
 
+// validateSpeedConfig checks that temperatures of the curve are strictly increasing
+func validateSpeedConfig(fanSpeedConfig [][2]uint8) error {
+	for i := 1; i < len(fanSpeedConfig); i++ {
+		prev, curr := fanSpeedConfig[i-1], fanSpeedConfig[i]
+		if curr[0] <= prev[0] {
+			return fmt.Errorf("temperature at pair %d (%d:%d) must be greater than temperature at previous pair (%d:%d)", i, curr[0], curr[1], prev[0], prev[1])
+		}
+	}
+	return nil
+}
+
+func formatSpeedConfig(fanSpeedConfig [][2]uint8) string {
+	speedPoints := make([]string, 0, len(fanSpeedConfig))
+	for _, r := range fanSpeedConfig {
+		speedPoints = append(speedPoints, fmt.Sprintf("%d:%d", r[0], r[1]))
+	}
+	return strings.Join(speedPoints, ",")
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "override":
+			os.Exit(runOverrideCommand(os.Args[2:]))
+		case "status":
+			os.Exit(runStatusCommand(os.Args[2:]))
+		case "boost":
+			os.Exit(runBoostCommand(os.Args[2:]))
+		case "polling":
+			os.Exit(runPollingCommand(os.Args[2:]))
+		case "init":
+			os.Exit(runInitCommand(os.Args[2:]))
+		case "import":
+			os.Exit(runImportCommand(os.Args[2:]))
+		case "config":
+			os.Exit(runConfigCommand(os.Args[2:]))
+		case "simulate":
+			os.Exit(runSimulateCommand(os.Args[2:]))
+		case FAN_HELPER_SUBCOMMAND:
+			os.Exit(runFanHelperCommand(os.Args[2:]))
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	exitCode := run(ctx, runOptions{args: os.Args[1:]})
+	stop()
+	os.Exit(exitCode)
+}
+
+// runOptions are flags of the daemon, and what run does instead of controlling fans for subcommands
+type runOptions struct {
+	args []string
+	// Resolved settings are printed instead of controlling fans, if not nil
+	export *configExportOptions
+	// Control loop is simulated on a trace instead of controlling fans, if not nil
+	simulation *simulateOptions
+}
+
+// run contains the whole program, so that deferred functions are executed before main calls os.Exit.
+// Fan control stops gracefully when ctx is done, i.e. -exit-action is applied to fans before run returns.
+func run(ctx context.Context, options runOptions) int {
+	// Registered first, so that it is stopped after all other deferred functions restoring devices are run
+	var shutdownTimer *time.Timer
+	defer func() {
+		if shutdownTimer != nil {
+			shutdownTimer.Stop()
+		}
+	}()
 	var fanSpeedEncoded string
+	var preset string
+	var scheduleStr string
 	var deviceIndex int
 	var dryrun bool
+	var dryRunReport string
 	var wg sync.WaitGroup
 	var logLevelStr string
+	var logLevelsStr string
 	var pollingDuration time.Duration
-	cancel := make(chan bool, 1)
+	var calibrate bool
+	var calibrateTargetTemp uint
+	var calibrateStepsStr string
+	var calibrateSettle time.Duration
+	var controlSocket string
+	var maxSpeed uint
+	var minSpeed uint
+	var failsafeTemp uint
+	var tempOffset int
+	var spikeThreshold uint
+	var medianSamples uint
+	var memoryFanSpeedEncoded string
+	var tempSourceSpec string
+	var tempSourceScale float64
+	var sourceFanSpeedEncoded string
+	var speedFormulaStr string
+	var tempBlendStr string
+	var nvidiaSettingsFallback bool
+	var waitForDriverDuration time.Duration
+	var backendName string
+	var httpListen string
+	var stateFile string
+	var logFile string
+	var logFormat string
+	var logMaxSizeMB int
+	var logMaxAge time.Duration
+	var logMaxBackups int
+	var logRepeatInterval time.Duration
+	var nvidiaSettingsDisplay string
+	var configFile string
+	var adaptivePolling bool
+	var nvmlEvents bool
+	var lowWakeup bool
+	var writeInterval time.Duration
+	var fansStr string
+	var autoFansStr string
+	var fanOffsetsStr string
+	var devicesStr string
+	var deviceMatch string
+	var excludeDevicesStr string
+	var fallbackSpeedAbove uint
+	var speedStep uint
+	var rpmSpeedEncoded string
+	var targetTemp uint
+	var takeoverTemp uint
+	var idlePState uint
+	var persistenceMode bool
+	var powerLimit uint
+	var lockedClocksStr string
+	var hwmonPWMStr string
+	var hwmonFanSpeedEncoded string
+	var liquidctlStr string
+	var coolerCommand string
+	var coolerFanSpeedEncoded string
+	var ipmiVendor string
+	var ipmiArgs string
+	var ipmiFanSpeedEncoded string
+	var predictAhead time.Duration
+	var controlListen string
+	var controlToken string
+	var tlsCert string
+	var tlsKey string
+	var tlsClientCA string
+	var otlpEndpoint string
+	var otlpInterval time.Duration
+	var historyDuration time.Duration
+	var historyInterval time.Duration
+	var statsInterval time.Duration
+	var logindSleep bool
+	var wearFile string
+	var historyDBPath string
+	var alertTemp uint
+	var alertWebhook string
+	var hookCommand string
+	var hookEvents string
+	var alertTempDuration time.Duration
+	var alertRiseRate float64
+	var riseBoostDuration time.Duration
+	var alertSMTPAddr string
+	var alertDiscordWebhook string
+	var alertTelegramToken string
+	var alertTelegramChatID string
+	var alertSMTPUsername string
+	var alertSMTPPassword string
+	var alertSMTPFrom string
+	var alertSMTPTo string
+	var historyDBInterval time.Duration
+	var historyDBRetention time.Duration
+	var fallbackSpeedBelow uint
+	var pollingFastDuration time.Duration
+	var pollingSlowDuration time.Duration
+	var exitAction string
+	var exitSpeed uint
+	var noResetOnExit bool
+	var selfTest bool
+	var force bool
+	var lockDir string
+	var privsepUser string
+	var shutdownTimeout time.Duration
 
-	flag.StringVar(&fanSpeedEncoded, "speeds", "35:40,40:50,50:60,60:90,80:100", "Set fan speed linear graph by a list of temperature:fanspeed pair")
-	flag.IntVar(&deviceIndex, "device-index", 0, "GPU index to be tuned, if the PC only have 1 GPU, then no need to use this flag")
-	flag.BoolVar(&dryrun, "dry-run", false, "Perform dryrun, which won't update any config to the GPU, and show only log to check if config values are correct")
-	flag.StringVar(&logLevelStr, "log-level", "INFO", "Adjust log level: DEBUG, INFO, WARN, ERROR")
-	flag.DurationVar(&pollingDuration, "polling-duration", 5*time.Second, "Time duration between each polling for fan speed update i.e. 5s, 10s, 1m, etc.")
-	flag.Parse()
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flags.StringVar(&fanSpeedEncoded, "speeds", CURVE_PRESETS["balanced"], "Set fan speed linear graph by a list of temperature:fanspeed pair")
+	flags.StringVar(&scheduleStr, "schedule", "", "Semicolon-separated rules, which switch fan curve of all GPUs by day of week and time of day e.g. \"mon-fri 09:00-18:00=aggressive;sat,sun=silent\". Each rule is optional days, optional HH:MM-HH:MM window, and preset name or curve after '='. The first matching rule wins, and the configured curve is used outside all rules. Disabled if empty")
+	flags.StringVar(&preset, "preset", "", fmt.Sprintf("Use a built-in fan curve instead of -speeds, one of %s. It cannot be combined with -speeds. Disabled if empty", strings.Join(presetNames(), ", ")))
+	flags.StringVar(&speedFormulaStr, "speed-formula", "", "Compute fan speed by an expression instead of -speeds curve lookup, e.g. \"max(curve(gpu_temp), curve2(mem_temp)) + 5*rising\". See README for variables and functions. Disabled if empty")
+	flags.StringVar(&tempBlendStr, "temp-blend", "", fmt.Sprintf("Look up the curve by weighted average of sensor temperatures instead of core temperature, by comma-separated sensor:weight pairs e.g. core:0.7,memory:0.3. Sensors are %s. Failsafe and takeover still use core temperature. Disabled if empty", strings.Join(BLEND_SENSORS, ", ")))
+	flags.DurationVar(&predictAhead, "predict-ahead", 0, "Look up the curve by temperature predicted this duration ahead, which is extrapolated from the slope of recent samples while temperature is rising, so that fans ramp up ahead of a fast rise e.g. 10s. Set to 0 to disable")
+	flags.StringVar(&rpmSpeedEncoded, "rpm-speeds", "", "Set fan curve by a list of temperature:RPM pair, which replaces -speeds. Fan duty is adjusted at each polling until measured RPM of the first fan reaches target RPM. Requires the device to report min/max fan speed and RPM")
+	flags.UintVar(&targetTemp, "target-temp", 0, "Temperature in Celsius, which is held by adjusting fan speed continuously by feedback instead of -speeds curve, e.g. 70. Fan speed stays within -min-speed and -max-speed. Set to 0 to disable")
+	flags.IntVar(&deviceIndex, "device-index", 0, "GPU index to be tuned, if the PC only have 1 GPU, then no need to use this flag")
+	flags.StringVar(&autoFansStr, "auto-fans", "", "Comma-separated list of fan indices to be kept on driver automatic policy e.g. 1, while other fans of the GPU are controlled. Can be combined with -fans")
+	flags.StringVar(&fanOffsetsStr, "fan-offsets", "", "Comma-separated list of fanIndex:offset pairs e.g. 1:10, where offset in percent is added to fan speed computed by the curve for the fan, so that the fan runs faster or slower than others. Offsets are not applied when failsafe is engaged or fan speed is overridden")
+	flags.StringVar(&fansStr, "fans", "", "Comma-separated list of fan indices to be controlled e.g. 0,2, while other fans of the GPU are left under driver control, e.g. a fan header which drives a pump. Every fan is controlled if empty")
+	flags.StringVar(&devicesStr, "devices", "", "Comma-separated list of GPU indices to be tuned together e.g. 0,1, or \"all\" for every GPU. Each GPU is controlled by its own loop, which is restarted with backoff on failure without affecting other GPUs. Overrides -device-index if set")
+	flags.StringVar(&deviceMatch, "device-match", "", "Regular expression matched against GPU names e.g. \"RTX 3090\". Only matching GPUs among -devices, or among all GPUs if -devices is not set, are tuned. Disabled if empty")
+	flags.StringVar(&excludeDevicesStr, "exclude-devices", "", "Comma-separated list of GPU indices or UUIDs which are never tuned, e.g. 1,GPU-8f6a2c1e-.... Other GPUs among -devices, or all GPUs if -devices is not set, are tuned. Disabled if empty")
+	flags.StringVar(&dryRunReport, "dry-run-report", "", "Path of file, to which a JSON report of resolved settings, fan curves, detected GPUs and operations which would be performed is written in dry run, after which the program exits instead of running the control loop. Set to - to write to stdout. Requires -dry-run. Disabled if empty")
+	flags.BoolVar(&dryrun, "dry-run", false, "Perform dryrun, which won't update any config to the GPU, and show only log to check if config values are correct")
+	flags.StringVar(&logLevelStr, "log-level", "INFO", "Adjust log level: DEBUG, INFO, WARN, ERROR")
+	flags.StringVar(&logLevelsStr, "log-levels", "", "Comma-separated list of module=level pairs e.g. controller=DEBUG,api=WARN, which override -log-level for subsystems: controller, nvml, api and metrics")
+	flags.DurationVar(&pollingDuration, "polling-duration", 5*time.Second, "Time duration between each polling for fan speed update i.e. 5s, 10s, 1m, etc.")
+	flags.BoolVar(&adaptivePolling, "adaptive-polling", false, "Poll at -polling-fast-duration when temperature changes quickly or is near a curve point, and at -polling-slow-duration when it is stable below the first curve point. Otherwise, poll at -polling-duration")
+	flags.BoolVar(&lowWakeup, "low-wakeup", false, "Energy-conscious mode for laptops, which polls up to 3 times less often while on battery or the GPU is idle, and aligns polling of all devices and samplers to the same instants, so that the CPU is woken up less often")
+	flags.DurationVar(&pollingFastDuration, "polling-fast-duration", time.Second, "Polling interval used by adaptive polling when temperature changes quickly or is near a curve point")
+	flags.DurationVar(&pollingSlowDuration, "polling-slow-duration", 10*time.Second, "Polling interval used by adaptive polling when temperature is stable below the first curve point")
+	flags.DurationVar(&writeInterval, "write-interval", 0, "Minimum time duration between fan speed writes, while temperature is still sampled at every polling, and the highest fan speed computed since the last write is applied. Set to 0 to write at every polling")
+	flags.BoolVar(&calibrate, "calibrate", false, "Run guided calibration, which steps fans through fixed speeds under a sustained GPU load and proposes a fan curve that holds target temperature")
+	flags.UintVar(&calibrateTargetTemp, "calibrate-target-temp", 75, "Target GPU temperature in Celsius under load that the calibrated fan curve should hold")
+	flags.StringVar(&calibrateStepsStr, "calibrate-steps", "100,80,65,50,40,30", "Comma-separated list of fan speeds in percent to be tested during calibration")
+	flags.DurationVar(&calibrateSettle, "calibrate-settle", time.Minute, "Time window in which temperature must stay within 1 Celsius to be considered steady during calibration")
+	flags.StringVar(&controlSocket, "control-socket", DEFAULT_CONTROL_SOCKET, "Path to unix socket of control API, which is used by subcommands e.g. override. Set to empty string to disable")
+	flags.StringVar(&controlListen, "control-listen", "", "TCP address of control API e.g. 0.0.0.0:9101, so that the daemon can be controlled remotely. Requires -control-token. Disabled if empty")
+	flags.StringVar(&controlToken, "control-token", "", "Shared token, which must be sent as bearer token to control API on -control-listen. Prefer setting it in config file, so that it is not visible in process list")
+	flags.StringVar(&otlpEndpoint, "otlp-endpoint", "", "Base URL of OTLP/HTTP endpoint of OpenTelemetry collector e.g. http://localhost:4318, where temperature, fan speed and control loop latency metrics are exported. Disabled if empty")
+	flags.DurationVar(&otlpInterval, "otlp-interval", 30*time.Second, "Time duration between each export of metrics to OTLP endpoint")
+	flags.DurationVar(&historyDuration, "history-duration", time.Hour, "Time duration of samples kept in memory, which are served by GET /history of control API and -http-listen. Set to 0 to disable")
+	flags.DurationVar(&historyInterval, "history-interval", 10*time.Second, "Time duration between each sample kept in history")
+	flags.StringVar(&wearFile, "wear-file", DEFAULT_WEAR_FILE, "Path to file, where cumulative runtime of each fan weighted by fan speed is kept across restarts, and reported by status. Set to empty string to disable")
+	flags.BoolVar(&logindSleep, "logind-sleep", false, "Take a delay inhibitor of systemd-logind, so that fans are returned to driver default policy before system sleep, and fan control is reasserted right after resume. Requires systemd-inhibit and busctl. Only supported on Linux with systemd")
+	flags.DurationVar(&statsInterval, "stats-interval", 0, "Time duration between summaries logged per GPU, with min/avg/max temperature, average fan speed and time spent at or above -alert-temp. Set to 0 to disable")
+	flags.StringVar(&historyDBPath, "history-db", "", "Path to SQLite file, where samples are stored for long-term analysis. Requires sqlite3 command. Disabled if empty")
+	flags.DurationVar(&historyDBInterval, "history-db-interval", time.Minute, "Time duration between each sample stored in -history-db")
+	flags.DurationVar(&historyDBRetention, "history-db-retention", 365*24*time.Hour, "Time duration of samples kept in -history-db, older samples are deleted. Set to 0 to keep samples forever")
+	flags.StringVar(&tlsCert, "tls-cert", "", "Path to PEM encoded TLS certificate. If set together with -tls-key, -http-listen and -control-listen serve HTTPS")
+	flags.StringVar(&tlsKey, "tls-key", "", "Path to PEM encoded private key of -tls-cert")
+	flags.StringVar(&tlsClientCA, "tls-client-ca", "", "Path to PEM encoded CA certificates. If set, HTTPS clients must present a certificate signed by one of them")
+	flags.UintVar(&maxSpeed, "max-speed", uint(MAX_FAN_SPEED_PERCENT), "Maximum fan speed in percent, which caps fan speed computed by the curve. The cap is ignored when failsafe is engaged")
+	flags.UintVar(&speedStep, "speed-step", 0, "Round fan speed computed by the curve up to a multiple of this percent e.g. 5, so that fan pitch changes in discrete steps and less often. Set to 0 to disable")
+	flags.UintVar(&minSpeed, "min-speed", 0, "Minimum fan speed in percent, so that fans never drop below this value even when the curve says 0")
+	flags.UintVar(&fallbackSpeedAbove, "fallback-speed-above", uint(MAX_FAN_SPEED_PERCENT), "Fan speed in percent applied when temperature is above the fan speed map, instead of leaving fan speed unchanged")
+	flags.UintVar(&fallbackSpeedBelow, "fallback-speed-below", 0, "Fan speed in percent applied when temperature is below the fan speed map, instead of leaving fan speed unchanged")
+	flags.StringVar(&exitAction, "exit-action", EXIT_ACTION_DEFAULT, "Action applied to fans on graceful shutdown: default returns fans to driver default policy, hold leaves fans at the last applied speed, and park sets fans to -exit-speed. Fans are returned to driver default policy if fan control fails")
+	flags.UintVar(&exitSpeed, "exit-speed", 50, "Fan speed in percent, at which fans are left on graceful shutdown by -exit-action park")
+	flags.BoolVar(&noResetOnExit, "no-reset-on-exit", false, "Keep fans at the last applied speed on graceful shutdown instead of returning them to driver default policy, e.g. so that fans do not blip while the daemon is restarted for a config change. Same as -exit-action hold")
+	flags.BoolVar(&force, "force", false, "Start even if other fan control programs e.g. GreenWithEnvy, CoolerControl or another instance of this program are running, which fight over fan control policy")
+	flags.StringVar(&privsepUser, "privsep-user", "", "Drop root privilege to this user after starting a privileged helper, which only sets fan speed and default fan control policy on request of the main process, so that control API, config and everything else never run as root. Features changing other GPU settings or writing to sysfs are not available. Only supported on Linux. Disabled if empty")
+	flags.StringVar(&lockDir, "lock-dir", DEFAULT_LOCK_DIR, "Directory of lock files, one per GPU UUID, which prevent two instances from controlling the same GPU. Set to empty string to disable")
+	flags.BoolVar(&selfTest, "self-test", true, "Set a test speed to controlled fans on startup, and read back fan speed and policy to confirm that the device honors manual fan control. Startup fails if it does not. Skipped in dry run")
+	flags.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "Maximum time duration of graceful shutdown, after which the process exits even if devices are not yet restored, e.g. when NVML hangs. Set to 0 to wait forever")
+	flags.UintVar(&failsafeTemp, "failsafe-temp", 90, "Temperature in Celsius at which fans always run at full speed, regardless of the curve, cap and override. Set to 0 to disable")
+	flags.UintVar(&alertTemp, "alert-temp", 0, "Temperature in Celsius at which overtemp alert is sent. Set to 0 to disable")
+	flags.DurationVar(&alertTempDuration, "alert-temp-duration", 0, "Time duration for which temperature must stay at or above -alert-temp before overtemp alert is sent, so that short spikes are not alerted")
+	flags.Float64Var(&alertRiseRate, "alert-rise-rate", 0, "Rate of temperature rise in Celsius per second e.g. 0.5, above which rapid rise alert is sent, as it usually indicates fan failure or blocked airflow before -alert-temp is reached. Set to 0 to disable")
+	flags.DurationVar(&riseBoostDuration, "rise-boost-duration", 0, "Time duration for which fans run at full speed when rapid rise alert is raised, the same way as boost. Requires -alert-rise-rate. Set to 0 to only alert")
+	flags.StringVar(&hookCommand, "hook-command", "", "Shell command, which is run on events with event details in NVML_FAN_* environment variables. Disabled if empty")
+	flags.StringVar(&hookEvents, "hook-events", "", "Comma-separated list of events on which -hook-command runs: overtemp, failsafe, control_lost, rapid_rise, curve_changed, shutdown. All events if empty")
+	flags.StringVar(&alertWebhook, "alert-webhook", "", "URL, to which alerts are posted as JSON when temperature reaches -alert-temp, failsafe engages, or fan control is lost. Disabled if empty")
+	flags.StringVar(&alertDiscordWebhook, "alert-discord-webhook", "", "URL of Discord webhook, to which alerts are sent as messages. Disabled if empty")
+	flags.StringVar(&alertTelegramToken, "alert-telegram-token", "", "Token of Telegram bot, by which alerts are sent as messages to -alert-telegram-chat-id. Prefer setting it in config file, so that it is not visible in process list. Disabled if empty")
+	flags.StringVar(&alertTelegramChatID, "alert-telegram-chat-id", "", "ID of Telegram chat, to which alerts are sent by -alert-telegram-token")
+	flags.StringVar(&alertSMTPAddr, "alert-smtp-addr", "", "Address of SMTP server e.g. smtp.example.com:587, through which alerts are sent by email to -alert-smtp-to. Disabled if empty")
+	flags.StringVar(&alertSMTPUsername, "alert-smtp-username", "", "Username of SMTP server. Authentication is skipped if empty")
+	flags.StringVar(&alertSMTPPassword, "alert-smtp-password", "", "Password of SMTP server. Prefer setting it in config file, so that it is not visible in process list")
+	flags.StringVar(&alertSMTPFrom, "alert-smtp-from", "", "Sender address of alert emails")
+	flags.StringVar(&alertSMTPTo, "alert-smtp-to", "", "Comma-separated list of recipient addresses of alert emails")
+	flags.StringVar(&hwmonPWMStr, "hwmon-pwm", "", "Comma-separated list of motherboard PWM channels e.g. /sys/class/hwmon/hwmon2/pwm1, whose case fans follow temperature of the hottest controlled GPU by -hwmon-speeds curve. Channels are switched to manual control, and restored on exit. Disabled if empty")
+	flags.StringVar(&hwmonFanSpeedEncoded, "hwmon-speeds", "", "Set case fan speed linear graph of -hwmon-pwm channels based on GPU temperature by a list of temperature:fanspeed pair. -speeds is used if empty")
+	flags.StringVar(&liquidctlStr, "liquidctl", "", "Comma-separated list of liquidctl device match and channel pairs e.g. kraken:pump,kraken:fan, whose speed follows temperature of the hottest controlled GPU by -cooler-speeds curve. Channels are left at full speed on exit. Disabled if empty")
+	flags.StringVar(&coolerCommand, "cooler-command", "", "Shell command which sets speed of an external cooler, which follows temperature of the hottest controlled GPU by -cooler-speeds curve. Speed in percent is passed by NVML_FAN_COOLER_SPEED environment variable, and NVML_FAN_COOLER_RESTORE is 1 on exit. Disabled if empty")
+	flags.StringVar(&coolerFanSpeedEncoded, "cooler-speeds", "", "Set speed linear graph of -liquidctl and -cooler-command coolers based on GPU temperature by a list of temperature:speed pair. -speeds is used if empty")
+	flags.StringVar(&ipmiVendor, "ipmi", "", "Vendor of server BMC, supermicro or dell, whose chassis fan duty follows temperature of the hottest controlled GPU by -ipmi-speeds curve through ipmitool raw commands. BMC returns to automatic fan control on exit. Disabled if empty")
+	flags.StringVar(&ipmiArgs, "ipmi-args", "", "Arguments given to ipmitool before raw command, e.g. \"-I lanplus -H 10.0.0.2 -U admin -E\" for remote BMC. Local BMC is used if empty")
+	flags.StringVar(&ipmiFanSpeedEncoded, "ipmi-speeds", "", "Set chassis fan duty linear graph of -ipmi based on GPU temperature by a list of temperature:duty pair. -speeds is used if empty")
+	flags.StringVar(&lockedClocksStr, "locked-clocks", "", "Range of GPU clock in MHz e.g. 300:1800, within which GPU clock is locked on startup and reset to driver default on exit, so that clocks and thermals are managed together. Unlocked if empty")
+	flags.UintVar(&powerLimit, "power-limit", 0, "Power limit of GPU in watts, which is set on startup and restored on exit, so that heat output is reduced together with fan speed e.g. for a quiet setup. It must be within the range allowed by the GPU. Set to 0 to leave power limit unchanged")
+	flags.BoolVar(&persistenceMode, "persistence-mode", false, "Enable persistence mode of GPU on startup, so that driver is kept loaded between polls on headless machines, which otherwise makes NVML calls slow and resets fan policy. Persistence mode is restored on exit. Only supported on Linux")
+	flags.UintVar(&idlePState, "idle-pstate", 0, "Performance state e.g. 8 for P8, in which or in any deeper state fans are left to stock fan curve of the device while the GPU idles, e.g. to allow zero RPM. The configured curve takes over again when the GPU clocks up. Set to 0 to disable")
+	flags.UintVar(&takeoverTemp, "takeover-temp", 0, "Temperature in Celsius below which fans are left to stock fan curve of the device, and the configured curve only takes over at or above it. Set to 0 to always use the configured curve")
+	flags.UintVar(&spikeThreshold, "spike-threshold", 0, "Ignore a single temperature reading, which differs from the previous reading by more than this number of Celsius, e.g. a sensor glitch of some cards. The reading is used if the next reading confirms it, so that a real jump is delayed by one polling. Set to 0 to disable")
+	flags.UintVar(&medianSamples, "median-samples", 0, fmt.Sprintf("Use the median of this number of recent temperature readings e.g. 3, which rejects outliers with less lag than averaging. Up to %d. Set to 0 to disable", MAX_MEDIAN_SAMPLES))
+	flags.IntVar(&tempOffset, "temp-offset", 0, "Offset in Celsius added to the temperature reported by the device before the curve lookup, e.g. to compensate for cards whose core temperature understates hotspot")
+	flags.StringVar(&memoryFanSpeedEncoded, "memory-speeds", "", "Set fan speed linear graph based on memory temperature by a list of temperature:fanspeed pair. If set, applied fan speed is the maximum of -speeds and -memory-speeds curves. Memory temperature is only available on some GPUs e.g. GDDR6X")
+	flags.StringVar(&tempSourceSpec, "temp-source", "", "External temperature source e.g. ambient probe or coolant sensor of water loop, which drives -temp-source-speeds curve. One of exec:<command> printing temperature, file:<path> containing temperature, or http(s):// URL responding temperature. Disabled if empty")
+	flags.Float64Var(&tempSourceScale, "temp-source-scale", 1, "Multiplier applied to value read from -temp-source, e.g. 0.001 for hwmon files in millidegree Celsius")
+	flags.StringVar(&sourceFanSpeedEncoded, "temp-source-speeds", "", "Set fan speed linear graph based on -temp-source temperature by a list of temperature:fanspeed pair. Applied fan speed is the maximum of -speeds and -temp-source-speeds curves")
+	flags.BoolVar(&nvmlEvents, "nvml-events", false, "Apply fan speed immediately on NVML P-state and clock change events, which indicate GPU load changes, in addition to polling. Only supported on Linux")
+	flags.StringVar(&backendName, "backend", GPU_BACKEND_AUTO, "Backend to access GPUs: auto, nvml, jetson or nvidia-smi. Jetson backend reads GPU temperature from thermal zone and drives the PWM fan through sysfs on Jetson boards, which NVML does not support. nvidia-smi backend only reads sensors by running nvidia-smi, so that GPUs are monitored only. Auto selects jetson on Jetson boards and nvml otherwise, which falls back to nvidia-smi if NVML library cannot be loaded")
+	flags.DurationVar(&waitForDriverDuration, "wait-for-driver", 0, "Maximum time duration to wait for NVIDIA driver on startup. NVML initialization is retried with backoff until it succeeds or this duration has passed, e.g. when the service starts at boot before the driver is loaded. Set to 0 to exit immediately on failure")
+	flags.BoolVar(&nvidiaSettingsFallback, "nvidia-settings-fallback", true, "Set fan speed by nvidia-settings CLI when NVML does not support setting fan speed of the device, which requires X server with Coolbits option enabled")
+	flags.StringVar(&nvidiaSettingsDisplay, "nvidia-settings-display", ":0", "X display used by nvidia-settings fallback")
+	flags.StringVar(&httpListen, "http-listen", "", "TCP address of HTTP server serving /healthz, /status, /history and /events endpoints e.g. 127.0.0.1:9100. Disabled if empty")
+	flags.StringVar(&stateFile, "state-file", DEFAULT_STATE_FILE, "Path to file where last applied fan speeds are saved, and restored immediately on next startup. Set to empty string to disable")
+	flags.StringVar(&logFormat, "log-format", LOG_FORMAT_TEXT, "Format of logs: text, json or logfmt. Text logs on stderr are plain lines, unless -log-file or -log-levels is set")
+	flags.StringVar(&logFile, "log-file", "", "Path to log file, where logs are written in addition to stderr. Disabled if empty")
+	flags.IntVar(&logMaxSizeMB, "log-max-size", 10, "Maximum size in megabytes of log file before it gets rotated")
+	flags.DurationVar(&logMaxAge, "log-max-age", 7*24*time.Hour, "Maximum age of log file before it gets rotated")
+	flags.IntVar(&logMaxBackups, "log-max-backups", 5, "Maximum number of rotated log files to keep")
+	flags.DurationVar(&logRepeatInterval, "log-repeat-interval", 5*time.Minute, "Repeated warnings, e.g. temperature out of fan curve, are logged at most once per this interval together with the number of suppressed repetitions. Set to 0 to log every repetition")
+	flags.StringVar(&configFile, "config", DEFAULT_CONFIG_FILE, "Path to JSON config file, whose keys are flag names. Environment variables and flags given on command line take precedence over config file. Missing config file at default path is ignored")
+	flags.Parse(options.args)
 
+	deviceConfigs, settingSources, err := loadSettings(flags, os.LookupEnv)
+	if err != nil {
+		slog.Error("unable to load settings", "config", configFile, "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+
+	if preset != "" {
+		if settingSources["speeds"] != SETTING_SOURCE_DEFAULT {
+			slog.Error("preset cannot be combined with speeds", "preset", preset, "speeds", fanSpeedEncoded)
+			return EXIT_CONFIG_ERROR
+		}
+		if fanSpeedEncoded, err = presetCurve(preset); err != nil {
+			slog.Error("unable to apply preset", "err", err)
+			return EXIT_CONFIG_ERROR
+		}
+	}
+	schedule, err := parseSchedule(scheduleStr)
+	if err != nil {
+		slog.Error("unable to parse schedule flag", "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+	// Default fan curve is chosen per device by its model, unless a curve is configured
+	curveByModel := preset == "" && settingSources["speeds"] == SETTING_SOURCE_DEFAULT
 	fanSpeedConfig, err := parseSpeedConfigFlag(fanSpeedEncoded)
 	if err != nil {
 		slog.Error("unable to parse fan speed flag", "err", err)
-		return
+		return EXIT_CONFIG_ERROR
+	}
+
+	if noResetOnExit {
+		if exitAction != EXIT_ACTION_DEFAULT && exitAction != EXIT_ACTION_HOLD {
+			slog.Error("-no-reset-on-exit cannot be combined with other exit action", "exitAction", exitAction)
+			return EXIT_CONFIG_ERROR
+		}
+		exitAction = EXIT_ACTION_HOLD
+	}
+	if err := validateExitAction(exitAction, exitSpeed); err != nil {
+		slog.Error("invalid exit action", "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+	if idlePState > MAX_PSTATE {
+		slog.Error("idle performance state must not be greater than 15", "idlePState", idlePState)
+		return EXIT_CONFIG_ERROR
+	}
+	if alertTemp > uint(MAX_TEMP) {
+		slog.Error("alert temperature must not be greater than maximum temperature", "alertTemp", alertTemp, "maxTemp", MAX_TEMP)
+		return EXIT_CONFIG_ERROR
+	}
+	if alertTempDuration < 0 {
+		slog.Error("alert temperature duration must not be negative", "alertTempDuration", alertTempDuration)
+		return EXIT_CONFIG_ERROR
+	}
+	if alertRiseRate < 0 || math.IsNaN(alertRiseRate) || math.IsInf(alertRiseRate, 0) {
+		slog.Error("alert rise rate must be a non-negative number", "alertRiseRate", alertRiseRate)
+		return EXIT_CONFIG_ERROR
+	}
+	if riseBoostDuration < 0 || riseBoostDuration > MAX_OVERRIDE_DURATION {
+		slog.Error("rise boost duration is out of range", "riseBoostDuration", riseBoostDuration, "maxDuration", MAX_OVERRIDE_DURATION)
+		return EXIT_CONFIG_ERROR
+	}
+	if riseBoostDuration > 0 && alertRiseRate == 0 {
+		slog.Error("rise boost duration requires alert rise rate")
+		return EXIT_CONFIG_ERROR
+	}
+
+	if adaptivePolling && pollingFastDuration <= 0 {
+		slog.Error("adaptive polling durations must satisfy 0 < fast <= polling <= slow", "fast", pollingFastDuration, "polling", pollingDuration, "slow", pollingSlowDuration)
+		return EXIT_CONFIG_ERROR
+	}
+	// Bounds of adaptive polling, which per device polling duration is also checked against
+	var adaptiveFastDuration, adaptiveSlowDuration time.Duration
+	if adaptivePolling {
+		adaptiveFastDuration, adaptiveSlowDuration = pollingFastDuration, pollingSlowDuration
+	}
+	values := controlValues{
+		pollingDuration:     pollingDuration,
+		pollingFastDuration: adaptiveFastDuration,
+		pollingSlowDuration: adaptiveSlowDuration,
+		minSpeed:            minSpeed,
+		maxSpeed:            maxSpeed,
+		speedStep:           speedStep,
+		fallbackSpeedAbove:  fallbackSpeedAbove,
+		fallbackSpeedBelow:  fallbackSpeedBelow,
+		failsafeTemp:        failsafeTemp,
+		takeoverTemp:        takeoverTemp,
+		targetTemp:          targetTemp,
+		spikeThreshold:      spikeThreshold,
+		tempOffset:          tempOffset,
+		medianSamples:       medianSamples,
+		writeInterval:       writeInterval,
+		rpmCurve:            rpmSpeedEncoded != "",
+		formula:             speedFormulaStr != "",
+	}
+	if err := values.validate(); err != nil {
+		slog.Error("invalid config", "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+
+	var deviceMatchPattern *regexp.Regexp
+	if deviceMatch != "" {
+		if deviceMatchPattern, err = regexp.Compile(deviceMatch); err != nil {
+			slog.Error("unable to parse device match pattern", "pattern", deviceMatch, "err", err)
+			return EXIT_CONFIG_ERROR
+		}
+	}
+
+	var rpmConfig []rpmPoint
+	if rpmSpeedEncoded != "" {
+		if calibrate {
+			slog.Error("calibration cannot be run in RPM-target mode")
+			return EXIT_CONFIG_ERROR
+		}
+		rpmConfig, err = parseRPMConfigFlag(rpmSpeedEncoded)
+		if err != nil {
+			slog.Error("unable to parse RPM speeds flag", "err", err)
+			return EXIT_CONFIG_ERROR
+		}
+	}
+
+	if targetTemp > 0 && calibrate {
+		slog.Error("calibration cannot be run in target temperature mode")
+		return EXIT_CONFIG_ERROR
+	}
+
+	if predictAhead < 0 {
+		slog.Error("prediction look-ahead must not be negative", "predictAhead", predictAhead)
+		return EXIT_CONFIG_ERROR
+	}
+	if controlListen != "" && controlToken == "" {
+		slog.Error("control token must be set when control API listens on TCP address", "controlListen", controlListen)
+		return EXIT_CONFIG_ERROR
+	}
+	var tlsConfig *tls.Config
+	if tlsCert != "" || tlsKey != "" {
+		if tlsCert == "" || tlsKey == "" {
+			slog.Error("both TLS certificate and key must be set")
+			return EXIT_CONFIG_ERROR
+		}
+		if tlsConfig, err = newServerTLSConfig(tlsCert, tlsKey, tlsClientCA); err != nil {
+			slog.Error("unable to load TLS config", "err", err)
+			return EXIT_CONFIG_ERROR
+		}
+	} else if tlsClientCA != "" {
+		slog.Error("TLS client CA requires TLS certificate and key")
+		return EXIT_CONFIG_ERROR
+	}
+	for _, addr := range []string{httpListen, controlListen} {
+		if addr != "" && tlsConfig == nil && !isLoopbackAddr(addr) {
+			slog.Warn("HTTP API listens on non-loopback address without TLS, requests are sent in plaintext", "addr", addr)
+		}
+	}
+	if otlpEndpoint != "" && otlpInterval <= 0 {
+		slog.Error("OTLP export interval must be positive", "otlpInterval", otlpInterval)
+		return EXIT_CONFIG_ERROR
+	}
+	// Only auto falls back to nvidia-smi, as explicit nvml is expected to control fans
+	nvidiaSMIFallback := backendName == GPU_BACKEND_AUTO
+	backendName, err = resolveGPUBackend(backendName)
+	if err != nil {
+		slog.Error("invalid backend", "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+	if backendName != GPU_BACKEND_NVML && (privsepUser != "" || persistenceMode || powerLimit > 0 || lockedClocksStr != "") {
+		slog.Error("backend other than nvml cannot be used with privsep user, persistence mode, power limit or locked clocks, which require NVML", "backend", backendName)
+		return EXIT_CONFIG_ERROR
+	}
+	if dryRunReport != "" && (!dryrun || calibrate) {
+		slog.Error("dry-run report requires dry run, and cannot be used with calibration", "dryRunReport", dryRunReport)
+		return EXIT_CONFIG_ERROR
+	}
+	if waitForDriverDuration < 0 {
+		slog.Error("wait for driver duration must not be negative", "waitForDriver", waitForDriverDuration)
+		return EXIT_CONFIG_ERROR
+	}
+	if statsInterval < 0 {
+		slog.Error("stats interval must not be negative", "statsInterval", statsInterval)
+		return EXIT_CONFIG_ERROR
+	}
+	if historyDuration > 0 && historyInterval <= 0 {
+		slog.Error("History interval must be positive", "historyInterval", historyInterval)
+		return EXIT_CONFIG_ERROR
+	}
+	if historyDBPath != "" && historyDBInterval <= 0 {
+		slog.Error("History database interval must be positive", "historyDBInterval", historyDBInterval)
+		return EXIT_CONFIG_ERROR
+	}
+	if historyDBRetention < 0 {
+		slog.Error("History database retention must not be negative", "historyDBRetention", historyDBRetention)
+		return EXIT_CONFIG_ERROR
+	}
+	if privsepUser != "" && (persistenceMode || powerLimit > 0 || lockedClocksStr != "" || hwmonPWMStr != "") {
+		slog.Error("privsep user cannot be used with persistence mode, power limit, locked clocks or hwmon PWM, which require root privilege", "privsepUser", privsepUser)
+		return EXIT_CONFIG_ERROR
+	}
+	fans, err := parseFanIndices(fansStr)
+	if err != nil {
+		slog.Error("unable to parse fans flag", "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+	autoFans, err := parseFanIndices(autoFansStr)
+	if err != nil {
+		slog.Error("unable to parse auto fans flag", "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+	fanOffsets, err := parseFanOffsets(fanOffsetsStr)
+	if err != nil {
+		slog.Error("unable to parse fan offsets flag", "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+	minClockMHz, maxClockMHz, err := parseLockedClocks(lockedClocksStr)
+	if err != nil {
+		slog.Error("unable to parse locked clocks flag", "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+
+	var memoryFanSpeedConfig [][2]uint8
+	if memoryFanSpeedEncoded != "" {
+		memoryFanSpeedConfig, err = parseSpeedConfigFlag(memoryFanSpeedEncoded)
+		if err != nil {
+			slog.Error("unable to parse memory fan speed flag", "err", err)
+			return EXIT_CONFIG_ERROR
+		}
+	}
+
+	var blend temperatureBlend
+	if tempBlendStr != "" {
+		if blend, err = parseTemperatureBlend(tempBlendStr); err != nil {
+			slog.Error("unable to parse temperature blend", "blend", tempBlendStr, "err", err)
+			return EXIT_CONFIG_ERROR
+		}
+		if speedFormulaStr != "" {
+			slog.Error("temperature blend cannot be used together with fan speed formula, which can blend sensors by itself")
+			return EXIT_CONFIG_ERROR
+		}
+		if blend.uses(BLEND_SENSOR_SOURCE) && tempSourceSpec == "" {
+			slog.Error("source of temperature blend requires -temp-source")
+			return EXIT_CONFIG_ERROR
+		}
+	}
+
+	var tempSource temperatureSource
+	var sourceSpeedMap map[uint8]uint8
+	if tempSourceSpec != "" {
+		if sourceFanSpeedEncoded == "" && speedFormulaStr == "" && !blend.uses(BLEND_SENSOR_SOURCE) {
+			slog.Error("temperature source requires -temp-source-speeds, -speed-formula or source of -temp-blend")
+			return EXIT_CONFIG_ERROR
+		}
+		if tempSource, err = newTemperatureSource(tempSourceSpec, tempSourceScale); err != nil {
+			slog.Error("unable to configure temperature source", "err", err)
+			return EXIT_CONFIG_ERROR
+		}
+		if sourceFanSpeedEncoded != "" {
+			sourceFanSpeedConfig, err := parseSpeedConfigFlag(sourceFanSpeedEncoded)
+			if err != nil {
+				slog.Error("unable to parse temperature source fan speed flag", "err", err)
+				return EXIT_CONFIG_ERROR
+			}
+			sourceSpeedMap = generateTempNFanSpeedMap(sourceFanSpeedConfig)
+		}
+	}
+
+	var formula *speedFormula
+	if speedFormulaStr != "" {
+		if formula, err = parseSpeedFormula(speedFormulaStr); err != nil {
+			slog.Error("unable to parse fan speed formula", "formula", speedFormulaStr, "err", err)
+			return EXIT_CONFIG_ERROR
+		}
+		if rpmSpeedEncoded != "" {
+			slog.Error("fan speed formula cannot be used together with RPM-target mode")
+			return EXIT_CONFIG_ERROR
+		}
+		if formula.uses(FORMULA_FUNC_CURVE2) && memoryFanSpeedEncoded == "" {
+			slog.Error("curve2() of fan speed formula requires -memory-speeds")
+			return EXIT_CONFIG_ERROR
+		}
+		if formula.uses(FORMULA_VAR_SOURCE_TEMP) && tempSource == nil {
+			slog.Error("source_temp of fan speed formula requires -temp-source")
+			return EXIT_CONFIG_ERROR
+		}
+	}
+
+	var calibrateSteps []uint8
+	if calibrate {
+		if dryrun {
+			slog.Error("calibration cannot be run in dry-run mode")
+			return EXIT_CONFIG_ERROR
+		}
+		if calibrateTargetTemp < 30 || calibrateTargetTemp > 95 {
+			slog.Error("calibration target temperature must be between 30 and 95", "temp", calibrateTargetTemp)
+			return EXIT_CONFIG_ERROR
+		}
+		calibrateSteps, err = parseCalibrationSteps(calibrateStepsStr)
+		if err != nil {
+			slog.Error("unable to parse calibration steps flag", "err", err)
+			return EXIT_CONFIG_ERROR
+		}
 	}
 
 	var logLevel slog.Level
 	if err := logLevel.UnmarshalText([]byte(logLevelStr)); err != nil {
 		slog.Error("unable to parse log level", "level", logLevelStr, "err", err)
-		return
+		return EXIT_CONFIG_ERROR
+	}
+	moduleLevels, err := parseLogLevels(logLevelsStr)
+	if err != nil {
+		slog.Error("unable to parse log levels flag", "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+	// Handler must pass records at the lowest level, which are then filtered by level of their module
+	handlerLevel := logLevel
+	for _, level := range moduleLevels {
+		handlerLevel = min(handlerLevel, level)
+	}
+	slog.SetLogLoggerLevel(handlerLevel)
+	logWriter := io.Writer(os.Stderr)
+	logFormat = strings.ToLower(logFormat)
+	if _, err := newLogHandler(logFormat, logWriter, &slog.HandlerOptions{}); err != nil {
+		slog.Error("unable to parse log format", "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+
+	if logFile != "" {
+		if logMaxSizeMB <= 0 || logMaxAge <= 0 || logMaxBackups < 0 {
+			slog.Error("log rotation settings must be positive", "maxSize", logMaxSizeMB, "maxAge", logMaxAge, "maxBackups", logMaxBackups)
+			return EXIT_CONFIG_ERROR
+		}
+		file, err := newRotatingFile(logFile, int64(logMaxSizeMB)*1024*1024, logMaxAge, logMaxBackups)
+		if err != nil {
+			slog.Error("unable to open log file", "path", logFile, "err", err)
+			return EXIT_CONFIG_ERROR
+		}
+		defer file.Close()
+		logWriter = io.MultiWriter(os.Stderr, file)
+	}
+	// Default handler writes plain text lines through log package, which is redirected to the new default logger and
+	// deadlocks if wrapped, so that it is replaced whenever records need other format, destination or filtering
+	if logFormat != LOG_FORMAT_TEXT || logFile != "" || len(moduleLevels) > 0 {
+		handler, _ := newLogHandler(logFormat, logWriter, &slog.HandlerOptions{Level: handlerLevel})
+		if len(moduleLevels) > 0 {
+			handler = newModuleLevelHandler(handler, moduleLevels, logLevel)
+		}
+		slog.SetDefault(slog.New(handler))
+	}
+	logSettings(flags, settingSources)
+	if options.export != nil {
+		if err := exportSettings(os.Stdout, flags, deviceConfigs, *options.export); err != nil {
+			slog.Error("Unable to export settings", "err", err)
+			return EXIT_CONFIG_ERROR
+		}
+		return EXIT_OK
 	}
-	slog.SetLogLoggerLevel(logLevel)
 
 	speedMap := generateTempNFanSpeedMap(fanSpeedConfig)
 	slog.Debug("Fan speed at different temperatures", "temps", speedMap)
+	var memorySpeedMap map[uint8]uint8
+	if memoryFanSpeedConfig != nil {
+		memorySpeedMap = generateTempNFanSpeedMap(memoryFanSpeedConfig)
+		slog.Debug("Fan speed at different memory temperatures", "temps", memorySpeedMap)
+	}
 
-	slog.Info("Initialize NVML API")
-	ret := nvml.Init()
-	if ret != nvml.SUCCESS {
-		slog.Error("Unable to initialize NVML", "err", nvml.ErrorString(ret))
-		return
+	// Config shared by all devices, which is overridden per device by config file
+	config := controlConfig{
+		speedMap:           speedMap,
+		memorySpeedMap:     memorySpeedMap,
+		tempSource:         tempSource,
+		sourceSpeedMap:     sourceSpeedMap,
+		formula:            formula,
+		pollingDuration:    pollingDuration,
+		dryrun:             dryrun,
+		maxSpeed:           uint8(maxSpeed),
+		minSpeed:           uint8(minSpeed),
+		speedStep:          uint8(speedStep),
+		failsafeTemp:       uint8(failsafeTemp),
+		tempOffset:         tempOffset,
+		spikeThreshold:     uint8(spikeThreshold),
+		medianSamples:      medianSamples,
+		rpmCurve:           rpmConfig,
+		targetTemp:         uint8(targetTemp),
+		takeoverTemp:       uint8(takeoverTemp),
+		idlePState:         uint8(idlePState),
+		predictAhead:       predictAhead,
+		fallbackSpeedAbove: uint8(fallbackSpeedAbove),
+		fallbackSpeedBelow: uint8(fallbackSpeedBelow),
+		logRepeatInterval:  logRepeatInterval,
+		nvmlEvents:         nvmlEvents,
+		lowWakeup:          lowWakeup,
+		writeInterval:      writeInterval,
+		fans:               fanSelection{fans: fans, autoFans: autoFans, offsets: fanOffsets},
+		powerLimit:         powerLimit,
+		lockedClocks:       [2]uint32{minClockMHz, maxClockMHz},
+		alertTemp:          uint8(alertTemp),
+		alertTempDuration:  alertTempDuration,
+		riseRate:           alertRiseRate,
+		blend:              blend,
+		riseBoostDuration:  riseBoostDuration,
+	}
+	if options.simulation != nil {
+		return runSimulation(os.Stdout, config, *options.simulation)
+	}
+
+	if !dryrun {
+		conflicts, err := findConflictingPrograms()
+		if err != nil {
+			slog.Warn("Unable to detect other fan control programs", "err", err)
+		}
+		if len(conflicts) > 0 {
+			if !force {
+				slog.Error("Other fan control programs are running, which fight over fan control policy. Stop them, or use -force to start anyway", "programs", conflicts)
+				return EXIT_CONFLICT
+			}
+			slog.Warn("Other fan control programs are running, which may fight over fan control policy", "programs", conflicts)
+		}
+	}
+
+	// Control socket is created while the process still has root privilege, and served once devices are ready
+	var controlListener net.Listener
+	if controlSocket != "" && !calibrate {
+		controlListener, err = listenControlSocket(controlSocket)
+		if err != nil {
+			slog.Error("Unable to start control API, continue without it", "socket", controlSocket, "err", err)
+		} else {
+			// Socket may not be removed after privilege is dropped, in which case it is replaced on next startup
+			defer func() {
+				controlListener.Close()
+				os.Remove(controlSocket)
+			}()
+		}
+	}
+
+	// Helper is started while the process still has root privilege, which is dropped right after,
+	// so that NVML is initialized and everything else is run by the unprivileged user
+	selection := deviceSelection{index: deviceIndex, indices: devicesStr, exclude: excludeDevicesStr, match: deviceMatchPattern}
+	var helper *fanHelperClient
+	if privsepUser != "" && !dryrun {
+		allowed, code := fanHelperDevices(ctx, waitForDriverDuration, selection)
+		if code != EXIT_OK {
+			return code
+		}
+		err = waitForDriver(ctx, waitForDriverDuration, func() error {
+			helper, err = startFanHelper(allowed)
+			return err
+		})
+		if err != nil {
+			slog.Error("Unable to start fan helper", "err", err)
+			return EXIT_RUNTIME_FAILURE
+		}
+		// Closed after all devices are restored, as defers run in reverse order
+		defer helper.close()
+		var ownedDirs []string
+		if lockDir != "" {
+			ownedDirs = append(ownedDirs, lockDir)
+		}
+		if stateFile != "" {
+			ownedDirs = append(ownedDirs, filepath.Dir(stateFile))
+		}
+		if wearFile != "" {
+			ownedDirs = append(ownedDirs, filepath.Dir(wearFile))
+		}
+		if err := dropPrivileges(privsepUser, ownedDirs); err != nil {
+			slog.Error("Unable to drop root privilege", "user", privsepUser, "err", err)
+			return EXIT_PERMISSION_DENIED
+		}
+		slog.Info("Dropped root privilege, fan speed is set by privileged helper", "user", privsepUser, "helperPID", helper.cmd.Process.Pid)
+	}
+
+	slog.Info("Initialize GPU backend", "backend", backendName)
+	backend := newGPUBackendByName(backendName)
+	if err := waitForDriver(ctx, waitForDriverDuration, backend.Init); err != nil {
+		if !nvidiaSMIFallback || backendName != GPU_BACKEND_NVML || !errors.Is(err, ErrLibraryNotFound) {
+			slog.Error("Unable to initialize NVML", "err", err)
+			return EXIT_NVML_INIT_FAILURE
+		}
+		slog.Warn("NVML library cannot be loaded, fall back to nvidia-smi, which only reads sensors. Fan speed cannot be set, so that fans are left to driver default policy", "err", err)
+		backendName = GPU_BACKEND_NVIDIA_SMI
+		backend = newGPUBackendByName(backendName)
+		if err := backend.Init(); err != nil {
+			slog.Error("Unable to initialize nvidia-smi fallback", "err", err)
+			return EXIT_NVML_INIT_FAILURE
+		}
 	}
 	defer func() {
-		ret := nvml.Shutdown()
-		if ret != nvml.SUCCESS {
-			slog.Error("Unable to shutdown NVML", "err", nvml.ErrorString(ret))
+		if err := backend.Shutdown(); err != nil {
+			slog.Error("Unable to shutdown NVML", "err", err)
 			return
 		}
 	}()
-	slog.Info("NVML API initialized")
+	slog.Info("GPU backend initialized", "backend", backendName)
+	// Access is checked once backend is initialized, so that auto is checked only when it did not fall back to
+	// nvidia-smi, which only reads sensors. It is reported here in plain words, rather than by NO_PERMISSION error on
+	// the first fan speed update. It only matters when this process sets fan speed through NVML, i.e. not by other
+	// backends or privileged helper. Missing capability is only warned, as the driver reports it anyway.
+	if !dryrun && backendName == GPU_BACKEND_NVML && privsepUser == "" {
+		if err := checkFanControlPermission(); err != nil {
+			if !errors.Is(err, ErrMissingPrivilege) {
+				slog.Error("Insufficient privilege to control fans", "err", err)
+				return EXIT_PERMISSION_DENIED
+			}
+			slog.Warn("Fan speed may be rejected by the driver for insufficient privilege", "err", err)
+		}
+	}
+	forceNvidiaSettings := false
+	if backendName == GPU_BACKEND_NVML {
+		forceNvidiaSettings = checkDriverCompatibility(backend, nvidiaSettingsFallback)
+	}
 
-	count, ret := nvml.DeviceGetCount()
-	if ret != nvml.SUCCESS {
-		slog.Error("Unable to get device count", "err", nvml.ErrorString(ret))
+	count, err := backend.DeviceCount()
+	if err != nil {
+		slog.Error("Unable to get device count", "err", err)
+	}
+	deviceIndices, code := selectDevices(backend, count, selection)
+	if code != EXIT_OK {
+		return code
 	}
-	slog.Info("Found devices", "count", count, "selectedDeviceIdx", deviceIndex)
+	if calibrate && len(deviceIndices) > 1 {
+		slog.Error("calibration can only be run on a single device", "devices", deviceIndices)
+		return EXIT_CONFIG_ERROR
+	}
+	slog.Info("Found devices", "count", count, "selectedDeviceIndices", deviceIndices)
 
-	device, ret := nvml.DeviceGetHandleByIndex(deviceIndex)
-	if ret != nvml.SUCCESS {
-		slog.Error("Unable to get device at index", "index", 0, "err", nvml.ErrorString(ret))
-		return
+	openDevice := func(index int) (gpuDevice, error) {
+		device, err := backend.Device(index)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get device at index %d: %w", index, err)
+		}
+		device = withCachedInfo(device)
+		if helper != nil {
+			if device, err = withFanHelper(device, helper); err != nil {
+				return nil, err
+			}
+		}
+		if nvidiaSettingsFallback && backendName == GPU_BACKEND_NVML {
+			device = withNvidiaSettingsFallback(backend, device, index, nvidiaSettingsDisplay, forceNvidiaSettings)
+		}
+		return device, nil
 	}
 
-	// This function reset NVIDIA GPU fan speed to default policy, before this process exited
-	defer func() {
-		if dryrun {
-			slog.Info("(Dryrun) Set NVIDIA GPU fan speed to default setting", "deviceIdx", deviceIndex)
-			return
+	// Shared by all devices, so that NVML is re-initialized once, rather than by each device in turn
+	reinit := newBackendReinit(backend)
+	var devices []*controlledDevice
+	// Exit action only applies on graceful shutdown, while fans are returned to driver default policy on failure,
+	// as no controller is left to react to temperature
+	appliedExitAction := EXIT_ACTION_DEFAULT
+	for _, index := range deviceIndices {
+		device, err := openDevice(index)
+		if err != nil {
+			slog.Error("Unable to get device at index", LABEL_GPU_INDEX, index, "err", err)
+			return EXIT_UNSUPPORTED_DEVICE
 		}
 
-		numFans, ret := nvml.DeviceGetNumFans(device)
-		if ret != nvml.SUCCESS {
-			slog.Error("Unable to get number of fans from device", "err", nvml.ErrorString(ret), "deviceIdx", deviceIndex)
+		handle := newDeviceHandle(device, func() (gpuDevice, error) {
+			return openDevice(index)
+		}, reinit)
+
+		// Locked before anything is changed on the device, and released after everything is restored
+		if lockDir != "" && !dryrun {
+			uuid, err := device.UUID()
+			if err != nil {
+				slog.Error("Unable to get device UUID, which is required by instance lock", LABEL_GPU_INDEX, index, "err", err)
+				return EXIT_UNSUPPORTED_DEVICE
+			}
+			unlock, err := lockDevice(lockDir, uuid)
+			if errors.Is(err, errInstanceLocked) {
+				slog.Error("Device is already controlled by another instance", LABEL_GPU_INDEX, index, "err", err)
+				return EXIT_CONFLICT
+			}
+			if err != nil {
+				slog.Error("Unable to lock device", LABEL_GPU_INDEX, index, "err", err)
+				return EXIT_RUNTIME_FAILURE
+			}
+			defer unlock()
 		}
-		slog.Info("Setting device fan speed policy to default", "deviceIdx", deviceIndex)
-		for i := 0; i < numFans; i++ {
-			ret := nvml.DeviceSetDefaultFanSpeed_v2(device, i)
-			if ret != nvml.SUCCESS {
-				slog.Error("Unable to set fan speed to default state", "err", nvml.ErrorString(ret))
+
+		var overrides map[string]string
+		if len(deviceConfigs) > 0 {
+			uuid, err := device.UUID()
+			if err != nil {
+				slog.Error("Unable to get device UUID, which is required by per device config", LABEL_GPU_INDEX, index, "err", err)
+				return EXIT_UNSUPPORTED_DEVICE
+			}
+			if overrides, err = deviceConfigValues(deviceConfigs, index, uuid); err != nil {
+				slog.Error("Invalid per device config", "err", err)
+				return EXIT_CONFIG_ERROR
 			}
 		}
-	}()
+		baseConfig, baseCurve := config, fanSpeedConfig
+		if curveByModel {
+			name, err := device.Name()
+			if err != nil {
+				slog.Warn("Unable to get device name, use default fan curve", LABEL_GPU_INDEX, index, "err", err)
+			} else if model, ok := modelDefaultCurve(name); ok {
+				if baseCurve, err = parseSpeedConfigFlag(model.speeds); err != nil {
+					slog.Error("Invalid default fan curve of GPU model", "model", model.description, "err", err)
+					return EXIT_CONFIG_ERROR
+				}
+				baseConfig.speedMap = generateTempNFanSpeedMap(baseCurve)
+				slog.Info("No fan curve is configured, use default fan curve of GPU model", LABEL_GPU_INDEX, index, "name", name, "model", model.description, "speeds", model.speeds)
+			}
+		}
+		deviceConfig, deviceCurve, err := applyDeviceOverrides(baseConfig, baseCurve, overrides, adaptiveFastDuration, adaptiveSlowDuration)
+		if err != nil {
+			slog.Error("Invalid per device config", LABEL_GPU_INDEX, index, "err", err)
+			return EXIT_CONFIG_ERROR
+		}
+		if len(overrides) > 0 {
+			slog.Info("Apply per device config", LABEL_GPU_INDEX, index, "config", overrides)
+		}
+
+		d := newControlledDevice(index, handle, newControllerState(deviceCurve, memoryFanSpeedConfig))
+		d.config = deviceConfig
+
+		if persistenceMode {
+			// Restored after fan speeds, as defers run in reverse order
+			restorePersistenceMode := enablePersistenceMode(d.logger, handle, dryrun)
+			defer func() { restorePersistenceMode() }()
+		}
+
+		if d.config.powerLimit > 0 {
+			restorePowerLimit, err := applyPowerLimit(d.logger, handle, d.config.powerLimit, dryrun)
+			if err != nil {
+				d.logger.Error("Unable to apply power limit", "err", err)
+				return EXIT_UNSUPPORTED_DEVICE
+			}
+			defer func() { restorePowerLimit() }()
+		}
+		if d.config.lockedClocks[1] > 0 {
+			resetLockedClocks, err := applyLockedClocks(d.logger, handle, d.config.lockedClocks[0], d.config.lockedClocks[1], dryrun)
+			if err != nil {
+				d.logger.Error("Unable to apply locked clocks", "err", err)
+				return EXIT_UNSUPPORTED_DEVICE
+			}
+			defer func() { resetLockedClocks() }()
+		}
+
+		// This function applies exit action e.g. reset NVIDIA GPU fan speed to default policy, before this process exited
+		defer func() {
+			if d.config.observeOnly {
+				return
+			}
+			device := handle.get()
+			fans, _, err := controlledFans(device, d.config.fans)
+			if err != nil {
+				d.logger.Error("Unable to get fans of device", "err", err)
+			}
+			applyExitAction(d.logger, device, fans, appliedExitAction, uint8(exitSpeed), dryrun)
+		}()
 
-	printDeviceInfo(device)
+		printDeviceInfo(device)
+		err = probeFanControl(device, d.config.fans)
+		if err == nil && selfTest && !dryrun {
+			fans, _, _ := controlledFans(device, d.config.fans)
+			err = runSelfTest(d.logger, device, fans)
+		}
+		if errors.Is(err, ErrUnsupportedDevice) && !calibrate {
+			d.logger.Warn("Device does not support fan control, monitor its temperature only", "reason", err)
+			d.config.observeOnly = true
+			d.state.setObserveOnly(true)
+		} else if err != nil {
+			d.logger.Error("Fan control of device is not usable, use -self-test=false to skip self-test", "err", err)
+			return EXIT_UNSUPPORTED_DEVICE
+		}
+		devices = append(devices, d)
+	}
 
+	// Health check must tolerate the longest interval between polls of all devices
+	healthPollingDuration := time.Duration(0)
+	for _, d := range devices {
+		healthPollingDuration = max(healthPollingDuration, d.config.pollingDuration, d.config.writeInterval)
+	}
+	if adaptivePolling {
+		healthPollingDuration = max(healthPollingDuration, pollingSlowDuration)
+	}
+	if lowWakeup {
+		healthPollingDuration = max(healthPollingDuration, lowWakeupInterval(healthPollingDuration))
+	}
+	if historyDuration > 0 && !calibrate {
+		for _, d := range devices {
+			d.history = newTelemetryHistory(int(historyDuration / historyInterval))
+		}
+		recorderCtx, stopRecorder := context.WithCancel(ctx)
+		go runHistoryRecorder(recorderCtx, historyInterval, lowWakeup, devices)
+		defer stopRecorder()
+	}
+	if len(schedule) > 0 && !calibrate {
+		scheduleCtx, stopSchedule := context.WithCancel(ctx)
+		go runSchedule(scheduleCtx, schedule, devices)
+		defer stopSchedule()
+	}
+	if statsInterval > 0 && !calibrate {
+		for _, d := range devices {
+			statsCtx, stopStats := context.WithCancel(ctx)
+			go runStatsSummary(statsCtx, statsInterval, d)
+			defer stopStats()
+		}
+	}
+	if logindSleep && !calibrate {
+		sleepCtx, stopSleep := context.WithCancel(ctx)
+		go func() {
+			if err := runLogindSleepMonitor(sleepCtx, devices); err != nil {
+				slog.Warn("Unable to listen to sleep of logind, continue with resume detection only", "err", err)
+			}
+		}()
+		defer stopSleep()
+	}
+	controlServer := newControlServer(devices, healthPollingDuration, configFile)
+	if wearFile != "" && !dryrun && !calibrate {
+		tracker, err := loadWearTracker(wearFile)
+		if err != nil {
+			slog.Warn("Unable to load fan wear, continue without tracking it", "path", wearFile, "err", err)
+		} else {
+			for _, d := range devices {
+				for i := 0; ; i++ {
+					wear, ok := tracker.fan(d.labels.uuid, i)
+					if !ok {
+						break
+					}
+					d.logger.Info("Fan wear", LABEL_FAN_INDEX, i, "hours", int(wear.Hours), "dutyHours", int(wear.DutyHours), "hoursAbove80", int(wear.HoursAbove[80]))
+				}
+			}
+			controlServer.wear = tracker
+			wearCtx, stopWear := context.WithCancel(ctx)
+			wearDone := make(chan struct{})
+			go func() {
+				runWearTracker(wearCtx, tracker, lowWakeup, devices)
+				close(wearDone)
+			}()
+			defer func() {
+				stopWear()
+				<-wearDone
+			}()
+		}
+	}
+	if controlListener != nil {
+		server := serveControlSocket(controlListener, controlServer.handler())
+		slog.Info("Control API is listening", "socket", controlSocket)
+		defer server.Close()
+	}
+	if controlListen != "" && !calibrate {
+		server, err := serveHTTP(controlListen, controlServer.remoteHandler(controlToken), tlsConfig)
+		if err != nil {
+			slog.Error("Unable to start control API on TCP address", "addr", controlListen, "err", err)
+			return EXIT_CONFIG_ERROR
+		}
+		slog.Info("Control API is listening", "addr", controlListen)
+		defer server.Close()
+	}
+	if httpListen != "" && !calibrate {
+		server, err := serveHTTP(httpListen, controlServer.publicHandler(), tlsConfig)
+		if err != nil {
+			slog.Error("Unable to start HTTP server", "addr", httpListen, "err", err)
+			return EXIT_CONFIG_ERROR
+		}
+		slog.Info("HTTP server is listening", "addr", httpListen)
+		defer server.Close()
+	}
+	if otlpEndpoint != "" && !calibrate {
+		exporterCtx, stopExporter := context.WithCancel(ctx)
+		go runOTLPExporter(exporterCtx, otlpEndpoint, otlpInterval, devices, logRepeatInterval)
+		slog.Info("Export metrics to OTLP endpoint", "endpoint", otlpEndpoint, "interval", otlpInterval)
+		defer stopExporter()
+	}
+	var notifiers []alertNotifier
+	if alertWebhook != "" {
+		notifiers = append(notifiers, newWebhookNotifier(alertWebhook))
+	}
+	if alertDiscordWebhook != "" {
+		notifiers = append(notifiers, newDiscordNotifier(alertDiscordWebhook))
+	}
+	if alertTelegramToken != "" {
+		notifier, err := newTelegramNotifier(alertTelegramToken, alertTelegramChatID)
+		if err != nil {
+			slog.Error("Unable to configure Telegram alerts", "err", err)
+			return EXIT_CONFIG_ERROR
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if alertSMTPAddr != "" {
+		var recipients []string
+		for _, recipient := range strings.Split(alertSMTPTo, ",") {
+			if recipient = strings.TrimSpace(recipient); recipient != "" {
+				recipients = append(recipients, recipient)
+			}
+		}
+		notifier, err := newSMTPNotifier(alertSMTPAddr, alertSMTPUsername, alertSMTPPassword, alertSMTPFrom, recipients)
+		if err != nil {
+			slog.Error("Unable to configure SMTP alerts", "err", err)
+			return EXIT_CONFIG_ERROR
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	var hooks []alertNotifier
+	if hookCommand != "" {
+		hook, err := newHookNotifier(hookCommand, hookEvents)
+		if err != nil {
+			slog.Error("Unable to configure event hook", "err", err)
+			return EXIT_CONFIG_ERROR
+		}
+		hooks = append(hooks, hook)
+	}
+	var alerts *alertDispatcher
+	if len(notifiers)+len(hooks) > 0 && !calibrate {
+		alerts = newAlertDispatcher(notifiers, hooks)
+		// Queued alerts e.g. control lost right before exit, are delivered before exiting
+		defer alerts.close()
+		controlServer.alerts = alerts
+	} else if alertTemp > 0 {
+		slog.Warn("Alert temperature is set without any alert destination, alerts are not sent", "alertTemp", alertTemp)
+	}
+	if historyDBPath != "" && !calibrate {
+		db, err := openHistoryDB(historyDBPath, historyDBRetention)
+		if err != nil {
+			slog.Error("Unable to open history database", "path", historyDBPath, "err", err)
+			return EXIT_CONFIG_ERROR
+		}
+		writerCtx, stopWriter := context.WithCancel(ctx)
+		go runHistoryDBWriter(writerCtx, db, historyDBInterval, devices, logRepeatInterval)
+		slog.Info("Store history to SQLite file", "path", historyDBPath, "interval", historyDBInterval, "retention", historyDBRetention)
+		defer stopWriter()
+	}
+	var coolers []externalCooler
+	if hwmonPWMStr != "" && !calibrate {
+		hwmonSpeedMap := speedMap
+		if hwmonFanSpeedEncoded != "" {
+			hwmonFanSpeedConfig, err := parseSpeedConfigFlag(hwmonFanSpeedEncoded)
+			if err != nil {
+				slog.Error("unable to parse hwmon fan speed flag", "err", err)
+				return EXIT_CONFIG_ERROR
+			}
+			hwmonSpeedMap = generateTempNFanSpeedMap(hwmonFanSpeedConfig)
+		}
+		for _, path := range strings.Split(hwmonPWMStr, ",") {
+			pwm, err := newHWMonPWM(strings.TrimSpace(path), dryrun)
+			if err != nil {
+				slog.Error("Unable to take control of PWM channel", "path", path, "err", err)
+				return EXIT_CONFIG_ERROR
+			}
+			// Channels taken so far must be restored even if a later one fails
+			defer func() {
+				if err := pwm.restore(); err != nil {
+					slog.Error("Unable to restore PWM channel", "path", pwm.path, "err", err)
+				}
+			}()
+			coolers = append(coolers, externalCooler{output: pwm, speedMap: hwmonSpeedMap})
+		}
+		slog.Info("Case fans follow GPU temperature", "channels", hwmonPWMStr)
+	}
+	if (liquidctlStr != "" || coolerCommand != "") && !calibrate {
+		coolerSpeedMap := speedMap
+		if coolerFanSpeedEncoded != "" {
+			coolerFanSpeedConfig, err := parseSpeedConfigFlag(coolerFanSpeedEncoded)
+			if err != nil {
+				slog.Error("unable to parse cooler speed flag", "err", err)
+				return EXIT_CONFIG_ERROR
+			}
+			coolerSpeedMap = generateTempNFanSpeedMap(coolerFanSpeedConfig)
+		}
+		var outputs []coolerOutput
+		if liquidctlStr != "" {
+			channels, err := parseLiquidctlChannels(liquidctlStr)
+			if err != nil {
+				slog.Error("unable to parse liquidctl flag", "err", err)
+				return EXIT_CONFIG_ERROR
+			}
+			for _, channel := range channels {
+				outputs = append(outputs, channel)
+			}
+		}
+		if coolerCommand != "" {
+			outputs = append(outputs, &commandCooler{command: coolerCommand})
+		}
+		for _, output := range outputs {
+			if !dryrun {
+				defer func() {
+					if err := output.restore(); err != nil {
+						slog.Error("Unable to restore cooler", "cooler", output.name(), "err", err)
+					}
+				}()
+			}
+			coolers = append(coolers, externalCooler{output: output, speedMap: coolerSpeedMap})
+		}
+		slog.Info("External coolers follow GPU temperature", "liquidctl", liquidctlStr, "command", coolerCommand)
+	}
+	if ipmiVendor != "" && !calibrate {
+		ipmiSpeedMap := speedMap
+		if ipmiFanSpeedEncoded != "" {
+			ipmiFanSpeedConfig, err := parseSpeedConfigFlag(ipmiFanSpeedEncoded)
+			if err != nil {
+				slog.Error("unable to parse IPMI fan speed flag", "err", err)
+				return EXIT_CONFIG_ERROR
+			}
+			ipmiSpeedMap = generateTempNFanSpeedMap(ipmiFanSpeedConfig)
+		}
+		ipmi, err := newIPMICooler(ipmiVendor, ipmiArgs, dryrun)
+		if err != nil {
+			slog.Error("Unable to take control of chassis fans by IPMI", "err", err)
+			return EXIT_CONFIG_ERROR
+		}
+		defer func() {
+			if err := ipmi.restore(); err != nil {
+				slog.Error("Unable to return chassis fans to automatic control", "err", err)
+			}
+		}()
+		coolers = append(coolers, externalCooler{output: ipmi, speedMap: ipmiSpeedMap})
+		slog.Info("Chassis fans follow GPU temperature by IPMI", "vendor", ipmiVendor)
+	}
+	if len(coolers) > 0 {
+		coolersCtx, stopCoolers := context.WithCancel(ctx)
+		coolersDone := make(chan struct{})
+		go func() {
+			defer close(coolersDone)
+			runExternalCoolers(coolersCtx, coolers, config, devices)
+		}()
+		// Coolers must be stopped before they are restored
+		defer func() {
+			stopCoolers()
+			<-coolersDone
+		}()
+	}
+	if stateFile != "" && !dryrun && !calibrate {
+		for _, d := range devices {
+			if d.config.observeOnly {
+				continue
+			}
+			restorePersistedState(d.logger, deviceStateFile(stateFile, d.index, len(devices) > 1), d.handle.get(), d.config.fans, d.state)
+		}
+	}
+	if dryRunReport != "" {
+		if err := writeDryRunReport(dryRunReport, flags, devices, memoryFanSpeedConfig, persistenceMode, exitAction, uint8(exitSpeed)); err != nil {
+			slog.Error("Unable to write dry-run report", "err", err)
+			return EXIT_RUNTIME_FAILURE
+		}
+		slog.Info("Dry-run report is written", "path", dryRunReport)
+		return EXIT_OK
+	}
+	exitCode := EXIT_OK
+	done := make(chan struct{})
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		if err := runCustomGPUFanCurve(device, speedMap, pollingDuration, dryrun, cancel); err != nil {
-			slog.Error("error occurred when run custom GPU fan curve", "err", err)
+		defer close(done)
+		if calibrate {
+			d := devices[0]
+			results, err := runCalibration(ctx, d.handle.get(), d.config.fans, calibrateSteps, uint8(calibrateTargetTemp), calibrateSettle, pollingDuration)
+			if err != nil {
+				slog.Error("error occurred when run calibration", "err", err)
+				exitCode = EXIT_RUNTIME_FAILURE
+			}
+			curve, err := proposeCalibratedCurve(results, uint8(calibrateTargetTemp))
+			if err != nil {
+				slog.Error("unable to propose fan curve from calibration results", "err", err)
+				exitCode = EXIT_RUNTIME_FAILURE
+			}
+			printCalibrationReport(results, curve)
+			return
+		}
+		if dryrun {
+			for _, d := range devices {
+				if len(devices) > 1 {
+					fmt.Printf("GPU %d\n", d.index)
+				}
+				printSpeedMapTable(d.config, d.state.curveConfig(), memoryFanSpeedConfig)
+			}
 		}
+
+		// A single device keeps exiting on failure, so that service manager can restart the whole process
+		if len(devices) == 1 {
+			d := devices[0]
+			config := d.config
+			if adaptivePolling {
+				config.poller = newAdaptivePoller(pollingFastDuration, config.pollingDuration, pollingSlowDuration, d.state.curveConfig())
+			}
+			config.stateFile = stateFile
+			config.logger = d.logger
+			config.labels = d.labels
+			config.alerts = alerts
+			if err := runCustomGPUFanCurve(ctx, d.handle, config, d.state, d.togglePause, d.applyNow, d.prepareSleep); err != nil {
+				slog.Error("error occurred when run custom GPU fan curve", "err", err)
+				if config.alerts != nil {
+					config.alerts.send(ALERT_CONTROL_LOST, d.labels, 0, fmt.Sprintf("Fan control is lost, fans are returned to driver default policy: %s", err))
+				}
+				exitCode = EXIT_RUNTIME_FAILURE
+			}
+			return
+		}
+
+		var loops sync.WaitGroup
+		for _, d := range devices {
+			deviceConfig := d.config
+			deviceConfig.logger = d.logger
+			deviceConfig.labels = d.labels
+			deviceConfig.alerts = alerts
+			if adaptivePolling {
+				deviceConfig.poller = newAdaptivePoller(pollingFastDuration, deviceConfig.pollingDuration, pollingSlowDuration, d.state.curveConfig())
+			}
+			if stateFile != "" {
+				deviceConfig.stateFile = deviceStateFile(stateFile, d.index, true)
+			}
+			loops.Add(1)
+			go func(d *controlledDevice) {
+				defer loops.Done()
+				superviseControlLoop(ctx, d, deviceConfig)
+			}(d)
+		}
+		loops.Wait()
 	}()
 
-	gracefulStop := make(chan os.Signal, 1)
-	signal.Notify(gracefulStop, syscall.SIGTERM)
-	signal.Notify(gracefulStop, syscall.SIGINT)
+	// SIGUSR1 dumps current state to log without interrupting fan control
+	dumpState := make(chan os.Signal, 1)
+	notifyDumpStateSignal(dumpState)
+	// SIGUSR2 toggles between custom fan curve and driver default policy
+	pauseSignal := make(chan os.Signal, 1)
+	notifyPauseSignal(pauseSignal)
 
-	<-gracefulStop
-	cancel <- true
+loop:
+	for {
+		select {
+		case <-dumpState:
+			for _, d := range devices {
+				d.state.dump(d.logger, d.handle.get())
+			}
+		case <-pauseSignal:
+			for _, d := range devices {
+				select {
+				case d.togglePause <- struct{}{}:
+				default:
+					slog.Warn("Previous pause/resume request is still being processed, ignore this one", LABEL_GPU_INDEX, d.index)
+				}
+			}
+		case <-ctx.Done():
+			break loop
+		case <-done:
+			break loop
+		}
+	}
+	if shutdownTimeout > 0 {
+		shutdownTimer = time.AfterFunc(shutdownTimeout, func() {
+			slog.Error("Graceful shutdown did not finish in time, exit without restoring remaining devices", "timeout", shutdownTimeout)
+			os.Exit(EXIT_RUNTIME_FAILURE)
+		})
+	}
 	wg.Wait()
-	close(cancel)
+	if ctx.Err() != nil && !calibrate {
+		appliedExitAction = exitAction
+	}
+	if alerts != nil {
+		for _, d := range devices {
+			alerts.send(ALERT_SHUTDOWN, d.labels, 0, fmt.Sprintf("Fan controller is shutting down, %s", describeExitAction(appliedExitAction, uint8(exitSpeed))))
+		}
+	}
 
 	slog.Info("Bye, and run deferred functions before exit")
+	return exitCode
 }
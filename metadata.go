@@ -0,0 +1,61 @@
+package main
+
+import "sync"
+
+// cachedInfoDevice keeps name, UUID and number of fans of the device once they are queried successfully, as they do
+// not change while the device is open, and they are needed by labels, locks, fan selection and fan wear among others.
+// Failed queries are not cached, so that they are retried by the next caller. A new wrapper is created whenever the
+// device is reopened, so that metadata is refreshed on reconnection.
+type cachedInfoDevice struct {
+	gpuDevice
+
+	mu      sync.Mutex
+	name    string
+	uuid    string
+	numFans int
+	// Whether each of the fields above has been queried successfully
+	hasName, hasUUID, hasNumFans bool
+}
+
+func withCachedInfo(device gpuDevice) gpuDevice {
+	return &cachedInfoDevice{gpuDevice: device}
+}
+
+func (d *cachedInfoDevice) Name() (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.hasName {
+		name, err := d.gpuDevice.Name()
+		if err != nil {
+			return "", err
+		}
+		d.name, d.hasName = name, true
+	}
+	return d.name, nil
+}
+
+func (d *cachedInfoDevice) UUID() (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.hasUUID {
+		uuid, err := d.gpuDevice.UUID()
+		if err != nil {
+			return "", err
+		}
+		d.uuid, d.hasUUID = uuid, true
+	}
+	return d.uuid, nil
+}
+
+func (d *cachedInfoDevice) NumFans() (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.hasNumFans {
+		numFans, err := d.gpuDevice.NumFans()
+		if err != nil {
+			return 0, err
+		}
+		d.numFans, d.hasNumFans = numFans, true
+	}
+	return d.numFans, nil
+}
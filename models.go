@@ -0,0 +1,51 @@
+package main
+
+import "regexp"
+
+// modelCurve is default fan curve for GPU models whose name matches the pattern
+type modelCurve struct {
+	// Short description of the models for logs
+	description string
+	pattern     *regexp.Regexp
+	// Fan curve in -speeds format
+	speeds string
+}
+
+// Default fan curves by GPU model, which are used when no curve is configured. The first match wins, so that more
+// specific patterns come first. Devices matching none use the balanced preset.
+var MODEL_CURVES = []modelCurve{
+	{
+		// Fans of laptop GPUs are shared with CPU, and are usually controlled by embedded controller anyway
+		description: "laptop GPU",
+		pattern:     regexp.MustCompile(`(?i)laptop|max-q|mobile|\bmx\s?\d{3}\b`),
+		speeds:      "50:30,65:45,75:65,85:100",
+	},
+	{
+		// Blower coolers exhaust heat out of the case, and need more airflow for the same temperature
+		description: "workstation GPU with blower cooler",
+		pattern:     regexp.MustCompile(`(?i)quadro|\brtx a\d{4}\b|\brtx \d{4} ada\b|\brtx pro \d{4}\b|\bturbo\b|\bblower\b`),
+		speeds:      "35:40,50:55,65:75,75:90,82:100",
+	},
+	{
+		// GDDR6X of high end Ampere cards runs much hotter than the core, which is not reported on most of them
+		description: "Ampere GPU with GDDR6X memory",
+		pattern:     regexp.MustCompile(`(?i)\brtx 30(70 ti|80|90)\b`),
+		speeds:      "35:40,45:55,55:70,65:90,75:100",
+	},
+	{
+		// Large axial coolers of Ada and Blackwell cards stay quiet up to higher temperature
+		description: "Ada or Blackwell GPU with axial cooler",
+		pattern:     regexp.MustCompile(`(?i)\brtx [45]0\d{2}\b`),
+		speeds:      "40:30,55:40,65:55,75:80,83:100",
+	},
+}
+
+// modelDefaultCurve returns default fan curve for the GPU model, chosen by its name
+func modelDefaultCurve(deviceName string) (modelCurve, bool) {
+	for _, model := range MODEL_CURVES {
+		if model.pattern.MatchString(deviceName) {
+			return model, true
+		}
+	}
+	return modelCurve{}, false
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const OTLP_METRICS_PATH = "/v1/metrics"
+
+// Types below encode OTLP metrics export request in JSON, as defined by OTLP/HTTP protocol,
+// so that no OpenTelemetry SDK is needed for a handful of gauges.
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpDataPoint struct {
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	TimeUnixNano string         `json:"timeUnixNano"`
+	AsDouble     float64        `json:"asDouble"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpMetric struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Unit        string    `json:"unit"`
+	Gauge       otlpGauge `json:"gauge"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpExportRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+func otlpString(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &value}}
+}
+
+func otlpInt(key string, value int) otlpKeyValue {
+	encoded := strconv.Itoa(value)
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{IntValue: &encoded}}
+}
+
+// buildOTLPRequest builds export request of temperature, fan speed and control loop latency of all devices
+func buildOTLPRequest(devices []*controlledDevice) otlpExportRequest {
+	temperature := otlpMetric{Name: "gpu.temperature", Description: "GPU core temperature reported by the device", Unit: "Cel"}
+	memoryTemperature := otlpMetric{Name: "gpu.memory.temperature", Description: "GPU memory temperature reported by the device", Unit: "Cel"}
+	fanSpeed := otlpMetric{Name: "gpu.fan.speed", Description: "Fan speed applied by the controller", Unit: "%"}
+	latency := otlpMetric{Name: "controller.loop.latency", Description: "Duration of the last control loop update", Unit: "s"}
+
+	for _, d := range devices {
+		m := d.state.metrics()
+		if m.polledAt.IsZero() {
+			continue
+		}
+		timestamp := strconv.FormatInt(m.polledAt.UnixNano(), 10)
+		deviceAttrs := []otlpKeyValue{
+			otlpInt(LABEL_GPU_INDEX, d.labels.index),
+			otlpString(LABEL_GPU_UUID, d.labels.uuid),
+			otlpString(LABEL_GPU_NAME, d.labels.name),
+		}
+
+		temperature.Gauge.DataPoints = append(temperature.Gauge.DataPoints, otlpDataPoint{Attributes: deviceAttrs, TimeUnixNano: timestamp, AsDouble: float64(m.temperature)})
+		if m.memoryTemperature > 0 {
+			memoryTemperature.Gauge.DataPoints = append(memoryTemperature.Gauge.DataPoints, otlpDataPoint{Attributes: deviceAttrs, TimeUnixNano: timestamp, AsDouble: float64(m.memoryTemperature)})
+		}
+		latency.Gauge.DataPoints = append(latency.Gauge.DataPoints, otlpDataPoint{Attributes: deviceAttrs, TimeUnixNano: timestamp, AsDouble: m.loopLatency.Seconds()})
+
+		fanIndices := make([]int, 0, len(m.fanSpeeds))
+		for fanIdx := range m.fanSpeeds {
+			fanIndices = append(fanIndices, fanIdx)
+		}
+		sort.Ints(fanIndices)
+		for _, fanIdx := range fanIndices {
+			fanAttrs := append(append([]otlpKeyValue{}, deviceAttrs...), otlpInt(LABEL_FAN_INDEX, fanIdx))
+			fanSpeed.Gauge.DataPoints = append(fanSpeed.Gauge.DataPoints, otlpDataPoint{Attributes: fanAttrs, TimeUnixNano: timestamp, AsDouble: float64(m.fanSpeeds[fanIdx])})
+		}
+	}
+
+	var metrics []otlpMetric
+	for _, metric := range []otlpMetric{temperature, memoryTemperature, fanSpeed, latency} {
+		if len(metric.Gauge.DataPoints) > 0 {
+			metrics = append(metrics, metric)
+		}
+	}
+
+	scope := otlpScopeMetrics{Scope: otlpScope{Name: "nvml-fan"}, Metrics: metrics}
+	resource := otlpResourceMetrics{ScopeMetrics: []otlpScopeMetrics{scope}}
+	resource.Resource.Attributes = []otlpKeyValue{otlpString("service.name", "nvml-fan")}
+	return otlpExportRequest{ResourceMetrics: []otlpResourceMetrics{resource}}
+}
+
+// exportOTLP sends metrics to OTLP/HTTP endpoint of a collector e.g. http://localhost:4318
+func exportOTLP(client *http.Client, endpoint string, req otlpExportRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("unable to encode metrics: %w", err)
+	}
+	resp, err := client.Post(strings.TrimSuffix(endpoint, "/")+OTLP_METRICS_PATH, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to send metrics: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("collector responded with status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// runOTLPExporter exports metrics of all devices periodically until ctx is done
+func runOTLPExporter(ctx context.Context, endpoint string, interval time.Duration, devices []*controlledDevice, logRepeatInterval time.Duration) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	limiter := newLogLimiter(logRepeatInterval, moduleLogger(LOG_MODULE_METRICS))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := exportOTLP(client, endpoint, buildOTLPRequest(devices)); err != nil {
+				limiter.Warn("Unable to export metrics to OTLP collector", "endpoint", endpoint, "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
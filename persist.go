@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const DEFAULT_STATE_FILE = "/var/lib/nvml-fan/state.json"
+
+// persistedState is written to state file whenever applied fan speeds change,
+// so that they can be applied immediately on next startup before the first polling tick.
+type persistedState struct {
+	DeviceUUID string        `json:"deviceUUID"`
+	Curve      string        `json:"curve"`
+	FanSpeeds  map[int]uint8 `json:"fanSpeeds"`
+	SavedAt    time.Time     `json:"savedAt"`
+}
+
+func loadPersistedState(path string) (*persistedState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read state file: %w", err)
+	}
+	var st persistedState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("unable to decode state file: %w", err)
+	}
+	return &st, nil
+}
+
+// deviceStateFile returns path of state file for the device. When multiple devices are controlled,
+// each device gets its own file suffixed by device index e.g. state-1.json
+func deviceStateFile(path string, deviceIndex int, multiple bool) string {
+	if !multiple {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(path, ext), deviceIndex, ext)
+}
+
+// savePersistedState writes state to a temporary file, then renames it, so that the state file is never half-written
+func savePersistedState(path string, st persistedState) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("unable to create state directory: %w", err)
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode state: %w", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("unable to write state file: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("unable to replace state file: %w", err)
+	}
+	return nil
+}
+
+// restorePersistedState applies fan speeds saved by previous process, if they were saved for the same device.
+// Only fans which are still controlled are restored, see controlledFans.
+func restorePersistedState(logger *slog.Logger, path string, device gpuDevice, selectedFans fanSelection, state *controllerState) {
+	st, err := loadPersistedState(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("Unable to load saved state, skip restoring fan speeds", "path", path, "err", err)
+		}
+		return
+	}
+	uuid, err := device.UUID()
+	if err != nil {
+		logger.Warn("Unable to get device UUID, skip restoring fan speeds", "err", err)
+		return
+	}
+	if st.DeviceUUID != uuid {
+		logger.Info("Saved state belongs to another device, skip restoring fan speeds", "savedDevice", st.DeviceUUID)
+		return
+	}
+
+	fans, _, err := controlledFans(device, selectedFans)
+	if err != nil {
+		logger.Warn("Unable to get fans of device, skip restoring fan speeds", "err", err)
+		return
+	}
+	controlled := make(map[int]bool, len(fans))
+	for _, fanIdx := range fans {
+		controlled[fanIdx] = true
+	}
+
+	logger.Info("Restoring fan speeds saved by previous process", "fanSpeeds", st.FanSpeeds, "curve", st.Curve, "savedAt", st.SavedAt)
+	for fanIdx, speed := range st.FanSpeeds {
+		if !controlled[fanIdx] {
+			continue
+		}
+		if err := device.SetFanSpeed(fanIdx, speed); err != nil {
+			logger.Warn("Unable to restore fan speed", LABEL_FAN_INDEX, fanIdx, "speed", speed, "err", err)
+			continue
+		}
+		state.setFanSpeed(fanIdx, speed)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"slices"
+	"time"
+)
+
+// Actions decided for a sample, which are also printed in action column of simulation
+const (
+	FAN_ACTION_SET      = "set"
+	FAN_ACTION_FAILSAFE = "failsafe"
+	// Fan speed of all fans is forced by override, e.g. by control API or rapid rise boost
+	FAN_ACTION_OVERRIDE = "override"
+	// Fan speed is kept until write interval has passed
+	FAN_ACTION_HOLD = "hold"
+	// Fans are left to stock fan curve below takeover temperature, or while the GPU idles
+	FAN_ACTION_STOCK = "stock"
+	// Temperature is out of the fan curve, so that fan speed is not updated
+	FAN_ACTION_SKIP = "skip"
+)
+
+// fanSample is what a polling has read, from which decideFanSpeed decides fan speed. Sensors are read by the control
+// loop from the device, and by simulation from the trace.
+type fanSample struct {
+	now time.Time
+	// Core temperature after filters and offset, which failsafe and takeover temperature compare with
+	temperature uint32
+	// Temperature after blend and prediction, by which the curve is looked up
+	curveTemperature uint32
+	// Speed computed by RPM-target mode, target temperature or fan speed formula instead of the curve lookup.
+	// It is only used if computed is true, and is missing if computedOk is false.
+	computedSpeed uint8
+	computedOk    bool
+	computed      bool
+	// Memory temperature, and temperature of external source, which are used only if read successfully
+	memoryTemperature uint32
+	memoryOk          bool
+	sourceTemperature uint32
+	sourceOk          bool
+	// Performance state of the GPU, which is used only if read successfully
+	pstate   uint32
+	pstateOk bool
+	// Override in effect, which applies to all fans if overrideFans is nil
+	overridden    bool
+	overrideSpeed uint8
+	overrideFans  []int
+	// Fan speed is written regardless of write interval
+	force bool
+}
+
+// fanDecisionState is carried from one sample to the next. Zero value is not taken over, so that it must be
+// created by newFanDecisionState.
+type fanDecisionState struct {
+	takenOver bool
+	// Between fan speed writes, the highest speed computed from sampled temperatures is kept, so that short spikes are
+	// not missed
+	pendingSpeed  uint8
+	lastWrittenAt time.Time
+}
+
+// newFanDecisionState returns state before the first sample, which starts as taken over, so that fan speeds restored
+// from state file are released to stock fan curve at the first sample
+func newFanDecisionState() fanDecisionState {
+	return fanDecisionState{takenOver: true}
+}
+
+// fanDecision is what decideFanSpeed decided for a sample
+type fanDecision struct {
+	action string
+	// Speed to write, which is meaningful for set, failsafe and override actions
+	speed    uint8
+	failsafe bool
+	// Fans are taken over from, or returned to, stock fan curve at this sample
+	takeOver bool
+	release  bool
+	// Override in effect, which is kept to compute speed of each fan
+	overridden    bool
+	overrideSpeed uint8
+	overrideFans  []int
+}
+
+// writes tells whether fan speed is written at this sample
+func (d fanDecision) writes() bool {
+	return d.action == FAN_ACTION_SET || d.action == FAN_ACTION_FAILSAFE || d.action == FAN_ACTION_OVERRIDE
+}
+
+// fanSpeed returns speed of the fan. Per fan offsets are not applied to failsafe and override speed.
+func (d fanDecision) fanSpeed(fanIdx int, config controlConfig) uint8 {
+	switch {
+	case d.failsafe:
+		return d.speed
+	case d.overridden && (d.overrideFans == nil || slices.Contains(d.overrideFans, fanIdx)):
+		return d.overrideSpeed
+	}
+	return fanSpeedWithOffset(d.speed, config.fans.offsets[fanIdx], config)
+}
+
+// decideFanSpeed decides fan speed of a sample by curves or computed speed, speed limits, failsafe, override,
+// takeover temperature, idle P-state and write interval, in this order. It only depends on its arguments, so that the
+// control loop and simulation decide the same way.
+func decideFanSpeed(config controlConfig, speedMap map[uint8]uint8, state fanDecisionState, sample fanSample) (fanDecision, fanDecisionState) {
+	speed, ok := sample.computedSpeed, sample.computedOk
+	if !sample.computed {
+		speed, ok = lookupFanSpeed(speedMap, sample.curveTemperature, config)
+	}
+	// Memory temperature is already an input of fan speed formula
+	if sample.memoryOk && config.formula == nil {
+		if memorySpeed, found := lookupFanSpeed(config.memorySpeedMap, sample.memoryTemperature, config); found {
+			speed, ok = max(speed, memorySpeed), true
+		}
+	}
+	if sample.sourceOk {
+		if sourceSpeed, found := lookupFanSpeed(config.sourceSpeedMap, sample.sourceTemperature, config); found {
+			speed, ok = max(speed, sourceSpeed), true
+		}
+	}
+	speed, failsafe := limitFanSpeed(speed, sample.temperature, config)
+	if failsafe {
+		ok = true
+	}
+	decision := fanDecision{failsafe: failsafe, overridden: sample.overridden && !failsafe, overrideSpeed: sample.overrideSpeed, overrideFans: sample.overrideFans}
+	// Override of selected fans is applied per fan, while other fans keep following the curve
+	overridesAll := decision.overridden && sample.overrideFans == nil
+	if overridesAll {
+		speed, ok = sample.overrideSpeed, true
+	}
+
+	// Below takeover temperature, or while the GPU idles in a deep P-state, fans are left to stock fan curve of the device
+	if config.takeoverTemp > 0 || config.idlePState > 0 {
+		idle := config.idlePState > 0 && sample.pstateOk && sample.pstate >= uint32(config.idlePState) && sample.pstate <= MAX_PSTATE
+		aboveTakeover := config.takeoverTemp == 0 || sample.temperature >= uint32(config.takeoverTemp)
+		belowTakeover := config.takeoverTemp > 0 && sample.temperature+TAKEOVER_HYSTERESIS < uint32(config.takeoverTemp)
+		switch {
+		case failsafe || sample.overridden || (aboveTakeover && !idle):
+			if !state.takenOver {
+				state.takenOver = true
+				decision.takeOver = true
+			}
+		case state.takenOver && (idle || belowTakeover):
+			state.takenOver = false
+			state.pendingSpeed = 0
+			decision.release = true
+		}
+		if !state.takenOver {
+			decision.action = FAN_ACTION_STOCK
+			return decision, state
+		}
+	}
+	if !ok {
+		decision.action = FAN_ACTION_SKIP
+		return decision, state
+	}
+	if config.writeInterval > 0 && !decision.overridden {
+		speed = max(speed, state.pendingSpeed)
+		// Failsafe is never delayed
+		if !sample.force && !failsafe && sample.now.Sub(state.lastWrittenAt) < config.writeInterval {
+			state.pendingSpeed = speed
+			decision.action, decision.speed = FAN_ACTION_HOLD, speed
+			return decision, state
+		}
+	}
+	state.pendingSpeed = 0
+	state.lastWrittenAt = sample.now
+
+	decision.speed = speed
+	switch {
+	case failsafe:
+		decision.action = FAN_ACTION_FAILSAFE
+	case overridesAll:
+		decision.action = FAN_ACTION_OVERRIDE
+	default:
+		decision.action = FAN_ACTION_SET
+	}
+	return decision, state
+}
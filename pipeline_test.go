@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecideFanSpeed(t *testing.T) {
+	now := time.Unix(0, 0)
+	tests := []struct {
+		name       string
+		config     func(config *controlConfig)
+		sample     fanSample
+		wantAction string
+		// Speed of fans 0 and 1, where fan 1 runs 10% faster by offset
+		wantFans [2]uint8
+	}{
+		{
+			name:       "curve with fan offset",
+			sample:     fanSample{now: now, temperature: 50, curveTemperature: 50},
+			wantAction: FAN_ACTION_SET,
+			wantFans:   [2]uint8{50, 60},
+		},
+		{
+			name:       "curve is looked up by curve temperature",
+			sample:     fanSample{now: now, temperature: 40, curveTemperature: 60},
+			wantAction: FAN_ACTION_SET,
+			wantFans:   [2]uint8{70, 80},
+		},
+		{
+			name:       "computed speed replaces the curve",
+			sample:     fanSample{now: now, temperature: 50, curveTemperature: 50, computed: true, computedSpeed: 35, computedOk: true},
+			wantAction: FAN_ACTION_SET,
+			wantFans:   [2]uint8{35, 45},
+		},
+		{
+			name:       "missing computed speed skips the update",
+			sample:     fanSample{now: now, temperature: 50, curveTemperature: 50, computed: true},
+			wantAction: FAN_ACTION_SKIP,
+		},
+		{
+			name:       "override of all fans ignores offsets",
+			sample:     fanSample{now: now, temperature: 50, curveTemperature: 50, overridden: true, overrideSpeed: 80},
+			wantAction: FAN_ACTION_OVERRIDE,
+			wantFans:   [2]uint8{80, 80},
+		},
+		{
+			name:       "override of selected fans",
+			sample:     fanSample{now: now, temperature: 50, curveTemperature: 50, overridden: true, overrideSpeed: 80, overrideFans: []int{0}},
+			wantAction: FAN_ACTION_SET,
+			wantFans:   [2]uint8{80, 60},
+		},
+		{
+			name: "failsafe wins over override",
+			config: func(config *controlConfig) {
+				config.failsafeTemp = 90
+			},
+			sample:     fanSample{now: now, temperature: 95, curveTemperature: 95, overridden: true, overrideSpeed: 20},
+			wantAction: FAN_ACTION_FAILSAFE,
+			wantFans:   [2]uint8{100, 100},
+		},
+		{
+			name: "override takes over from stock fan curve",
+			config: func(config *controlConfig) {
+				config.takeoverTemp = 60
+			},
+			sample:     fanSample{now: now, temperature: 40, curveTemperature: 40, overridden: true, overrideSpeed: 70},
+			wantAction: FAN_ACTION_OVERRIDE,
+			wantFans:   [2]uint8{70, 70},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newTestControlConfig(t, "40:30,60:70")
+			config.fans.offsets = map[int]int{1: 10}
+			if tt.config != nil {
+				tt.config(&config)
+			}
+			decision, _ := decideFanSpeed(config, config.speedMap, newFanDecisionState(), tt.sample)
+			if decision.action != tt.wantAction {
+				t.Fatalf("action = %q, want %q", decision.action, tt.wantAction)
+			}
+			if !decision.writes() {
+				return
+			}
+			if got := [2]uint8{decision.fanSpeed(0, config), decision.fanSpeed(1, config)}; got != tt.wantFans {
+				t.Errorf("fan speeds = %v, want %v", got, tt.wantFans)
+			}
+		})
+	}
+}
+
+func TestDecideFanSpeedReleasesRestoredSpeeds(t *testing.T) {
+	config := newTestControlConfig(t, "40:30,60:70")
+	config.takeoverTemp = 60
+	decision, state := decideFanSpeed(config, config.speedMap, newFanDecisionState(), fanSample{temperature: 40, curveTemperature: 40})
+	if !decision.release || decision.action != FAN_ACTION_STOCK {
+		t.Fatalf("first decision below takeover = %+v, want release to stock", decision)
+	}
+	decision, _ = decideFanSpeed(config, config.speedMap, state, fanSample{temperature: 40, curveTemperature: 40})
+	if decision.release || decision.action != FAN_ACTION_STOCK {
+		t.Errorf("second decision below takeover = %+v, want stock without release", decision)
+	}
+}
@@ -0,0 +1,240 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	DEFAULT_CONTROL_SOCKET = "/run/nvml-fan.sock"
+	DEFAULT_CONFIG_FILE    = "/etc/nvml-fan/config.json"
+	DEFAULT_LOCK_DIR       = "/run/nvml-fan"
+	// Control device node of NVIDIA driver, which NVML opens for every request
+	NVIDIA_CONTROL_DEVICE = "/dev/nvidiactl"
+	// Driver only accepts fan control from processes with CAP_SYS_ADMIN, which root has
+	CAP_SYS_ADMIN = 21
+)
+
+// notifyDumpStateSignal relays SIGUSR1, which requests state dump, to the channel
+func notifyDumpStateSignal(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
+
+// notifyPauseSignal relays SIGUSR2, which toggles pause state, to the channel
+func notifyPauseSignal(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// checkFanControlPermission tells why the process is not allowed to set fan speed through NVML, or returns nil.
+// Missing capability is reported as ErrMissingPrivilege.
+func checkFanControlPermission() error {
+	file, err := os.OpenFile(NVIDIA_CONTROL_DEVICE, os.O_RDWR, 0)
+	switch {
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("no read/write access to %s, run as root or grant access to NVIDIA device nodes, e.g. pass them to the container", NVIDIA_CONTROL_DEVICE)
+	case err == nil:
+		file.Close()
+	}
+	// Missing device node is reported by NVML initialization, which tells whether the driver is loaded
+
+	hasCapability, err := hasEffectiveCapability(CAP_SYS_ADMIN)
+	if err != nil {
+		// Capabilities are only exposed by Linux, so fall back to root check elsewhere
+		hasCapability = os.Geteuid() == 0
+	}
+	if !hasCapability {
+		return fmt.Errorf("%w: setting fan speed requires root privilege (CAP_SYS_ADMIN), which uid %d does not have. Run with sudo, or as a system service", ErrMissingPrivilege, os.Geteuid())
+	}
+	return nil
+}
+
+// hasEffectiveCapability reports whether the capability is in effective set of current process, read from /proc
+func hasEffectiveCapability(capability uint) (bool, error) {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		value, found := strings.CutPrefix(scanner.Text(), "CapEff:")
+		if !found {
+			continue
+		}
+		mask, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		if err != nil {
+			return false, fmt.Errorf("unable to parse effective capabilities %q: %w", value, err)
+		}
+		return mask&(1<<capability) != 0, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+	return false, fmt.Errorf("effective capabilities are not found in /proc/self/status")
+}
+
+// listProcesses lists running processes from /proc, which only exists on Linux
+func listProcesses() ([]processInfo, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var processes []processInfo
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// Process may have exited in the meantime. Kernel threads and zombies have empty command line, and are skipped
+		comm, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "comm"))
+		if err != nil {
+			continue
+		}
+		cmdline, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		if err != nil || len(cmdline) == 0 {
+			continue
+		}
+		args := strings.Split(strings.TrimSuffix(string(cmdline), "\x00"), "\x00")
+		processes = append(processes, processInfo{
+			pid: pid,
+			// Command name is truncated to 15 characters, while executable name is not
+			names: []string{strings.TrimSpace(string(comm)), filepath.Base(args[0])},
+			args:  args,
+		})
+	}
+	return processes, nil
+}
+
+// lockFile takes exclusive advisory lock of the file, and writes pid of current process to it
+func lockFile(path string) (func(), error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errInstanceLocked
+		}
+		return nil, err
+	}
+	file.Truncate(0)
+	fmt.Fprintf(file, "%d\n", os.Getpid())
+	return func() {
+		// Lock file is not removed, as another process may have opened it, and would lock a file which is no longer found by path
+		file.Truncate(0)
+		file.Close()
+	}, nil
+}
+
+// Existing directory is only handed over to privsep user if it is dedicated to this program by its name, e.g.
+// /var/lib/nvml-fan, as handing over a shared directory e.g. /tmp or /var/lib would let the user tamper with files of others
+const PRIVSEP_DEDICATED_DIR_NAME = "nvml-fan"
+
+// handOverDir makes the user own the directory, if the directory is created here or is dedicated to this program.
+// Other existing directories are refused, unless the user already owns them.
+func handOverDir(dir string, uid, gid int) error {
+	info, err := os.Stat(dir)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("unable to create directory %s: %w", dir, err)
+		}
+	case err != nil:
+		return fmt.Errorf("unable to stat directory %s: %w", dir, err)
+	case !info.IsDir():
+		return fmt.Errorf("%s is not a directory", dir)
+	default:
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) == uid {
+			return nil
+		}
+		if filepath.Base(filepath.Clean(dir)) != PRIVSEP_DEDICATED_DIR_NAME {
+			return fmt.Errorf("directory %s already exists and may be shared with other programs, so that it is not handed over to the user. Use a directory of its own e.g. /var/lib/%s", dir, PRIVSEP_DEDICATED_DIR_NAME)
+		}
+	}
+	if err := os.Chown(dir, uid, gid); err != nil {
+		return fmt.Errorf("unable to change owner of directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+// dropPrivileges switches the process to the user and its primary group, after handing the user ownership of the
+// directories which the process writes at runtime. It applies to all threads of the process.
+func dropPrivileges(username string, ownedDirs []string) error {
+	account, err := user.Lookup(username)
+	if err != nil {
+		return fmt.Errorf("unable to look up user %q: %w", username, err)
+	}
+	uid, err := strconv.Atoi(account.Uid)
+	if err != nil {
+		return fmt.Errorf("unable to parse uid %q of user %q: %w", account.Uid, username, err)
+	}
+	gid, err := strconv.Atoi(account.Gid)
+	if err != nil {
+		return fmt.Errorf("unable to parse gid %q of user %q: %w", account.Gid, username, err)
+	}
+	for _, dir := range ownedDirs {
+		if err := handOverDir(dir, uid, gid); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("unable to drop supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("unable to set gid %d: %w", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("unable to set uid %d: %w", uid, err)
+	}
+	return nil
+}
+
+// Power supplies are listed by the kernel under this directory
+const POWER_SUPPLY_DIR = "/sys/class/power_supply"
+
+// onBatteryPower tells whether the machine runs on battery. It is on battery if no mains adapter is online, or if it
+// has no mains adapter but a battery which is discharging. Machines without power supplies e.g. desktops are on mains.
+func onBatteryPower() (bool, error) {
+	entries, err := os.ReadDir(POWER_SUPPLY_DIR)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to list power supplies: %w", err)
+	}
+	hasMains, mainsOnline, discharging := false, false, false
+	for _, entry := range entries {
+		dir := filepath.Join(POWER_SUPPLY_DIR, entry.Name())
+		supplyType, err := os.ReadFile(filepath.Join(dir, "type"))
+		if err != nil {
+			continue
+		}
+		switch strings.TrimSpace(string(supplyType)) {
+		case "Mains":
+			hasMains = true
+			if online, err := os.ReadFile(filepath.Join(dir, "online")); err == nil && strings.TrimSpace(string(online)) == "1" {
+				mainsOnline = true
+			}
+		case "Battery":
+			if status, err := os.ReadFile(filepath.Join(dir, "status")); err == nil && strings.TrimSpace(string(status)) == "Discharging" {
+				discharging = true
+			}
+		}
+	}
+	if hasMains {
+		return !mainsOnline, nil
+	}
+	return discharging, nil
+}
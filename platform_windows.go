@@ -0,0 +1,136 @@
+//go:build windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// TokenElevation class of GetTokenInformation, which tells whether the process runs as administrator
+	TOKEN_ELEVATION_CLASS = 20
+	// Returned by CreateFile when the file is opened by another process without sharing
+	ERROR_SHARING_VIOLATION = syscall.Errno(32)
+)
+
+const (
+	DEFAULT_CONTROL_SOCKET = `C:\ProgramData\nvml-fan.sock`
+	DEFAULT_CONFIG_FILE    = `C:\ProgramData\nvml-fan\config.json`
+	DEFAULT_LOCK_DIR       = `C:\ProgramData\nvml-fan`
+)
+
+// notifyDumpStateSignal does nothing, as Windows has no SIGUSR1
+func notifyDumpStateSignal(c chan<- os.Signal) {}
+
+// notifyPauseSignal does nothing, as Windows has no SIGUSR2
+func notifyPauseSignal(c chan<- os.Signal) {}
+
+// withNvidiaSettingsFallback returns device as is, as nvidia-settings is only available with X server
+func withNvidiaSettingsFallback(backend gpuBackend, device gpuDevice, deviceIndex int, display string, forced bool) gpuDevice {
+	return device
+}
+
+// checkFanControlPermission tells why the process is not allowed to set fan speed through NVML, or returns nil.
+// Missing elevation is reported as ErrMissingPrivilege.
+func checkFanControlPermission() error {
+	// Privilege is left to NVML if it cannot be told
+	var token syscall.Token
+	process, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return nil
+	}
+	if err := syscall.OpenProcessToken(process, syscall.TOKEN_QUERY, &token); err != nil {
+		return nil
+	}
+	defer token.Close()
+	var elevated uint32
+	var size uint32
+	if err := syscall.GetTokenInformation(token, TOKEN_ELEVATION_CLASS, (*byte)(unsafe.Pointer(&elevated)), uint32(unsafe.Sizeof(elevated)), &size); err != nil {
+		return nil
+	}
+	if elevated == 0 {
+		return fmt.Errorf("%w: setting fan speed requires administrator privilege. Run from an elevated prompt, or as a service", ErrMissingPrivilege)
+	}
+	return nil
+}
+
+// listProcesses lists running processes by tasklist, which does not tell command line arguments
+func listProcesses() ([]processInfo, error) {
+	output, err := exec.Command("tasklist", "/fo", "csv", "/nh").Output()
+	if err != nil {
+		return nil, fmt.Errorf("tasklist failed: %w", err)
+	}
+	records, err := csv.NewReader(bytes.NewReader(output)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse output of tasklist: %w", err)
+	}
+	var processes []processInfo
+	for _, record := range records {
+		if len(record) < 2 {
+			continue
+		}
+		pid, err := strconv.Atoi(record[1])
+		if err != nil {
+			continue
+		}
+		processes = append(processes, processInfo{pid: pid, names: []string{record[0]}})
+	}
+	return processes, nil
+}
+
+// lockFile opens the file without sharing write access, so that it cannot be opened by another instance until this
+// process exits, and writes pid of current process to it
+func lockFile(path string) (func(), error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, syscall.FILE_SHARE_READ, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if errors.Is(err, ERROR_SHARING_VIOLATION) {
+		return nil, errInstanceLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	file := os.NewFile(uintptr(handle), path)
+	file.Truncate(0)
+	fmt.Fprintf(file, "%d\r\n", os.Getpid())
+	return func() {
+		file.Truncate(0)
+		file.Close()
+	}, nil
+}
+
+// dropPrivileges is not supported on Windows, where a process cannot switch to another user
+func dropPrivileges(username string, ownedDirs []string) error {
+	return errors.New("privilege separation is not supported on Windows")
+}
+
+var procGetSystemPowerStatus = syscall.NewLazyDLL("kernel32.dll").NewProc("GetSystemPowerStatus")
+
+// systemPowerStatus is SYSTEM_POWER_STATUS of GetSystemPowerStatus
+type systemPowerStatus struct {
+	ACLineStatus        byte
+	BatteryFlag         byte
+	BatteryLifePercent  byte
+	SystemStatusFlag    byte
+	BatteryLifeTime     uint32
+	BatteryFullLifeTime uint32
+}
+
+// onBatteryPower tells whether the machine runs on battery, which is when AC line is reported offline
+func onBatteryPower() (bool, error) {
+	var status systemPowerStatus
+	if ok, _, err := procGetSystemPowerStatus.Call(uintptr(unsafe.Pointer(&status))); ok == 0 {
+		return false, fmt.Errorf("unable to get system power status: %w", err)
+	}
+	return status.ACLineStatus == 0, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// Temperature change in Celsius between polls, at which polling switches to fast interval
+	ADAPTIVE_POLLING_FAST_DELTA = 2
+	// Distance in Celsius to a curve point, within which polling switches to fast interval
+	ADAPTIVE_POLLING_BREAKPOINT_MARGIN = 2
+
+	// In low-wakeup mode, polling interval is multiplied by this factor while on battery or the GPU idles
+	LOW_WAKEUP_SLOWDOWN = 3
+	// Lengthened polling interval never exceeds this, unless the configured interval is already longer
+	LOW_WAKEUP_MAX_INTERVAL = 30 * time.Second
+	// Power source is checked at most once per this interval
+	LOW_WAKEUP_POWER_CHECK_INTERVAL = 30 * time.Second
+)
+
+// adaptivePoller chooses polling interval based on temperature, so that the control loop reacts quickly under load,
+// while waking up rarely when the GPU is idle.
+type adaptivePoller struct {
+	fast   time.Duration
+	normal time.Duration
+	slow   time.Duration
+	// Temperatures of curve points, where fan speed changes its slope
+	breakpoints []uint8
+
+	lastTemperature uint32
+	hasLast         bool
+}
+
+func newAdaptivePoller(fast, normal, slow time.Duration, curve [][2]uint8) *adaptivePoller {
+	breakpoints := make([]uint8, 0, len(curve))
+	for _, point := range curve {
+		breakpoints = append(breakpoints, point[0])
+	}
+	return &adaptivePoller{
+		fast:        fast,
+		normal:      normal,
+		slow:        slow,
+		breakpoints: breakpoints,
+	}
+}
+
+// next returns polling interval to be used after the given temperature is read
+func (p *adaptivePoller) next(temperature uint32) time.Duration {
+	delta := uint32(0)
+	if p.hasLast {
+		delta = max(temperature, p.lastTemperature) - min(temperature, p.lastTemperature)
+	}
+	p.lastTemperature, p.hasLast = temperature, true
+
+	if delta >= ADAPTIVE_POLLING_FAST_DELTA {
+		return p.fast
+	}
+	for _, breakpoint := range p.breakpoints {
+		if max(temperature, uint32(breakpoint))-min(temperature, uint32(breakpoint)) <= ADAPTIVE_POLLING_BREAKPOINT_MARGIN {
+			return p.fast
+		}
+	}
+	// Stable and below the first curve point, where fans stay at the lowest speed
+	if len(p.breakpoints) > 0 && temperature < uint32(p.breakpoints[0]) {
+		return p.slow
+	}
+	return p.normal
+}
+
+// lowWakeupPolicy lengthens polling interval while the machine runs on battery or the GPU idles, so that the controller
+// itself does not keep the CPU out of deep sleep states
+type lowWakeupPolicy struct {
+	logger           *slog.Logger
+	batteryCheckedAt time.Time
+	onBattery        bool
+	slow             bool
+}
+
+func newLowWakeupPolicy(logger *slog.Logger) *lowWakeupPolicy {
+	return &lowWakeupPolicy{logger: logger}
+}
+
+// interval returns polling interval to be used instead of the base interval. The GPU is idle when its utilization is 0.
+func (p *lowWakeupPolicy) interval(now time.Time, base time.Duration, device gpuDevice) time.Duration {
+	if p.batteryCheckedAt.IsZero() || now.Sub(p.batteryCheckedAt) >= LOW_WAKEUP_POWER_CHECK_INTERVAL {
+		p.batteryCheckedAt = now
+		onBattery, err := onBatteryPower()
+		if err != nil {
+			p.logger.Debug("unable to get power source, assume mains power", "err", err)
+		}
+		p.onBattery = onBattery
+	}
+	idle := false
+	if utilization, err := device.Utilization(); err == nil {
+		idle = utilization == 0
+	}
+
+	slow := p.onBattery || idle
+	if slow != p.slow {
+		p.slow = slow
+		if slow {
+			p.logger.Info("Lengthen polling interval to save power", "onBattery", p.onBattery, "idle", idle)
+		} else {
+			p.logger.Info("Return to normal polling interval")
+		}
+	}
+	if !slow {
+		return base
+	}
+	return lowWakeupInterval(base)
+}
+
+// lowWakeupInterval returns polling interval lengthened from the base interval in low-wakeup mode
+func lowWakeupInterval(base time.Duration) time.Duration {
+	return max(base, min(base*LOW_WAKEUP_SLOWDOWN, LOW_WAKEUP_MAX_INTERVAL))
+}
+
+// pollTicker ticks every interval like time.Ticker, and its interval can be changed by Reset. If aligned, ticks fall
+// on multiples of the interval on wall clock, so that periodic work of all devices and background samplers wakes up
+// the CPU together instead of one after another.
+type pollTicker struct {
+	C <-chan time.Time
+
+	c        chan time.Time
+	aligned  bool
+	mu       sync.Mutex
+	timer    *time.Timer
+	interval time.Duration
+	stopped  bool
+}
+
+func newPollTicker(interval time.Duration, aligned bool) *pollTicker {
+	c := make(chan time.Time, 1)
+	t := &pollTicker{C: c, c: c, aligned: aligned, interval: interval}
+	t.timer = time.AfterFunc(t.untilNext(time.Now()), t.fire)
+	return t
+}
+
+func (t *pollTicker) untilNext(now time.Time) time.Duration {
+	if !t.aligned {
+		return t.interval
+	}
+	// Truncate works on wall clock, so that every ticker of the same interval agrees on the next tick
+	return now.Truncate(t.interval).Add(t.interval).Sub(now)
+}
+
+func (t *pollTicker) fire() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return
+	}
+	now := time.Now()
+	// Ticks are dropped while the receiver is busy, the same as time.Ticker
+	select {
+	case t.c <- now:
+	default:
+	}
+	t.timer.Reset(t.untilNext(now))
+}
+
+// Reset changes the interval, and the next tick is after the new interval, or at its next multiple if aligned
+func (t *pollTicker) Reset(interval time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.interval = interval
+	if !t.stopped {
+		t.timer.Reset(t.untilNext(time.Now()))
+	}
+}
+
+func (t *pollTicker) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+	t.timer.Stop()
+}
@@ -0,0 +1,103 @@
+package main
+
+import "time"
+
+const (
+	// Number of recent samples, over which temperature slope is computed
+	PREDICTION_SAMPLES = 5
+	// Predicted temperature never exceeds current temperature by more than this value, so that a noisy sample does not max out fans
+	PREDICTION_MAX_DELTA = 10
+	// Number of recent samples, over which rate of temperature rise is computed for rapid rise alarm. It is shorter than
+	// prediction, so that a rise is reported within a few polling intervals
+	RISE_RATE_SAMPLES = 3
+)
+
+type temperatureSample struct {
+	at          time.Time
+	temperature uint32
+}
+
+// temperaturePredictor extrapolates temperature slope of recent samples, so that fans ramp up ahead of a fast rise
+// instead of lagging one polling interval behind. Falling temperature is not extrapolated, as fans should slow down only after it actually drops.
+type temperaturePredictor struct {
+	ahead   time.Duration
+	samples []temperatureSample
+}
+
+func newTemperaturePredictor(ahead time.Duration) *temperaturePredictor {
+	return &temperaturePredictor{
+		ahead:   ahead,
+		samples: make([]temperatureSample, 0, PREDICTION_SAMPLES),
+	}
+}
+
+// predict adds the sample, and returns temperature predicted after the look-ahead duration
+func (p *temperaturePredictor) predict(now time.Time, temperature uint32) uint32 {
+	if len(p.samples) == PREDICTION_SAMPLES {
+		p.samples = append(p.samples[:0], p.samples[1:]...)
+	}
+	p.samples = append(p.samples, temperatureSample{at: now, temperature: temperature})
+	slope := temperatureSlope(p.samples)
+	if slope <= 0 {
+		return temperature
+	}
+
+	delta := min(slope*p.ahead.Seconds(), PREDICTION_MAX_DELTA)
+	return temperature + uint32(delta)
+}
+
+// temperatureSlope returns least squares slope of the samples in Celsius per second, or 0 if it cannot be computed
+func temperatureSlope(samples []temperatureSample) float64 {
+	if len(samples) < 2 {
+		return 0
+	}
+	var sumX, sumY, sumXY, sumXX float64
+	for _, sample := range samples {
+		x := sample.at.Sub(samples[0].at).Seconds()
+		y := float64(sample.temperature)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	n := float64(len(samples))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
+
+// riseDetector tells when temperature rises faster than the rate, which usually indicates fan failure or blocked
+// airflow before absolute thresholds trip. It is re-armed once the rate drops below half of the threshold, so that
+// a single rise is reported once.
+type riseDetector struct {
+	// Threshold in Celsius per second
+	rate    float64
+	samples []temperatureSample
+	rising  bool
+}
+
+func newRiseDetector(rate float64) *riseDetector {
+	return &riseDetector{
+		rate:    rate,
+		samples: make([]temperatureSample, 0, RISE_RATE_SAMPLES),
+	}
+}
+
+// observe adds the sample, and returns current rate of rise, and whether a rapid rise has just started
+func (r *riseDetector) observe(now time.Time, temperature uint32) (float64, bool) {
+	if len(r.samples) == RISE_RATE_SAMPLES {
+		r.samples = append(r.samples[:0], r.samples[1:]...)
+	}
+	r.samples = append(r.samples, temperatureSample{at: now, temperature: temperature})
+	slope := temperatureSlope(r.samples)
+	switch {
+	case !r.rising && slope >= r.rate:
+		r.rising = true
+		return slope, true
+	case r.rising && slope < r.rate/2:
+		r.rising = false
+	}
+	return slope, false
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Built-in fan curves selected by -preset, in the same format as -speeds
+var CURVE_PRESETS = map[string]string{
+	// Fans stay quiet until the GPU is under sustained load, and trade higher temperature for noise
+	"silent": "45:30,60:40,70:55,80:75,87:100",
+	// Default curve of -speeds
+	"balanced": "35:40,40:50,50:60,60:90,80:100",
+	// Fans ramp up early, which keeps the GPU cool e.g. for overclocking or hot rooms
+	"aggressive": "30:45,40:60,50:75,60:90,70:100",
+	// Fans always run at full speed
+	"max": "0:100",
+}
+
+// presetNames returns names of built-in presets in alphabetical order
+func presetNames() []string {
+	names := make([]string, 0, len(CURVE_PRESETS))
+	for name := range CURVE_PRESETS {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// presetCurve returns fan curve of the built-in preset in -speeds format
+func presetCurve(name string) (string, error) {
+	curve, ok := CURVE_PRESETS[name]
+	if !ok {
+		return "", fmt.Errorf("unknown preset %q, must be one of %s", name, strings.Join(presetNames(), ", "))
+	}
+	return curve, nil
+}
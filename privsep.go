@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Subcommand which runs fan helper. It is started by the daemon itself, and is not meant to be run by hand.
+const FAN_HELPER_SUBCOMMAND = "fan-helper"
+
+// Operations accepted by fan helper, which are the only ones requiring root privilege
+const (
+	FAN_HELPER_OP_SET_FAN_SPEED         = "set_fan_speed"
+	FAN_HELPER_OP_SET_DEFAULT_FAN_SPEED = "set_default_fan_speed"
+)
+
+// fanHelperRequest is a line of JSON sent to stdin of fan helper
+type fanHelperRequest struct {
+	Op    string `json:"op"`
+	UUID  string `json:"uuid"`
+	Fan   int    `json:"fan"`
+	Speed uint8  `json:"speed,omitempty"`
+}
+
+// fanHelperResponse is a line of JSON written to stdout of fan helper for each request, and once on startup
+type fanHelperResponse struct {
+	Error       string `json:"error,omitempty"`
+	FailureMode string `json:"failureMode,omitempty"`
+	ReturnCode  *int   `json:"returnCode,omitempty"`
+}
+
+func newFanHelperResponse(err error) fanHelperResponse {
+	if err == nil {
+		return fanHelperResponse{}
+	}
+	response := fanHelperResponse{Error: err.Error(), FailureMode: failureMode(err)}
+	if code, ok := nvmlReturnCode(err); ok {
+		response.ReturnCode = &code
+	}
+	return response
+}
+
+// err turns the response back into error, which matches the same failure modes as the error in fan helper
+func (r fanHelperResponse) err() error {
+	if r.Error == "" {
+		return nil
+	}
+	if r.ReturnCode != nil {
+		return fanHelperError{message: r.Error, mode: r.FailureMode, code: *r.ReturnCode}
+	}
+	return errors.New(r.Error)
+}
+
+// fanHelperError is NVML error returned by fan helper
+type fanHelperError struct {
+	message string
+	mode    string
+	code    int
+}
+
+func (e fanHelperError) Error() string {
+	return e.message
+}
+
+func (e fanHelperError) Is(target error) bool {
+	return e.mode != "" && e.mode == failureMode(target)
+}
+
+func (e fanHelperError) returnCode() int {
+	return e.code
+}
+
+// fanHelperClient sends fan speed operations to fan helper through a pipe
+type fanHelperClient struct {
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	scanner *bufio.Scanner
+}
+
+// fanHelperDevices selects devices in a short NVML session while the process still has root privilege, and returns
+// number of fans of each by UUID. They are given to fan helper on startup, so that the helper only sets fans which
+// the daemon controls, even if the unprivileged daemon is compromised later.
+func fanHelperDevices(ctx context.Context, waitDuration time.Duration, selection deviceSelection) (map[string]int, int) {
+	backend := newGPUBackend()
+	if err := waitForDriver(ctx, waitDuration, backend.Init); err != nil {
+		slog.Error("Unable to initialize NVML", "err", err)
+		return nil, EXIT_NVML_INIT_FAILURE
+	}
+	defer backend.Shutdown()
+	count, err := backend.DeviceCount()
+	if err != nil {
+		slog.Error("Unable to get device count", "err", err)
+		return nil, EXIT_NVML_INIT_FAILURE
+	}
+	indices, code := selectDevices(backend, count, selection)
+	if code != EXIT_OK {
+		return nil, code
+	}
+	devices := make(map[string]int, len(indices))
+	for _, index := range indices {
+		device, err := backend.Device(index)
+		if err != nil {
+			slog.Error("Unable to get device at index", LABEL_GPU_INDEX, index, "err", err)
+			return nil, EXIT_UNSUPPORTED_DEVICE
+		}
+		uuid, err := device.UUID()
+		if err != nil {
+			slog.Error("Unable to get device UUID, which is required by fan helper", LABEL_GPU_INDEX, index, "err", err)
+			return nil, EXIT_UNSUPPORTED_DEVICE
+		}
+		numFans, err := device.NumFans()
+		if err != nil {
+			slog.Error("Unable to get number of fans", LABEL_GPU_INDEX, index, "err", err)
+			return nil, EXIT_UNSUPPORTED_DEVICE
+		}
+		devices[uuid] = numFans
+	}
+	return devices, EXIT_OK
+}
+
+// startFanHelper starts fan helper as a child process with the same privilege as the current process, and waits
+// until it has initialized NVML. Devices are passed as UUID=fans arguments, and the helper rejects any other device
+// or fan index.
+func startFanHelper(devices map[string]int) (*fanHelperClient, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("unable to find executable of fan helper: %w", err)
+	}
+	args := []string{FAN_HELPER_SUBCOMMAND}
+	for uuid, numFans := range devices {
+		args = append(args, fmt.Sprintf("%s=%d", uuid, numFans))
+	}
+	cmd := exec.Command(executable, args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create stdin pipe of fan helper: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create stdout pipe of fan helper: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unable to start fan helper: %w", err)
+	}
+	client := &fanHelperClient{cmd: cmd, stdin: stdin, scanner: bufio.NewScanner(stdout)}
+	if err := client.receive(); err != nil {
+		client.close()
+		return nil, fmt.Errorf("fan helper failed to start: %w", err)
+	}
+	return client, nil
+}
+
+func (c *fanHelperClient) receive() error {
+	if !c.scanner.Scan() {
+		if err := c.scanner.Err(); err != nil {
+			return fmt.Errorf("unable to read response of fan helper: %w", err)
+		}
+		return errors.New("fan helper has exited")
+	}
+	var response fanHelperResponse
+	if err := json.Unmarshal(c.scanner.Bytes(), &response); err != nil {
+		return fmt.Errorf("unable to parse response of fan helper: %w", err)
+	}
+	return response.err()
+}
+
+func (c *fanHelperClient) do(request fanHelperRequest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := json.NewEncoder(c.stdin).Encode(request); err != nil {
+		return fmt.Errorf("unable to send request to fan helper: %w", err)
+	}
+	return c.receive()
+}
+
+// close stops fan helper by closing its stdin, and waits for it to exit
+func (c *fanHelperClient) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stdin.Close()
+	return c.cmd.Wait()
+}
+
+// fanHelperDevice sets fan speed of the device through fan helper, while everything else is read by the
+// unprivileged process directly
+type fanHelperDevice struct {
+	gpuDevice
+	helper *fanHelperClient
+	uuid   string
+}
+
+// withFanHelper wraps the device, so that fan speed is set through fan helper
+func withFanHelper(device gpuDevice, helper *fanHelperClient) (gpuDevice, error) {
+	uuid, err := device.UUID()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get device UUID, which is required by fan helper: %w", err)
+	}
+	return &fanHelperDevice{gpuDevice: device, helper: helper, uuid: uuid}, nil
+}
+
+func (d *fanHelperDevice) SetFanSpeed(fanIdx int, speed uint8) error {
+	return d.helper.do(fanHelperRequest{Op: FAN_HELPER_OP_SET_FAN_SPEED, UUID: d.uuid, Fan: fanIdx, Speed: speed})
+}
+
+func (d *fanHelperDevice) SetDefaultFanSpeed(fanIdx int) error {
+	return d.helper.do(fanHelperRequest{Op: FAN_HELPER_OP_SET_DEFAULT_FAN_SPEED, UUID: d.uuid, Fan: fanIdx})
+}
+
+// fanHelper executes validated fan speed operations with root privilege
+type fanHelper struct {
+	backend gpuBackend
+	// Number of fans by UUID of devices which the daemon controls, and which are the only ones the helper sets
+	allowed map[string]int
+	// Devices opened so far by UUID, which are dropped when NVML is initialized again
+	devices map[string]gpuDevice
+}
+
+// runFanHelperCommand serves requests of the daemon line by line from stdin until it is closed
+func runFanHelperCommand(args []string) int {
+	allowed, err := parseFanHelperDevices(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", FAN_HELPER_SUBCOMMAND, err)
+		return EXIT_CONFIG_ERROR
+	}
+	// Signals from terminal or service manager are meant for the daemon, which still needs the helper to restore fans
+	// before it exits. The helper exits once the daemon closes the pipe.
+	signal.Ignore(syscall.SIGINT, syscall.SIGTERM)
+
+	out := json.NewEncoder(os.Stdout)
+	backend := newGPUBackend()
+	if err := backend.Init(); err != nil {
+		out.Encode(newFanHelperResponse(fmt.Errorf("unable to initialize NVML: %w", err)))
+		return EXIT_NVML_INIT_FAILURE
+	}
+	defer backend.Shutdown()
+	if err := out.Encode(fanHelperResponse{}); err != nil {
+		return EXIT_RUNTIME_FAILURE
+	}
+
+	helper := &fanHelper{backend: backend, allowed: allowed, devices: make(map[string]gpuDevice)}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var request fanHelperRequest
+		err := json.Unmarshal(scanner.Bytes(), &request)
+		if err != nil {
+			err = fmt.Errorf("invalid request: %w", err)
+		} else {
+			err = helper.handle(request)
+		}
+		if err := out.Encode(newFanHelperResponse(err)); err != nil {
+			return EXIT_RUNTIME_FAILURE
+		}
+	}
+	return EXIT_OK
+}
+
+func (h *fanHelper) handle(request fanHelperRequest) error {
+	switch request.Op {
+	case FAN_HELPER_OP_SET_FAN_SPEED:
+		if request.Speed > MAX_FAN_SPEED_PERCENT {
+			return fmt.Errorf("speed must not be greater than %d", MAX_FAN_SPEED_PERCENT)
+		}
+	case FAN_HELPER_OP_SET_DEFAULT_FAN_SPEED:
+	default:
+		return fmt.Errorf("unknown operation %q", request.Op)
+	}
+	err := h.apply(request)
+	if _, isNVMLError := nvmlReturnCode(err); isNVMLError && failureMode(err) != "unsupported_device" && failureMode(err) != "policy_rejected" {
+		// NVML session of the helper may be stale e.g. after resume from suspend, which the daemon recovers from by
+		// initializing NVML again on its side, so do the same here once
+		if err := h.reinit(); err != nil {
+			return err
+		}
+		err = h.apply(request)
+	}
+	return err
+}
+
+func (h *fanHelper) apply(request fanHelperRequest) error {
+	allowedFans, ok := h.allowed[request.UUID]
+	if !ok {
+		return fmt.Errorf("device with UUID %q is not controlled by the daemon", request.UUID)
+	}
+	if request.Fan < 0 || request.Fan >= allowedFans {
+		return fmt.Errorf("fan index %d is out of range, device had %d fans on startup", request.Fan, allowedFans)
+	}
+	device, err := h.device(request.UUID)
+	if err != nil {
+		return err
+	}
+	numFans, err := device.NumFans()
+	if err != nil {
+		return fmt.Errorf("unable to get number of fans: %w", err)
+	}
+	if request.Fan < 0 || request.Fan >= numFans {
+		return fmt.Errorf("fan index %d is out of range, device has %d fans", request.Fan, numFans)
+	}
+	if request.Op == FAN_HELPER_OP_SET_DEFAULT_FAN_SPEED {
+		return device.SetDefaultFanSpeed(request.Fan)
+	}
+	return device.SetFanSpeed(request.Fan, request.Speed)
+}
+
+// device returns the device with the UUID, which is looked up by UUID rather than index, as device index may differ
+// between the helper and the daemon
+func (h *fanHelper) device(uuid string) (gpuDevice, error) {
+	if device, ok := h.devices[uuid]; ok {
+		return device, nil
+	}
+	count, err := h.backend.DeviceCount()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get device count: %w", err)
+	}
+	for i := 0; i < count; i++ {
+		device, err := h.backend.Device(i)
+		if err != nil {
+			continue
+		}
+		if deviceUUID, err := device.UUID(); err == nil && deviceUUID == uuid {
+			h.devices[uuid] = device
+			return device, nil
+		}
+	}
+	return nil, fmt.Errorf("no device with UUID %q", uuid)
+}
+
+// parseFanHelperDevices parses arguments of fan helper, which are UUID=fans of each device it may set fans of
+func parseFanHelperDevices(args []string) (map[string]int, error) {
+	if len(args) == 0 {
+		return nil, errors.New("no device is given")
+	}
+	devices := make(map[string]int, len(args))
+	for _, arg := range args {
+		uuid, numFansStr, found := strings.Cut(arg, "=")
+		if !found || uuid == "" {
+			return nil, fmt.Errorf("invalid device %q, must be UUID=fans", arg)
+		}
+		numFans, err := strconv.Atoi(numFansStr)
+		if err != nil || numFans < 0 {
+			return nil, fmt.Errorf("invalid number of fans of device %q", arg)
+		}
+		devices[uuid] = numFans
+	}
+	return devices, nil
+}
+
+func (h *fanHelper) reinit() error {
+	h.devices = make(map[string]gpuDevice)
+	h.backend.Shutdown()
+	if err := h.backend.Init(); err != nil {
+		return fmt.Errorf("unable to initialize NVML: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Phases of operations in dry-run report
+const (
+	DRY_RUN_PHASE_STARTUP = "startup"
+	DRY_RUN_PHASE_CONTROL = "control"
+	DRY_RUN_PHASE_EXIT    = "exit"
+)
+
+// dryRunReport is written by -dry-run-report, so that CI jobs and scripts can verify config without parsing logs
+type dryRunReport struct {
+	// Settings resolved from defaults, config file, environment variables and flags, as exported by config export
+	Settings map[string]any       `json:"settings"`
+	Devices  []dryRunDeviceReport `json:"devices"`
+}
+
+// dryRunDeviceReport describes a detected device, its config after per device settings, and what would be done to it
+type dryRunDeviceReport struct {
+	Index       int    `json:"index"`
+	UUID        string `json:"uuid"`
+	Name        string `json:"name"`
+	ObserveOnly bool   `json:"observeOnly"`
+	Fans        []int  `json:"fans"`
+	AutoFans    []int  `json:"autoFans"`
+	Curve       string `json:"curve"`
+	// Temperature reported by the device at the time of report, nil if it cannot be read
+	Temperature *uint32           `json:"temperature"`
+	Table       []speedMapRow     `json:"table"`
+	Operations  []dryRunOperation `json:"operations"`
+}
+
+// dryRunOperation is a change, which would be made to the device without dry run
+type dryRunOperation struct {
+	Phase  string `json:"phase"`
+	Op     string `json:"op"`
+	Fan    *int   `json:"fan,omitempty"`
+	Speed  *uint8 `json:"speed,omitempty"`
+	Watts  uint   `json:"watts,omitempty"`
+	MinMHz uint32 `json:"minMHz,omitempty"`
+	MaxMHz uint32 `json:"maxMHz,omitempty"`
+}
+
+func fanOperations(phase, op string, fans []int, speed *uint8) []dryRunOperation {
+	operations := make([]dryRunOperation, 0, len(fans))
+	for _, fan := range fans {
+		operations = append(operations, dryRunOperation{Phase: phase, Op: op, Fan: &fan, Speed: speed})
+	}
+	return operations
+}
+
+// newDryRunDeviceReport describes the device. Operation of control phase is the first fan speed write at current
+// temperature, which is only derived from fan curves, as formula, RPM-target and target temperature modes depend on
+// state of the control loop.
+func newDryRunDeviceReport(d *controlledDevice, memoryFanSpeedConfig [][2]uint8, persistenceMode bool, exitAction string, exitSpeed uint8) dryRunDeviceReport {
+	device := d.handle.get()
+	curve := d.state.curveConfig()
+	report := dryRunDeviceReport{
+		Index:       d.index,
+		UUID:        d.labels.uuid,
+		Name:        d.labels.name,
+		ObserveOnly: d.config.observeOnly,
+		Curve:       formatSpeedConfig(curve),
+		Table:       speedMapRows(d.config, curve, memoryFanSpeedConfig),
+		Operations:  []dryRunOperation{},
+	}
+	if temperature, err := device.Temperature(); err == nil {
+		report.Temperature = &temperature
+	}
+	if fans, autoFans, err := controlledFans(device, d.config.fans); err == nil && !d.config.observeOnly {
+		report.Fans, report.AutoFans = fans, autoFans
+	}
+
+	if persistenceMode {
+		report.Operations = append(report.Operations, dryRunOperation{Phase: DRY_RUN_PHASE_STARTUP, Op: "enable_persistence_mode"})
+	}
+	if d.config.powerLimit > 0 {
+		report.Operations = append(report.Operations, dryRunOperation{Phase: DRY_RUN_PHASE_STARTUP, Op: "set_power_limit", Watts: d.config.powerLimit})
+	}
+	if d.config.lockedClocks[1] > 0 {
+		report.Operations = append(report.Operations, dryRunOperation{Phase: DRY_RUN_PHASE_STARTUP, Op: "lock_clocks", MinMHz: d.config.lockedClocks[0], MaxMHz: d.config.lockedClocks[1]})
+	}
+	if !d.config.observeOnly {
+		report.Operations = append(report.Operations, fanOperations(DRY_RUN_PHASE_STARTUP, "set_default_fan_speed", report.AutoFans, nil)...)
+		if report.Temperature != nil && d.config.formula == nil && d.config.rpmCurve == nil && d.config.targetTemp == 0 {
+			report.Operations = append(report.Operations, controlOperations(device, d.config, *report.Temperature, report.Fans)...)
+		}
+		switch exitAction {
+		case EXIT_ACTION_DEFAULT:
+			report.Operations = append(report.Operations, fanOperations(DRY_RUN_PHASE_EXIT, "set_default_fan_speed", report.Fans, nil)...)
+		case EXIT_ACTION_PARK:
+			report.Operations = append(report.Operations, fanOperations(DRY_RUN_PHASE_EXIT, "set_fan_speed", report.Fans, &exitSpeed)...)
+		}
+	}
+	if d.config.lockedClocks[1] > 0 {
+		report.Operations = append(report.Operations, dryRunOperation{Phase: DRY_RUN_PHASE_EXIT, Op: "reset_locked_clocks"})
+	}
+	if d.config.powerLimit > 0 {
+		report.Operations = append(report.Operations, dryRunOperation{Phase: DRY_RUN_PHASE_EXIT, Op: "restore_power_limit"})
+	}
+	if persistenceMode {
+		report.Operations = append(report.Operations, dryRunOperation{Phase: DRY_RUN_PHASE_EXIT, Op: "restore_persistence_mode"})
+	}
+	return report
+}
+
+// controlOperations returns fan speed writes of the first update at the temperature, following the control loop
+func controlOperations(device gpuDevice, config controlConfig, reportedTemperature uint32, fans []int) []dryRunOperation {
+	temperature := applyTempOffset(reportedTemperature, config.tempOffset)
+	if config.takeoverTemp > 0 && temperature < uint32(config.takeoverTemp) {
+		return fanOperations(DRY_RUN_PHASE_CONTROL, "set_default_fan_speed", fans, nil)
+	}
+	speed, ok := lookupFanSpeed(config.speedMap, temperature, config)
+	if config.memorySpeedMap != nil {
+		if memoryTemperature, err := readMemoryTemperature(device); err == nil {
+			if memorySpeed, found := lookupFanSpeed(config.memorySpeedMap, memoryTemperature, config); found {
+				speed, ok = max(speed, memorySpeed), true
+			}
+		}
+	}
+	speed, failsafe := limitFanSpeed(speed, temperature, config)
+	if !ok && !failsafe {
+		return nil
+	}
+	operations := make([]dryRunOperation, 0, len(fans))
+	for _, fan := range fans {
+		fanSpeed := speed
+		if !failsafe {
+			fanSpeed = fanSpeedWithOffset(speed, config.fans.offsets[fan], config)
+		}
+		operations = append(operations, dryRunOperation{Phase: DRY_RUN_PHASE_CONTROL, Op: "set_fan_speed", Fan: &fan, Speed: &fanSpeed})
+	}
+	return operations
+}
+
+// writeDryRunReport writes report of the devices as JSON to the path, or to stdout if path is "-"
+func writeDryRunReport(path string, flags *flag.FlagSet, devices []*controlledDevice, memoryFanSpeedConfig [][2]uint8, persistenceMode bool, exitAction string, exitSpeed uint8) error {
+	report := dryRunReport{Settings: make(map[string]any), Devices: make([]dryRunDeviceReport, 0, len(devices))}
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" {
+			return
+		}
+		if SECRET_FLAGS[f.Name] && f.Value.String() != "" {
+			report.Settings[f.Name] = "<redacted>"
+			return
+		}
+		report.Settings[f.Name], err = exportValue(f)
+	})
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		report.Devices = append(report.Devices, newDryRunDeviceReport(d, memoryFanSpeedConfig, persistenceMode, exitAction, exitSpeed))
+	}
+
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		file, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("unable to create dry-run report: %w", err)
+		}
+		defer file.Close()
+		w = file
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return fmt.Errorf("unable to write dry-run report: %w", err)
+	}
+	return nil
+}
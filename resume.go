@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Wall clock must jump ahead of monotonic clock by this duration between polls to be considered a system resume
+const SUSPEND_DETECTION_THRESHOLD = 10 * time.Second
+
+// backendReinit re-initializes the backend shared by all devices at most once per need, e.g. when every control loop
+// detects the same resume, so that a re-initialization does not invalidate handles just fetched by other devices.
+// Each re-initialization starts a new generation, and handles fetched in an older generation are stale.
+type backendReinit struct {
+	mu         sync.Mutex
+	backend    gpuBackend
+	generation uint64
+}
+
+func newBackendReinit(backend gpuBackend) *backendReinit {
+	return &backendReinit{backend: backend}
+}
+
+// reinit re-initializes the backend, unless it has already been re-initialized after the generation seen by the
+// caller, and returns the current generation
+func (r *backendReinit) reinit(seen uint64) (uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.generation != seen {
+		return r.generation, nil
+	}
+	if err := r.backend.Shutdown(); err != nil {
+		moduleLogger(LOG_MODULE_NVML).Warn("Unable to shutdown NVML before re-initialization", "err", err)
+	}
+	if err := r.backend.Init(); err != nil {
+		return seen, fmt.Errorf("unable to initialize NVML: %w", err)
+	}
+	r.generation++
+	return r.generation, nil
+}
+
+func (r *backendReinit) current() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.generation
+}
+
+// deviceHandle holds current GPU device, which is replaced when the device is fetched again, e.g. after the control
+// loop fails or NVML is re-initialized after system resume
+type deviceHandle struct {
+	mu     sync.Mutex
+	device gpuDevice
+	open   func() (gpuDevice, error)
+	reinit *backendReinit
+	// Generation of the backend, in which device is fetched
+	generation uint64
+}
+
+func newDeviceHandle(device gpuDevice, open func() (gpuDevice, error), reinit *backendReinit) *deviceHandle {
+	return &deviceHandle{
+		device:     device,
+		open:       open,
+		reinit:     reinit,
+		generation: reinit.current(),
+	}
+}
+
+func (h *deviceHandle) get() gpuDevice {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.device
+}
+
+// stale tells whether NVML has been re-initialized since the device is fetched, which invalidates the device
+func (h *deviceHandle) stale() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.generation != h.reinit.current()
+}
+
+// refresh fetches the device again, while NVML stays initialized, as other devices are still using it.
+// It gives up without touching NVML if ctx is done, so that retries after failure do not delay shutdown.
+func (h *deviceHandle) refresh(ctx context.Context) (gpuDevice, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("unable to reopen device: %w", err)
+	}
+	// Generation is taken before fetching, so that a re-initialization in between leaves the device stale
+	generation := h.reinit.current()
+	device, err := h.open()
+	if err != nil {
+		return nil, fmt.Errorf("unable to reopen device: %w", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.device = device
+	h.generation = generation
+	return device, nil
+}
+
+// reopen re-initializes NVML once for all devices, e.g. after resume, and fetches the device again. If another device
+// has already re-initialized NVML since this device is fetched, the device is only fetched again.
+func (h *deviceHandle) reopen(ctx context.Context) (gpuDevice, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("unable to reopen device: %w", err)
+	}
+	h.mu.Lock()
+	seen := h.generation
+	h.mu.Unlock()
+	if _, err := h.reinit.reinit(seen); err != nil {
+		return nil, fmt.Errorf("unable to reopen device: %w", err)
+	}
+	return h.refresh(ctx)
+}
+
+// suspendDetector detects system suspend by comparing wall clock with monotonic clock,
+// as monotonic clock does not advance while the system is suspended.
+type suspendDetector struct {
+	last time.Time
+}
+
+func newSuspendDetector(now time.Time) *suspendDetector {
+	return &suspendDetector{last: now}
+}
+
+// check returns duration of suspend since last check, and whether the system has been resumed from suspend
+func (d *suspendDetector) check(now time.Time) (time.Duration, bool) {
+	// Round(0) strips monotonic clock reading, so that wall clock is used for subtraction
+	wallElapsed := now.Round(0).Sub(d.last.Round(0))
+	monotonicElapsed := now.Sub(d.last)
+	d.last = now
+
+	suspended := wallElapsed - monotonicElapsed
+	return suspended, suspended > SUSPEND_DETECTION_THRESHOLD
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Highest plausible fan speed in RPM of GPU fans
+	MAX_FAN_SPEED_RPM = 10000
+	// Duty is not changed when measured RPM is within this distance to target RPM
+	RPM_CONTROL_DEADBAND = 50
+	// Duty change in percent per RPM of error
+	RPM_CONTROL_GAIN = 0.02
+	// Maximum duty change in percent per polling, so that fans do not oscillate
+	RPM_CONTROL_MAX_STEP = 10
+)
+
+// rpmPoint is a temperature:RPM pair of RPM-target fan curve
+type rpmPoint struct {
+	temperature uint8
+	rpm         uint32
+}
+
+func parseRPMConfigFlag(rpmStrConfig string) ([]rpmPoint, error) {
+	var points []rpmPoint
+	for i, rpmPair := range strings.Split(rpmStrConfig, ",") {
+		rpmPairArr := strings.Split(strings.TrimSpace(rpmPair), ":")
+		if len(rpmPairArr) != 2 {
+			return nil, fmt.Errorf("RPM pair at index %d is not a pair: %s", i, rpmPair)
+		}
+		temperature, err := strconv.ParseUint(rpmPairArr[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse temperature at pair %d (%s): %w", i, rpmPair, err)
+		}
+		rpm, err := strconv.ParseUint(rpmPairArr[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse RPM at pair %d (%s): %w", i, rpmPair, err)
+		}
+		if temperature > uint64(MAX_TEMP) {
+			return nil, fmt.Errorf("temperature at pair %d (%s) is not plausible, it must be between %d and %d", i, rpmPair, MIN_TEMP, MAX_TEMP)
+		}
+		if rpm > MAX_FAN_SPEED_RPM {
+			return nil, fmt.Errorf("RPM at pair %d (%s) must be between 0 and %d", i, rpmPair, MAX_FAN_SPEED_RPM)
+		}
+		if i > 0 && uint8(temperature) <= points[i-1].temperature {
+			return nil, fmt.Errorf("temperature at pair %d (%s) must be greater than temperature at previous pair", i, rpmPair)
+		}
+		points = append(points, rpmPoint{temperature: uint8(temperature), rpm: uint32(rpm)})
+	}
+	return points, nil
+}
+
+// targetRPM interpolates target RPM of the temperature linearly between curve points.
+// Below the first point, target is 0, and above the last point, RPM of the last point is kept.
+func targetRPM(points []rpmPoint, temperature uint32) uint32 {
+	if len(points) == 0 || temperature < uint32(points[0].temperature) {
+		return 0
+	}
+	for i := 1; i < len(points); i++ {
+		prev, curr := points[i-1], points[i]
+		if temperature < uint32(curr.temperature) {
+			slope := (float64(curr.rpm) - float64(prev.rpm)) / float64(curr.temperature-prev.temperature)
+			return uint32(float64(prev.rpm) + slope*float64(temperature-uint32(prev.temperature)))
+		}
+	}
+	return points[len(points)-1].rpm
+}
+
+// rpmController converts target RPM to fan duty in percent by feedback from measured RPM,
+// as the same duty results in very different RPM across card models.
+type rpmController struct {
+	minDuty uint8
+	maxDuty uint8
+	duty    uint8
+}
+
+func newRPMController(minDuty, maxDuty, initialDuty uint8) *rpmController {
+	return &rpmController{
+		minDuty: minDuty,
+		maxDuty: maxDuty,
+		duty:    max(min(initialDuty, maxDuty), minDuty),
+	}
+}
+
+// next returns duty to be applied, given target RPM and RPM measured at current duty
+func (c *rpmController) next(target, measured uint32) uint8 {
+	if target == 0 {
+		c.duty = c.minDuty
+		return c.duty
+	}
+	diff := float64(target) - float64(measured)
+	if diff > -RPM_CONTROL_DEADBAND && diff < RPM_CONTROL_DEADBAND {
+		return c.duty
+	}
+	step := max(min(diff*RPM_CONTROL_GAIN, RPM_CONTROL_MAX_STEP), -RPM_CONTROL_MAX_STEP)
+	// Move at least 1 percent, otherwise small errors outside deadband are never corrected
+	if step > 0 && step < 1 {
+		step = 1
+	} else if step < 0 && step > -1 {
+		step = -1
+	}
+	duty := max(min(float64(c.duty)+step, float64(c.maxDuty)), float64(c.minDuty))
+	c.duty = uint8(duty)
+	return c.duty
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule is checked at this interval, so that a rule takes effect within this delay after its start time
+const SCHEDULE_CHECK_INTERVAL = 30 * time.Second
+
+// Day names accepted by schedule, indexed by time.Weekday
+var SCHEDULE_DAYS = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// scheduleRule applies a fan curve on selected days, within a time window of each day
+type scheduleRule struct {
+	// Days of week on which the rule applies, indexed by time.Weekday
+	days [7]bool
+	// Start and end of time window since midnight. Window ending before its start continues past midnight,
+	// and belongs to the day on which it starts. Window is the whole day if allDay is set.
+	start, end time.Duration
+	allDay     bool
+	// Rule as written, for logs
+	source string
+	curve  [][2]uint8
+}
+
+// parseSchedule parses semicolon-separated rules of days, optional time window, and preset name or curve,
+// e.g. "mon-fri 09:00-18:00=aggressive;sat,sun=silent;22:00-07:00=30:30,70:60,85:100".
+// Days are sun to sat, ranges of them e.g. mon-fri, weekdays, weekend or daily, and default to daily.
+func parseSchedule(scheduleStr string) ([]scheduleRule, error) {
+	var rules []scheduleRule
+	for _, ruleStr := range strings.Split(scheduleStr, ";") {
+		ruleStr = strings.TrimSpace(ruleStr)
+		if ruleStr == "" {
+			continue
+		}
+		when, value, found := strings.Cut(ruleStr, "=")
+		if !found {
+			return nil, fmt.Errorf("schedule rule %q must be when=preset or when=curve", ruleStr)
+		}
+		rule := scheduleRule{source: ruleStr, allDay: true}
+		daysStr, windowStr := "daily", ""
+		for _, field := range strings.Fields(when) {
+			if strings.Contains(field, ":") {
+				windowStr = field
+			} else {
+				daysStr = field
+			}
+		}
+		days, err := parseScheduleDays(daysStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid days of schedule rule %q: %w", ruleStr, err)
+		}
+		rule.days = days
+		if windowStr != "" {
+			startStr, endStr, found := strings.Cut(windowStr, "-")
+			if !found {
+				return nil, fmt.Errorf("time window of schedule rule %q must be HH:MM-HH:MM", ruleStr)
+			}
+			if rule.start, err = parseTimeOfDay(startStr); err != nil {
+				return nil, fmt.Errorf("invalid start of schedule rule %q: %w", ruleStr, err)
+			}
+			if rule.end, err = parseTimeOfDay(endStr); err != nil {
+				return nil, fmt.Errorf("invalid end of schedule rule %q: %w", ruleStr, err)
+			}
+			if rule.start == rule.end {
+				return nil, fmt.Errorf("time window of schedule rule %q is empty", ruleStr)
+			}
+			rule.allDay = false
+		}
+		value = strings.TrimSpace(value)
+		if _, isPreset := CURVE_PRESETS[value]; isPreset {
+			value, _ = presetCurve(value)
+		}
+		if rule.curve, err = parseSpeedConfigFlag(value); err != nil {
+			return nil, fmt.Errorf("schedule rule %q must end with preset name or fan curve: %w", ruleStr, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseScheduleDays parses comma-separated days or ranges of days e.g. mon-fri,sun
+func parseScheduleDays(daysStr string) ([7]bool, error) {
+	var days [7]bool
+	for _, part := range strings.Split(strings.ToLower(daysStr), ",") {
+		switch part {
+		case "daily", "*":
+			return [7]bool{true, true, true, true, true, true, true}, nil
+		case "weekdays":
+			part = "mon-fri"
+		case "weekend":
+			part = "sat-sun"
+		}
+		firstStr, lastStr, isRange := strings.Cut(part, "-")
+		if !isRange {
+			lastStr = firstStr
+		}
+		first, last := scheduleDayIndex(firstStr), scheduleDayIndex(lastStr)
+		if first < 0 || last < 0 {
+			return days, fmt.Errorf("unknown day %q, must be one of %s, weekdays, weekend or daily", part, strings.Join(SCHEDULE_DAYS, ", "))
+		}
+		// Ranges may wrap around the week e.g. fri-mon
+		for day := first; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func scheduleDayIndex(name string) int {
+	for i, day := range SCHEDULE_DAYS {
+		if name == day {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseTimeOfDay parses HH:MM into duration since midnight
+func parseTimeOfDay(timeStr string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(timeStr))
+	if err != nil {
+		return 0, fmt.Errorf("time %q must be HH:MM", timeStr)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// matches tells whether the rule applies at the time in its location
+func (r scheduleRule) matches(now time.Time) bool {
+	weekday := now.Weekday()
+	if r.allDay {
+		return r.days[weekday]
+	}
+	sinceMidnight := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+	if r.start < r.end {
+		return r.days[weekday] && sinceMidnight >= r.start && sinceMidnight < r.end
+	}
+	// Window past midnight belongs to the day on which it starts
+	previousDay := (weekday + 6) % 7
+	return (r.days[weekday] && sinceMidnight >= r.start) || (r.days[previousDay] && sinceMidnight < r.end)
+}
+
+// activeScheduleRule returns index of the first rule which applies at the time, or -1 if none does
+func activeScheduleRule(rules []scheduleRule, now time.Time) int {
+	for i, rule := range rules {
+		if rule.matches(now) {
+			return i
+		}
+	}
+	return -1
+}
+
+// runSchedule switches the curve of all devices whenever the active rule changes, until ctx is done.
+// Outside all rules, each device returns to the curve it started with. As the curve is only switched on transitions,
+// a curve changed through control API is kept until the next transition.
+func runSchedule(ctx context.Context, rules []scheduleRule, devices []*controlledDevice) {
+	logger := moduleLogger(LOG_MODULE_CONTROLLER)
+	baseCurves := make([][][2]uint8, len(devices))
+	for i, d := range devices {
+		baseCurves[i] = d.state.curveConfig()
+	}
+	ticker := time.NewTicker(SCHEDULE_CHECK_INTERVAL)
+	defer ticker.Stop()
+	active := -1
+	for {
+		if next := activeScheduleRule(rules, time.Now()); next != active {
+			active = next
+			for i, d := range devices {
+				curve := baseCurves[i]
+				if active >= 0 {
+					curve = rules[active].curve
+				}
+				d.state.setCurve(curve, generateTempNFanSpeedMap(curve))
+				select {
+				case d.applyNow <- struct{}{}:
+				default:
+				}
+			}
+			if active >= 0 {
+				logger.Info("Schedule rule is active, switch fan curve", "rule", rules[active].source, "curve", formatSpeedConfig(rules[active].curve))
+			} else {
+				logger.Info("No schedule rule is active, return to configured fan curve")
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
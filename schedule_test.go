@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	rules, err := parseSchedule("mon-fri 09:00-18:00=aggressive; sat,sun=silent;22:00-07:00=30:30,70:60;")
+	if err != nil {
+		t.Fatalf("parseSchedule: %v", err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("parseSchedule returned %d rules, want 3", len(rules))
+	}
+
+	weekdays := [7]bool{false, true, true, true, true, true, false}
+	if rules[0].days != weekdays || rules[0].allDay || rules[0].start != 9*time.Hour || rules[0].end != 18*time.Hour {
+		t.Errorf("rule 0 = %+v, want weekdays from 09:00 to 18:00", rules[0])
+	}
+	if got := formatSpeedConfig(rules[0].curve); got != CURVE_PRESETS["aggressive"] {
+		t.Errorf("curve of rule 0 = %s, want aggressive preset %s", got, CURVE_PRESETS["aggressive"])
+	}
+	weekend := [7]bool{true, false, false, false, false, false, true}
+	if rules[1].days != weekend || !rules[1].allDay {
+		t.Errorf("rule 1 = %+v, want all day on weekend", rules[1])
+	}
+	daily := [7]bool{true, true, true, true, true, true, true}
+	if rules[2].days != daily || rules[2].start != 22*time.Hour || rules[2].end != 7*time.Hour {
+		t.Errorf("rule 2 = %+v, want daily from 22:00 to 07:00", rules[2])
+	}
+	if got := formatSpeedConfig(rules[2].curve); got != "30:30,70:60" {
+		t.Errorf("curve of rule 2 = %s, want 30:30,70:60", got)
+	}
+}
+
+func TestParseScheduleDays(t *testing.T) {
+	tests := []struct {
+		days string
+		want [7]bool
+	}{
+		{days: "daily", want: [7]bool{true, true, true, true, true, true, true}},
+		{days: "weekdays", want: [7]bool{false, true, true, true, true, true, false}},
+		{days: "weekend", want: [7]bool{true, false, false, false, false, false, true}},
+		{days: "fri-mon", want: [7]bool{true, true, false, false, false, true, true}},
+		{days: "Tue,thu", want: [7]bool{false, false, true, false, true, false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.days, func(t *testing.T) {
+			got, err := parseScheduleDays(tt.days)
+			if err != nil {
+				t.Fatalf("parseScheduleDays(%q): %v", tt.days, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseScheduleDays(%q) = %v, want %v", tt.days, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, schedule := range []string{
+		"silent",
+		"someday=silent",
+		"mon-funday=silent",
+		"09:00=silent",
+		"25:00-07:00=silent",
+		"09:00-09:00=silent",
+		"mon=loud",
+		"mon=50:40,40:50",
+	} {
+		t.Run(schedule, func(t *testing.T) {
+			if _, err := parseSchedule(schedule); err == nil {
+				t.Errorf("parseSchedule(%q) succeeded, want error", schedule)
+			}
+		})
+	}
+}
+
+func TestScheduleRuleMatches(t *testing.T) {
+	rules, err := parseSchedule("mon-fri 09:00-18:00=aggressive;fri 22:00-07:00=silent")
+	if err != nil {
+		t.Fatalf("parseSchedule: %v", err)
+	}
+	tests := []struct {
+		at   string
+		want int
+	}{
+		// 2024-01-01 is Monday
+		{at: "2024-01-01 08:59", want: -1},
+		{at: "2024-01-01 09:00", want: 0},
+		{at: "2024-01-01 18:00", want: -1},
+		{at: "2024-01-05 23:00", want: 1},
+		// Window past midnight belongs to Friday, on which it starts
+		{at: "2024-01-06 06:59", want: 1},
+		{at: "2024-01-06 07:00", want: -1},
+		{at: "2024-01-06 12:00", want: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.at, func(t *testing.T) {
+			now, err := time.Parse("2006-01-02 15:04", tt.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := activeScheduleRule(rules, now); got != tt.want {
+				t.Errorf("activeScheduleRule at %s = %d, want %d", tt.at, got, tt.want)
+			}
+		})
+	}
+}
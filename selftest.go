@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	// Fan speed in percent set by self-test, which is raised to minimum fan speed of the device if needed
+	SELF_TEST_SPEED = 50
+	// Fan speed read back may differ from the speed set by rounding of the driver
+	SELF_TEST_TOLERANCE = 2
+	// Read back is retried until this duration, as some drivers apply fan speed asynchronously
+	SELF_TEST_TIMEOUT       = 3 * time.Second
+	SELF_TEST_POLL_INTERVAL = 200 * time.Millisecond
+)
+
+// errSelfTestFailed means the device accepted fan speed, but did not apply it
+var errSelfTestFailed = errors.New("device does not honor manual fan control")
+
+// runSelfTest sets a test speed to the fans, and reads back fan speed and policy to confirm that the device
+// actually honors manual fan control. Fans are returned to their previous speed or policy afterwards.
+func runSelfTest(logger *slog.Logger, device gpuDevice, fans []int) error {
+	speed := uint8(SELF_TEST_SPEED)
+	if minSpeed, maxSpeed, err := device.MinMaxFanSpeed(); err == nil {
+		speed = uint8(min(max(uint32(speed), minSpeed), maxSpeed, uint32(MAX_FAN_SPEED_PERCENT)))
+	}
+
+	type fanState struct {
+		speed  uint32
+		policy fanControlPolicy
+		known  bool
+	}
+	previous := make(map[int]fanState, len(fans))
+	for _, i := range fans {
+		fanSpeed, speedErr := device.FanSpeed(i)
+		policy, policyErr := device.FanControlPolicy(i)
+		previous[i] = fanState{speed: fanSpeed, policy: policy, known: speedErr == nil && policyErr == nil}
+	}
+	defer func() {
+		for _, i := range fans {
+			state := previous[i]
+			var err error
+			if state.known && state.policy == FAN_POLICY_MANUAL {
+				err = device.SetFanSpeed(i, uint8(min(state.speed, uint32(MAX_FAN_SPEED_PERCENT))))
+			} else {
+				err = device.SetDefaultFanSpeed(i)
+			}
+			if err != nil {
+				logger.Warn("Unable to return fan to its state before self-test", LABEL_FAN_INDEX, i, "err", err)
+			}
+		}
+	}()
+
+	logger.Info("Run self-test of manual fan control", "fans", fans, "speed", speed)
+	for _, i := range fans {
+		if err := device.SetFanSpeed(i, speed); err != nil {
+			switch {
+			case errors.Is(err, ErrUnsupportedDevice):
+				return fmt.Errorf("fan %d does not support manual fan control (NOT_SUPPORTED), e.g. on laptops or passively cooled GPUs: %w", i, err)
+			case errors.Is(err, ErrPolicyRejected):
+				return fmt.Errorf("fan %d rejected manual fan control, make sure the process runs as root: %w", i, err)
+			}
+			return fmt.Errorf("unable to set test speed to fan %d: %w", i, err)
+		}
+	}
+
+	deadline := time.Now().Add(SELF_TEST_TIMEOUT)
+	for _, i := range fans {
+		for {
+			err := verifyFanControl(device, i, speed)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, errSelfTestFailed) || time.Now().After(deadline) {
+				return err
+			}
+			time.Sleep(SELF_TEST_POLL_INTERVAL)
+		}
+	}
+	logger.Info("Self-test of manual fan control passed", "fans", fans)
+	return nil
+}
+
+// verifyFanControl reads back fan speed and policy of the fan, which must match the test speed and manual policy.
+// Policy is not checked if the device does not report it.
+func verifyFanControl(device gpuDevice, fanIdx int, speed uint8) error {
+	policy, err := device.FanControlPolicy(fanIdx)
+	if err != nil && !errors.Is(err, ErrUnsupportedDevice) {
+		return fmt.Errorf("unable to read back fan control policy of fan %d: %w", fanIdx, err)
+	}
+	if err == nil && policy != FAN_POLICY_MANUAL {
+		return fmt.Errorf("%w: fan %d is on %s policy after setting fan speed", errSelfTestFailed, fanIdx, policy)
+	}
+	fanSpeed, err := device.FanSpeed(fanIdx)
+	if err != nil {
+		return fmt.Errorf("unable to read back fan speed of fan %d: %w", fanIdx, err)
+	}
+	if diff := int(fanSpeed) - int(speed); diff > SELF_TEST_TOLERANCE || diff < -SELF_TEST_TOLERANCE {
+		return fmt.Errorf("%w: fan %d reads back %d%% after setting %d%%", errSelfTestFailed, fanIdx, fanSpeed, speed)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// readMemoryTemperature reads memory temperature through NVML field value API, or from thermal sensor of memory
+// on GPUs which do not expose the field value
+func readMemoryTemperature(device gpuDevice) (uint32, error) {
+	temperature, err := device.MemoryTemperature()
+	if err == nil || !errors.Is(err, ErrUnsupportedDevice) {
+		return temperature, err
+	}
+	sensors, sensorErr := device.ThermalSensors()
+	if sensorErr != nil {
+		return 0, err
+	}
+	if temperature, ok := sensors[THERMAL_TARGET_MEMORY]; ok {
+		return temperature, nil
+	}
+	return 0, err
+}
+
+// readThermalSensor reads temperature of thermal sensor of the given target
+func readThermalSensor(device gpuDevice, target thermalTarget) (uint32, error) {
+	sensors, err := device.ThermalSensors()
+	if err != nil {
+		return 0, fmt.Errorf("unable to get thermal sensors: %w", err)
+	}
+	temperature, ok := sensors[target]
+	if !ok {
+		return 0, fmt.Errorf("device has no %s thermal sensor", target)
+	}
+	return temperature, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// Actions applied to controlled fans when the controller shuts down gracefully
+const (
+	// Fans are returned to driver default policy, which may stop fans right after a hot workload on zero RPM cards
+	EXIT_ACTION_DEFAULT = "default"
+	// Fans are left on manual policy at the last applied speed
+	EXIT_ACTION_HOLD = "hold"
+	// Fans are set to -exit-speed, and left on manual policy
+	EXIT_ACTION_PARK = "park"
+)
+
+func validateExitAction(action string, speed uint) error {
+	switch action {
+	case EXIT_ACTION_DEFAULT, EXIT_ACTION_HOLD, EXIT_ACTION_PARK:
+	default:
+		return fmt.Errorf("unknown exit action %q, supported values are default, hold and park", action)
+	}
+	if speed > uint(MAX_FAN_SPEED_PERCENT) {
+		return fmt.Errorf("exit speed %d must not be greater than %d", speed, MAX_FAN_SPEED_PERCENT)
+	}
+	return nil
+}
+
+// applyExitAction leaves the fans of the device in the state chosen by exit action.
+// Fans are returned to driver default policy if parking speed cannot be set.
+func applyExitAction(logger *slog.Logger, device gpuDevice, fans []int, action string, speed uint8, dryrun bool) {
+	switch action {
+	case EXIT_ACTION_HOLD:
+		if dryrun {
+			logger.Info("(Dryrun) Leave NVIDIA GPU fan speed at the last applied speed")
+			return
+		}
+		logger.Warn("Leave fans at the last applied speed, fan speed does not follow temperature until fan control is started again")
+	case EXIT_ACTION_PARK:
+		if dryrun {
+			logger.Info("(Dryrun) Set NVIDIA GPU fan speed to parking speed", "speed", speed)
+			return
+		}
+		logger.Warn("Set fans to parking speed, fan speed does not follow temperature until fan control is started again", "speed", speed)
+		if err := setAllFanSpeeds(device, fans, speed); err != nil {
+			logger.Error("Unable to set parking speed, return fans to driver default policy", "err", err)
+			restoreDefaultFanSpeeds(logger, device, fans, dryrun)
+		}
+	default:
+		restoreDefaultFanSpeeds(logger, device, fans, dryrun)
+	}
+}
+
+// describeExitAction tells what happens to fans on exit, which is a part of shutdown alert message
+func describeExitAction(action string, speed uint8) string {
+	switch action {
+	case EXIT_ACTION_HOLD:
+		return "fans are held at the last applied speed"
+	case EXIT_ACTION_PARK:
+		return fmt.Sprintf("fans are parked at %d%%", speed)
+	default:
+		return "fans are returned to driver default policy"
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Action printed instead of override, as the only override of a simulation is boost after rapid rise
+const SIMULATE_ACTION_BOOST = "boost"
+
+// simulateOptions are options of "simulate" subcommand, which makes run replay a trace through the control pipeline
+// instead of controlling fans
+type simulateOptions struct {
+	trace string
+	seed  int64
+	// Maximum sensor noise in Celsius, which is added to each sample by random number generator seeded by seed
+	noise uint
+}
+
+// traceSample is a line of trace, with time since start of the trace, and memory temperature, temperature of
+// external source and P-state if the trace has them
+type traceSample struct {
+	at                time.Duration
+	temperature       uint32
+	memoryTemperature uint32
+	hasMemory         bool
+	sourceTemperature uint32
+	hasSource         bool
+	pstate            uint32
+	hasPState         bool
+}
+
+// readTrace reads CSV lines of seconds since start, GPU temperature, and optional memory temperature, temperature of
+// external source and P-state e.g. "2.5,64,80" or "2.5,64,,31,8", where empty fields are not recorded.
+// Blank lines, lines starting with # and a header line are skipped.
+func readTrace(r io.Reader) ([]traceSample, error) {
+	var samples []traceSample
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		seconds, err := strconv.ParseFloat(strings.TrimSpace(fields[0]), 64)
+		if err != nil && len(samples) == 0 && lineNo == 1 {
+			continue
+		}
+		if err != nil || len(fields) < 2 || len(fields) > 5 {
+			return nil, fmt.Errorf("line %d of trace must be seconds,temperature[,memory temperature[,source temperature[,pstate]]]: %q", lineNo, line)
+		}
+		sample := traceSample{at: time.Duration(seconds * float64(time.Second))}
+		if len(samples) > 0 && sample.at < samples[len(samples)-1].at {
+			return nil, fmt.Errorf("line %d of trace goes back in time", lineNo)
+		}
+		temperature, err := strconv.ParseUint(strings.TrimSpace(fields[1]), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid temperature at line %d of trace: %w", lineNo, err)
+		}
+		sample.temperature = uint32(temperature)
+		optional := []struct {
+			name  string
+			value *uint32
+			has   *bool
+		}{
+			{"memory temperature", &sample.memoryTemperature, &sample.hasMemory},
+			{"source temperature", &sample.sourceTemperature, &sample.hasSource},
+			{"pstate", &sample.pstate, &sample.hasPState},
+		}
+		for i, field := range fields[2:] {
+			if field = strings.TrimSpace(field); field == "" {
+				continue
+			}
+			value, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s at line %d of trace: %w", optional[i].name, lineNo, err)
+			}
+			*optional[i].value, *optional[i].has = uint32(value), true
+		}
+		samples = append(samples, sample)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read trace: %w", err)
+	}
+	return samples, nil
+}
+
+// runSimulation replays the trace through spike and median filters, temperature offset, temperature blend,
+// prediction, rapid rise boost and the decision of fan speed shared with the control loop, and writes applied fan
+// speed of every sample as CSV. Time is taken from the trace rather than the clock, so that output only depends on
+// the trace, the config and the seed.
+func runSimulation(w io.Writer, config controlConfig, options simulateOptions) int {
+	if config.formula != nil || config.rpmCurve != nil {
+		slog.Error("simulation does not support fan speed formula or RPM-target mode, whose inputs are not in the trace")
+		return EXIT_CONFIG_ERROR
+	}
+	if config.blend.uses(BLEND_SENSOR_BOARD) || config.blend.uses(BLEND_SENSOR_PSU) {
+		slog.Error("simulation supports only core, memory and source sensors of temperature blend, as others are not in the trace")
+		return EXIT_CONFIG_ERROR
+	}
+	var input io.Reader = os.Stdin
+	if options.trace != "-" {
+		file, err := os.Open(options.trace)
+		if err != nil {
+			slog.Error("Unable to open trace", "err", err)
+			return EXIT_CONFIG_ERROR
+		}
+		defer file.Close()
+		input = file
+	}
+	samples, err := readTrace(input)
+	if err != nil {
+		slog.Error("Unable to read trace", "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+	simulateTrace(w, config, samples, options)
+	return EXIT_OK
+}
+
+// simulateTrace writes header and a CSV line of applied fan speed for every sample of the trace
+func simulateTrace(w io.Writer, config controlConfig, samples []traceSample, options simulateOptions) {
+	offsetFans := make([]int, 0, len(config.fans.offsets))
+	for fanIdx := range config.fans.offsets {
+		offsetFans = append(offsetFans, fanIdx)
+	}
+	sort.Ints(offsetFans)
+	header := "time,temperature,curve_temperature,speed,action"
+	for _, fanIdx := range offsetFans {
+		header += fmt.Sprintf(",fan%d", fanIdx)
+	}
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+	fmt.Fprintln(out, header)
+
+	rng := rand.New(rand.NewSource(options.seed))
+	var predictor *temperaturePredictor
+	if config.predictAhead > 0 {
+		predictor = newTemperaturePredictor(config.predictAhead)
+	}
+	var rise *riseDetector
+	if config.riseRate > 0 {
+		rise = newRiseDetector(config.riseRate)
+	}
+	var boostUntil time.Duration
+	var targetCtl *targetTempController
+	if config.targetTemp > 0 {
+		// Fans are assumed to start at min speed, as the trace does not have fan speed
+		targetCtl = newTargetTempController(config.targetTemp, config.minSpeed, config.maxSpeed, config.minSpeed)
+	}
+	var spikes *spikeFilter
+	if config.spikeThreshold > 0 {
+		spikes = newSpikeFilter(uint32(config.spikeThreshold))
+	}
+	var median *medianFilter
+	if config.medianSamples > 1 {
+		median = newMedianFilter(int(config.medianSamples))
+	}
+	// Predictor only uses differences of time, so that any fixed start gives the same result
+	start := time.Unix(0, 0)
+	decisionState := newFanDecisionState()
+	// Decision which fans run at, unless they are on stock fan curve or as they were before the first write
+	var applied fanDecision
+	manual := false
+	for _, sample := range samples {
+		now := start.Add(sample.at)
+		reportedTemperature := sample.temperature
+		if options.noise > 0 {
+			noise := rng.Intn(2*int(options.noise)+1) - int(options.noise)
+			reportedTemperature = uint32(max(int(reportedTemperature)+noise, 0))
+		}
+		temperature := reportedTemperature
+		if spikes != nil {
+			temperature, _ = spikes.filter(reportedTemperature)
+		}
+		if median != nil {
+			temperature = median.filter(temperature)
+		}
+		temperature = applyTempOffset(temperature, config.tempOffset)
+		// Source temperature is taken from the trace, rather than read from the source
+		sourceOk := config.tempSource != nil && sample.hasSource
+		curveTemperature := temperature
+		if config.blend != nil {
+			if blended, blendOk, _ := config.blend.blend(func(sensor string) (uint32, error) {
+				switch sensor {
+				case BLEND_SENSOR_MEMORY:
+					if !sample.hasMemory {
+						return 0, fmt.Errorf("memory temperature is not in the trace")
+					}
+					return sample.memoryTemperature, nil
+				case BLEND_SENSOR_SOURCE:
+					if !sourceOk {
+						return 0, fmt.Errorf("source temperature is not in the trace")
+					}
+					return sample.sourceTemperature, nil
+				}
+				return temperature, nil
+			}); blendOk {
+				curveTemperature = blended
+			}
+		}
+		if predictor != nil {
+			curveTemperature = predictor.predict(now, curveTemperature)
+		}
+		if rise != nil {
+			if _, started := rise.observe(now, temperature); started && config.riseBoostDuration > 0 && sample.at >= boostUntil {
+				boostUntil = sample.at + config.riseBoostDuration
+			}
+		}
+
+		input := fanSample{
+			now:               now,
+			temperature:       temperature,
+			curveTemperature:  curveTemperature,
+			memoryTemperature: sample.memoryTemperature,
+			memoryOk:          config.memorySpeedMap != nil && sample.hasMemory,
+			sourceTemperature: sample.sourceTemperature,
+			sourceOk:          sourceOk,
+			pstate:            sample.pstate,
+			pstateOk:          sample.hasPState,
+			// Boost after rapid rise is an override of all fans, as in the control loop
+			overridden:    sample.at < boostUntil,
+			overrideSpeed: MAX_FAN_SPEED_PERCENT,
+		}
+		if targetCtl != nil {
+			input.computed = true
+			input.computedSpeed, input.computedOk = targetCtl.next(now, curveTemperature), true
+		}
+		decision, nextDecisionState := decideFanSpeed(config, config.speedMap, decisionState, input)
+		decisionState = nextDecisionState
+		if decision.release {
+			manual = false
+		}
+		if decision.writes() {
+			applied, manual = decision, true
+		}
+		action := decision.action
+		if action == FAN_ACTION_OVERRIDE {
+			action = SIMULATE_ACTION_BOOST
+		}
+
+		line := fmt.Sprintf("%s,%d,%d,", strconv.FormatFloat(sample.at.Seconds(), 'f', -1, 64), reportedTemperature, curveTemperature)
+		if manual {
+			line += strconv.Itoa(int(applied.speed))
+		}
+		line += "," + action
+		for _, fanIdx := range offsetFans {
+			line += ","
+			if manual {
+				line += strconv.Itoa(int(applied.fanSpeed(fanIdx, config)))
+			}
+		}
+		fmt.Fprintln(out, line)
+	}
+}
+
+// runSimulateCommand implements `simulate` subcommand, which replays a temperature trace through the control pipeline
+// configured by daemon flags after --, and prints applied fan speeds without touching any GPU
+func runSimulateCommand(args []string) int {
+	options := simulateOptions{}
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	flags.StringVar(&options.trace, "trace", "", "Path to CSV trace of seconds since start, GPU temperature and optional memory temperature per line. Set to - to read from stdin")
+	flags.Int64Var(&options.seed, "seed", 1, "Seed of random number generator of sensor noise, so that the same seed gives the same output")
+	flags.UintVar(&options.noise, "noise", 0, "Maximum sensor noise in Celsius, which is added to every sample. Set to 0 to replay the trace as is")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s simulate -trace file [-seed N] [-noise C] [-- flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if options.trace == "" {
+		flags.Usage()
+		return EXIT_CONFIG_ERROR
+	}
+
+	return run(context.Background(), runOptions{args: flags.Args(), simulation: &options})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestControlConfig returns config of the curve without limits, as run would build it from default flags
+func newTestControlConfig(t *testing.T, speeds string) controlConfig {
+	t.Helper()
+	curve, err := parseSpeedConfigFlag(speeds)
+	if err != nil {
+		t.Fatalf("parseSpeedConfigFlag(%q): %v", speeds, err)
+	}
+	return controlConfig{
+		speedMap:           generateTempNFanSpeedMap(curve),
+		maxSpeed:           MAX_FAN_SPEED_PERCENT,
+		fallbackSpeedAbove: MAX_FAN_SPEED_PERCENT,
+	}
+}
+
+// simulatedSpeeds replays the trace and returns "speed action" of each sample, where speed is empty while fans are
+// not under manual control
+func simulatedSpeeds(t *testing.T, config controlConfig, trace string) []string {
+	t.Helper()
+	samples, err := readTrace(strings.NewReader(trace))
+	if err != nil {
+		t.Fatalf("readTrace: %v", err)
+	}
+	var out bytes.Buffer
+	simulateTrace(&out, config, samples, simulateOptions{})
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")[1:]
+	speeds := make([]string, 0, len(lines))
+	for _, line := range lines {
+		fields := strings.Split(line, ",")
+		speeds = append(speeds, fields[3]+" "+fields[4])
+	}
+	return speeds
+}
+
+func TestSimulateTrace(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(config *controlConfig)
+		trace  string
+		want   []string
+	}{
+		{
+			name:  "curve",
+			trace: "0,20\n1,40\n2,50\n3,60\n",
+			want:  []string{"0 set", "30 set", "50 set", "70 set"},
+		},
+		{
+			name: "min and max speed",
+			config: func(config *controlConfig) {
+				config.minSpeed, config.maxSpeed = 20, 60
+			},
+			trace: "0,20\n1,50\n2,60\n",
+			want:  []string{"20 set", "50 set", "60 set"},
+		},
+		{
+			name: "failsafe bypasses max speed",
+			config: func(config *controlConfig) {
+				config.maxSpeed, config.failsafeTemp = 60, 90
+			},
+			trace: "0,60\n1,90\n2,60\n",
+			want:  []string{"60 set", "100 failsafe", "60 set"},
+		},
+		{
+			name: "speed step rounds up",
+			config: func(config *controlConfig) {
+				config.speedStep = 15
+			},
+			trace: "0,50\n",
+			want:  []string{"60 set"},
+		},
+		{
+			name: "memory curve",
+			config: func(config *controlConfig) {
+				config.memorySpeedMap = generateTempNFanSpeedMap([][2]uint8{{80, 90}})
+			},
+			trace: "0,50,70\n1,50,80\n2,50\n",
+			want:  []string{"50 set", "90 set", "50 set"},
+		},
+		{
+			name: "source curve",
+			config: func(config *controlConfig) {
+				config.tempSource = &fileTemperatureSource{}
+				config.sourceSpeedMap = generateTempNFanSpeedMap([][2]uint8{{35, 80}})
+			},
+			trace: "0,50,,30\n1,50,,35\n2,50\n",
+			want:  []string{"50 set", "80 set", "50 set"},
+		},
+		{
+			name: "takeover temperature with hysteresis",
+			config: func(config *controlConfig) {
+				config.takeoverTemp = 50
+			},
+			trace: "0,40\n1,50\n2,48\n3,46\n4,50\n",
+			want:  []string{" stock", "50 set", "46 set", " stock", "50 set"},
+		},
+		{
+			name: "idle P-state",
+			config: func(config *controlConfig) {
+				config.idlePState = 8
+			},
+			trace: "0,50,,,8\n1,50,,,2\n2,50,,,12\n3,50\n",
+			want:  []string{" stock", "50 set", " stock", "50 set"},
+		},
+		{
+			name: "failsafe takes over from idle P-state",
+			config: func(config *controlConfig) {
+				config.idlePState, config.failsafeTemp = 8, 90
+			},
+			trace: "0,50,,,8\n1,90,,,8\n",
+			want:  []string{" stock", "100 failsafe"},
+		},
+		{
+			name: "write interval keeps the highest speed",
+			config: func(config *controlConfig) {
+				config.writeInterval = 10 * time.Second
+			},
+			trace: "0,40\n5,60\n6,50\n10,50\n",
+			want:  []string{"30 set", "30 hold", "30 hold", "70 set"},
+		},
+		{
+			name: "failsafe is not delayed by write interval",
+			config: func(config *controlConfig) {
+				config.writeInterval, config.failsafeTemp = 10*time.Second, 90
+			},
+			trace: "0,40\n1,90\n",
+			want:  []string{"30 set", "100 failsafe"},
+		},
+		{
+			name: "rapid rise boost",
+			config: func(config *controlConfig) {
+				config.riseRate, config.riseBoostDuration = 1, 5*time.Second
+			},
+			trace: "0,40\n1,40\n2,50\n3,52\n10,52\n",
+			want:  []string{"30 set", "30 set", "100 boost", "100 boost", "54 set"},
+		},
+		{
+			name: "target temperature",
+			config: func(config *controlConfig) {
+				config.targetTemp, config.minSpeed = 70, 30
+			},
+			trace: "0,60\n",
+			want:  []string{"30 set"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newTestControlConfig(t, "40:30,60:70")
+			if tt.config != nil {
+				tt.config(&config)
+			}
+			got := simulatedSpeeds(t, config, tt.trace)
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("speeds = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadTrace(t *testing.T) {
+	tests := []struct {
+		name    string
+		trace   string
+		want    []traceSample
+		wantErr bool
+	}{
+		{
+			name:  "header, comments and blank lines",
+			trace: "seconds,temperature\n# comment\n\n0,40\n2.5,41\n",
+			want:  []traceSample{{at: 0, temperature: 40}, {at: 2500 * time.Millisecond, temperature: 41}},
+		},
+		{
+			name:  "optional columns",
+			trace: "0,40,70\n1,41,,30\n2,42,,,8\n3,43,71,31,0\n",
+			want: []traceSample{
+				{at: 0, temperature: 40, memoryTemperature: 70, hasMemory: true},
+				{at: time.Second, temperature: 41, sourceTemperature: 30, hasSource: true},
+				{at: 2 * time.Second, temperature: 42, pstate: 8, hasPState: true},
+				{at: 3 * time.Second, temperature: 43, memoryTemperature: 71, hasMemory: true, sourceTemperature: 31, hasSource: true, pstate: 0, hasPState: true},
+			},
+		},
+		{name: "time goes back", trace: "1,40\n0,40\n", wantErr: true},
+		{name: "missing temperature", trace: "0\n", wantErr: true},
+		{name: "too many columns", trace: "0,40,70,30,8,1\n", wantErr: true},
+		{name: "invalid temperature", trace: "0,hot\n", wantErr: true},
+		{name: "invalid memory temperature", trace: "0,40,-1\n", wantErr: true},
+		{name: "invalid time after first line", trace: "0,40\nlater,41\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readTrace(strings.NewReader(tt.trace))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readTrace() = %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readTrace(): %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("readTrace() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("sample %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	// Control loops must return fans to driver default policy within this duration after logind announces sleep,
+	// which is shorter than default InhibitDelayMaxSec of logind
+	LOGIND_SLEEP_TIMEOUT = 4 * time.Second
+	// Match of PrepareForSleep signal, which logind sends with true before sleep and with false after resume
+	LOGIND_PREPARE_FOR_SLEEP_MATCH = "type='signal',sender='org.freedesktop.login1',interface='org.freedesktop.login1.Manager',member='PrepareForSleep'"
+)
+
+// sleepEvent tells control loop that the system is about to sleep, or has resumed
+type sleepEvent struct {
+	sleeping bool
+	// done is called by control loop once it has handled the event
+	done func()
+}
+
+// busctlMessage is a D-Bus message printed by busctl monitor --json=short
+type busctlMessage struct {
+	Type    string `json:"type"`
+	Member  string `json:"member"`
+	Payload struct {
+		Data []json.RawMessage `json:"data"`
+	} `json:"payload"`
+}
+
+// logindInhibitor is a delay inhibitor of sleep held by systemd-inhibit, so that logind waits until it is released
+// or for InhibitDelayMaxSec before the system sleeps
+type logindInhibitor struct {
+	cmd *exec.Cmd
+}
+
+func takeLogindInhibitor() (*logindInhibitor, error) {
+	cmd := exec.Command("systemd-inhibit", "--what=sleep", "--mode=delay", "--who=nvml-fan", "--why=Return fans to driver default policy before sleep", "sleep", "infinity")
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unable to take sleep inhibitor: %w", err)
+	}
+	return &logindInhibitor{cmd: cmd}, nil
+}
+
+func (i *logindInhibitor) release() {
+	i.cmd.Process.Kill()
+	i.cmd.Wait()
+}
+
+// runLogindSleepMonitor listens to PrepareForSleep signal of logind until ctx is done. Before sleep, control loops
+// of the devices return fans to driver default policy, and the inhibitor is released to let the system sleep.
+// After resume, the inhibitor is taken again, and control loops re-initialize NVML and reassert fan speed.
+func runLogindSleepMonitor(ctx context.Context, devices []*controlledDevice) error {
+	cmd := exec.CommandContext(ctx, "busctl", "monitor", "--system", "--json=short", "--match", LOGIND_PREPARE_FOR_SLEEP_MATCH)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("unable to create stdout pipe of busctl: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("unable to monitor logind by busctl: %w", err)
+	}
+	defer cmd.Wait()
+
+	inhibitor, err := takeLogindInhibitor()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if inhibitor != nil {
+			inhibitor.release()
+		}
+	}()
+
+	logger := moduleLogger(LOG_MODULE_CONTROLLER)
+	logger.Info("Listen to sleep of logind, fans are returned to driver default policy before sleep")
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		var msg busctlMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil || msg.Type != "signal" || msg.Member != "PrepareForSleep" || len(msg.Payload.Data) == 0 {
+			continue
+		}
+		var sleeping bool
+		if err := json.Unmarshal(msg.Payload.Data[0], &sleeping); err != nil {
+			continue
+		}
+		if sleeping {
+			logger.Info("System is about to sleep, return fans to driver default policy")
+		} else {
+			logger.Info("System has resumed, reassert fan control")
+		}
+		if !notifySleep(devices, sleeping, LOGIND_SLEEP_TIMEOUT) {
+			logger.Warn("Not all control loops handled sleep in time", "sleeping", sleeping, "timeout", LOGIND_SLEEP_TIMEOUT)
+		}
+		if sleeping && inhibitor != nil {
+			inhibitor.release()
+			inhibitor = nil
+		}
+		if !sleeping && inhibitor == nil {
+			if inhibitor, err = takeLogindInhibitor(); err != nil {
+				logger.Warn("Unable to take sleep inhibitor again, fans may not be returned to driver default policy before next sleep", "err", err)
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return fmt.Errorf("busctl monitor has exited")
+}
+
+// notifySleep sends sleep event to control loops of the devices, and waits until all of them have handled it or timeout
+func notifySleep(devices []*controlledDevice, sleeping bool, timeout time.Duration) bool {
+	var wg sync.WaitGroup
+	for _, d := range devices {
+		// Event which has not been received e.g. while the control loop restarts is superseded
+		select {
+		case <-d.prepareSleep:
+		default:
+		}
+		wg.Add(1)
+		d.prepareSleep <- sleepEvent{sleeping: sleeping, done: sync.OnceFunc(wg.Done)}
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
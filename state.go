@@ -0,0 +1,359 @@
+package main
+
+import (
+	"log/slog"
+	"maps"
+	"sort"
+	"sync"
+	"time"
+)
+
+// controllerState holds runtime state of the control loop, which can be inspected from other goroutines
+type controllerState struct {
+	mu sync.Mutex
+
+	curve [][2]uint8
+	// Fan speed map of the curve changed at runtime e.g. by curve editor, nil means the configured map is used
+	liveSpeedMap map[uint8]uint8
+	// Polling interval changed at runtime, 0 means the configured interval is used
+	livePollingDuration time.Duration
+	memoryCurve         [][2]uint8
+	startedAt           time.Time
+	lastTemperature     uint32
+	// Temperature after offset is applied, which is used for the curve lookup
+	lastEffectiveTemperature uint32
+	lastMemoryTemperature    uint32
+	// Temperature read from external source, 0 if disabled
+	lastSourceTemperature uint32
+	lastPolledAt          time.Time
+	fanSpeeds             map[int]uint8
+	lastAppliedAt         time.Time
+	paused                bool
+	failsafe              bool
+	// Fans are left to stock fan curve, as temperature is below takeover temperature
+	stock bool
+	// Device does not support fan control, so that its sensors are only monitored
+	observeOnly   bool
+	overrideSpeed uint8
+	overrideUntil time.Time
+	// Fans forced by override, nil means all controlled fans
+	overrideFans []int
+
+	// Duration of the last update of control loop, from reading temperature to applying fan speed
+	loopLatency time.Duration
+
+	temperatureErrors  uint64
+	missingSpeedBucket uint64
+	setSpeedErrors     uint64
+
+	// Sample of each update is delivered to subscribers e.g. event stream clients
+	telemetry       *telemetryBroadcaster
+	lastPublishedAt time.Time
+}
+
+func newControllerState(curve, memoryCurve [][2]uint8) *controllerState {
+	return &controllerState{
+		curve:       curve,
+		memoryCurve: memoryCurve,
+		startedAt:   time.Now(),
+		fanSpeeds:   make(map[int]uint8),
+		telemetry:   newTelemetryBroadcaster(),
+	}
+}
+
+func (s *controllerState) setTemperature(temperature, effectiveTemperature uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastTemperature = temperature
+	s.lastEffectiveTemperature = effectiveTemperature
+	s.lastPolledAt = time.Now()
+}
+
+func (s *controllerState) setMemoryTemperature(temperature uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastMemoryTemperature = temperature
+}
+
+func (s *controllerState) setSourceTemperature(temperature uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSourceTemperature = temperature
+}
+
+func (s *controllerState) setFanSpeed(fanIdx int, speed uint8) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fanSpeeds[fanIdx] = speed
+	s.lastAppliedAt = time.Now()
+}
+
+func (s *controllerState) setPaused(paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = paused
+}
+
+func (s *controllerState) setStock(stock bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stock = stock
+}
+
+func (s *controllerState) setObserveOnly(observeOnly bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observeOnly = observeOnly
+}
+
+func (s *controllerState) setFailsafe(failsafe bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failsafe = failsafe
+}
+
+func (s *controllerState) setOverride(speed uint8, until time.Time, fans []int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overrideSpeed = speed
+	s.overrideUntil = until
+	s.overrideFans = fans
+}
+
+func (s *controllerState) clearOverride() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overrideUntil = time.Time{}
+}
+
+// activeOverride returns forced fan speed and the fans it applies to, if override is set and not expired yet.
+// Nil fans means all controlled fans. Expired override is cleared, and reported as the last return value.
+func (s *controllerState) activeOverride(now time.Time) (speed uint8, fans []int, ok bool, expired bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.overrideUntil.IsZero() {
+		return 0, nil, false, false
+	}
+	if !now.Before(s.overrideUntil) {
+		s.overrideUntil = time.Time{}
+		return 0, nil, false, true
+	}
+	return s.overrideSpeed, s.overrideFans, true, false
+}
+
+func (s *controllerState) incTemperatureErrors() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.temperatureErrors++
+}
+
+func (s *controllerState) incMissingSpeedBucket() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.missingSpeedBucket++
+}
+
+func (s *controllerState) incSetSpeedErrors() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setSpeedErrors++
+}
+
+func (s *controllerState) curveString() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return formatSpeedConfig(s.curve)
+}
+
+// setCurve replaces the curve at runtime, which is used by control loop from next update
+func (s *controllerState) setCurve(curve [][2]uint8, speedMap map[uint8]uint8) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.curve = curve
+	s.liveSpeedMap = speedMap
+}
+
+func (s *controllerState) curveConfig() [][2]uint8 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.curve
+}
+
+// speedMap returns fan speed map of the curve changed at runtime, or nil if the curve has not been changed
+func (s *controllerState) speedMap() map[uint8]uint8 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.liveSpeedMap
+}
+
+// setPollingDuration replaces the polling interval at runtime, which is used by control loop from next update
+func (s *controllerState) setPollingDuration(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.livePollingDuration = interval
+}
+
+// pollingDuration returns polling interval changed at runtime, or 0 if it has not been changed
+func (s *controllerState) pollingDuration() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.livePollingDuration
+}
+
+func (s *controllerState) setLoopLatency(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loopLatency = latency
+}
+
+// publishSample delivers current telemetry to subscribers, unless temperature has not been polled since the last one
+func (s *controllerState) publishSample() {
+	m := s.metrics()
+	s.mu.Lock()
+	if !m.polledAt.After(s.lastPublishedAt) {
+		s.mu.Unlock()
+		return
+	}
+	s.lastPublishedAt = m.polledAt
+	s.mu.Unlock()
+	s.telemetry.publish(historySample{
+		Time:              m.polledAt,
+		Temperature:       m.temperature,
+		MemoryTemperature: m.memoryTemperature,
+		FanSpeeds:         m.fanSpeeds,
+	})
+}
+
+// stateMetrics is a snapshot of state, which is exported as metrics
+type stateMetrics struct {
+	polledAt          time.Time
+	temperature       uint32
+	memoryTemperature uint32
+	fanSpeeds         map[int]uint8
+	loopLatency       time.Duration
+}
+
+func (s *controllerState) metrics() stateMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fanSpeeds := make(map[int]uint8, len(s.fanSpeeds))
+	for fanIdx, speed := range s.fanSpeeds {
+		fanSpeeds[fanIdx] = speed
+	}
+	return stateMetrics{
+		polledAt:          s.lastPolledAt,
+		temperature:       s.lastTemperature,
+		memoryTemperature: s.lastMemoryTemperature,
+		fanSpeeds:         fanSpeeds,
+		loopLatency:       s.loopLatency,
+	}
+}
+
+// Modes of control loop reported by status
+const (
+	CONTROL_MODE_CURVE    = "curve"
+	CONTROL_MODE_OVERRIDE = "override"
+	CONTROL_MODE_FAILSAFE = "failsafe"
+	CONTROL_MODE_PAUSED   = "paused"
+	CONTROL_MODE_STOCK    = "stock"
+	CONTROL_MODE_OBSERVE  = "observe"
+)
+
+// status returns a snapshot of state for status query, without actual fan speeds which are read from the device.
+// Mode is the one which decides fan speed, e.g. failsafe takes precedence over override.
+func (s *controllerState) status(now time.Time) deviceStatusResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mode := CONTROL_MODE_CURVE
+	switch {
+	case s.observeOnly:
+		mode = CONTROL_MODE_OBSERVE
+	case s.paused:
+		mode = CONTROL_MODE_PAUSED
+	case s.failsafe:
+		mode = CONTROL_MODE_FAILSAFE
+	case !s.overrideUntil.IsZero() && now.Before(s.overrideUntil):
+		mode = CONTROL_MODE_OVERRIDE
+	case s.stock:
+		mode = CONTROL_MODE_STOCK
+	}
+	resp := deviceStatusResponse{
+		StartedAt:         s.startedAt,
+		LastPolledAt:      s.lastPolledAt,
+		Temperature:       s.lastTemperature,
+		MemoryTemperature: s.lastMemoryTemperature,
+		Mode:              mode,
+		Curve:             formatSpeedConfig(s.curve),
+	}
+	if mode == CONTROL_MODE_OVERRIDE {
+		until := s.overrideUntil
+		resp.OverrideUntil = &until
+		resp.OverrideFans = s.overrideFans
+	}
+	for fanIdx, speed := range s.fanSpeeds {
+		resp.Fans = append(resp.Fans, fanStatusResponse{Index: fanIdx, Target: speed})
+	}
+	sort.Slice(resp.Fans, func(i, j int) bool { return resp.Fans[i].Index < resp.Fans[j].Index })
+	return resp
+}
+
+func (s *controllerState) health(now time.Time, maxAge time.Duration) healthResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lastSuccessAt := s.lastAppliedAt
+	if s.paused || s.stock || s.observeOnly {
+		lastSuccessAt = s.lastPolledAt
+	}
+	return healthResponse{
+		Healthy:       !lastSuccessAt.IsZero() && now.Sub(lastSuccessAt) <= maxAge,
+		LastPolledAt:  s.lastPolledAt,
+		LastAppliedAt: s.lastAppliedAt,
+		Paused:        s.paused,
+	}
+}
+
+// dump logs current state, together with fan control policy queried from the device.
+// State is copied under the lock, which is released before querying the device, so that a slow or hung driver call
+// does not block control loops updating the state.
+func (s *controllerState) dump(logger *slog.Logger, device gpuDevice) {
+	s.mu.Lock()
+	attrs := []any{
+		"curve", formatSpeedConfig(s.curve),
+		"memoryCurve", formatSpeedConfig(s.memoryCurve),
+		"uptime", time.Since(s.startedAt).Round(time.Second),
+		"lastTemperature", s.lastTemperature,
+		"lastEffectiveTemperature", s.lastEffectiveTemperature,
+		"lastMemoryTemperature", s.lastMemoryTemperature,
+		"lastSourceTemperature", s.lastSourceTemperature,
+		"lastPolledAt", s.lastPolledAt,
+		"fanSpeeds", maps.Clone(s.fanSpeeds),
+		"lastAppliedAt", s.lastAppliedAt,
+		"paused", s.paused,
+		"failsafe", s.failsafe,
+		"stock", s.stock,
+		"observeOnly", s.observeOnly,
+		"overrideSpeed", s.overrideSpeed,
+		"overrideUntil", s.overrideUntil,
+		"temperatureErrors", s.temperatureErrors,
+		"missingSpeedBucket", s.missingSpeedBucket,
+		"setSpeedErrors", s.setSpeedErrors,
+	}
+	s.mu.Unlock()
+	logger.Info("State dump", attrs...)
+
+	numFans, err := device.NumFans()
+	if err != nil {
+		logger.Error("Unable to get number of fans from device", "err", err)
+		return
+	}
+	for i := 0; i < numFans; i++ {
+		policy, err := device.FanControlPolicy(i)
+		if err != nil {
+			logger.Error("Unable to get fan control policy", LABEL_FAN_INDEX, i, "err", err)
+			continue
+		}
+		logger.Info("State dump fan control policy", LABEL_FAN_INDEX, i, "policy", policy)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// thermalStats accumulates samples of a device between two summaries
+type thermalStats struct {
+	samples        int
+	minTemperature uint32
+	maxTemperature uint32
+	temperatureSum uint64
+	// Sum of average fan speed of each sample, and number of samples with fan speeds
+	fanSpeedSum     float64
+	fanSpeedSamples int
+	// Time spent at or above alert temperature, counted from each sample to the next one
+	aboveAlertTemp time.Duration
+	lastSampleAt   time.Time
+	lastAbove      bool
+}
+
+func (s *thermalStats) add(sample historySample, alertTemp uint8) {
+	if s.lastAbove && !s.lastSampleAt.IsZero() {
+		s.aboveAlertTemp += sample.Time.Sub(s.lastSampleAt)
+	}
+	s.lastSampleAt = sample.Time
+	s.lastAbove = alertTemp > 0 && sample.Temperature >= uint32(alertTemp)
+
+	if s.samples == 0 || sample.Temperature < s.minTemperature {
+		s.minTemperature = sample.Temperature
+	}
+	s.maxTemperature = max(s.maxTemperature, sample.Temperature)
+	s.temperatureSum += uint64(sample.Temperature)
+	s.samples++
+	if len(sample.FanSpeeds) > 0 {
+		sum := 0
+		for _, speed := range sample.FanSpeeds {
+			sum += int(speed)
+		}
+		s.fanSpeedSum += float64(sum) / float64(len(sample.FanSpeeds))
+		s.fanSpeedSamples++
+	}
+}
+
+// reset clears the stats for the next summary, while time above alert temperature keeps counting from the last sample
+func (s *thermalStats) reset() {
+	*s = thermalStats{lastSampleAt: s.lastSampleAt, lastAbove: s.lastAbove}
+}
+
+func (s *thermalStats) log(logger *slog.Logger, interval time.Duration, alertTemp uint8) {
+	if s.samples == 0 {
+		logger.Info("Thermal summary, no temperature has been polled", "interval", interval)
+		return
+	}
+	args := []any{
+		"interval", interval,
+		"samples", s.samples,
+		"minTemperature", s.minTemperature,
+		"avgTemperature", math.Round(float64(s.temperatureSum)/float64(s.samples)*10) / 10,
+		"maxTemperature", s.maxTemperature,
+	}
+	if s.fanSpeedSamples > 0 {
+		args = append(args, "avgFanSpeed", math.Round(s.fanSpeedSum/float64(s.fanSpeedSamples)*10)/10)
+	}
+	if alertTemp > 0 {
+		args = append(args, "alertTemp", alertTemp, "aboveAlertTemp", s.aboveAlertTemp.Round(time.Second))
+	}
+	logger.Info("Thermal summary", args...)
+}
+
+// runStatsSummary logs summary of temperature and fan speed of the device every interval until ctx is done
+func runStatsSummary(ctx context.Context, interval time.Duration, d *controlledDevice) {
+	samples, unsubscribe := d.state.telemetry.subscribe()
+	defer unsubscribe()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var stats thermalStats
+	for {
+		select {
+		case sample := <-samples:
+			stats.add(sample, d.config.alertTemp)
+		case <-ticker.C:
+			stats.log(d.logger, interval, d.config.alertTemp)
+			stats.reset()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of samples buffered for each subscriber, further samples are dropped for a slow subscriber
+	TELEMETRY_SUBSCRIBER_BUFFER = 16
+	// Comment is sent to event stream at this interval, so that idle connections are not closed by proxies
+	EVENT_STREAM_KEEPALIVE = 15 * time.Second
+)
+
+// telemetryBroadcaster delivers sample of each update of control loop to subscribers e.g. event stream clients
+type telemetryBroadcaster struct {
+	mu          sync.Mutex
+	subscribers map[chan historySample]struct{}
+}
+
+func newTelemetryBroadcaster() *telemetryBroadcaster {
+	return &telemetryBroadcaster{subscribers: make(map[chan historySample]struct{})}
+}
+
+// subscribe returns channel of samples, and function which stops delivery to the channel
+func (b *telemetryBroadcaster) subscribe() (<-chan historySample, func()) {
+	ch := make(chan historySample, TELEMETRY_SUBSCRIBER_BUFFER)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subscribers, ch)
+		b.mu.Unlock()
+	}
+}
+
+// publish sends the sample to subscribers without blocking, so that a slow subscriber never delays control loop
+func (b *telemetryBroadcaster) publish(sample historySample) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- sample:
+		default:
+		}
+	}
+}
+
+// telemetryEvent is a sample of a device, which is sent to event stream
+type telemetryEvent struct {
+	GPUIndex int    `json:"gpu_index"`
+	GPUUUID  string `json:"gpu_uuid"`
+	historySample
+}
+
+// subscribeTelemetry merges samples of all devices into one channel, until returned function is called
+func subscribeTelemetry(devices []*controlledDevice) (<-chan telemetryEvent, func()) {
+	events := make(chan telemetryEvent, TELEMETRY_SUBSCRIBER_BUFFER)
+	done := make(chan struct{})
+	var unsubscribes []func()
+	for _, d := range devices {
+		samples, unsubscribe := d.state.telemetry.subscribe()
+		unsubscribes = append(unsubscribes, unsubscribe)
+		go func(d *controlledDevice) {
+			for {
+				select {
+				case sample := <-samples:
+					select {
+					case events <- telemetryEvent{GPUIndex: d.labels.index, GPUUUID: d.labels.uuid, historySample: sample}:
+					default:
+					}
+				case <-done:
+					return
+				}
+			}
+		}(d)
+	}
+	return events, func() {
+		for _, unsubscribe := range unsubscribes {
+			unsubscribe()
+		}
+		close(done)
+	}
+}
+
+// handleEvents streams a sample of each device at every update of its control loop as server-sent events,
+// so that clients can follow live telemetry without polling
+func (c *controlServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	events, unsubscribe := subscribeTelemetry(c.devices)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(EVENT_STREAM_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				moduleLogger(LOG_MODULE_API).Error("unable to encode telemetry event", "err", err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: sample\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// Fan speed in percent per Celsius above target temperature
+	TARGET_TEMP_GAIN_P = 3.0
+	// Fan speed in percent per second per Celsius above target temperature, which removes steady error over time
+	TARGET_TEMP_GAIN_I = 0.05
+	// Maximum fan speed change in percent per polling, so that fans ramp instead of jumping
+	TARGET_TEMP_MAX_STEP = 10
+	// Longer intervals between updates e.g. across suspend are counted as this, so that error is not accumulated for hours
+	TARGET_TEMP_MAX_INTERVAL = 30 * time.Second
+)
+
+// targetTempController adjusts fan speed continuously to hold temperature at target, by proportional-integral
+// feedback instead of mapping temperature to fixed speeds. Fan speed stays within min and max speed, and the integral
+// term is clamped to the same range, so that it does not wind up while fans are already at min or max speed.
+type targetTempController struct {
+	target   uint8
+	minSpeed float64
+	maxSpeed float64
+	integral float64
+	speed    float64
+	lastAt   time.Time
+}
+
+// newTargetTempController returns controller, which starts from initial speed, so that fans do not jump when it takes over
+func newTargetTempController(target, minSpeed, maxSpeed, initialSpeed uint8) *targetTempController {
+	initial := max(min(float64(initialSpeed), float64(maxSpeed)), float64(minSpeed))
+	return &targetTempController{
+		target:   target,
+		minSpeed: float64(minSpeed),
+		maxSpeed: float64(maxSpeed),
+		integral: initial,
+		speed:    initial,
+	}
+}
+
+// next returns fan speed to be applied at the temperature
+func (c *targetTempController) next(now time.Time, temperature uint32) uint8 {
+	diff := float64(temperature) - float64(c.target)
+	if !c.lastAt.IsZero() {
+		elapsed := min(now.Sub(c.lastAt), TARGET_TEMP_MAX_INTERVAL).Seconds()
+		c.integral = max(min(c.integral+TARGET_TEMP_GAIN_I*diff*max(elapsed, 0), c.maxSpeed), c.minSpeed)
+	}
+	c.lastAt = now
+	speed := max(min(TARGET_TEMP_GAIN_P*diff+c.integral, c.maxSpeed), c.minSpeed)
+	c.speed = max(min(speed, c.speed+TARGET_TEMP_MAX_STEP), c.speed-TARGET_TEMP_MAX_STEP)
+	return uint8(math.Round(c.speed))
+}
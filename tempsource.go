@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// External temperature source must respond within this duration, so that it never stalls the control loop
+const TEMP_SOURCE_TIMEOUT = 5 * time.Second
+
+// temperatureSource reads temperature from a sensor outside GPU, e.g. ambient probe or coolant sensor of water loop
+type temperatureSource interface {
+	// Temperature returns temperature in Celsius
+	Temperature() (uint32, error)
+}
+
+// newTemperatureSource creates temperature source by spec, which is one of
+//
+//	exec:<shell command>  runs the command, which prints temperature to stdout
+//	file:<path>           reads temperature from the file, e.g. /sys/class/hwmon/hwmon2/temp1_input
+//	http(s)://<url>       gets temperature from response body of the URL
+//
+// Read value is multiplied by scale, e.g. 0.001 for hwmon files in millidegree.
+func newTemperatureSource(spec string, scale float64) (temperatureSource, error) {
+	if scale <= 0 {
+		return nil, fmt.Errorf("scale must be positive")
+	}
+	switch {
+	case strings.HasPrefix(spec, "exec:"):
+		return &execTemperatureSource{command: strings.TrimPrefix(spec, "exec:"), scale: scale}, nil
+	case strings.HasPrefix(spec, "file:"):
+		return &fileTemperatureSource{path: strings.TrimPrefix(spec, "file:"), scale: scale}, nil
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return &httpTemperatureSource{url: spec, scale: scale, client: &http.Client{Timeout: TEMP_SOURCE_TIMEOUT}}, nil
+	default:
+		return nil, fmt.Errorf("temperature source must start with exec:, file:, http:// or https://: %s", spec)
+	}
+}
+
+// parseSourceTemperature parses temperature printed by a source, which may be a decimal number
+func parseSourceTemperature(data []byte, scale float64) (uint32, error) {
+	value, err := strconv.ParseFloat(string(bytes.TrimSpace(data)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse temperature %q: %w", bytes.TrimSpace(data), err)
+	}
+	temperature := math.Round(value * scale)
+	if math.IsNaN(temperature) || temperature < 0 || temperature > float64(MAX_TEMP) {
+		return 0, fmt.Errorf("temperature %v is not plausible, it must be between %d and %d", temperature, MIN_TEMP, MAX_TEMP)
+	}
+	return uint32(temperature), nil
+}
+
+type execTemperatureSource struct {
+	command string
+	scale   float64
+}
+
+func (s *execTemperatureSource) Temperature() (uint32, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), TEMP_SOURCE_TIMEOUT)
+	defer cancel()
+	cmd := shellCommand(ctx, s.command)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("temperature source command failed; err: %w, stderr: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return parseSourceTemperature(output, s.scale)
+}
+
+type fileTemperatureSource struct {
+	path  string
+	scale float64
+}
+
+func (s *fileTemperatureSource) Temperature() (uint32, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read temperature source file: %w", err)
+	}
+	return parseSourceTemperature(data, s.scale)
+}
+
+type httpTemperatureSource struct {
+	url    string
+	scale  float64
+	client *http.Client
+}
+
+func (s *httpTemperatureSource) Temperature() (uint32, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get temperature from source URL: %w", err)
+	}
+	defer resp.Body.Close()
+	// Only a number is expected, so large body is truncated
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return 0, fmt.Errorf("unable to read temperature from source URL: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("temperature source URL responded with status %d", resp.StatusCode)
+	}
+	return parseSourceTemperature(body, s.scale)
+}
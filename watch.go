@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// ANSI escape sequences, by which watch mode redraws the table in place
+const (
+	ANSI_CURSOR_HOME  = "\033[H"
+	ANSI_CLEAR_SCREEN = "\033[2J"
+	ANSI_CLEAR_LINE   = "\033[K"
+	ANSI_CLEAR_BELOW  = "\033[J"
+	ANSI_HIDE_CURSOR  = "\033[?25l"
+	ANSI_SHOW_CURSOR  = "\033[?25h"
+)
+
+// Arrows, which tell whether temperature rose or fell at the last polling
+const (
+	WATCH_TREND_UP     = "↑"
+	WATCH_TREND_DOWN   = "↓"
+	WATCH_TREND_STABLE = "→"
+)
+
+// temperatureTrend remembers temperature of the previous polling of each GPU, so that the trend is kept between
+// polls, rather than turning stable whenever the table is refreshed faster than the daemon polls
+type temperatureTrend struct {
+	polledAt    map[string]time.Time
+	temperature map[string]uint32
+	trend       map[string]string
+}
+
+func newTemperatureTrend() *temperatureTrend {
+	return &temperatureTrend{
+		polledAt:    make(map[string]time.Time),
+		temperature: make(map[string]uint32),
+		trend:       make(map[string]string),
+	}
+}
+
+// observe returns trend arrow of the GPU, which is empty until the second polling is seen
+func (t *temperatureTrend) observe(d deviceStatusResponse) string {
+	if previousAt, ok := t.polledAt[d.GPUUUID]; ok && !d.LastPolledAt.After(previousAt) {
+		return t.trend[d.GPUUUID]
+	}
+	if previous, ok := t.temperature[d.GPUUUID]; ok {
+		switch {
+		case d.Temperature > previous:
+			t.trend[d.GPUUUID] = WATCH_TREND_UP
+		case d.Temperature < previous:
+			t.trend[d.GPUUUID] = WATCH_TREND_DOWN
+		default:
+			t.trend[d.GPUUUID] = WATCH_TREND_STABLE
+		}
+	}
+	t.polledAt[d.GPUUUID] = d.LastPolledAt
+	t.temperature[d.GPUUUID] = d.Temperature
+	return t.trend[d.GPUUUID]
+}
+
+// watchTableLines returns table with one compact line per GPU, which shows temperature and its trend, policy deciding
+// fan speed and target/actual speed of each fan
+func watchTableLines(resp statusResponse, trend *temperatureTrend, now time.Time) []string {
+	lines := []string{fmt.Sprintf("%-3s  %-24s  %-8s  %-16s  %s", "GPU", "NAME", "TEMP", "POLICY", "FANS target/actual")}
+	for _, d := range resp.Devices {
+		temperature := fmt.Sprintf("%d°C %s", d.Temperature, trend.observe(d))
+		policy := d.Mode
+		if d.OverrideUntil != nil {
+			policy = fmt.Sprintf("%s %s", d.Mode, d.OverrideUntil.Sub(now).Round(time.Second))
+		}
+		fans := make([]string, 0, len(d.Fans))
+		for _, fan := range d.Fans {
+			actual := "?"
+			if fan.Actual != nil {
+				actual = fmt.Sprintf("%d", *fan.Actual)
+			}
+			fans = append(fans, fmt.Sprintf("%d:%d/%s%%", fan.Index, fan.Target, actual))
+		}
+		name := d.GPUName
+		if len([]rune(name)) > 24 {
+			name = string([]rune(name)[:23]) + "…"
+		}
+		lines = append(lines, fmt.Sprintf("%-3d  %-24s  %-8s  %-16s  %s", d.GPUIndex, name, temperature, policy, strings.Join(fans, " ")))
+	}
+	return lines
+}
+
+// runStatusWatch redraws status of running daemon in place every interval until interrupted. If stdout is not a
+// terminal, tables are appended one after another instead, so that the output can be piped or logged.
+func runStatusWatch(client *controlClient, interval time.Duration) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	terminal := false
+	if info, err := os.Stdout.Stat(); err == nil {
+		terminal = info.Mode()&os.ModeCharDevice != 0
+	}
+	if terminal {
+		fmt.Print(ANSI_HIDE_CURSOR + ANSI_CLEAR_SCREEN)
+		defer fmt.Print(ANSI_SHOW_CURSOR)
+	}
+
+	trend := newTemperatureTrend()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for first := true; ; first = false {
+		now := time.Now()
+		header := fmt.Sprintf("nvml-fan status every %s, %s. Press Ctrl+C to exit", interval, now.Format(time.DateTime))
+		var lines []string
+		var resp statusResponse
+		if err := client.do(http.MethodGet, "/status", nil, &resp); err != nil {
+			if first {
+				slog.Error("unable to get status, make sure the daemon is running", "err", err)
+				return EXIT_RUNTIME_FAILURE
+			}
+			// Daemon may be restarting, so that watching continues until it is back
+			lines = []string{fmt.Sprintf("Unable to get status: %s", err)}
+		} else {
+			lines = watchTableLines(resp, trend, now)
+		}
+
+		var out strings.Builder
+		if terminal {
+			out.WriteString(ANSI_CURSOR_HOME)
+		} else if !first {
+			out.WriteString("\n")
+		}
+		for _, line := range append([]string{header, ""}, lines...) {
+			out.WriteString(line)
+			if terminal {
+				out.WriteString(ANSI_CLEAR_LINE)
+			}
+			out.WriteString("\n")
+		}
+		if terminal {
+			out.WriteString(ANSI_CLEAR_BELOW)
+		}
+		fmt.Print(out.String())
+
+		select {
+		case <-ctx.Done():
+			return EXIT_OK
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_WEAR_FILE = "/var/lib/nvml-fan/wear.json"
+	// Fan speeds are sampled at this interval, and the elapsed time is credited to the sampled speed
+	WEAR_SAMPLE_INTERVAL = 10 * time.Second
+	// Wear is written to file at this interval and on exit, so that little is lost on crash without wearing the disk
+	WEAR_SAVE_INTERVAL = 10 * time.Minute
+)
+
+// Fan speeds in percent, above which runtime of each fan is counted separately
+var WEAR_DUTY_THRESHOLDS = []uint8{50, 80}
+
+// fanWear is cumulative usage of a fan over all runs of the program
+type fanWear struct {
+	// Hours during which the fan has been monitored
+	Hours float64 `json:"hours"`
+	// Hours weighted by fan speed, i.e. equivalent hours at full speed
+	DutyHours float64 `json:"dutyHours"`
+	// Hours spent above each of WEAR_DUTY_THRESHOLDS
+	HoursAbove map[uint8]float64 `json:"hoursAbove"`
+}
+
+// deviceWear is wear of fans of a device, keyed by fan index
+type deviceWear struct {
+	Name string           `json:"name"`
+	Fans map[int]*fanWear `json:"fans"`
+}
+
+// wearRecord is content of wear file, where devices are keyed by UUID, as wear belongs to the card rather than its slot
+type wearRecord struct {
+	Devices   map[string]*deviceWear `json:"devices"`
+	UpdatedAt time.Time              `json:"updatedAt"`
+}
+
+// wearTracker accumulates fan wear of all devices, and persists it to wear file
+type wearTracker struct {
+	mu     sync.Mutex
+	path   string
+	record wearRecord
+}
+
+// loadWearTracker reads wear accumulated by previous runs. Missing file starts from zero.
+func loadWearTracker(path string) (*wearTracker, error) {
+	t := &wearTracker{path: path, record: wearRecord{Devices: make(map[string]*deviceWear)}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read wear file: %w", err)
+	}
+	if err := json.Unmarshal(data, &t.record); err != nil {
+		return nil, fmt.Errorf("unable to decode wear file: %w", err)
+	}
+	if t.record.Devices == nil {
+		t.record.Devices = make(map[string]*deviceWear)
+	}
+	return t, nil
+}
+
+// add credits elapsed time at the fan speed to the fan
+func (t *wearTracker) add(uuid, name string, fanIdx int, speed uint32, elapsed time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	device, ok := t.record.Devices[uuid]
+	if !ok {
+		device = &deviceWear{Fans: make(map[int]*fanWear)}
+		t.record.Devices[uuid] = device
+	}
+	device.Name = name
+	fan, ok := device.Fans[fanIdx]
+	if !ok {
+		fan = &fanWear{}
+		device.Fans[fanIdx] = fan
+	}
+	if fan.HoursAbove == nil {
+		fan.HoursAbove = make(map[uint8]float64)
+	}
+	hours := elapsed.Hours()
+	fan.Hours += hours
+	fan.DutyHours += hours * float64(min(speed, uint32(MAX_FAN_SPEED_PERCENT))) / float64(MAX_FAN_SPEED_PERCENT)
+	for _, threshold := range WEAR_DUTY_THRESHOLDS {
+		if speed > uint32(threshold) {
+			fan.HoursAbove[threshold] += hours
+		}
+	}
+}
+
+// fan returns a copy of wear of the fan, or false if it has never been recorded
+func (t *wearTracker) fan(uuid string, fanIdx int) (fanWear, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	device, ok := t.record.Devices[uuid]
+	if !ok {
+		return fanWear{}, false
+	}
+	fan, ok := device.Fans[fanIdx]
+	if !ok {
+		return fanWear{}, false
+	}
+	wear := *fan
+	wear.HoursAbove = make(map[uint8]float64, len(fan.HoursAbove))
+	for threshold, hours := range fan.HoursAbove {
+		wear.HoursAbove[threshold] = hours
+	}
+	return wear, true
+}
+
+// save writes wear to a temporary file, then renames it, so that the wear file is never half-written
+func (t *wearTracker) save() error {
+	t.mu.Lock()
+	t.record.UpdatedAt = time.Now()
+	data, err := json.MarshalIndent(t.record, "", "  ")
+	t.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("unable to encode wear: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0755); err != nil {
+		return fmt.Errorf("unable to create wear directory: %w", err)
+	}
+	tmpPath := t.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("unable to write wear file: %w", err)
+	}
+	if err := os.Rename(tmpPath, t.path); err != nil {
+		return fmt.Errorf("unable to replace wear file: %w", err)
+	}
+	return nil
+}
+
+// runWearTracker samples speed of all fans of the devices, including ones left to the driver, until ctx is done.
+// Wear is saved periodically and once more before returning. If aligned, sampling is aligned to polling of the devices.
+func runWearTracker(ctx context.Context, tracker *wearTracker, aligned bool, devices []*controlledDevice) {
+	logger := moduleLogger(LOG_MODULE_CONTROLLER)
+	sampleTicker := newPollTicker(WEAR_SAMPLE_INTERVAL, aligned)
+	defer sampleTicker.Stop()
+	saveTicker := time.NewTicker(WEAR_SAVE_INTERVAL)
+	defer saveTicker.Stop()
+	defer func() {
+		if err := tracker.save(); err != nil {
+			logger.Warn("Unable to save fan wear", "path", tracker.path, "err", err)
+		}
+	}()
+	lastSampledAt := time.Now()
+	for {
+		select {
+		case now := <-sampleTicker.C:
+			// Time while the machine was suspended is not counted
+			elapsed := min(now.Sub(lastSampledAt), 2*WEAR_SAMPLE_INTERVAL)
+			lastSampledAt = now
+			for _, d := range devices {
+				if d.labels.uuid == "" {
+					continue
+				}
+				device := d.handle.get()
+				numFans, err := device.NumFans()
+				if err != nil {
+					continue
+				}
+				for i := 0; i < numFans; i++ {
+					if speed, err := device.FanSpeed(i); err == nil {
+						tracker.add(d.labels.uuid, d.labels.name, i, speed, elapsed)
+					}
+				}
+			}
+		case <-saveTicker.C:
+			if err := tracker.save(); err != nil {
+				logger.Warn("Unable to save fan wear", "path", tracker.path, "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// GUID appended to client key to compute Sec-WebSocket-Accept, defined by RFC 6455
+	WEBSOCKET_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// Control messages are small JSON objects, larger messages are rejected
+	WEBSOCKET_MAX_MESSAGE_SIZE = 64 * 1024
+	// Frame must be written within this duration, otherwise the client is considered dead
+	WEBSOCKET_WRITE_TIMEOUT = 10 * time.Second
+
+	WEBSOCKET_OP_CONTINUATION = 0x0
+	WEBSOCKET_OP_TEXT         = 0x1
+	WEBSOCKET_OP_BINARY       = 0x2
+	WEBSOCKET_OP_CLOSE        = 0x8
+	WEBSOCKET_OP_PING         = 0x9
+	WEBSOCKET_OP_PONG         = 0xA
+)
+
+// Types of WebSocket messages
+const (
+	// Sent by daemon
+	WS_MESSAGE_SAMPLE = "sample"
+	WS_MESSAGE_RESULT = "result"
+	// Sent by client
+	WS_MESSAGE_OVERRIDE        = "override"
+	WS_MESSAGE_CANCEL_OVERRIDE = "cancel-override"
+	WS_MESSAGE_BOOST           = "boost"
+	WS_MESSAGE_CURVE           = "curve"
+	WS_MESSAGE_STATUS          = "status"
+)
+
+// wsConn is a server side WebSocket connection, which implements just enough of RFC 6455 for telemetry and
+// control messages, so that no dependency is needed
+type wsConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// Telemetry and responses are written from different goroutines
+	mu sync.Mutex
+}
+
+// upgradeWebSocket completes WebSocket handshake of the request, and takes over its connection.
+// If the request is not a valid handshake, error response is written and nil is returned.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) *wsConn {
+	if !headerContainsToken(r.Header, "Connection", "upgrade") || !headerContainsToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "request is not a WebSocket upgrade", http.StatusBadRequest)
+		return nil
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, fmt.Sprintf("unsupported WebSocket version %q", r.Header.Get("Sec-WebSocket-Version")), http.StatusBadRequest)
+		return nil
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be taken over", http.StatusInternalServerError)
+		return nil
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		moduleLogger(LOG_MODULE_API).Error("Unable to take over WebSocket connection", "err", err)
+		return nil
+	}
+
+	hash := sha1.Sum([]byte(key + WEBSOCKET_GUID))
+	accept := base64.StdEncoding.EncodeToString(hash[:])
+	conn.SetWriteDeadline(time.Now().Add(WEBSOCKET_WRITE_TIMEOUT))
+	if _, err := fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", accept); err != nil {
+		conn.Close()
+		return nil
+	}
+	return &wsConn{conn: conn, reader: rw.Reader}
+}
+
+// headerContainsToken reports whether comma-separated header contains the token case-insensitively
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	header := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(WEBSOCKET_WRITE_TIMEOUT))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return fmt.Errorf("unable to write WebSocket frame: %w", err)
+	}
+	return nil
+}
+
+func (c *wsConn) writeJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("unable to encode WebSocket message: %w", err)
+	}
+	return c.writeFrame(WEBSOCKET_OP_TEXT, data)
+}
+
+// readMessage returns payload of the next text or binary message, while answering ping and close frames.
+// io.EOF is returned when the client closes the connection.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+			return nil, err
+		}
+		fin, opcode := header[0]&0x80 != 0, header[0]&0x0F
+		masked, length := header[1]&0x80 != 0, uint64(header[1]&0x7F)
+		switch length {
+		case 126:
+			var extended [2]byte
+			if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+				return nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(extended[:]))
+		case 127:
+			var extended [8]byte
+			if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+				return nil, err
+			}
+			length = binary.BigEndian.Uint64(extended[:])
+		}
+		// Client must mask frames, as required by RFC 6455
+		if !masked {
+			return nil, fmt.Errorf("WebSocket frame from client is not masked")
+		}
+		if length > WEBSOCKET_MAX_MESSAGE_SIZE || uint64(len(message))+length > WEBSOCKET_MAX_MESSAGE_SIZE {
+			return nil, fmt.Errorf("WebSocket message is larger than %d bytes", WEBSOCKET_MAX_MESSAGE_SIZE)
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case WEBSOCKET_OP_PING:
+			if err := c.writeFrame(WEBSOCKET_OP_PONG, payload); err != nil {
+				return nil, err
+			}
+		case WEBSOCKET_OP_PONG:
+		case WEBSOCKET_OP_CLOSE:
+			// Echo status code of the client, then the connection is closed by caller
+			c.writeFrame(WEBSOCKET_OP_CLOSE, payload[:min(len(payload), 2)])
+			return nil, io.EOF
+		case WEBSOCKET_OP_TEXT, WEBSOCKET_OP_BINARY, WEBSOCKET_OP_CONTINUATION:
+			if (opcode == WEBSOCKET_OP_CONTINUATION) != (message != nil) {
+				return nil, fmt.Errorf("unexpected WebSocket frame with opcode %d", opcode)
+			}
+			message = append(message, payload...)
+			if message == nil {
+				message = []byte{}
+			}
+			if fin {
+				return message, nil
+			}
+		default:
+			return nil, fmt.Errorf("unknown WebSocket opcode %d", opcode)
+		}
+	}
+}
+
+func (c *wsConn) close() error {
+	return c.conn.Close()
+}
+
+// wsMessage is a message from client, whose fields are used depending on type
+type wsMessage struct {
+	Type string `json:"type"`
+	// ID is echoed in result, so that client can match result to its message
+	ID       string `json:"id,omitempty"`
+	Speed    uint8  `json:"speed,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	Fans     []int  `json:"fans,omitempty"`
+	Curve    string `json:"curve,omitempty"`
+	Persist  bool   `json:"persist,omitempty"`
+}
+
+// wsResult is the response to a message from client
+type wsResult struct {
+	Type  string `json:"type"`
+	ID    string `json:"id,omitempty"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	Data  any    `json:"data,omitempty"`
+}
+
+// wsSample is a telemetry sample sent to client
+type wsSample struct {
+	Type string `json:"type"`
+	telemetryEvent
+}
+
+// handleWebSocket streams telemetry samples like GET /events, and accepts control messages on the same connection
+func (c *controlServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn := upgradeWebSocket(w, r)
+	if conn == nil {
+		return
+	}
+	defer conn.close()
+	events, unsubscribe := subscribeTelemetry(c.devices)
+	defer unsubscribe()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case event := <-events:
+				if err := conn.writeJSON(wsSample{Type: WS_MESSAGE_SAMPLE, telemetryEvent: event}); err != nil {
+					// Reading fails as well once the connection is closed, which ends the handler
+					conn.close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		payload, err := conn.readMessage()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				moduleLogger(LOG_MODULE_API).Debug("WebSocket connection is closed", "err", err)
+			}
+			return
+		}
+		var msg wsMessage
+		result := wsResult{Type: WS_MESSAGE_RESULT}
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			result.Error = fmt.Sprintf("unable to decode message: %s", err)
+		} else {
+			result.ID = msg.ID
+			if data, err := c.handleWebSocketMessage(msg); err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Data = data
+			}
+		}
+		result.OK = result.Error == ""
+		if err := conn.writeJSON(result); err != nil {
+			return
+		}
+	}
+}
+
+// handleWebSocketMessage performs control message, which has the same effect as the corresponding HTTP endpoint
+func (c *controlServer) handleWebSocketMessage(msg wsMessage) (any, error) {
+	switch msg.Type {
+	case WS_MESSAGE_OVERRIDE:
+		return c.setOverride(overrideRequest{Speed: msg.Speed, Duration: msg.Duration, Fans: msg.Fans})
+	case WS_MESSAGE_BOOST:
+		return c.boost(boostRequest{Duration: msg.Duration})
+	case WS_MESSAGE_CANCEL_OVERRIDE:
+		c.clearOverride()
+		return nil, nil
+	case WS_MESSAGE_CURVE:
+		resp, _, err := c.setCurve(curveRequest{Curve: msg.Curve, Persist: msg.Persist})
+		return resp, err
+	case WS_MESSAGE_STATUS:
+		return c.status(), nil
+	default:
+		return nil, fmt.Errorf("unknown message type %q", msg.Type)
+	}
+}
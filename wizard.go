@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+const (
+	// Acoustic threshold used by the wizard when the device does not report it
+	WIZARD_DEFAULT_ACOUSTIC_THRESHOLD = 83
+	// The curve starts ramping up at this number of degrees above idle temperature
+	WIZARD_IDLE_MARGIN = 5
+	// The curve reaches full speed at this number of degrees above acoustic threshold
+	WIZARD_FULL_SPEED_MARGIN = 5
+)
+
+// Fan speeds of the generated curve, from the point above idle temperature to acoustic threshold
+var wizardPreferenceSpeeds = map[string][]uint8{
+	"quiet":       {30, 40, 55, 75},
+	"balanced":    {35, 50, 65, 85},
+	"performance": {45, 60, 75, 95},
+}
+
+// wizardPrompter asks questions on terminal, and returns default answer on empty input
+type wizardPrompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func (p *wizardPrompter) ask(question string, defaultAnswer string) (string, error) {
+	fmt.Fprintf(p.out, "%s [%s]: ", question, defaultAnswer)
+	line, err := p.in.ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", fmt.Errorf("unable to read answer: %w", err)
+	}
+	answer := strings.TrimSpace(line)
+	if answer == "" {
+		return defaultAnswer, nil
+	}
+	return answer, nil
+}
+
+func (p *wizardPrompter) choose(question string, choices []string, defaultChoice string) (string, error) {
+	for {
+		answer, err := p.ask(fmt.Sprintf("%s (%s)", question, strings.Join(choices, "/")), defaultChoice)
+		if err != nil {
+			return "", err
+		}
+		for _, choice := range choices {
+			if strings.EqualFold(answer, choice) {
+				return choice, nil
+			}
+		}
+		fmt.Fprintf(p.out, "Please answer one of: %s\n", strings.Join(choices, ", "))
+	}
+}
+
+func (p *wizardPrompter) confirm(question string, defaultYes bool) (bool, error) {
+	defaultAnswer := "n"
+	if defaultYes {
+		defaultAnswer = "y"
+	}
+	answer, err := p.choose(question, []string{"y", "n"}, defaultAnswer)
+	return answer == "y", err
+}
+
+// proposeWizardCurve spreads curve points evenly between idle temperature and acoustic threshold,
+// so that fans are quiet at idle and reach full speed shortly after acoustic threshold.
+func proposeWizardCurve(idleTemp, acousticThreshold uint32, preference string) [][2]uint8 {
+	speeds := wizardPreferenceSpeeds[preference]
+	startTemp := idleTemp + WIZARD_IDLE_MARGIN
+	// Keep enough room between points, even if the GPU idles hot
+	endTemp := max(acousticThreshold, startTemp+uint32(len(speeds))*3)
+	endTemp = min(endTemp, uint32(MAX_TEMP)-WIZARD_FULL_SPEED_MARGIN)
+	startTemp = min(startTemp, endTemp-uint32(len(speeds))*3)
+
+	curve := make([][2]uint8, 0, len(speeds)+1)
+	step := (endTemp - startTemp) / uint32(len(speeds)-1)
+	for i, speed := range speeds {
+		temp := startTemp + uint32(i)*step
+		if i == len(speeds)-1 {
+			temp = endTemp
+		}
+		curve = append(curve, [2]uint8{uint8(temp), speed})
+	}
+	curve = append(curve, [2]uint8{uint8(endTemp + WIZARD_FULL_SPEED_MARGIN), MAX_FAN_SPEED_PERCENT})
+	return curve
+}
+
+// runInitCommand interrogates the selected GPU, asks for user preference, and writes a config file with a suitable fan curve
+func runInitCommand(args []string) int {
+	var configFile string
+	var deviceIndex int
+
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	flags.StringVar(&configFile, "config", DEFAULT_CONFIG_FILE, "Path to config file to be written")
+	flags.IntVar(&deviceIndex, "device-index", 0, "GPU index to be tuned")
+	flags.Parse(args)
+
+	backend := newGPUBackend()
+	if err := backend.Init(); err != nil {
+		slog.Error("Unable to initialize NVML", "err", err)
+		return EXIT_NVML_INIT_FAILURE
+	}
+	defer func() {
+		if err := backend.Shutdown(); err != nil {
+			slog.Error("Unable to shutdown NVML", "err", err)
+		}
+	}()
+
+	device, err := backend.Device(deviceIndex)
+	if err != nil {
+		slog.Error("Unable to get device at index", LABEL_GPU_INDEX, deviceIndex, "err", err)
+		return EXIT_UNSUPPORTED_DEVICE
+	}
+	name, err := device.Name()
+	if err != nil {
+		slog.Error("Unable to get device name", "err", err)
+		return EXIT_UNSUPPORTED_DEVICE
+	}
+	numFans, err := device.NumFans()
+	if err != nil {
+		slog.Error("Unable to get number of fans from device", "err", err)
+		return EXIT_UNSUPPORTED_DEVICE
+	}
+	if numFans == 0 {
+		slog.Error("Device has no controllable fans", "name", name)
+		return EXIT_UNSUPPORTED_DEVICE
+	}
+	idleTemp, err := device.Temperature()
+	if err != nil {
+		slog.Error("Unable to get device temperature", "err", err)
+		return EXIT_UNSUPPORTED_DEVICE
+	}
+	acousticThreshold, err := device.AcousticTemperatureThreshold()
+	if err != nil || acousticThreshold == 0 {
+		slog.Warn("Unable to get acoustic temperature threshold, use a common default instead", "threshold", WIZARD_DEFAULT_ACOUSTIC_THRESHOLD, "err", err)
+		acousticThreshold = WIZARD_DEFAULT_ACOUSTIC_THRESHOLD
+	}
+
+	fmt.Printf("GPU %d: %s\n", deviceIndex, name)
+	fmt.Printf("  Fans: %d\n", numFans)
+	fmt.Printf("  Current temperature: %d C (make sure the GPU is idle for a sensible curve)\n", idleTemp)
+	fmt.Printf("  Acoustic threshold: %d C\n\n", acousticThreshold)
+
+	prompter := &wizardPrompter{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+	preference, err := prompter.choose("Do you prefer quiet fans or lower temperature?", []string{"quiet", "balanced", "performance"}, "balanced")
+	if err != nil {
+		slog.Error("Unable to get answer", "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+	zeroRPM, err := prompter.confirm("Allow fans to stop when the GPU is idle?", preference == "quiet")
+	if err != nil {
+		slog.Error("Unable to get answer", "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+
+	curve := proposeWizardCurve(idleTemp, acousticThreshold, preference)
+	if err := validateSpeedConfig(curve); err != nil {
+		slog.Error("Generated fan curve is invalid", "curve", formatSpeedConfig(curve), "err", err)
+		return EXIT_CONFIG_ERROR
+	}
+
+	config := map[string]any{
+		"device-index": deviceIndex,
+		"speeds":       formatSpeedConfig(curve),
+	}
+	if !zeroRPM {
+		// Fans would be stopped below the first point of the curve
+		config["min-speed"] = curve[0][1]
+	}
+
+	fmt.Printf("\nProposed fan curve: %s\n", formatSpeedConfig(curve))
+	if _, err := os.Stat(configFile); err == nil {
+		overwrite, err := prompter.confirm(fmt.Sprintf("Config file %s already exists, overwrite it?", configFile), false)
+		if err != nil {
+			slog.Error("Unable to get answer", "err", err)
+			return EXIT_CONFIG_ERROR
+		}
+		if !overwrite {
+			fmt.Println("Config file is not written")
+			return EXIT_OK
+		}
+	}
+	if err := writeConfigFile(configFile, config); err != nil {
+		slog.Error("Unable to write config file", "path", configFile, "err", err)
+		return EXIT_RUNTIME_FAILURE
+	}
+
+	fmt.Printf("Config file is written to %s\n", configFile)
+	fmt.Printf("Try it with: %s -config %s -dry-run\n", os.Args[0], configFile)
+	return EXIT_OK
+}